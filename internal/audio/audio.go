@@ -0,0 +1,87 @@
+// Package audio decodes uploaded audio in pure Go, so the service can
+// analyse tracks without external tools.
+package audio
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrUnsupported is returned for data that is not in a format Decode
+// understands.
+var ErrUnsupported = errors.New("unsupported audio format")
+
+// Formats Decode understands.
+const (
+	FormatWAV  = "wav"
+	FormatFLAC = "flac"
+	FormatMP3  = "mp3"
+)
+
+// source produces the interleaved samples of a format.
+type source interface {
+	read(p []float64) (int, error)
+}
+
+// Decoder reads the samples of an audio stream.
+type Decoder struct {
+	Format     string
+	SampleRate int
+	Channels   int
+
+	src source
+}
+
+// Decode starts decoding r, telling its format from the first bytes.
+func Decode(r io.Reader) (d *Decoder, err error) {
+	defer recoverMalformed(&err)
+	br := bufio.NewReaderSize(r, 64<<10)
+	head, _ := br.Peek(12)
+
+	switch {
+	case len(head) >= 12 && (bytes.Equal(head[:4], []byte("RIFF")) || bytes.Equal(head[:4], []byte("RF64"))) && bytes.Equal(head[8:12], []byte("WAVE")):
+		d, err = decodeWAV(br)
+	case bytes.HasPrefix(head, []byte("fLaC")):
+		d, err = decodeFLAC(br)
+	case bytes.HasPrefix(head, []byte("ID3")) || len(head) >= 2 && isMP3Sync(head):
+		d, err = decodeMP3(br)
+	default:
+		return nil, ErrUnsupported
+	}
+	if err != nil {
+		return nil, err
+	}
+	if d.SampleRate <= 0 || d.Channels <= 0 {
+		return nil, errors.New("audio: stream has no samples")
+	}
+	return d, nil
+}
+
+// recoverMalformed turns a panic into an error in *err. The decoders of
+// other packages panic on some malformed streams, which uploads are free
+// to contain.
+func recoverMalformed(err *error) {
+	if v := recover(); v != nil {
+		*err = fmt.Errorf("audio: malformed stream: %v", v)
+	}
+}
+
+// isMP3Sync reports whether head starts with the frame sync of an MPEG
+// audio layer III frame.
+func isMP3Sync(head []byte) bool {
+	return head[0] == 0xFF && head[1]&0xE0 == 0xE0 && head[1]&0x06 == 0x02
+}
+
+// Read reads interleaved samples, scaled to [-1, 1], into p. It returns
+// io.EOF once the stream has ended.
+func (d *Decoder) Read(p []float64) (n int, err error) {
+	defer recoverMalformed(&err)
+	if len(p) < d.Channels {
+		return 0, io.ErrShortBuffer
+	}
+	// Only whole frames, a sample of every channel, are returned.
+	return d.src.read(p[:len(p)-len(p)%d.Channels])
+}
@@ -0,0 +1,184 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"testing"
+
+	"github.com/mewkiz/flac"
+	"github.com/mewkiz/flac/frame"
+	"github.com/mewkiz/flac/meta"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readAll decodes the rest of d.
+func readAll(t *testing.T, d *Decoder) []float64 {
+	var samples []float64
+	buf := make([]float64, 1000)
+	for {
+		n, err := d.Read(buf)
+		samples = append(samples, buf[:n]...)
+		if err == io.EOF {
+			return samples
+		}
+		require.NoError(t, err)
+	}
+}
+
+// encodeFLAC encodes 16-bit interleaved samples as FLAC, in verbatim
+// frames of 1024 samples.
+func encodeFLAC(t testing.TB, sampleRate, channels int, samples []float64) []byte {
+	var out bytes.Buffer
+	frames := len(samples) / channels
+	enc, err := flac.NewEncoder(&out, &meta.StreamInfo{
+		BlockSizeMin:  16,
+		BlockSizeMax:  1024,
+		SampleRate:    uint32(sampleRate),
+		NChannels:     uint8(channels),
+		BitsPerSample: 16,
+		NSamples:      uint64(frames),
+	})
+	require.NoError(t, err)
+	for start := 0; start < frames; start += 1024 {
+		n := min(1024, frames-start)
+		f := &frame.Frame{Header: frame.Header{
+			HasFixedBlockSize: true,
+			BlockSize:         uint16(n),
+			SampleRate:        uint32(sampleRate),
+			Channels:          frame.ChannelsMono,
+			BitsPerSample:     16,
+			Num:               uint64(start / 1024),
+		}}
+		if channels == 2 {
+			f.Channels = frame.ChannelsLR
+		}
+		for ch := 0; ch < channels; ch++ {
+			sub := &frame.Subframe{SubHeader: frame.SubHeader{Pred: frame.PredVerbatim}, NSamples: n}
+			for i := 0; i < n; i++ {
+				sub.Samples = append(sub.Samples, int32(math.Round(samples[(start+i)*channels+ch]*math.MaxInt16)))
+			}
+			f.Subframes = append(f.Subframes, sub)
+		}
+		require.NoError(t, enc.WriteFrame(f))
+	}
+	require.NoError(t, enc.Close())
+	return out.Bytes()
+}
+
+// silentMP3 returns frames of silent 128 kbit/s, 44.1 kHz MPEG-1 layer III
+// audio.
+func silentMP3(frames int) []byte {
+	frame := make([]byte, 417)
+	copy(frame, []byte{0xFF, 0xFB, 0x90, 0x64})
+	return bytes.Repeat(frame, frames)
+}
+
+func TestDecode_WAV(t *testing.T) {
+	tone := Sine(8000, 2, 440, 0.5, 0.5)
+	d, err := Decode(bytes.NewReader(EncodeWAV(8000, 2, tone)))
+	require.NoError(t, err)
+	assert.Equal(t, FormatWAV, d.Format)
+	assert.Equal(t, 8000, d.SampleRate)
+	assert.Equal(t, 2, d.Channels)
+
+	samples := readAll(t, d)
+	require.Len(t, samples, len(tone))
+	assert.InDeltaSlice(t, tone, samples, 1.0/(1<<15))
+}
+
+func TestDecode_WAVFormats(t *testing.T) {
+	// wav builds a mono file with a LIST chunk before the samples.
+	wav := func(format, bits int, samples []byte) []byte {
+		var b bytes.Buffer
+		b.WriteString("RIFF\x00\x00\x00\x00WAVEfmt ")
+		binary.Write(&b, binary.LittleEndian, []uint32{16})
+		binary.Write(&b, binary.LittleEndian, []uint16{uint16(format), 1})
+		binary.Write(&b, binary.LittleEndian, []uint32{44100, uint32(44100 * bits / 8)})
+		binary.Write(&b, binary.LittleEndian, []uint16{uint16(bits / 8), uint16(bits)})
+		b.WriteString("LIST\x03\x00\x00\x00abc\x00data")
+		binary.Write(&b, binary.LittleEndian, []uint32{uint32(len(samples))})
+		b.Write(samples)
+		return b.Bytes()
+	}
+	float32s := make([]byte, 8)
+	binary.LittleEndian.PutUint32(float32s, math.Float32bits(0.25))
+	binary.LittleEndian.PutUint32(float32s[4:], math.Float32bits(-1))
+
+	for _, tc := range []struct {
+		name     string
+		data     []byte
+		expected []float64
+	}{
+		{"8-bit", wav(1, 8, []byte{0x80, 0xC0, 0x00}), []float64{0, 0.5, -1}},
+		{"24-bit", wav(1, 24, []byte{0, 0, 0x40, 0, 0, 0x80}), []float64{0.5, -1}},
+		{"32-bit", wav(1, 32, []byte{0, 0, 0, 0xC0}), []float64{-0.5}},
+		{"float", wav(3, 32, float32s), []float64{0.25, -1}},
+		{"truncated", wav(1, 16, []byte{0, 0x40, 0}), []float64{0.5}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d, err := Decode(bytes.NewReader(tc.data))
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, readAll(t, d))
+		})
+	}
+
+	_, err := Decode(bytes.NewReader(wav(2, 4, nil)))
+	assert.ErrorIs(t, err, ErrUnsupported)
+}
+
+func TestDecode_FLAC(t *testing.T) {
+	tone := Sine(44100, 2, 1000, 0.25, 0.1)
+	d, err := Decode(bytes.NewReader(encodeFLAC(t, 44100, 2, tone)))
+	require.NoError(t, err)
+	assert.Equal(t, FormatFLAC, d.Format)
+	assert.Equal(t, 44100, d.SampleRate)
+	assert.Equal(t, 2, d.Channels)
+
+	samples := readAll(t, d)
+	require.Len(t, samples, len(tone))
+	assert.InDeltaSlice(t, tone, samples, 1.0/(1<<15))
+}
+
+func TestDecode_MP3(t *testing.T) {
+	d, err := Decode(bytes.NewReader(silentMP3(20)))
+	require.NoError(t, err)
+	assert.Equal(t, FormatMP3, d.Format)
+	assert.Equal(t, 44100, d.SampleRate)
+	assert.Equal(t, 2, d.Channels)
+
+	samples := readAll(t, d)
+	assert.NotEmpty(t, samples)
+	for _, v := range samples {
+		require.Zero(t, v)
+	}
+}
+
+func TestDecode_Unsupported(t *testing.T) {
+	for _, data := range []string{"", "hello world", "RIFF\x00\x00\x00\x00AVI LIST"} {
+		_, err := Decode(bytes.NewReader([]byte(data)))
+		assert.ErrorIs(t, err, ErrUnsupported, data)
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	f.Add(EncodeWAV(8000, 1, Sine(8000, 1, 440, 0.5, 0.01)))
+	f.Add(encodeFLAC(f, 8000, 1, Sine(8000, 1, 440, 0.5, 0.01)))
+	f.Add(silentMP3(2))
+	// go-mp3 panics on this one.
+	f.Add([]byte("\xff\xf2$00000000000000001\xbd0000000000000000000000000000"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		d, err := Decode(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		buf := make([]float64, 1024)
+		for i := 0; i < 1000; i++ {
+			if _, err := d.Read(buf); err != nil {
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,237 @@
+package audio
+
+import (
+	"io"
+	"math"
+	"math/bits"
+	"math/cmplx"
+	"time"
+)
+
+// Fingerprint is a chromaprint-style acoustic fingerprint. Every 32-bit
+// sub-fingerprint describes the pitch classes heard in a step of audio and
+// how they relate, which survives re-encoding at another bitrate, sample
+// rate or volume.
+type Fingerprint []uint32
+
+const (
+	fingerprintRate  = 11025
+	fingerprintFrame = 4096
+	fingerprintHop   = fingerprintFrame / 3
+	// chroma covers the notes from A0 up to A7.
+	chromaMinFreq = 27.5
+	chromaMaxFreq = 3520
+)
+
+// FingerprintStep is the length of audio every sub-fingerprint covers.
+const FingerprintStep = fingerprintHop * time.Second / fingerprintRate
+
+// ComputeFingerprint decodes up to length of d, all of it if length is 0,
+// and returns its fingerprint.
+func ComputeFingerprint(d *Decoder, length time.Duration) (Fingerprint, error) {
+	resampler := newResampler(d.SampleRate)
+	maxFrames := int64(-1)
+	if length > 0 {
+		maxFrames = int64(length.Seconds() * float64(d.SampleRate))
+	}
+
+	var fp Fingerprint
+	var prev [12]float64
+	window := make([]float64, 0, fingerprintFrame)
+	spectrum := newSpectrum()
+	buf := make([]float64, 4096*d.Channels)
+	var frames int64
+	for maxFrames < 0 || frames < maxFrames {
+		n, err := d.Read(buf)
+		for i := 0; i+d.Channels <= n && (maxFrames < 0 || frames < maxFrames); i += d.Channels {
+			frames++
+			mono := 0.0
+			for _, v := range buf[i : i+d.Channels] {
+				mono += v
+			}
+			resampler.push(mono/float64(d.Channels), func(v float64) {
+				window = append(window, v)
+				if len(window) < fingerprintFrame {
+					return
+				}
+				chroma := spectrum.chroma(window)
+				if len(fp) > 0 {
+					fp = append(fp, subFingerprint(chroma, prev))
+				} else {
+					fp = append(fp, subFingerprint(chroma, chroma))
+				}
+				prev = chroma
+				window = append(window[:0], window[fingerprintHop:]...)
+			})
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fp, nil
+}
+
+// subFingerprint derives 32 bits from the chroma of a step and the one
+// before it: which pitch classes are stronger than their neighbour and
+// their fifth, and which got louder.
+func subFingerprint(chroma, prev [12]float64) uint32 {
+	var v uint32
+	for i := 0; i < 12; i++ {
+		if chroma[i] > chroma[(i+1)%12] {
+			v |= 1 << i
+		}
+		if chroma[i] > prev[i] {
+			v |= 1 << (12 + i)
+		}
+	}
+	for i := 0; i < 8; i++ {
+		if chroma[i] > chroma[(i+7)%12] {
+			v |= 1 << (24 + i)
+		}
+	}
+	return v
+}
+
+// maxFingerprintOffset is how far apart, in steps, two fingerprints are
+// aligned when comparing them, which allows for differing encoder delay
+// and leading silence.
+const maxFingerprintOffset = 16
+
+// Similarity returns how alike two fingerprints are, from 0 for unrelated
+// audio to 1 for the same. They are aligned at the best offset first.
+func (f Fingerprint) Similarity(other Fingerprint) float64 {
+	minOverlap := max(min(len(f), len(other))/2, 8)
+	best := 0.5
+	for offset := -maxFingerprintOffset; offset <= maxFingerprintOffset; offset++ {
+		start := max(0, offset)
+		end := min(len(f), len(other)+offset)
+		if end-start < minOverlap {
+			continue
+		}
+		errors := 0
+		for i := start; i < end; i++ {
+			errors += bits.OnesCount32(f[i] ^ other[i-offset])
+		}
+		best = min(best, float64(errors)/float64(32*(end-start)))
+	}
+	// Unrelated audio differs in about half of the bits.
+	return max(0, 1-2*best)
+}
+
+// resampler converts audio to fingerprintRate: it averages groups of
+// samples down to the nearest rate above, then interpolates linearly.
+type resampler struct {
+	group int
+	sum   float64
+	count int
+	// step is the distance between output samples in input samples.
+	step float64
+	// n is the index of the last input sample, next the position of the
+	// next output sample.
+	n    int64
+	next float64
+	last float64
+}
+
+func newResampler(rate int) *resampler {
+	group := max(1, rate/fingerprintRate)
+	return &resampler{group: group, step: float64(rate) / float64(group) / fingerprintRate, n: -1}
+}
+
+func (r *resampler) push(v float64, emit func(float64)) {
+	r.sum += v
+	if r.count++; r.count < r.group {
+		return
+	}
+	v = r.sum / float64(r.group)
+	r.sum, r.count = 0, 0
+	r.n++
+	for ; r.next <= float64(r.n); r.next += r.step {
+		emit(r.last + (v-r.last)*(r.next-float64(r.n-1)))
+	}
+	r.last = v
+}
+
+// spectrum computes the chroma of a frame through an FFT.
+type spectrum struct {
+	hann   []float64
+	class  []int
+	buffer []complex128
+}
+
+func newSpectrum() *spectrum {
+	s := &spectrum{
+		hann:   make([]float64, fingerprintFrame),
+		class:  make([]int, fingerprintFrame/2),
+		buffer: make([]complex128, fingerprintFrame),
+	}
+	for i := range s.hann {
+		s.hann[i] = 0.5 * (1 - math.Cos(2*math.Pi*float64(i)/float64(fingerprintFrame-1)))
+	}
+	for i := range s.class {
+		freq := float64(i) * fingerprintRate / fingerprintFrame
+		if freq < chromaMinFreq || freq > chromaMaxFreq {
+			s.class[i] = -1
+			continue
+		}
+		note := int(math.Round(12 * math.Log2(freq/chromaMinFreq)))
+		s.class[i] = note % 12
+	}
+	return s
+}
+
+func (s *spectrum) chroma(frame []float64) [12]float64 {
+	for i, v := range frame {
+		s.buffer[i] = complex(v*s.hann[i], 0)
+	}
+	fft(s.buffer)
+	var chroma [12]float64
+	for i, class := range s.class {
+		if class >= 0 {
+			a := cmplx.Abs(s.buffer[i])
+			chroma[class] += a * a
+		}
+	}
+	norm := 0.0
+	for _, v := range chroma {
+		norm += v * v
+	}
+	// Silence stays all zero rather than amplifying noise.
+	if norm = math.Sqrt(norm); norm > 1e-9 {
+		for i := range chroma {
+			chroma[i] /= norm
+		}
+	} else {
+		chroma = [12]float64{}
+	}
+	return chroma
+}
+
+// fft transforms x in place; its length must be a power of two.
+func fft(x []complex128) {
+	n := len(x)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		w := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			wk := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				a, b := x[start+k], x[start+k+size/2]*wk
+				x[start+k], x[start+k+size/2] = a+b, a-b
+				wk *= w
+			}
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package audio
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// melody renders notes, as semitones above A3, of a quarter second each
+// with a few harmonics, plus noise of the given amplitude.
+func melody(sampleRate int, notes []int, amplitude, noise float64) []float64 {
+	rng := rand.New(rand.NewSource(1))
+	frames := sampleRate / 4
+	samples := make([]float64, 0, len(notes)*frames)
+	for _, note := range notes {
+		freq := 220 * math.Pow(2, float64(note)/12)
+		for i := 0; i < frames; i++ {
+			t := float64(i) / float64(sampleRate)
+			v := 0.0
+			for h := 1.0; h <= 3; h++ {
+				v += math.Sin(2*math.Pi*freq*h*t) / h
+			}
+			samples = append(samples, amplitude*v/2+noise*(2*rng.Float64()-1))
+		}
+	}
+	return samples
+}
+
+func fingerprint(t *testing.T, sampleRate int, samples []float64) Fingerprint {
+	d, err := Decode(bytes.NewReader(EncodeWAV(sampleRate, 1, samples)))
+	require.NoError(t, err)
+	fp, err := ComputeFingerprint(d, 0)
+	require.NoError(t, err)
+	return fp
+}
+
+func TestFingerprint(t *testing.T) {
+	tune := []int{0, 4, 7, 12, 7, 4, 0, 2, 5, 9, 5, 2, 0, 7, 0, 7, 3, 10, 3, 10, 0, 4, 7, 12}
+	other := []int{1, 8, 3, 11, 6, 1, 9, 4, 11, 2, 8, 6, 1, 10, 5, 3, 11, 8, 2, 6, 9, 1, 4, 10}
+
+	fp := fingerprint(t, 44100, melody(44100, tune, 0.5, 0))
+	assert.InDelta(t, int(6*time.Second/FingerprintStep), len(fp), 3)
+	assert.Equal(t, 1.0, fp.Similarity(fp))
+
+	// The same recording at another rate, level and with noise added still
+	// matches, even when it starts a little later.
+	reencoded := fingerprint(t, 48000, append(make([]float64, 4800), melody(48000, tune, 0.2, 0.01)...))
+	assert.Greater(t, fp.Similarity(reencoded), 0.7)
+	assert.Equal(t, fp.Similarity(reencoded), reencoded.Similarity(fp))
+
+	assert.Less(t, fp.Similarity(fingerprint(t, 44100, melody(44100, other, 0.5, 0))), 0.4)
+	assert.Zero(t, fp.Similarity(nil))
+
+	// Only the requested length is fingerprinted.
+	d, err := Decode(bytes.NewReader(EncodeWAV(44100, 1, melody(44100, tune, 0.5, 0))))
+	require.NoError(t, err)
+	short, err := ComputeFingerprint(d, 2*time.Second)
+	require.NoError(t, err)
+	assert.Less(t, len(short), len(fp)/2)
+}
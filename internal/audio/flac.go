@@ -0,0 +1,55 @@
+package audio
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/mewkiz/flac"
+)
+
+// flacSource decodes FLAC frames as they are needed.
+type flacSource struct {
+	stream  *flac.Stream
+	scale   float64
+	pending []float64
+}
+
+func decodeFLAC(r io.Reader) (*Decoder, error) {
+	stream, err := flac.New(r)
+	if err != nil {
+		return nil, fmt.Errorf("flac: %w", err)
+	}
+	info := stream.Info
+	if info.BitsPerSample == 0 || info.BitsPerSample > 32 {
+		return nil, fmt.Errorf("%w: flac with %d bits per sample", ErrUnsupported, info.BitsPerSample)
+	}
+	return &Decoder{
+		Format:     FormatFLAC,
+		SampleRate: int(info.SampleRate),
+		Channels:   int(info.NChannels),
+		src:        &flacSource{stream: stream, scale: 1 / float64(uint64(1)<<(info.BitsPerSample-1))},
+	}, nil
+}
+
+func (s *flacSource) read(p []float64) (int, error) {
+	for len(s.pending) == 0 {
+		f, err := s.stream.ParseNext()
+		if err != nil {
+			return 0, err
+		}
+		n := len(f.Subframes[0].Samples)
+		channels := len(f.Subframes)
+		if cap(s.pending) < n*channels {
+			s.pending = make([]float64, n*channels)
+		}
+		s.pending = s.pending[:n*channels]
+		for ch, sub := range f.Subframes {
+			for i, v := range sub.Samples {
+				s.pending[i*channels+ch] = float64(v) * s.scale
+			}
+		}
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
@@ -0,0 +1,270 @@
+package audio
+
+import (
+	"io"
+	"math"
+	"slices"
+)
+
+// Loudness holds the EBU R128 measurements of a track.
+type Loudness struct {
+	// Integrated is the gated loudness of the whole track in LUFS, or
+	// negative infinity for silence.
+	Integrated float64
+	// Range is the loudness range in LU, the spread between the quiet and
+	// loud parts of the track.
+	Range float64
+	// TruePeak is the highest peak between the samples, found by
+	// oversampling them, in dBTP.
+	TruePeak float64
+}
+
+// replayGainReference is the loudness ReplayGain 2.0 normalizes to.
+const replayGainReference = -18
+
+// ReplayGain returns the ReplayGain 2.0 track gain in dB and the linear
+// track peak.
+func (l *Loudness) ReplayGain() (gain, peak float64) {
+	return replayGainReference - l.Integrated, math.Pow(10, l.TruePeak/20)
+}
+
+const (
+	absoluteGate  = -70
+	integratedGap = 10
+	rangeGap      = 20
+)
+
+// MeasureLoudness decodes the whole of d and measures its loudness per
+// ITU-R BS.1770-4 and EBU Tech 3342.
+func MeasureLoudness(d *Decoder) (*Loudness, error) {
+	filters := make([]kWeighting, d.Channels)
+	peaks := make([]truePeak, d.Channels)
+	weights := make([]float64, d.Channels)
+	for ch := range filters {
+		filters[ch] = newKWeighting(float64(d.SampleRate))
+		peaks[ch] = newTruePeak(d.SampleRate)
+		weights[ch] = channelWeight(ch, d.Channels)
+	}
+
+	// Loudness is measured over blocks overlapping by 100 ms steps, so the
+	// weighted energy of every step is kept.
+	step := max(1, d.SampleRate/10)
+	var steps []float64
+	var energy float64
+	count := 0
+
+	buf := make([]float64, 4096*d.Channels)
+	for {
+		n, err := d.Read(buf)
+		for frame := 0; frame+d.Channels <= n; frame += d.Channels {
+			for ch := 0; ch < d.Channels; ch++ {
+				v := buf[frame+ch]
+				peaks[ch].add(v)
+				k := filters[ch].filter(v)
+				energy += weights[ch] * k * k
+			}
+			if count++; count == step {
+				steps = append(steps, energy/float64(step))
+				energy, count = 0, 0
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	peak := 0.0
+	for i := range peaks {
+		p := &peaks[i]
+		// The last samples still have to pass the middle of the filter.
+		for range truePeakTaps / 2 {
+			p.add(0)
+		}
+		peak = max(peak, p.peak)
+	}
+	return &Loudness{
+		Integrated: integrated(blocks(steps, 4)),
+		Range:      loudnessRange(blocks(steps, 30)),
+		TruePeak:   20 * math.Log10(peak),
+	}, nil
+}
+
+// channelWeight weights the surround channels of 5.1 audio up and leaves
+// out its LFE channel.
+func channelWeight(ch, channels int) float64 {
+	switch {
+	case channels == 6 && ch == 3:
+		return 0
+	case (channels == 5 || channels == 6) && ch >= channels-2:
+		return 1.41
+	}
+	return 1
+}
+
+// blocks returns the mean energies of the windows of size steps.
+func blocks(steps []float64, size int) []float64 {
+	var out []float64
+	sum := 0.0
+	for i, e := range steps {
+		sum += e
+		if i >= size {
+			sum -= steps[i-size]
+		}
+		if i >= size-1 {
+			out = append(out, sum/float64(size))
+		}
+	}
+	return out
+}
+
+func lufs(energy float64) float64 {
+	return -0.691 + 10*math.Log10(energy)
+}
+
+// gate returns the energies of the blocks above the absolute gate, and of
+// those gap LU below their mean.
+func gate(energies []float64, gap float64) []float64 {
+	var kept []float64
+	sum := 0.0
+	for _, e := range energies {
+		if lufs(e) > absoluteGate {
+			kept = append(kept, e)
+			sum += e
+		}
+	}
+	if len(kept) == 0 {
+		return nil
+	}
+	threshold := lufs(sum/float64(len(kept))) - gap
+	return slices.DeleteFunc(kept, func(e float64) bool { return lufs(e) <= threshold })
+}
+
+// integrated returns the gated loudness of the 400 ms blocks.
+func integrated(energies []float64) float64 {
+	kept := gate(energies, integratedGap)
+	if len(kept) == 0 {
+		return math.Inf(-1)
+	}
+	sum := 0.0
+	for _, e := range kept {
+		sum += e
+	}
+	return lufs(sum / float64(len(kept)))
+}
+
+// loudnessRange returns the spread between the 10th and 95th percentile of
+// the gated 3 s blocks.
+func loudnessRange(energies []float64) float64 {
+	kept := gate(energies, rangeGap)
+	if len(kept) == 0 {
+		return 0
+	}
+	slices.Sort(kept)
+	percentile := func(p float64) float64 {
+		return lufs(kept[int(math.Round(p*float64(len(kept)-1)))])
+	}
+	return percentile(0.95) - percentile(0.10)
+}
+
+// kWeighting is the two stage filter modelling the head, a high shelf
+// followed by a high-pass, with coefficients for any sample rate.
+type kWeighting struct {
+	shelf, highPass biquad
+}
+
+func newKWeighting(rate float64) kWeighting {
+	const (
+		shelfFreq = 1681.974450955533
+		shelfGain = 3.999843853973347
+		shelfQ    = 0.7071752369554196
+		passFreq  = 38.13547087602444
+		passQ     = 0.5003270373238773
+	)
+	k := math.Tan(math.Pi * shelfFreq / rate)
+	vh := math.Pow(10, shelfGain/20)
+	vb := math.Pow(vh, 0.4996667741545416)
+	a0 := 1 + k/shelfQ + k*k
+	shelf := biquad{
+		b0: (vh + vb*k/shelfQ + k*k) / a0,
+		b1: 2 * (k*k - vh) / a0,
+		b2: (vh - vb*k/shelfQ + k*k) / a0,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/shelfQ + k*k) / a0,
+	}
+
+	k = math.Tan(math.Pi * passFreq / rate)
+	a0 = 1 + k/passQ + k*k
+	highPass := biquad{
+		b0: 1, b1: -2, b2: 1,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/passQ + k*k) / a0,
+	}
+	return kWeighting{shelf: shelf, highPass: highPass}
+}
+
+func (k *kWeighting) filter(v float64) float64 {
+	return k.highPass.filter(k.shelf.filter(v))
+}
+
+// biquad is a second order IIR filter in direct form II.
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+	z1, z2             float64
+}
+
+func (f *biquad) filter(v float64) float64 {
+	w := v - f.a1*f.z1 - f.a2*f.z2
+	out := f.b0*w + f.b1*f.z1 + f.b2*f.z2
+	f.z2, f.z1 = f.z1, w
+	return out
+}
+
+// truePeakTaps is the length of the interpolation filter of every phase.
+const truePeakTaps = 12
+
+// truePeak tracks the peak of a channel between its samples, interpolating
+// them with a windowed sinc.
+type truePeak struct {
+	coefs   [][truePeakTaps]float64
+	history [truePeakTaps]float64
+	peak    float64
+}
+
+func newTruePeak(rate int) truePeak {
+	factor := 4
+	switch {
+	case rate >= 192000:
+		factor = 1
+	case rate >= 96000:
+		factor = 2
+	}
+	coefs := make([][truePeakTaps]float64, factor)
+	const half = truePeakTaps / 2
+	for p := range coefs {
+		for k := range coefs[p] {
+			// The distance to the point between the middle taps.
+			d := float64(k-half+1) - float64(p)/float64(factor)
+			sinc := 1.0
+			if d != 0 {
+				sinc = math.Sin(math.Pi*d) / (math.Pi * d)
+			}
+			coefs[p][k] = sinc * 0.5 * (1 + math.Cos(math.Pi*d/half))
+		}
+	}
+	return truePeak{coefs: coefs}
+}
+
+func (t *truePeak) add(v float64) {
+	copy(t.history[:], t.history[1:])
+	t.history[truePeakTaps-1] = v
+	for _, coefs := range t.coefs {
+		y := 0.0
+		for k, c := range coefs {
+			y += c * t.history[k]
+		}
+		t.peak = max(t.peak, math.Abs(y))
+	}
+}
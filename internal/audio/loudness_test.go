@@ -0,0 +1,69 @@
+package audio
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// measure encodes samples as WAV and measures their loudness.
+func measure(t *testing.T, sampleRate, channels int, samples []float64) *Loudness {
+	d, err := Decode(bytes.NewReader(EncodeWAV(sampleRate, channels, samples)))
+	require.NoError(t, err)
+	l, err := MeasureLoudness(d)
+	require.NoError(t, err)
+	return l
+}
+
+// dBFS returns the amplitude of a level in dB relative to full scale.
+func dBFS(level float64) float64 {
+	return math.Pow(10, level/20)
+}
+
+func TestMeasureLoudness(t *testing.T) {
+	// The first test signal of EBU Tech 3341 reads -23 LUFS.
+	l := measure(t, 48000, 2, Sine(48000, 2, 1000, dBFS(-23), 20))
+	assert.InDelta(t, -23, l.Integrated, 0.1)
+	assert.InDelta(t, 0, l.Range, 0.1)
+	assert.InDelta(t, -23, l.TruePeak, 0.1)
+
+	gain, peak := l.ReplayGain()
+	assert.InDelta(t, 5, gain, 0.1)
+	assert.InDelta(t, dBFS(-23), peak, 0.001)
+
+	// Loudness is independent of the sample rate.
+	l = measure(t, 44100, 2, Sine(44100, 2, 1000, dBFS(-23), 5))
+	assert.InDelta(t, -23, l.Integrated, 0.1)
+}
+
+func TestMeasureLoudness_Gating(t *testing.T) {
+	// Tech 3341: the silence in the middle is gated out.
+	samples := Sine(48000, 2, 1000, dBFS(-36), 10)
+	samples = append(samples, Sine(48000, 2, 1000, dBFS(-72), 10)...)
+	samples = append(samples, Sine(48000, 2, 1000, dBFS(-36), 10)...)
+	l := measure(t, 48000, 2, samples)
+	assert.InDelta(t, -36, l.Integrated, 0.1)
+
+	// Tech 3342: two levels 10 dB apart span a range of 10 LU.
+	samples = Sine(48000, 2, 1000, dBFS(-20), 20)
+	samples = append(samples, Sine(48000, 2, 1000, dBFS(-30), 20)...)
+	l = measure(t, 48000, 2, samples)
+	assert.InDelta(t, 10, l.Range, 1)
+
+	l = measure(t, 48000, 1, make([]float64, 48000))
+	assert.True(t, math.IsInf(l.Integrated, -1))
+}
+
+func TestMeasureLoudness_TruePeak(t *testing.T) {
+	// A quarter of the sample rate shifted by 45 degrees peaks between its
+	// samples, which are 3 dB lower.
+	samples := make([]float64, 48000)
+	for i := range samples {
+		samples[i] = 0.5 * math.Sin(math.Pi/2*float64(i)+math.Pi/4)
+	}
+	l := measure(t, 48000, 1, samples)
+	assert.InDelta(t, 20*math.Log10(0.5), l.TruePeak, 0.5)
+}
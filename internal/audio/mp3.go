@@ -0,0 +1,43 @@
+package audio
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/hajimehoshi/go-mp3"
+)
+
+// mp3Source converts the 16-bit stereo output of the MP3 decoder.
+type mp3Source struct {
+	dec *mp3.Decoder
+	buf []byte
+}
+
+func decodeMP3(r io.Reader) (*Decoder, error) {
+	dec, err := mp3.NewDecoder(r)
+	if err != nil {
+		return nil, fmt.Errorf("mp3: %w", err)
+	}
+	// Mono streams are decoded to stereo too.
+	return &Decoder{Format: FormatMP3, SampleRate: dec.SampleRate(), Channels: 2, src: &mp3Source{dec: dec}}, nil
+}
+
+func (s *mp3Source) read(p []float64) (int, error) {
+	if cap(s.buf) < len(p)*2 {
+		s.buf = make([]byte, len(p)*2)
+	}
+	buf := s.buf[:len(p)*2]
+	n, err := io.ReadFull(s.dec, buf)
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	samples := n / 2
+	for i := 0; i < samples; i++ {
+		p[i] = float64(int16(binary.LittleEndian.Uint16(buf[i*2:]))) / (1 << 15)
+	}
+	if samples > 0 && err == io.EOF {
+		err = nil
+	}
+	return samples, err
+}
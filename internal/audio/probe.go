@@ -0,0 +1,219 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Format describes how an audio file is encoded.
+type Format struct {
+	// Container is one of wav, flac, mp3, ogg or mp4.
+	Container string
+	// Codec is one of pcm, pcm_float, flac, mp1, mp2, mp3, vorbis, opus,
+	// aac or alac.
+	Codec      string
+	SampleRate int
+	// BitDepth is the bits per sample of lossless codecs, 0 for lossy ones.
+	BitDepth int
+	Channels int
+	// Bitrate is the average bitrate of the audio in bits per second.
+	Bitrate int
+	// VBR is set for lossy streams encoded with a variable bitrate.
+	VBR      bool
+	Duration time.Duration
+}
+
+// Probe reads the headers of the size bytes of audio in r to tell their
+// format and duration. Data in other formats returns ErrUnsupported.
+func Probe(r io.ReaderAt, size int64) (*Format, error) {
+	head := make([]byte, 12)
+	n, _ := r.ReadAt(head, 0)
+	head = head[:n]
+
+	var f *Format
+	var err error
+	switch {
+	case len(head) >= 12 && (bytes.Equal(head[:4], []byte("RIFF")) || bytes.Equal(head[:4], []byte("RF64"))) && bytes.Equal(head[8:12], []byte("WAVE")):
+		f, err = probeWAV(r, size)
+	case bytes.HasPrefix(head, []byte("OggS")):
+		f, err = probeOgg(r, size)
+	case len(head) >= 8 && bytes.Equal(head[4:8], []byte("ftyp")):
+		f, err = probeMP4(r, size)
+	default:
+		// FLAC and MP3 files may start with an ID3v2 tag.
+		start := id3Size(head)
+		if start > 0 {
+			head = make([]byte, 4)
+			n, _ := r.ReadAt(head, start)
+			head = head[:n]
+		}
+		switch {
+		case bytes.HasPrefix(head, []byte("fLaC")):
+			f, err = probeFLAC(r, start, size)
+		case len(head) >= 2 && head[0] == 0xFF && head[1]&0xE0 == 0xE0:
+			f, err = probeMP3(r, start, size)
+		default:
+			return nil, ErrUnsupported
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if f.SampleRate <= 0 || f.Channels <= 0 {
+		return nil, fmt.Errorf("%s: missing stream parameters", f.Container)
+	}
+	return f, nil
+}
+
+// errTruncated is returned for files ending within their headers.
+var errTruncated = errors.New("truncated file")
+
+// id3Size returns the length of the ID3v2 tag head starts with, 0 if none.
+func id3Size(head []byte) int64 {
+	if len(head) < 10 || !bytes.HasPrefix(head, []byte("ID3")) {
+		return 0
+	}
+	size := int64(head[6]&0x7F)<<21 | int64(head[7]&0x7F)<<14 | int64(head[8]&0x7F)<<7 | int64(head[9]&0x7F)
+	size += 10
+	if head[5]&0x10 != 0 {
+		// A footer follows the tag.
+		size += 10
+	}
+	return size
+}
+
+// readAt reads exactly n bytes at off.
+func readAt(r io.ReaderAt, off int64, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if read, err := r.ReadAt(buf, off); read < n {
+		if err == io.EOF || err == nil {
+			return nil, errTruncated
+		}
+		return nil, err
+	}
+	return buf, nil
+}
+
+// seconds converts a number of samples at rate to a duration.
+func seconds(samples int64, rate int) time.Duration {
+	if rate <= 0 {
+		return 0
+	}
+	return time.Duration(float64(samples) / float64(rate) * float64(time.Second))
+}
+
+// bitrate returns the average bitrate of bytes of audio lasting d.
+func bitrate(bytes int64, d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	return int(float64(bytes*8) / d.Seconds())
+}
+
+func probeWAV(r io.ReaderAt, size int64) (*Format, error) {
+	f := &Format{Container: FormatWAV, Codec: "pcm"}
+	var dataSize int64 = -1
+	var blockAlign int
+	rf64 := false
+	if head, err := readAt(r, 0, 4); err == nil && string(head) == "RF64" {
+		rf64 = true
+	}
+
+	for off := int64(12); off+8 <= size; {
+		chunk, err := readAt(r, off, 8)
+		if err != nil {
+			return nil, err
+		}
+		id := string(chunk[:4])
+		chunkSize := int64(binary.LittleEndian.Uint32(chunk[4:]))
+		switch id {
+		case "ds64":
+			// RF64 keeps the sizes that do not fit the chunk headers here.
+			ds64, err := readAt(r, off+8, 24)
+			if err != nil {
+				return nil, err
+			}
+			dataSize = int64(binary.LittleEndian.Uint64(ds64[8:]))
+		case "fmt ":
+			if chunkSize < 16 {
+				return nil, fmt.Errorf("wav: invalid fmt chunk of %d bytes", chunkSize)
+			}
+			data, err := readAt(r, off+8, int(min(chunkSize, 40)))
+			if err != nil {
+				return nil, err
+			}
+			format := binary.LittleEndian.Uint16(data)
+			if format == wavFormatExtensible && len(data) >= 26 {
+				format = binary.LittleEndian.Uint16(data[24:])
+			}
+			switch format {
+			case wavFormatPCM:
+			case wavFormatFloat:
+				f.Codec = "pcm_float"
+			default:
+				return nil, fmt.Errorf("%w: wav format %d", ErrUnsupported, format)
+			}
+			f.Channels = int(binary.LittleEndian.Uint16(data[2:]))
+			f.SampleRate = int(binary.LittleEndian.Uint32(data[4:]))
+			blockAlign = int(binary.LittleEndian.Uint16(data[12:]))
+			f.BitDepth = int(binary.LittleEndian.Uint16(data[14:]))
+		case "data":
+			if !rf64 || dataSize < 0 {
+				dataSize = chunkSize
+			}
+			// Streamed files may leave the size unset.
+			if dataSize <= 0 || dataSize > size-off-8 {
+				dataSize = size - off - 8
+			}
+			if blockAlign == 0 {
+				return nil, errors.New("wav: data chunk before fmt chunk")
+			}
+			f.Duration = seconds(dataSize/int64(blockAlign), f.SampleRate)
+			f.Bitrate = f.SampleRate * f.Channels * f.BitDepth
+			return f, nil
+		}
+		off += 8 + chunkSize + chunkSize%2
+	}
+	return nil, errors.New("wav: no data chunk")
+}
+
+func probeFLAC(r io.ReaderAt, start, size int64) (*Format, error) {
+	f := &Format{Container: FormatFLAC, Codec: "flac"}
+	var samples int64
+	off := start + 4
+	for {
+		header, err := readAt(r, off, 4)
+		if err != nil {
+			return nil, err
+		}
+		last := header[0]&0x80 != 0
+		blockType := header[0] & 0x7F
+		length := int64(header[1])<<16 | int64(header[2])<<8 | int64(header[3])
+		if blockType == 0 {
+			info, err := readAt(r, off+4, 18)
+			if err != nil {
+				return nil, err
+			}
+			parseStreamInfo(f, info)
+			samples = int64(info[13]&0x0F)<<32 | int64(binary.BigEndian.Uint32(info[14:]))
+		}
+		off += 4 + length
+		if last {
+			break
+		}
+	}
+	f.Duration = seconds(samples, f.SampleRate)
+	f.Bitrate = bitrate(size-off, f.Duration)
+	return f, nil
+}
+
+// parseStreamInfo reads the stream parameters of a FLAC STREAMINFO block.
+func parseStreamInfo(f *Format, info []byte) {
+	f.SampleRate = int(info[10])<<12 | int(info[11])<<4 | int(info[12])>>4
+	f.Channels = int(info[12]>>1&0x07) + 1
+	f.BitDepth = int(info[12]&0x01)<<4 | int(info[13]>>4) + 1
+}
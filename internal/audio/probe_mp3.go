@@ -0,0 +1,219 @@
+package audio
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+)
+
+// mpegBitrates are the bitrates in kbit/s by version 1 or 2 and layer.
+var mpegBitrates = [2][3][15]int{
+	{
+		{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+	},
+	{
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+	},
+}
+
+// mpegSampleRates are the sample rates of MPEG 1, 2 and 2.5.
+var mpegSampleRates = [3][3]int{{44100, 48000, 32000}, {22050, 24000, 16000}, {11025, 12000, 8000}}
+
+// mpegFrame is the header of an MPEG audio frame.
+type mpegFrame struct {
+	// version is 0 for MPEG 1, 1 for MPEG 2 and 2 for MPEG 2.5.
+	version    int
+	layer      int
+	bitrate    int
+	sampleRate int
+	channels   int
+	size       int
+	samples    int
+}
+
+// parseMPEGFrame parses the four byte header of a frame.
+func parseMPEGFrame(h []byte) (mpegFrame, bool) {
+	if len(h) < 4 || h[0] != 0xFF || h[1]&0xE0 != 0xE0 {
+		return mpegFrame{}, false
+	}
+	var f mpegFrame
+	switch h[1] >> 3 & 0x03 {
+	case 0:
+		f.version = 2
+	case 2:
+		f.version = 1
+	case 3:
+		f.version = 0
+	default:
+		return mpegFrame{}, false
+	}
+	f.layer = 4 - int(h[1]>>1&0x03)
+	bitrateIndex, rateIndex := int(h[2]>>4), int(h[2]>>2&0x03)
+	// Free format streams are not supported.
+	if f.layer == 4 || bitrateIndex == 0 || bitrateIndex == 15 || rateIndex == 3 {
+		return mpegFrame{}, false
+	}
+	f.bitrate = mpegBitrates[min(f.version, 1)][f.layer-1][bitrateIndex] * 1000
+	f.sampleRate = mpegSampleRates[f.version][rateIndex]
+	f.channels = 2
+	if h[3]>>6 == 3 {
+		f.channels = 1
+	}
+
+	padding := int(h[2] >> 1 & 0x01)
+	switch {
+	case f.layer == 1:
+		f.samples = 384
+		f.size = (12*f.bitrate/f.sampleRate + padding) * 4
+	case f.layer == 2 || f.version == 0:
+		f.samples = 1152
+		f.size = 144*f.bitrate/f.sampleRate + padding
+	default:
+		f.samples = 576
+		f.size = 72*f.bitrate/f.sampleRate + padding
+	}
+	return f, true
+}
+
+// sideInfoSize returns the length of the layer III side information
+// following the header.
+func (f mpegFrame) sideInfoSize() int {
+	switch {
+	case f.version == 0 && f.channels == 1:
+		return 17
+	case f.version == 0:
+		return 32
+	case f.channels == 1:
+		return 9
+	}
+	return 17
+}
+
+func probeMP3(r io.ReaderAt, start, size int64) (*Format, error) {
+	// An ID3v1 tag may follow the audio.
+	if size-start >= 128 {
+		if tag, err := readAt(r, size-128, 3); err == nil && string(tag) == "TAG" {
+			size -= 128
+		}
+	}
+
+	first, off, err := findMPEGFrame(r, start, size)
+	if err != nil {
+		return nil, err
+	}
+	f := &Format{Container: FormatMP3, Codec: "mp3", SampleRate: first.sampleRate, Channels: first.channels}
+	if first.layer != 3 {
+		f.Codec = "mp" + strconv.Itoa(first.layer)
+	}
+
+	// Encoders write the length of the stream into the first frame: Xing
+	// and Info headers after the side information, VBRI at a fixed offset.
+	data, _ := readAt(r, off, min(first.size, int(size-off)))
+	xing := 4 + first.sideInfoSize()
+	switch {
+	case first.layer == 3 && len(data) >= xing+8 && (bytes.Equal(data[xing:xing+4], []byte("Xing")) || bytes.Equal(data[xing:xing+4], []byte("Info"))):
+		frames, audioBytes, skip, ok := parseXing(data[xing:])
+		if ok {
+			f.VBR = string(data[xing:xing+4]) == "Xing"
+			if audioBytes == 0 {
+				audioBytes = size - off - int64(first.size)
+			}
+			f.Duration = seconds(frames*int64(first.samples)-skip, first.sampleRate)
+			f.Bitrate = bitrate(audioBytes, f.Duration)
+			return f, nil
+		}
+	case len(data) >= 36+18 && bytes.Equal(data[36:40], []byte("VBRI")):
+		audioBytes := int64(binary.BigEndian.Uint32(data[46:]))
+		frames := int64(binary.BigEndian.Uint32(data[50:]))
+		f.VBR = true
+		f.Duration = seconds(frames*int64(first.samples), first.sampleRate)
+		f.Bitrate = bitrate(audioBytes, f.Duration)
+		return f, nil
+	}
+
+	// Without a header, every frame is counted.
+	br := bufio.NewReaderSize(io.NewSectionReader(r, off, size-off), 64<<10)
+	var frames, audioBytes int64
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(br, header); err != nil {
+			break
+		}
+		frame, ok := parseMPEGFrame(header)
+		if !ok || frame.sampleRate != first.sampleRate {
+			break
+		}
+		if frame.bitrate != first.bitrate {
+			f.VBR = true
+		}
+		if _, err := br.Discard(frame.size - 4); err != nil {
+			break
+		}
+		frames++
+		audioBytes += int64(frame.size)
+	}
+	f.Duration = seconds(frames*int64(first.samples), first.sampleRate)
+	f.Bitrate = bitrate(audioBytes, f.Duration)
+	return f, nil
+}
+
+// findMPEGFrame returns the first frame from start that is followed by
+// another, which tells frames from bytes looking like a frame header.
+func findMPEGFrame(r io.ReaderAt, start, size int64) (mpegFrame, int64, error) {
+	const window = 64 << 10
+	buf := make([]byte, min(window, size-start))
+	n, _ := r.ReadAt(buf, start)
+	buf = buf[:n]
+	for i := 0; i+4 <= len(buf); i++ {
+		frame, ok := parseMPEGFrame(buf[i:])
+		if !ok {
+			continue
+		}
+		next := i + frame.size
+		if start+int64(next) == size {
+			return frame, start + int64(i), nil
+		}
+		if following, ok := parseMPEGFrame(buf[min(next, len(buf)):]); ok && following.sampleRate == frame.sampleRate {
+			return frame, start + int64(i), nil
+		}
+	}
+	return mpegFrame{}, 0, errors.New("mp3: no audio frames")
+}
+
+// parseXing reads the frame and byte counts of a Xing or Info header, and
+// the encoder delay and padding from a LAME tag following it.
+func parseXing(data []byte) (frames, audioBytes, skip int64, ok bool) {
+	flags := binary.BigEndian.Uint32(data[4:])
+	pos := 8
+	if flags&0x1 == 0 || len(data) < pos+4 {
+		return 0, 0, 0, false
+	}
+	frames = int64(binary.BigEndian.Uint32(data[pos:]))
+	pos += 4
+	if flags&0x2 != 0 && len(data) >= pos+4 {
+		audioBytes = int64(binary.BigEndian.Uint32(data[pos:]))
+		pos += 4
+	}
+	if flags&0x4 != 0 {
+		pos += 100
+	}
+	if flags&0x8 != 0 {
+		pos += 4
+	}
+	if len(data) >= pos+24 {
+		encoder := string(data[pos : pos+4])
+		if encoder == "LAME" || encoder == "Lavc" || encoder == "Lavf" {
+			delay := int64(data[pos+21])<<4 | int64(data[pos+22])>>4
+			padding := int64(data[pos+22]&0x0F)<<8 | int64(data[pos+23])
+			skip = delay + padding
+		}
+	}
+	return frames, audioBytes, skip, true
+}
@@ -0,0 +1,239 @@
+package audio
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// mp4Box is a box of an MP4 file, with the offsets of its payload.
+type mp4Box struct {
+	typ        string
+	start, end int64
+}
+
+// mp4Boxes returns the boxes between start and end.
+func mp4Boxes(r io.ReaderAt, start, end int64) ([]mp4Box, error) {
+	var boxes []mp4Box
+	for off := start; off+8 <= end; {
+		h, err := readAt(r, off, 8)
+		if err != nil {
+			return nil, err
+		}
+		size, typ, headerSize := int64(binary.BigEndian.Uint32(h)), string(h[4:]), int64(8)
+		switch size {
+		case 0:
+			size = end - off
+		case 1:
+			large, err := readAt(r, off+8, 8)
+			if err != nil {
+				return nil, err
+			}
+			size, headerSize = int64(binary.BigEndian.Uint64(large)), 16
+		}
+		if size < headerSize || off+size > end {
+			return nil, fmt.Errorf("mp4: invalid %q box", typ)
+		}
+		boxes = append(boxes, mp4Box{typ: typ, start: off + headerSize, end: off + size})
+		off += size
+	}
+	return boxes, nil
+}
+
+// mp4Find follows path down from the boxes between start and end.
+func mp4Find(r io.ReaderAt, start, end int64, path ...string) (mp4Box, error) {
+	box := mp4Box{start: start, end: end}
+	for _, typ := range path {
+		boxes, err := mp4Boxes(r, box.start, box.end)
+		if err != nil {
+			return mp4Box{}, err
+		}
+		found := false
+		for _, b := range boxes {
+			if b.typ == typ {
+				box, found = b, true
+				break
+			}
+		}
+		if !found {
+			return mp4Box{}, fmt.Errorf("mp4: no %q box", typ)
+		}
+	}
+	return box, nil
+}
+
+// mp4Payload reads the payload of box, up to limit bytes.
+func mp4Payload(r io.ReaderAt, box mp4Box, limit int) ([]byte, error) {
+	return readAt(r, box.start, int(min(box.end-box.start, int64(limit))))
+}
+
+func probeMP4(r io.ReaderAt, size int64) (*Format, error) {
+	top, err := mp4Boxes(r, 0, size)
+	if err != nil {
+		return nil, err
+	}
+	var moov mp4Box
+	var mdat int64
+	for _, box := range top {
+		switch box.typ {
+		case "moov":
+			moov = box
+		case "mdat":
+			mdat += box.end - box.start
+		}
+	}
+	if moov.typ == "" {
+		return nil, errors.New("mp4: no moov box")
+	}
+
+	traks, err := mp4Boxes(r, moov.start, moov.end)
+	if err != nil {
+		return nil, err
+	}
+	for _, trak := range traks {
+		if trak.typ != "trak" {
+			continue
+		}
+		hdlr, err := mp4Find(r, trak.start, trak.end, "mdia", "hdlr")
+		if err != nil {
+			continue
+		}
+		handler, err := mp4Payload(r, hdlr, 12)
+		if err != nil || len(handler) < 12 || string(handler[8:12]) != "soun" {
+			continue
+		}
+		return probeMP4Track(r, trak, mdat)
+	}
+	return nil, fmt.Errorf("%w: mp4 without an audio track", ErrUnsupported)
+}
+
+// probeMP4Track reads the format of an audio track.
+func probeMP4Track(r io.ReaderAt, trak mp4Box, mdat int64) (*Format, error) {
+	f := &Format{Container: "mp4"}
+	mdhd, err := mp4Find(r, trak.start, trak.end, "mdia", "mdhd")
+	if err != nil {
+		return nil, err
+	}
+	header, err := mp4Payload(r, mdhd, 32)
+	if err != nil {
+		return nil, err
+	}
+	var timescale uint32
+	var duration uint64
+	if len(header) >= 32 && header[0] == 1 {
+		timescale, duration = binary.BigEndian.Uint32(header[20:]), binary.BigEndian.Uint64(header[24:])
+	} else if len(header) >= 20 {
+		timescale, duration = binary.BigEndian.Uint32(header[12:]), uint64(binary.BigEndian.Uint32(header[16:]))
+	}
+	if timescale == 0 {
+		return nil, errors.New("mp4: track without a timescale")
+	}
+	f.Duration = seconds(int64(duration), int(timescale))
+
+	stsd, err := mp4Find(r, trak.start, trak.end, "mdia", "minf", "stbl", "stsd")
+	if err != nil {
+		return nil, err
+	}
+	// The sample descriptions follow the version, flags and their count.
+	entries, err := mp4Boxes(r, stsd.start+8, stsd.end)
+	if err != nil || len(entries) == 0 {
+		return nil, errors.New("mp4: no sample description")
+	}
+	entry := entries[0]
+	fields, err := mp4Payload(r, entry, 28)
+	if err != nil || len(fields) < 28 {
+		return nil, errors.New("mp4: truncated sample description")
+	}
+	f.Channels = int(binary.BigEndian.Uint16(fields[16:]))
+	sampleSize := int(binary.BigEndian.Uint16(fields[18:]))
+	f.SampleRate = int(binary.BigEndian.Uint32(fields[24:]) >> 16)
+	children, _ := mp4Boxes(r, entry.start+28, entry.end)
+
+	avgBitrate := 0
+	switch entry.typ {
+	case "mp4a":
+		f.Codec = "aac"
+		for _, child := range children {
+			if child.typ != "esds" {
+				continue
+			}
+			esds, err := mp4Payload(r, child, 64)
+			if err != nil {
+				break
+			}
+			var oti byte
+			oti, avgBitrate = parseESDS(esds)
+			if oti == 0x69 || oti == 0x6B {
+				f.Codec = "mp3"
+			}
+		}
+	case "alac":
+		f.Codec, f.BitDepth = "alac", sampleSize
+		// The sample entry only holds rates up to 65535 Hz.
+		for _, child := range children {
+			if child.typ != "alac" {
+				continue
+			}
+			if cfg, err := mp4Payload(r, child, 28); err == nil && len(cfg) >= 28 {
+				f.BitDepth = int(cfg[9])
+				f.Channels = int(cfg[13])
+				f.SampleRate = int(binary.BigEndian.Uint32(cfg[24:]))
+			}
+		}
+	case "fLaC":
+		f.Codec, f.BitDepth = "flac", sampleSize
+	case "Opus":
+		f.Codec, f.SampleRate = "opus", 48000
+	default:
+		return nil, fmt.Errorf("%w: mp4 audio in %q", ErrUnsupported, entry.typ)
+	}
+
+	f.Bitrate = avgBitrate
+	if f.Bitrate == 0 {
+		f.Bitrate = bitrate(mdat, f.Duration)
+	}
+	return f, nil
+}
+
+// parseESDS returns the object type and average bitrate from the decoder
+// configuration in an elementary stream descriptor.
+func parseESDS(esds []byte) (objectType byte, avgBitrate int) {
+	// descriptor returns the tag and payload offset of the descriptor at i.
+	descriptor := func(i int) (byte, int) {
+		if i >= len(esds) {
+			return 0, len(esds)
+		}
+		tag := esds[i]
+		i++
+		// Lengths take up to four bytes of seven bits.
+		for n := 0; n < 4 && i < len(esds); n++ {
+			i++
+			if esds[i-1]&0x80 == 0 {
+				break
+			}
+		}
+		return tag, i
+	}
+
+	tag, i := descriptor(4)
+	if tag != 0x03 || i+3 > len(esds) {
+		return 0, 0
+	}
+	flags := esds[i+2]
+	i += 3
+	if flags&0x80 != 0 {
+		i += 2
+	}
+	if flags&0x40 != 0 && i < len(esds) {
+		i += 1 + int(esds[i])
+	}
+	if flags&0x20 != 0 {
+		i += 2
+	}
+	tag, i = descriptor(i)
+	if tag != 0x04 || i+13 > len(esds) {
+		return 0, 0
+	}
+	return esds[i], int(binary.BigEndian.Uint32(esds[i+9:]))
+}
@@ -0,0 +1,86 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// oggPageHeaderSize is the length of an Ogg page header up to its segment
+// table.
+const oggPageHeaderSize = 27
+
+func probeOgg(r io.ReaderAt, size int64) (*Format, error) {
+	header, err := readAt(r, 0, oggPageHeaderSize)
+	if err != nil {
+		return nil, err
+	}
+	serial := binary.LittleEndian.Uint32(header[14:])
+	segments := int(header[26])
+	table, err := readAt(r, oggPageHeaderSize, segments)
+	if err != nil {
+		return nil, err
+	}
+	length := 0
+	for _, lacing := range table {
+		length += int(lacing)
+		if lacing < 255 {
+			break
+		}
+	}
+	// The first page holds just the identification header of the stream.
+	packet, err := readAt(r, int64(oggPageHeaderSize+segments), length)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &Format{Container: "ogg"}
+	var skip int64
+	switch {
+	case len(packet) >= 30 && bytes.HasPrefix(packet, []byte("\x01vorbis")):
+		f.Codec, f.VBR = "vorbis", true
+		f.Channels = int(packet[11])
+		f.SampleRate = int(binary.LittleEndian.Uint32(packet[12:]))
+	case len(packet) >= 19 && bytes.HasPrefix(packet, []byte("OpusHead")):
+		// Opus always decodes at 48 kHz, whatever the rate of its source.
+		f.Codec, f.VBR = "opus", true
+		f.Channels = int(packet[9])
+		f.SampleRate = 48000
+		skip = int64(binary.LittleEndian.Uint16(packet[10:]))
+	case len(packet) >= 51 && bytes.HasPrefix(packet, []byte("\x7FFLAC")) && bytes.Equal(packet[9:13], []byte("fLaC")):
+		f.Codec = "flac"
+		parseStreamInfo(f, packet[17:])
+	default:
+		return nil, fmt.Errorf("%w: ogg stream of an unknown codec", ErrUnsupported)
+	}
+
+	granule, err := lastGranule(r, size, serial)
+	if err != nil {
+		return nil, err
+	}
+	f.Duration = seconds(max(0, granule-skip), f.SampleRate)
+	f.Bitrate = bitrate(size, f.Duration)
+	return f, nil
+}
+
+// lastGranule returns the granule position of the last page of the stream,
+// its length in samples.
+func lastGranule(r io.ReaderAt, size int64, serial uint32) (int64, error) {
+	const window = 64 << 10
+	start := max(0, size-window)
+	buf := make([]byte, size-start)
+	n, _ := r.ReadAt(buf, start)
+	buf = buf[:n]
+	for i := bytes.LastIndex(buf, []byte("OggS")); i >= 0; i = bytes.LastIndex(buf[:i], []byte("OggS")) {
+		if i+oggPageHeaderSize > len(buf) || binary.LittleEndian.Uint32(buf[i+14:]) != serial {
+			continue
+		}
+		// Pages without a finished packet have no position.
+		if granule := int64(binary.LittleEndian.Uint64(buf[i+6:])); granule >= 0 {
+			return granule, nil
+		}
+	}
+	return 0, errors.New("ogg: no final page")
+}
@@ -0,0 +1,205 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func probe(t *testing.T, data []byte) *Format {
+	f, err := Probe(bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+	return f
+}
+
+// be32 encodes v as four big-endian bytes.
+func be32(v uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, v)
+}
+
+// mp3Frame returns a 128 kbit/s, 44.1 kHz joint stereo frame with payload
+// at the start of its data.
+func mp3Frame(payload []byte) []byte {
+	frame := make([]byte, 417)
+	copy(frame, []byte{0xFF, 0xFB, 0x90, 0x64})
+	copy(frame[4:], payload)
+	return frame
+}
+
+func TestProbe_WAV(t *testing.T) {
+	f := probe(t, EncodeWAV(44100, 2, make([]float64, 2*44100)))
+	assert.Equal(t, &Format{
+		Container:  "wav",
+		Codec:      "pcm",
+		SampleRate: 44100,
+		BitDepth:   16,
+		Channels:   2,
+		Bitrate:    1411200,
+		Duration:   time.Second,
+	}, f)
+}
+
+func TestProbe_FLAC(t *testing.T) {
+	data := encodeFLAC(t, 48000, 1, make([]float64, 24000))
+	f := probe(t, data)
+	assert.Equal(t, "flac", f.Container)
+	assert.Equal(t, "flac", f.Codec)
+	assert.Equal(t, 48000, f.SampleRate)
+	assert.Equal(t, 16, f.BitDepth)
+	assert.Equal(t, 1, f.Channels)
+	assert.Equal(t, 500*time.Millisecond, f.Duration)
+	assert.Positive(t, f.Bitrate)
+
+	// A leading ID3v2 tag is skipped.
+	tagged := append([]byte("ID3\x04\x00\x00\x00\x00\x00\x0A0123456789"), data...)
+	assert.Equal(t, f.Duration, probe(t, tagged).Duration)
+}
+
+func TestProbe_MP3(t *testing.T) {
+	// Without a header the frames are counted, skipping the tags around
+	// them.
+	data := []byte("ID3\x03\x00\x00\x00\x00\x00\x05hello")
+	data = append(data, silentMP3(100)...)
+	data = append(data, append([]byte("TAG"), make([]byte, 125)...)...)
+	f := probe(t, data)
+	assert.Equal(t, "mp3", f.Container)
+	assert.Equal(t, "mp3", f.Codec)
+	assert.Equal(t, 44100, f.SampleRate)
+	assert.Equal(t, 2, f.Channels)
+	assert.Zero(t, f.BitDepth)
+	assert.False(t, f.VBR)
+	assert.Equal(t, seconds(100*1152, 44100), f.Duration)
+	// The frames leave out the padding that brings them to 128 kbit/s.
+	assert.InDelta(t, 100*417*8/f.Duration.Seconds(), f.Bitrate, 1)
+
+	// A Xing header gives the frame count of VBR streams, and a LAME tag the
+	// encoder delay and padding to leave out.
+	xing := append([]byte("Xing"), be32(0x3)...)
+	xing = append(xing, be32(1000)...)
+	xing = append(xing, be32(320000)...)
+	lame := make([]byte, 24)
+	copy(lame, "LAME3.100")
+	lame[21], lame[22], lame[23] = 0x24, 0x03, 0xE8 // 576 and 1000 samples
+	xing = append(xing, lame...)
+	payload := append(make([]byte, 32), xing...)
+	f = probe(t, append(mp3Frame(payload), silentMP3(10)...))
+	assert.True(t, f.VBR)
+	assert.Equal(t, seconds(1000*1152-1576, 44100), f.Duration)
+	assert.InDelta(t, 320000*8/f.Duration.Seconds(), f.Bitrate, 1)
+
+	// Info headers mark CBR streams.
+	copy(payload[32:], "Info")
+	assert.False(t, probe(t, append(mp3Frame(payload), silentMP3(10)...)).VBR)
+
+	// Fraunhofer's encoder writes a VBRI header instead.
+	vbri := append([]byte("VBRI\x00\x01\x00\x00\x00\x00"), be32(500000)...)
+	vbri = append(vbri, be32(2000)...)
+	f = probe(t, append(mp3Frame(append(make([]byte, 32), vbri...)), silentMP3(10)...))
+	assert.True(t, f.VBR)
+	assert.Equal(t, seconds(2000*1152, 44100), f.Duration)
+}
+
+// oggPage returns an Ogg page holding packet.
+func oggPage(granule int64, packet []byte) []byte {
+	page := []byte("OggS\x00\x02")
+	page = binary.LittleEndian.AppendUint64(page, uint64(granule))
+	page = binary.LittleEndian.AppendUint32(page, 0x1234)
+	page = append(page, make([]byte, 8)...)
+	var lacing []byte
+	for n := len(packet); ; n -= 255 {
+		lacing = append(lacing, byte(min(n, 255)))
+		if n < 255 {
+			break
+		}
+	}
+	page = append(page, byte(len(lacing)))
+	page = append(page, lacing...)
+	return append(page, packet...)
+}
+
+func TestProbe_Ogg(t *testing.T) {
+	head := []byte("OpusHead\x01\x02\x38\x01\x44\xAC\x00\x00\x00\x00\x00")
+	data := append(oggPage(0, head), oggPage(0, []byte("OpusTags"))...)
+	data = append(data, make([]byte, 12000)...)
+	data = append(data, oggPage(312+96000, make([]byte, 100))...)
+	f := probe(t, data)
+	assert.Equal(t, "ogg", f.Container)
+	assert.Equal(t, "opus", f.Codec)
+	assert.Equal(t, 48000, f.SampleRate)
+	assert.Equal(t, 2, f.Channels)
+	assert.True(t, f.VBR)
+	assert.Equal(t, 2*time.Second, f.Duration)
+
+	vorbis := append([]byte("\x01vorbis\x00\x00\x00\x00\x01"), binary.LittleEndian.AppendUint32(nil, 22050)...)
+	vorbis = append(vorbis, make([]byte, 14)...)
+	data = append(oggPage(0, vorbis), oggPage(44100, nil)...)
+	f = probe(t, data)
+	assert.Equal(t, "vorbis", f.Codec)
+	assert.Equal(t, 1, f.Channels)
+	assert.Equal(t, 2*time.Second, f.Duration)
+
+	_, err := Probe(bytes.NewReader(oggPage(0, []byte("Speex   "))), 50)
+	assert.ErrorIs(t, err, ErrUnsupported)
+}
+
+// box returns an MP4 box of the given type.
+func box(typ string, payload ...[]byte) []byte {
+	data := bytes.Join(payload, nil)
+	return append(append(be32(uint32(8+len(data))), typ...), data...)
+}
+
+func TestProbe_MP4(t *testing.T) {
+	esds := []byte{0, 0, 0, 0, 0x03, 0x19, 0x00, 0x01, 0x00, 0x04, 0x11, 0x40, 0x15, 0, 0, 0}
+	esds = append(esds, be32(300000)...)
+	esds = append(esds, be32(256000)...)
+	sampleEntry := make([]byte, 28)
+	binary.BigEndian.PutUint16(sampleEntry[16:], 2)
+	binary.BigEndian.PutUint16(sampleEntry[18:], 16)
+	binary.BigEndian.PutUint32(sampleEntry[24:], 44100<<16)
+	mdhd := make([]byte, 20)
+	binary.BigEndian.PutUint32(mdhd[12:], 44100)
+	binary.BigEndian.PutUint32(mdhd[16:], 3*44100)
+
+	data := box("ftyp", []byte("M4A \x00\x00\x00\x00"))
+	data = append(data, box("moov",
+		box("mvhd", make([]byte, 100)),
+		box("trak", box("mdia",
+			box("mdhd", mdhd),
+			box("hdlr", []byte("\x00\x00\x00\x00\x00\x00\x00\x00soun")),
+			box("minf", box("stbl", box("stsd", make([]byte, 8), box("mp4a", sampleEntry, box("esds", esds))))),
+		)),
+	)...)
+	data = append(data, box("mdat", make([]byte, 1000))...)
+
+	f := probe(t, data)
+	assert.Equal(t, &Format{
+		Container:  "mp4",
+		Codec:      "aac",
+		SampleRate: 44100,
+		Channels:   2,
+		Bitrate:    256000,
+		Duration:   3 * time.Second,
+	}, f)
+
+	// Truncated boxes fail rather than panic.
+	data = box("ftyp", []byte("M4A \x00\x00\x00\x00"))
+	data = append(data, box("moov", box("trak", box("mdia",
+		box("hdlr", []byte("\x00\x00\x00\x00\x00\x00\x00\x00soun")),
+		box("mdhd"),
+	)))...)
+	_, err := Probe(bytes.NewReader(data), int64(len(data)))
+	assert.Error(t, err)
+}
+
+func TestProbe_Unsupported(t *testing.T) {
+	for _, data := range []string{"", "hello world", "\x00\x00\x00\x10ftypqt  moov"} {
+		_, err := Probe(bytes.NewReader([]byte(data)), int64(len(data)))
+		assert.Error(t, err, data)
+	}
+	_, err := Probe(bytes.NewReader([]byte("hello world")), 11)
+	assert.ErrorIs(t, err, ErrUnsupported)
+}
@@ -0,0 +1,437 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// Tags are the descriptive tags embedded in an audio file. Fields the file
+// leaves out are empty.
+type Tags struct {
+	Title       string
+	Artist      string
+	Album       string
+	AlbumArtist string
+	Genre       string
+	// Track is the position of the track on its album, 0 if unknown.
+	Track int
+	Year  int
+	// Explicit is set for tracks with a parental advisory.
+	Explicit bool
+}
+
+// ReadTags reads the tags of the size bytes of audio in r: ID3v2 and ID3v1
+// tags of MP3 and FLAC files, Vorbis comments of FLAC and Ogg files, and
+// the iTunes metadata of MP4 files. Data in other formats returns
+// ErrUnsupported; files without tags return empty Tags.
+func ReadTags(r io.ReaderAt, size int64) (*Tags, error) {
+	head := make([]byte, 12)
+	n, _ := r.ReadAt(head, 0)
+	head = head[:n]
+
+	t := &Tags{}
+	switch {
+	case len(head) >= 12 && (bytes.Equal(head[:4], []byte("RIFF")) || bytes.Equal(head[:4], []byte("RF64"))) && bytes.Equal(head[8:12], []byte("WAVE")):
+		// INFO chunks are rarely used, and left out.
+		return t, nil
+	case bytes.HasPrefix(head, []byte("OggS")):
+		return t, readOggTags(r, t)
+	case len(head) >= 8 && bytes.Equal(head[4:8], []byte("ftyp")):
+		return t, readMP4Tags(r, size, t)
+	}
+
+	start := id3Size(head)
+	if start > 0 {
+		tag, err := readAt(r, 0, int(start))
+		if err != nil {
+			return nil, err
+		}
+		parseID3v2(tag, t)
+		head = make([]byte, 4)
+		n, _ := r.ReadAt(head, start)
+		head = head[:n]
+	}
+	switch {
+	case bytes.HasPrefix(head, []byte("fLaC")):
+		if err := readFLACTags(r, start+4, t); err != nil {
+			return nil, err
+		}
+	case len(head) >= 2 && head[0] == 0xFF && head[1]&0xE0 == 0xE0:
+	default:
+		return nil, ErrUnsupported
+	}
+	if size >= 128 {
+		if tag, err := readAt(r, size-128, 128); err == nil {
+			parseID3v1(tag, t)
+		}
+	}
+	return t, nil
+}
+
+// set fills in the tag called name, as named by Vorbis comments, unless it
+// is set already.
+func (t *Tags) set(name, value string) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return
+	}
+	switch name {
+	case "TITLE":
+		setString(&t.Title, value)
+	case "ARTIST":
+		setString(&t.Artist, value)
+	case "ALBUM":
+		setString(&t.Album, value)
+	case "ALBUMARTIST", "ALBUM ARTIST":
+		setString(&t.AlbumArtist, value)
+	case "GENRE":
+		setString(&t.Genre, genreName(value))
+	case "TRACKNUMBER":
+		// Track numbers may come with the track count, as in 3/12.
+		if t.Track == 0 {
+			number, _, _ := strings.Cut(value, "/")
+			t.Track, _ = strconv.Atoi(strings.TrimSpace(number))
+		}
+	case "DATE", "YEAR":
+		if t.Year == 0 && len(value) >= 4 {
+			t.Year, _ = strconv.Atoi(value[:4])
+		}
+	case "ITUNESADVISORY":
+		// 1 marks explicit tracks and 2 clean versions of them.
+		t.Explicit = t.Explicit || value == "1"
+	}
+}
+
+func setString(field *string, value string) {
+	if *field == "" {
+		*field = value
+	}
+}
+
+// id3Frames maps ID3v2.2, v2.3 and v2.4 text frames to the tags they hold.
+var id3Frames = map[string]string{
+	"TT2": "TITLE", "TIT2": "TITLE",
+	"TP1": "ARTIST", "TPE1": "ARTIST",
+	"TAL": "ALBUM", "TALB": "ALBUM",
+	"TP2": "ALBUMARTIST", "TPE2": "ALBUMARTIST",
+	"TCO": "GENRE", "TCON": "GENRE",
+	"TRK": "TRACKNUMBER", "TRCK": "TRACKNUMBER",
+	"TYE": "YEAR", "TYER": "YEAR", "TDRC": "DATE",
+}
+
+// parseID3v2 reads the text frames of an ID3v2 tag.
+func parseID3v2(tag []byte, t *Tags) {
+	eachID3Frame(tag, func(id string, frame, data []byte) {
+		if len(data) == 0 {
+			return
+		}
+		text := id3Text(data[0], data[1:])
+		if id == "TXXX" || id == "TXX" {
+			// User defined frames hold a description and a value.
+			name, value, _ := strings.Cut(text, "\x00")
+			t.set(strings.ToUpper(name), strings.TrimPrefix(value, "\ufeff"))
+			return
+		}
+		if name, ok := id3Frames[id]; ok {
+			// ID3v2.4 separates multiple values by NUL; the first is kept.
+			value, _, _ := strings.Cut(text, "\x00")
+			t.set(name, value)
+		}
+	})
+}
+
+// eachID3Frame calls fn with the ID, the bytes and the data of every frame
+// of an ID3v2 tag, undoing unsynchronisation of the data.
+func eachID3Frame(tag []byte, fn func(id string, frame, data []byte)) {
+	version, flags := tag[3], tag[5]
+	body := tag[10:]
+	if flags&0x80 != 0 && version < 4 {
+		body = unsynchronize(body)
+	}
+	if flags&0x40 != 0 && len(body) >= 4 {
+		// Skip the extended header.
+		size := int(binary.BigEndian.Uint32(body))
+		if version == 4 {
+			size = syncsafe(body)
+		} else {
+			size += 4
+		}
+		body = body[min(size, len(body)):]
+	}
+
+	idSize, headerSize := 4, 10
+	if version == 2 {
+		idSize, headerSize = 3, 6
+	}
+	for len(body) >= headerSize && body[0] != 0 {
+		id := string(body[:idSize])
+		var size int
+		switch version {
+		case 2:
+			size = int(body[3])<<16 | int(body[4])<<8 | int(body[5])
+		case 3:
+			size = int(binary.BigEndian.Uint32(body[4:]))
+		default:
+			size = syncsafe(body[4:])
+		}
+		if size < 0 || headerSize+size > len(body) {
+			return
+		}
+		frame := body[:headerSize+size]
+		data := frame[headerSize:]
+		if version == 4 && body[9]&0x02 != 0 {
+			data = unsynchronize(data)
+		}
+		body = body[headerSize+size:]
+		fn(id, frame, data)
+	}
+}
+
+// syncsafe decodes a 28-bit integer stored in four bytes of seven bits.
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7F)<<21 | int(b[1]&0x7F)<<14 | int(b[2]&0x7F)<<7 | int(b[3]&0x7F)
+}
+
+// unsynchronize undoes ID3v2 unsynchronisation, which follows every 0xFF
+// with a 0x00.
+func unsynchronize(b []byte) []byte {
+	return bytes.ReplaceAll(b, []byte{0xFF, 0x00}, []byte{0xFF})
+}
+
+// id3Text decodes ID3v2 text in the given encoding.
+func id3Text(encoding byte, data []byte) string {
+	switch encoding {
+	case 1, 2:
+		order := binary.ByteOrder(binary.BigEndian)
+		if len(data) >= 2 && data[0] == 0xFF && data[1] == 0xFE {
+			order, data = binary.LittleEndian, data[2:]
+		} else if len(data) >= 2 && data[0] == 0xFE && data[1] == 0xFF {
+			data = data[2:]
+		}
+		units := make([]uint16, len(data)/2)
+		for i := range units {
+			units[i] = order.Uint16(data[2*i:])
+		}
+		return strings.TrimRight(string(utf16.Decode(units)), "\x00")
+	case 3:
+		return strings.TrimRight(string(data), "\x00")
+	default:
+		return strings.TrimRight(latin1(data), "\x00")
+	}
+}
+
+func latin1(b []byte) string {
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
+
+// parseID3v1 reads an ID3v1 tag, the last 128 bytes of a file.
+func parseID3v1(tag []byte, t *Tags) {
+	if !bytes.HasPrefix(tag, []byte("TAG")) {
+		return
+	}
+	field := func(b []byte) string {
+		b, _, _ = bytes.Cut(b, []byte{0})
+		return latin1(b)
+	}
+	t.set("TITLE", field(tag[3:33]))
+	t.set("ARTIST", field(tag[33:63]))
+	t.set("ALBUM", field(tag[63:93]))
+	t.set("YEAR", field(tag[93:97]))
+	// ID3v1.1 keeps the track number at the end of the comment.
+	if tag[125] == 0 && tag[126] != 0 {
+		t.set("TRACKNUMBER", strconv.Itoa(int(tag[126])))
+	}
+	if int(tag[127]) < len(id3Genres) {
+		t.set("GENRE", id3Genres[tag[127]])
+	}
+}
+
+// genreName resolves ID3 genre references like "(17)" or "17" to their
+// name.
+func genreName(genre string) string {
+	ref := strings.TrimSuffix(strings.TrimPrefix(genre, "("), ")")
+	if i, err := strconv.Atoi(ref); err == nil && i >= 0 && i < len(id3Genres) {
+		return id3Genres[i]
+	}
+	return genre
+}
+
+// id3Genres are the genres of ID3v1 by their number.
+var id3Genres = []string{
+	"Blues", "Classic Rock", "Country", "Dance", "Disco", "Funk", "Grunge",
+	"Hip-Hop", "Jazz", "Metal", "New Age", "Oldies", "Other", "Pop", "R&B",
+	"Rap", "Reggae", "Rock", "Techno", "Industrial", "Alternative", "Ska",
+	"Death Metal", "Pranks", "Soundtrack", "Euro-Techno", "Ambient",
+	"Trip-Hop", "Vocal", "Jazz+Funk", "Fusion", "Trance", "Classical",
+	"Instrumental", "Acid", "House", "Game", "Sound Clip", "Gospel", "Noise",
+	"AlternRock", "Bass", "Soul", "Punk", "Space", "Meditative",
+	"Instrumental Pop", "Instrumental Rock", "Ethnic", "Gothic", "Darkwave",
+	"Techno-Industrial", "Electronic", "Pop-Folk", "Eurodance", "Dream",
+	"Southern Rock", "Comedy", "Cult", "Gangsta", "Top 40", "Christian Rap",
+	"Pop/Funk", "Jungle", "Native American", "Cabaret", "New Wave",
+	"Psychedelic", "Rave", "Showtunes", "Trailer", "Lo-Fi", "Tribal",
+	"Acid Punk", "Acid Jazz", "Polka", "Retro", "Musical", "Rock & Roll",
+	"Hard Rock",
+}
+
+// readFLACTags reads the Vorbis comments of the FLAC metadata blocks at off.
+func readFLACTags(r io.ReaderAt, off int64, t *Tags) error {
+	for {
+		header, err := readAt(r, off, 4)
+		if err != nil {
+			return err
+		}
+		size := int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+		if header[0]&0x7F == 4 {
+			block, err := readAt(r, off+4, size)
+			if err != nil {
+				return err
+			}
+			parseVorbisComment(block, t)
+			return nil
+		}
+		if header[0]&0x80 != 0 {
+			return nil
+		}
+		off += 4 + int64(size)
+	}
+}
+
+// parseVorbisComment reads the little-endian vendor string and list of
+// NAME=value comments of a Vorbis comment block.
+func parseVorbisComment(block []byte, t *Tags) {
+	if len(block) < 4 {
+		return
+	}
+	vendor := int(binary.LittleEndian.Uint32(block))
+	if 4+vendor+4 > len(block) {
+		return
+	}
+	block = block[4+vendor:]
+	count := int(binary.LittleEndian.Uint32(block))
+	block = block[4:]
+	for i := 0; i < count && len(block) >= 4; i++ {
+		length := int(binary.LittleEndian.Uint32(block))
+		if 4+length > len(block) {
+			return
+		}
+		name, value, ok := strings.Cut(string(block[4:4+length]), "=")
+		if ok {
+			t.set(strings.ToUpper(name), value)
+		}
+		block = block[4+length:]
+	}
+}
+
+// readOggTags reads the comment header of a Vorbis, Opus or FLAC stream,
+// its second packet.
+func readOggTags(r io.ReaderAt, t *Tags) error {
+	var packets [][]byte
+	var packet []byte
+	for off := int64(0); len(packets) < 2; {
+		header, err := readAt(r, off, oggPageHeaderSize)
+		if err != nil {
+			return err
+		}
+		if !bytes.HasPrefix(header, []byte("OggS")) {
+			return nil
+		}
+		table, err := readAt(r, off+oggPageHeaderSize, int(header[26]))
+		if err != nil {
+			return err
+		}
+		off += oggPageHeaderSize + int64(len(table))
+		for _, lacing := range table {
+			data, err := readAt(r, off, int(lacing))
+			if err != nil {
+				return err
+			}
+			off += int64(lacing)
+			packet = append(packet, data...)
+			if lacing < 255 {
+				packets, packet = append(packets, packet), nil
+			}
+		}
+	}
+
+	comments := packets[1]
+	switch {
+	case bytes.HasPrefix(comments, []byte("\x03vorbis")):
+		parseVorbisComment(comments[7:], t)
+	case bytes.HasPrefix(comments, []byte("OpusTags")):
+		parseVorbisComment(comments[8:], t)
+	case len(comments) >= 4 && comments[0]&0x7F == 4:
+		// Ogg FLAC carries its metadata blocks as packets.
+		parseVorbisComment(comments[4:], t)
+	}
+	return nil
+}
+
+// mp4Items maps iTunes metadata items to the tags they hold.
+var mp4Items = map[string]string{
+	"\xa9nam": "TITLE",
+	"\xa9ART": "ARTIST",
+	"\xa9alb": "ALBUM",
+	"aART":    "ALBUMARTIST",
+	"\xa9gen": "GENRE",
+	"\xa9day": "DATE",
+}
+
+// readMP4Tags reads the iTunes metadata items in moov/udta/meta/ilst.
+func readMP4Tags(r io.ReaderAt, size int64, t *Tags) error {
+	meta, err := mp4Find(r, 0, size, "moov", "udta", "meta")
+	if err != nil {
+		return nil
+	}
+	// meta is a full box, with a version and flags before its children.
+	ilst, err := mp4Find(r, meta.start+4, meta.end, "ilst")
+	if err != nil {
+		return nil
+	}
+	items, err := mp4Boxes(r, ilst.start, ilst.end)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		data, err := mp4Find(r, item.start, item.end, "data")
+		if err != nil {
+			continue
+		}
+		// The value follows its type and locale.
+		payload, err := mp4Payload(r, data, 1024)
+		if err != nil || len(payload) < 8 {
+			continue
+		}
+		value := payload[8:]
+		switch item.typ {
+		case "trkn":
+			if len(value) >= 4 {
+				t.set("TRACKNUMBER", strconv.Itoa(int(binary.BigEndian.Uint16(value[2:]))))
+			}
+		case "rtng":
+			if len(value) >= 1 {
+				t.Explicit = value[0] == 1 || value[0] == 4
+			}
+		case "gnre":
+			// Genres by number count from 1.
+			if len(value) >= 2 {
+				if i := int(binary.BigEndian.Uint16(value)) - 1; i >= 0 && i < len(id3Genres) {
+					t.set("GENRE", id3Genres[i])
+				}
+			}
+		default:
+			if name, ok := mp4Items[item.typ]; ok {
+				t.set(name, string(value))
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readTags(t *testing.T, data []byte) *Tags {
+	tags, err := ReadTags(bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+	return tags
+}
+
+// id3Frame returns an ID3v2.3 frame.
+func id3Frame(id string, data []byte) []byte {
+	return append(append([]byte(id), append(be32(uint32(len(data))), 0, 0)...), data...)
+}
+
+// id3Tag returns an ID3v2 tag of the given version holding frames.
+func id3Tag(version byte, frames ...[]byte) []byte {
+	body := bytes.Join(frames, nil)
+	size := len(body)
+	return append([]byte{'I', 'D', '3', version, 0, 0, byte(size >> 21 & 0x7F), byte(size >> 14 & 0x7F), byte(size >> 7 & 0x7F), byte(size & 0x7F)}, body...)
+}
+
+// vorbisComment returns a Vorbis comment block holding comments.
+func vorbisComment(comments ...string) []byte {
+	block := binary.LittleEndian.AppendUint32(nil, 4)
+	block = append(block, "test"...)
+	block = binary.LittleEndian.AppendUint32(block, uint32(len(comments)))
+	for _, c := range comments {
+		block = binary.LittleEndian.AppendUint32(block, uint32(len(c)))
+		block = append(block, c...)
+	}
+	return block
+}
+
+func TestReadTags_ID3(t *testing.T) {
+	// UTF-16 with a byte order mark, and genres by number.
+	title := []byte{1, 0xFF, 0xFE, 'S', 0, 0xF6, 0, 'n', 0, 'g', 0, 0, 0}
+	tag := id3Tag(3,
+		id3Frame("TIT2", title),
+		id3Frame("TPE1", []byte("\x00Artist")),
+		id3Frame("TALB", []byte("\x00Album\x00")),
+		id3Frame("TRCK", []byte("\x003/12")),
+		id3Frame("TCON", []byte("\x00(17)")),
+		id3Frame("TYER", []byte("\x001999")),
+		id3Frame("APIC", make([]byte, 20)),
+	)
+	data := append(tag, silentMP3(10)...)
+	assert.Equal(t, &Tags{Title: "Söng", Artist: "Artist", Album: "Album", Genre: "Rock", Track: 3, Year: 1999}, readTags(t, data))
+
+	// ID3v1 fills in what ID3v2 leaves out.
+	v1 := make([]byte, 128)
+	copy(v1, "TAG")
+	copy(v1[3:], "Old title")
+	copy(v1[33:], "Old artist")
+	copy(v1[63:], "Other album")
+	v1[126], v1[127] = 7, 8
+	tags := readTags(t, append(data, v1...))
+	assert.Equal(t, "Söng", tags.Title)
+	assert.Equal(t, "Rock", tags.Genre)
+	tags = readTags(t, append(silentMP3(10), v1...))
+	assert.Equal(t, &Tags{Title: "Old title", Artist: "Old artist", Album: "Other album", Genre: "Jazz", Track: 7}, tags)
+
+	// ID3v2.4 uses UTF-8 and syncsafe sizes, and dates for years.
+	frame := func(id, value string) []byte {
+		data := append([]byte{3}, value...)
+		size := len(data)
+		return append(append([]byte(id), byte(size>>21&0x7F), byte(size>>14&0x7F), byte(size>>7&0x7F), byte(size&0x7F), 0, 0), data...)
+	}
+	long := string(bytes.Repeat([]byte("x"), 200))
+	tag = id3Tag(4, frame("TIT2", long), frame("TPE2", "Various"), frame("TDRC", "2021-04-01"))
+	tags = readTags(t, append(tag, silentMP3(10)...))
+	assert.Equal(t, &Tags{Title: long, AlbumArtist: "Various", Year: 2021}, tags)
+
+	assert.Equal(t, &Tags{}, readTags(t, silentMP3(10)))
+}
+
+func TestReadTags_FLAC(t *testing.T) {
+	data := []byte("fLaC\x00\x00\x00\x22")
+	data = append(data, make([]byte, 34)...)
+	comment := vorbisComment("title=Song", "ARTIST=Band", "ALBUMARTIST=Band", "TRACKNUMBER=2", "DATE=2020", "GENRE=Ambient")
+	data = append(data, 0x84, 0, byte(len(comment)>>8), byte(len(comment)))
+	data = append(data, comment...)
+	assert.Equal(t, &Tags{Title: "Song", Artist: "Band", AlbumArtist: "Band", Genre: "Ambient", Track: 2, Year: 2020}, readTags(t, data))
+}
+
+func TestReadTags_Ogg(t *testing.T) {
+	head := []byte("OpusHead\x01\x02\x38\x01\x44\xAC\x00\x00\x00\x00\x00")
+	// The comment packet spans more than one segment.
+	comments := append([]byte("OpusTags"), vorbisComment("TITLE="+string(bytes.Repeat([]byte("a"), 300)), "ALBUM=Live")...)
+	data := append(oggPage(0, head), oggPage(0, comments)...)
+	tags := readTags(t, data)
+	assert.Len(t, tags.Title, 300)
+	assert.Equal(t, "Live", tags.Album)
+}
+
+func TestReadTags_MP4(t *testing.T) {
+	item := func(typ string, value []byte) []byte {
+		return box(typ, box("data", make([]byte, 8), value))
+	}
+	data := box("ftyp", []byte("M4A \x00\x00\x00\x00"))
+	data = append(data, box("moov", box("udta", box("meta", make([]byte, 4), box("ilst",
+		item("\xa9nam", []byte("Song")),
+		item("\xa9ART", []byte("Artist")),
+		item("trkn", []byte{0, 0, 0, 5, 0, 10, 0, 0}),
+		item("gnre", []byte{0, 10}),
+		item("\xa9day", []byte("2001-01-01T00:00:00Z")),
+	))))...)
+	assert.Equal(t, &Tags{Title: "Song", Artist: "Artist", Genre: "Metal", Track: 5, Year: 2001}, readTags(t, data))
+}
+
+func TestReadTags_Unsupported(t *testing.T) {
+	_, err := ReadTags(bytes.NewReader([]byte("hello world")), 11)
+	assert.ErrorIs(t, err, ErrUnsupported)
+	assert.Equal(t, &Tags{}, readTags(t, EncodeWAV(8000, 1, make([]float64, 100))))
+}
@@ -0,0 +1,254 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// WriteTags writes the size bytes of audio in r to w with their tags
+// replaced by t: MP3 files get a new ID3v2 tag, and FLAC files a new Vorbis
+// comment block. Frames and comments t has no field for, like cover art,
+// are kept, while ID3v1 tags are dropped. Data in other formats returns
+// ErrUnsupported.
+func WriteTags(w io.Writer, r io.ReaderAt, size int64, t *Tags) error {
+	head := make([]byte, 10)
+	n, _ := r.ReadAt(head, 0)
+	head = head[:n]
+
+	start := id3Size(head)
+	var tag []byte
+	if start > 0 {
+		var err error
+		if tag, err = readAt(r, 0, int(start)); err != nil {
+			return err
+		}
+		head = make([]byte, 4)
+		n, _ := r.ReadAt(head, start)
+		head = head[:n]
+	}
+	switch {
+	case bytes.HasPrefix(head, []byte("fLaC")):
+		// An ID3v2 tag in front of FLAC, which FLAC does not define, would
+		// hide the new comments from ReadTags and is dropped.
+		return writeFLACTags(w, r, start+4, size, t)
+	case len(head) >= 2 && head[0] == 0xFF && head[1]&0xE0 == 0xE0:
+		end := size
+		if size-start >= 128 {
+			if v1, err := readAt(r, size-128, 128); err == nil && bytes.HasPrefix(v1, []byte("TAG")) {
+				end -= 128
+			}
+		}
+		if _, err := w.Write(newID3Tag(tag, t)); err != nil {
+			return err
+		}
+		_, err := io.Copy(w, io.NewSectionReader(r, start, end-start))
+		return err
+	default:
+		return ErrUnsupported
+	}
+}
+
+// newID3Tag returns an ID3v2 tag holding t and the frames of old, a tag of
+// the same file, that t has no field for. Tags keep their version unless
+// it is ID3v2.2, whose frames are left behind for ID3v2.4.
+func newID3Tag(old []byte, t *Tags) []byte {
+	version := byte(4)
+	if len(old) > 3 && old[3] == 3 {
+		version = 3
+	}
+	year := "TDRC"
+	if version == 3 {
+		year = "TYER"
+	}
+
+	var body []byte
+	frame := func(id string, data []byte) {
+		size := len(data)
+		body = append(body, id...)
+		if version == 4 {
+			body = append(body, byte(size>>21&0x7F), byte(size>>14&0x7F), byte(size>>7&0x7F), byte(size&0x7F))
+		} else {
+			body = binary.BigEndian.AppendUint32(body, uint32(size))
+		}
+		body = append(body, 0, 0)
+		body = append(body, data...)
+	}
+	text := func(id string, values ...string) {
+		if values[len(values)-1] == "" {
+			return
+		}
+		frame(id, id3Encode(version, strings.Join(values, "\x00")))
+	}
+	text("TIT2", t.Title)
+	text("TPE1", t.Artist)
+	text("TALB", t.Album)
+	text("TPE2", t.AlbumArtist)
+	text("TCON", t.Genre)
+	if t.Track > 0 {
+		text("TRCK", strconv.Itoa(t.Track))
+	}
+	if t.Year > 0 {
+		text(year, strconv.Itoa(t.Year))
+	}
+	if t.Explicit {
+		text("TXXX", "ITUNESADVISORY", "1")
+	}
+
+	if len(old) > 3 && old[3] == version {
+		eachID3Frame(old, func(id string, raw, data []byte) {
+			if _, ok := id3Frames[id]; ok {
+				return
+			}
+			if id == "TXXX" && len(data) > 0 {
+				name, _, _ := strings.Cut(id3Text(data[0], data[1:]), "\x00")
+				if strings.EqualFold(name, "ITUNESADVISORY") {
+					return
+				}
+			}
+			body = append(body, raw...)
+		})
+	}
+
+	size := len(body)
+	header := []byte{'I', 'D', '3', version, 0, 0, byte(size >> 21 & 0x7F), byte(size >> 14 & 0x7F), byte(size >> 7 & 0x7F), byte(size & 0x7F)}
+	return append(header, body...)
+}
+
+// id3Encode encodes text for a frame of an ID3v2 tag of the given version:
+// ID3v2.4 as UTF-8, and ID3v2.3, which predates it, as UTF-16 with a byte
+// order mark.
+func id3Encode(version byte, text string) []byte {
+	if version == 4 {
+		return append([]byte{3}, text...)
+	}
+	data := []byte{1, 0xFF, 0xFE}
+	for i, value := range strings.Split(text, "\x00") {
+		if i > 0 {
+			// Every string of a frame has its own byte order mark.
+			data = append(data, 0, 0, 0xFF, 0xFE)
+		}
+		for _, unit := range utf16.Encode([]rune(value)) {
+			data = binary.LittleEndian.AppendUint16(data, unit)
+		}
+	}
+	return data
+}
+
+// vorbisFields are the names of the comments Tags has a field for.
+var vorbisFields = map[string]bool{
+	"TITLE": true, "ARTIST": true, "ALBUM": true, "ALBUMARTIST": true,
+	"ALBUM ARTIST": true, "GENRE": true, "TRACKNUMBER": true, "DATE": true,
+	"YEAR": true, "ITUNESADVISORY": true,
+}
+
+// writeFLACTags writes the FLAC metadata blocks at off, up to size, with
+// a Vorbis comment block holding t, followed by the audio frames.
+func writeFLACTags(w io.Writer, r io.ReaderAt, off, size int64, t *Tags) error {
+	type block struct {
+		typ  byte
+		data []byte
+	}
+	var blocks []block
+	var old []byte
+	for last := false; !last; {
+		header, err := readAt(r, off, 4)
+		if err != nil {
+			return err
+		}
+		data, err := readAt(r, off+4, int(header[1])<<16|int(header[2])<<8|int(header[3]))
+		if err != nil {
+			return err
+		}
+		off += 4 + int64(len(data))
+		last = header[0]&0x80 != 0
+		switch typ := header[0] & 0x7F; typ {
+		case 1:
+			// Padding is left out; the blocks are written anew anyway.
+		case 4:
+			old = data
+		default:
+			blocks = append(blocks, block{typ, data})
+		}
+	}
+	if len(blocks) == 0 {
+		return errTruncated
+	}
+	// The comments follow STREAMINFO, which comes first.
+	blocks = append(blocks[:1], append([]block{{4, vorbisComments(old, t)}}, blocks[1:]...)...)
+
+	out := []byte("fLaC")
+	for i, b := range blocks {
+		typ := b.typ
+		if i == len(blocks)-1 {
+			typ |= 0x80
+		}
+		size := len(b.data)
+		out = append(out, typ, byte(size>>16), byte(size>>8), byte(size))
+		out = append(out, b.data...)
+	}
+	if _, err := w.Write(out); err != nil {
+		return err
+	}
+	_, err := io.Copy(w, io.NewSectionReader(r, off, size-off))
+	return err
+}
+
+// vorbisComments returns a Vorbis comment block holding t, and the vendor
+// string and comments of old that t has no field for.
+func vorbisComments(old []byte, t *Tags) []byte {
+	vendor := []byte("music-streaming")
+	var comments []string
+	add := func(name, value string) {
+		if value != "" {
+			comments = append(comments, name+"="+value)
+		}
+	}
+	add("TITLE", t.Title)
+	add("ARTIST", t.Artist)
+	add("ALBUM", t.Album)
+	add("ALBUMARTIST", t.AlbumArtist)
+	add("GENRE", t.Genre)
+	if t.Track > 0 {
+		add("TRACKNUMBER", strconv.Itoa(t.Track))
+	}
+	if t.Year > 0 {
+		add("DATE", strconv.Itoa(t.Year))
+	}
+	if t.Explicit {
+		add("ITUNESADVISORY", "1")
+	}
+
+	if len(old) >= 4 {
+		if n := int(binary.LittleEndian.Uint32(old)); 4+n+4 <= len(old) {
+			vendor = old[4 : 4+n]
+			rest := old[4+n:]
+			count := int(binary.LittleEndian.Uint32(rest))
+			rest = rest[4:]
+			for i := 0; i < count && len(rest) >= 4; i++ {
+				length := int(binary.LittleEndian.Uint32(rest))
+				if 4+length > len(rest) {
+					break
+				}
+				comment := string(rest[4 : 4+length])
+				name, _, _ := strings.Cut(comment, "=")
+				if !vorbisFields[strings.ToUpper(name)] {
+					comments = append(comments, comment)
+				}
+				rest = rest[4+length:]
+			}
+		}
+	}
+
+	block := binary.LittleEndian.AppendUint32(nil, uint32(len(vendor)))
+	block = append(block, vendor...)
+	block = binary.LittleEndian.AppendUint32(block, uint32(len(comments)))
+	for _, c := range comments {
+		block = binary.LittleEndian.AppendUint32(block, uint32(len(c)))
+		block = append(block, c...)
+	}
+	return block
+}
@@ -0,0 +1,64 @@
+package audio
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTags(t *testing.T, data []byte, tags *Tags) []byte {
+	var out bytes.Buffer
+	require.NoError(t, WriteTags(&out, bytes.NewReader(data), int64(len(data)), tags))
+	return out.Bytes()
+}
+
+func TestWriteTags_MP3(t *testing.T) {
+	cover := id3Frame("APIC", []byte("\x00image/png\x00\x03\x00png"))
+	old := id3Tag(3,
+		id3Frame("TIT2", []byte("\x00Old")),
+		id3Frame("TXXX", []byte("\x00ITUNESADVISORY\x001")),
+		cover,
+	)
+	v1 := make([]byte, 128)
+	copy(v1, "TAG")
+	copy(v1[3:], "Old title")
+	audio := silentMP3(10)
+	data := append(append(old, audio...), v1...)
+
+	tags := &Tags{Title: "Nöw", Artist: "Band", Genre: "Rock", Track: 4, Year: 2024}
+	out := writeTags(t, data, tags)
+	assert.Equal(t, tags, readTags(t, out))
+	// ID3v2.3 tags stay ID3v2.3, and frames without a field are kept.
+	assert.Equal(t, byte(3), out[3])
+	assert.True(t, bytes.Contains(out, cover))
+	// The audio is copied as it is, without the ID3v1 tag.
+	assert.True(t, bytes.HasSuffix(out, audio))
+
+	explicit := &Tags{Title: "Song", Explicit: true}
+	out = writeTags(t, audio, explicit)
+	assert.Equal(t, explicit, readTags(t, out))
+	assert.Equal(t, byte(4), out[3])
+}
+
+func TestWriteTags_FLAC(t *testing.T) {
+	tone := Sine(8000, 1, 440, 0.25, 0.1)
+	data := encodeFLAC(t, 8000, 1, tone)
+	data = writeTags(t, data, &Tags{Title: "Old", Genre: "Jazz"})
+	assert.Equal(t, &Tags{Title: "Old", Genre: "Jazz"}, readTags(t, data))
+
+	tags := &Tags{Title: "Song", Album: "Record", AlbumArtist: "Band", Track: 1, Year: 1999, Explicit: true}
+	data = writeTags(t, data, tags)
+	assert.Equal(t, tags, readTags(t, data))
+
+	d, err := Decode(bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.Len(t, readAll(t, d), len(tone))
+}
+
+func TestWriteTags_Unsupported(t *testing.T) {
+	wav := EncodeWAV(8000, 1, make([]float64, 100))
+	err := WriteTags(&bytes.Buffer{}, bytes.NewReader(wav), int64(len(wav)), &Tags{})
+	assert.ErrorIs(t, err, ErrUnsupported)
+}
@@ -0,0 +1,88 @@
+package audio
+
+import (
+	"io"
+	"math"
+)
+
+// DefaultWaveformResolutions are the samples per peak of the levels of a
+// waveform, from detailed to an overview.
+var DefaultWaveformResolutions = []int{256, 1024, 4096, 16384}
+
+// Waveform holds the peaks of a track at several resolutions, for drawing
+// it at different zoom levels.
+type Waveform struct {
+	SampleRate int `json:"sample_rate"`
+	Channels   int `json:"channels"`
+	// Samples is the number of samples of every channel.
+	Samples int64           `json:"samples"`
+	Levels  []WaveformLevel `json:"levels"`
+}
+
+// WaveformLevel holds the peaks of a track at one resolution.
+type WaveformLevel struct {
+	SamplesPerPeak int `json:"samples_per_peak"`
+	// Peaks holds the minimum and maximum of every SamplesPerPeak samples
+	// across channels, scaled from [-1, 1] to signed bytes. It is base64
+	// encoded in JSON.
+	Peaks []byte `json:"peaks"`
+}
+
+// Duration returns the length of the track in seconds.
+func (w *Waveform) Duration() float64 {
+	return float64(w.Samples) / float64(w.SampleRate)
+}
+
+// peakAcc accumulates the current peak of a level.
+type peakAcc struct {
+	min, max float64
+	count    int
+}
+
+// ComputeWaveform decodes the whole of d and returns its peaks at the given
+// resolutions.
+func ComputeWaveform(d *Decoder, resolutions []int) (*Waveform, error) {
+	w := &Waveform{SampleRate: d.SampleRate, Channels: d.Channels, Levels: make([]WaveformLevel, len(resolutions))}
+	accs := make([]peakAcc, len(resolutions))
+	for i, res := range resolutions {
+		w.Levels[i].SamplesPerPeak = res
+		accs[i] = peakAcc{min: 1, max: -1}
+	}
+
+	buf := make([]float64, 4096*d.Channels)
+	for {
+		n, err := d.Read(buf)
+		for frame := 0; frame+d.Channels <= n; frame += d.Channels {
+			lo, hi := buf[frame], buf[frame]
+			for _, v := range buf[frame+1 : frame+d.Channels] {
+				lo, hi = min(lo, v), max(hi, v)
+			}
+			w.Samples++
+			for i := range accs {
+				acc := &accs[i]
+				acc.min, acc.max = min(acc.min, lo), max(acc.max, hi)
+				if acc.count++; acc.count == resolutions[i] {
+					w.Levels[i].Peaks = append(w.Levels[i].Peaks, peakByte(acc.min), peakByte(acc.max))
+					*acc = peakAcc{min: 1, max: -1}
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i, acc := range accs {
+		if acc.count > 0 {
+			w.Levels[i].Peaks = append(w.Levels[i].Peaks, peakByte(acc.min), peakByte(acc.max))
+		}
+	}
+	return w, nil
+}
+
+// peakByte scales v from [-1, 1] to a signed byte.
+func peakByte(v float64) byte {
+	return byte(int8(math.Round(max(-1, min(1, v)) * 127)))
+}
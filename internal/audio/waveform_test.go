@@ -0,0 +1,36 @@
+package audio
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestComputeWaveform(t *testing.T) {
+	// Half a second of silence followed by half a second at half scale.
+	samples := make([]float64, 2*8000)
+	copy(samples[8000:], Sine(8000, 2, 400, 0.5, 0.5))
+	d, err := Decode(bytes.NewReader(EncodeWAV(8000, 2, samples)))
+	require.NoError(t, err)
+
+	w, err := ComputeWaveform(d, []int{1000, 3000})
+	require.NoError(t, err)
+	assert.Equal(t, 8000, w.SampleRate)
+	assert.Equal(t, 2, w.Channels)
+	assert.EqualValues(t, 8000, w.Samples)
+	assert.Equal(t, 1.0, w.Duration())
+
+	require.Len(t, w.Levels, 2)
+	assert.Equal(t, 1000, w.Levels[0].SamplesPerPeak)
+	assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, 0}, w.Levels[0].Peaks[:8])
+	assert.Equal(t, []byte{0xC0, 64}, w.Levels[0].Peaks[8:10])
+	require.Len(t, w.Levels[0].Peaks, 16)
+
+	// The last peak covers the remaining 2000 samples.
+	assert.Equal(t, 3000, w.Levels[1].SamplesPerPeak)
+	require.Len(t, w.Levels[1].Peaks, 6)
+	assert.Equal(t, []byte{0, 0}, w.Levels[1].Peaks[:2])
+	assert.Equal(t, []byte{0xC0, 64}, w.Levels[1].Peaks[4:])
+}
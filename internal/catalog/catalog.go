@@ -0,0 +1,100 @@
+// Package catalog keeps the tracks, albums and artists of the service in an
+// embedded SQLite database, so listing and browsing them is a query rather
+// than a scan of the bucket.
+package catalog
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	// The pure-Go driver keeps the binary free of cgo.
+	_ "modernc.org/sqlite"
+)
+
+var (
+	// ErrNotFound is returned for tracks that are not in the catalog.
+	ErrNotFound = errors.New("track not found")
+	// ErrConflict is returned for edits of a version of a track that has
+	// been replaced since.
+	ErrConflict = errors.New("track has changed")
+)
+
+// Track is an upload in the catalog, with the tags describing it.
+type Track struct {
+	// Key is the storage key of the upload.
+	Key string
+	// Name is the file name the upload was sent with.
+	Name string
+	// DataKey is where the data of the upload is stored, which differs from
+	// Key once it has been deduplicated.
+	DataKey string
+	Size    int64
+	SHA256  string
+	Owner   string
+
+	Title  string
+	Artist string
+	Album  string
+	// AlbumArtist is the artist the album is filed under, Artist if unset.
+	AlbumArtist string
+	Genre       string
+	TrackNumber int
+	Year        int
+	Explicit    bool
+	Duration    time.Duration
+
+	// Metadata is the upload metadata as of when the track was cataloged.
+	Metadata map[string]string
+	Created  time.Time
+	// Version counts the times the track has been stored, starting at 1.
+	// It is set by the catalog.
+	Version int
+}
+
+// Artist is an artist with tracks or albums in the catalog.
+type Artist struct {
+	ID     int64
+	Name   string
+	Tracks int
+}
+
+// Album is an album with tracks in the catalog.
+type Album struct {
+	ID     int64
+	Title  string
+	Artist string
+	Tracks int
+}
+
+// Catalog is the catalog database.
+type Catalog struct {
+	db *sql.DB
+}
+
+// Open opens the catalog database at path, creating it if needed, and
+// migrates it to the current schema. A path of ":memory:" keeps the
+// catalog in memory.
+func Open(path string) (*Catalog, error) {
+	q := url.Values{"_pragma": {"foreign_keys(1)", "busy_timeout(5000)"}}
+	db, err := sql.Open("sqlite", path+"?"+q.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open catalog: %w", err)
+	}
+	// SQLite takes one writer at a time, and every connection to an
+	// in-memory database would get a database of its own.
+	db.SetMaxOpenConns(1)
+	if err := migrate(context.Background(), db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Catalog{db: db}, nil
+}
+
+// Close closes the database.
+func (c *Catalog) Close() error {
+	return c.db.Close()
+}
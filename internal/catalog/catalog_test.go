@@ -0,0 +1,130 @@
+package catalog
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func openCatalog(t *testing.T) *Catalog {
+	c, err := Open(":memory:")
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestCatalog_Tracks(t *testing.T) {
+	ctx := context.Background()
+	c := openCatalog(t)
+
+	created := time.UnixMilli(1700000000000)
+	song := &Track{
+		Key:         "a",
+		Name:        "song.flac",
+		DataKey:     "blobs/cafe",
+		Size:        1000,
+		SHA256:      "cafe",
+		Owner:       "alice",
+		Title:       "Song",
+		Artist:      "Band",
+		Album:       "Record",
+		Genre:       "Rock",
+		TrackNumber: 2,
+		Year:        1999,
+		Duration:    3 * time.Minute,
+		Metadata:    map[string]string{"filename": "song.flac"},
+		Created:     created,
+	}
+	require.NoError(t, c.PutTrack(ctx, song))
+	require.NoError(t, c.PutTrack(ctx, &Track{Key: "b", Name: "b.wav", DataKey: "b", Artist: "Guest", Album: "Record", AlbumArtist: "Band"}))
+	require.NoError(t, c.PutTrack(ctx, &Track{Key: "c", Name: "memo.wav", DataKey: "c"}))
+
+	got, err := c.Track(ctx, "a")
+	require.NoError(t, err)
+	song.AlbumArtist = "Band"
+	song.Version = 1
+	assert.Equal(t, song, got)
+	_, err = c.Track(ctx, "missing")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// Tracks are filed under their album artist too.
+	tracks, err := c.Tracks(ctx, TrackFilter{Artist: "Band"})
+	require.NoError(t, err)
+	require.Len(t, tracks, 2)
+	assert.Equal(t, "a", tracks[0].Key)
+	assert.Equal(t, "Guest", tracks[1].Artist)
+	tracks, err = c.Tracks(ctx, TrackFilter{})
+	require.NoError(t, err)
+	assert.Len(t, tracks, 3)
+	tracks, err = c.Tracks(ctx, TrackFilter{Owner: "alice", Album: "Record"})
+	require.NoError(t, err)
+	assert.Len(t, tracks, 1)
+	tracks, err = c.Tracks(ctx, TrackFilter{Keys: []string{"c", "a", "missing"}})
+	require.NoError(t, err)
+	require.Len(t, tracks, 2)
+	assert.Equal(t, "c", tracks[1].Key)
+
+	albums, err := c.Albums(ctx)
+	require.NoError(t, err)
+	require.Len(t, albums, 1)
+	assert.Equal(t, "Band", albums[0].Artist)
+	assert.Equal(t, 2, albums[0].Tracks)
+
+	// Replacing a track refiles it and keeps when it was added.
+	require.NoError(t, c.PutTrack(ctx, &Track{Key: "a", Name: "song.flac", DataKey: "a", Artist: "New Band"}))
+	got, err = c.Track(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, created, got.Created)
+	assert.Equal(t, 2, got.Version)
+	assert.Empty(t, got.Album)
+
+	// Putting a track again unchanged, e.g. when it is processed again,
+	// keeps its version.
+	require.NoError(t, c.PutTrack(ctx, &Track{Key: "a", Name: "song.flac", DataKey: "a", Artist: "New Band"}))
+	got, err = c.Track(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, 2, got.Version)
+
+	require.NoError(t, c.DeleteTrack(ctx, "b"))
+	require.NoError(t, c.DeleteTrack(ctx, "b"))
+	n, err := c.CountTracks(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	// Albums and artists go with their last track.
+	albums, err = c.Albums(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, albums)
+	artists, err := c.Artists(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []Artist{{ID: artists[0].ID, Name: "New Band", Tracks: 1}}, artists)
+}
+
+func TestOpen_Migrates(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "catalog.db")
+	c, err := Open(path)
+	require.NoError(t, err)
+	require.NoError(t, c.PutTrack(ctx, &Track{Key: "a", Name: "a.mp3", DataKey: "a"}))
+	require.NoError(t, c.Close())
+
+	// Reopening keeps the data and applies nothing twice.
+	c, err = Open(path)
+	require.NoError(t, err)
+	defer c.Close()
+	var version int
+	require.NoError(t, c.db.QueryRow("PRAGMA user_version").Scan(&version))
+	assert.Equal(t, len(migrations), version)
+	_, err = c.Track(ctx, "a")
+	assert.NoError(t, err)
+
+	_, err = c.db.Exec("PRAGMA user_version = 1000")
+	require.NoError(t, err)
+	require.NoError(t, c.Close())
+	_, err = Open(path)
+	assert.ErrorContains(t, err, "newer")
+}
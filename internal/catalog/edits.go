@@ -0,0 +1,137 @@
+package catalog
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Edit is a change of the tags of a track by an editor.
+type Edit struct {
+	// Version is the version of the track the edit made.
+	Version int       `json:"version"`
+	Editor  string    `json:"editor,omitempty"`
+	Time    time.Time `json:"time"`
+	Changes []Change  `json:"changes"`
+}
+
+// Change is the change of one tag of a track, or of the checksum of its
+// data, from and to its values as text.
+type Change struct {
+	Field string `json:"field"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+}
+
+// changes returns how the tags of to differ from those of from.
+func changes(from, to *Track) []Change {
+	var changes []Change
+	field := func(name, from, to string) {
+		if from != to {
+			changes = append(changes, Change{Field: name, From: from, To: to})
+		}
+	}
+	albumArtist := func(t *Track) string {
+		if t.AlbumArtist == "" {
+			return t.Artist
+		}
+		return t.AlbumArtist
+	}
+	number := func(n int) string {
+		if n == 0 {
+			return ""
+		}
+		return strconv.Itoa(n)
+	}
+	field("title", from.Title, to.Title)
+	field("artist", from.Artist, to.Artist)
+	field("album", from.Album, to.Album)
+	field("album_artist", albumArtist(from), albumArtist(to))
+	field("genre", from.Genre, to.Genre)
+	field("track_number", number(from.TrackNumber), number(to.TrackNumber))
+	field("year", number(from.Year), number(to.Year))
+	field("explicit", strconv.FormatBool(from.Explicit), strconv.FormatBool(to.Explicit))
+	field("sha256", from.SHA256, to.SHA256)
+	return changes
+}
+
+// EditTrack replaces version of the track with t's key by t, like
+// PutTrack, and records how its tags changed as an edit by editor. Tracks
+// that have moved on from version return ErrConflict, and tracks that are
+// not in the catalog ErrNotFound. An edit changing nothing is not recorded
+// and returned with version, which the track stays at.
+func (c *Catalog) EditTrack(ctx context.Context, t *Track, version int, editor string) (*Edit, error) {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	old, err := scanTrack(tx.QueryRowContext(ctx, `SELECT `+trackColumns+` `+trackJoins+` WHERE t.key = ?`, t.Key))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if old.Version != version {
+		return nil, ErrConflict
+	}
+	changed, err := putTrack(ctx, tx, t)
+	if err != nil {
+		return nil, err
+	}
+	if !changed {
+		return &Edit{Version: version, Editor: editor, Time: time.Now().Truncate(time.Millisecond), Changes: []Change{}}, tx.Commit()
+	}
+	if err := prune(ctx, tx); err != nil {
+		return nil, err
+	}
+
+	edit := &Edit{Version: version + 1, Editor: editor, Time: time.Now().Truncate(time.Millisecond), Changes: changes(old, t)}
+	if edit.Changes == nil {
+		edit.Changes = []Change{}
+	}
+	data, err := json.Marshal(edit.Changes)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO track_edits (track_key, version, editor, changes, edited_ms) VALUES (?, ?, ?, ?, ?)`,
+		t.Key, edit.Version, editor, string(data), edit.Time.UnixMilli())
+	if err != nil {
+		return nil, fmt.Errorf("failed to record edit of track %s: %w", t.Key, err)
+	}
+	return edit, tx.Commit()
+}
+
+// TrackHistory lists the edits of the track of the upload stored under
+// key, oldest first, or returns ErrNotFound.
+func (c *Catalog) TrackHistory(ctx context.Context, key string) ([]Edit, error) {
+	if _, err := c.Track(ctx, key); err != nil {
+		return nil, err
+	}
+	rows, err := c.db.QueryContext(ctx, `SELECT version, editor, changes, edited_ms FROM track_edits WHERE track_key = ? ORDER BY version, id`, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list edits: %w", err)
+	}
+	defer rows.Close()
+	edits := make([]Edit, 0)
+	for rows.Next() {
+		var e Edit
+		var data string
+		var editedMS int64
+		if err := rows.Scan(&e.Version, &e.Editor, &data, &editedMS); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(data), &e.Changes); err != nil {
+			return nil, fmt.Errorf("invalid edit of track %s: %w", key, err)
+		}
+		e.Time = time.UnixMilli(editedMS)
+		edits = append(edits, e)
+	}
+	return edits, rows.Err()
+}
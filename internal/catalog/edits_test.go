@@ -0,0 +1,76 @@
+package catalog
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCatalog_EditTrack(t *testing.T) {
+	ctx := context.Background()
+	c := openCatalog(t)
+
+	track := &Track{Key: "a", Name: "a.mp3", DataKey: "a", Title: "Sogn", Artist: "Band", Album: "Record", TrackNumber: 1}
+	require.NoError(t, c.PutTrack(ctx, track))
+
+	edited := *track
+	edited.Title = "Song"
+	edited.AlbumArtist = "Various"
+	edited.TrackNumber = 0
+	edited.Explicit = true
+	edit, err := c.EditTrack(ctx, &edited, 1, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, 2, edit.Version)
+	assert.Equal(t, []Change{
+		{Field: "title", From: "Sogn", To: "Song"},
+		{Field: "album_artist", From: "Band", To: "Various"},
+		{Field: "track_number", From: "1", To: ""},
+		{Field: "explicit", From: "false", To: "true"},
+	}, edit.Changes)
+
+	got, err := c.Track(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, 2, got.Version)
+	assert.True(t, got.Explicit)
+	albums, err := c.Albums(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []Album{{ID: albums[0].ID, Title: "Record", Artist: "Various", Tracks: 1}}, albums)
+
+	// Edits of a version that has been replaced conflict.
+	_, err = c.EditTrack(ctx, &edited, 1, "bob")
+	assert.ErrorIs(t, err, ErrConflict)
+	_, err = c.EditTrack(ctx, &Track{Key: "missing"}, 1, "bob")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	edited.Genre = "Rock"
+	_, err = c.EditTrack(ctx, &edited, 2, "bob")
+	require.NoError(t, err)
+	history, err := c.TrackHistory(ctx, "a")
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	assert.Equal(t, edit, &history[0])
+	assert.Equal(t, "bob", history[1].Editor)
+	assert.Equal(t, []Change{{Field: "genre", From: "", To: "Rock"}}, history[1].Changes)
+
+	// Edits changing nothing are not recorded.
+	edit, err = c.EditTrack(ctx, &edited, 3, "carol")
+	require.NoError(t, err)
+	assert.Equal(t, 3, edit.Version)
+	assert.Empty(t, edit.Changes)
+	got, err = c.Track(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, 3, got.Version)
+	history, err = c.TrackHistory(ctx, "a")
+	require.NoError(t, err)
+	assert.Len(t, history, 2)
+
+	// Edits go with their track.
+	require.NoError(t, c.DeleteTrack(ctx, "a"))
+	_, err = c.TrackHistory(ctx, "a")
+	assert.ErrorIs(t, err, ErrNotFound)
+	var n int
+	require.NoError(t, c.db.QueryRow("SELECT count(*) FROM track_edits").Scan(&n))
+	assert.Zero(t, n)
+}
@@ -0,0 +1,91 @@
+package catalog
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// migrations bring the schema from one version to the next; the version of
+// a database is its user_version. Applied migrations must not change, new
+// ones are appended.
+var migrations = []string{
+	`
+CREATE TABLE artists (
+	id   INTEGER PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE
+);
+
+CREATE TABLE albums (
+	id        INTEGER PRIMARY KEY,
+	title     TEXT NOT NULL,
+	artist_id INTEGER REFERENCES artists (id)
+);
+CREATE UNIQUE INDEX albums_title_artist ON albums (title, coalesce(artist_id, 0));
+
+CREATE TABLE tracks (
+	key          TEXT PRIMARY KEY,
+	name         TEXT NOT NULL,
+	data_key     TEXT NOT NULL,
+	size         INTEGER NOT NULL,
+	sha256       TEXT NOT NULL DEFAULT '',
+	owner        TEXT NOT NULL DEFAULT '',
+	title        TEXT NOT NULL DEFAULT '',
+	artist_id    INTEGER REFERENCES artists (id),
+	album_id     INTEGER REFERENCES albums (id),
+	genre        TEXT NOT NULL DEFAULT '',
+	track_number INTEGER NOT NULL DEFAULT 0,
+	year         INTEGER NOT NULL DEFAULT 0,
+	duration_ms  INTEGER NOT NULL DEFAULT 0,
+	metadata     TEXT NOT NULL DEFAULT '{}',
+	created_ms   INTEGER NOT NULL
+);
+CREATE INDEX tracks_artist ON tracks (artist_id);
+CREATE INDEX tracks_album ON tracks (album_id);
+`,
+	`
+ALTER TABLE tracks ADD COLUMN explicit INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE tracks ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
+
+CREATE TABLE track_edits (
+	id        INTEGER PRIMARY KEY,
+	track_key TEXT NOT NULL REFERENCES tracks (key) ON DELETE CASCADE,
+	version   INTEGER NOT NULL,
+	editor    TEXT NOT NULL DEFAULT '',
+	changes   TEXT NOT NULL,
+	edited_ms INTEGER NOT NULL
+);
+CREATE INDEX track_edits_track ON track_edits (track_key, version);
+`,
+}
+
+// migrate applies the migrations db has not seen yet, each in a
+// transaction of its own.
+func migrate(ctx context.Context, db *sql.DB) error {
+	var version int
+	if err := db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("failed to read catalog version: %w", err)
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("catalog version %d is newer than this build supports (%d)", version, len(migrations))
+	}
+	for ; version < len(migrations); version++ {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, migrations[version]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to migrate catalog to version %d: %w", version+1, err)
+		}
+		// PRAGMA takes no parameters.
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", version+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to migrate catalog to version %d: %w", version+1, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,291 @@
+package catalog
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// trackColumns are the columns scanTrack reads, from tracks t joined with
+// their artist a, album al and album artist aa.
+const trackColumns = `t.key, t.name, t.data_key, t.size, t.sha256, t.owner, t.title,
+	coalesce(a.name, ''), coalesce(al.title, ''), coalesce(aa.name, ''),
+	t.genre, t.track_number, t.year, t.explicit, t.duration_ms, t.metadata, t.created_ms,
+	t.version`
+
+const trackJoins = `FROM tracks t
+	LEFT JOIN artists a ON a.id = t.artist_id
+	LEFT JOIN albums al ON al.id = t.album_id
+	LEFT JOIN artists aa ON aa.id = al.artist_id`
+
+// scanner is a *sql.Row or *sql.Rows.
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanTrack(row scanner) (*Track, error) {
+	var t Track
+	var durationMS, createdMS int64
+	var metadata string
+	err := row.Scan(&t.Key, &t.Name, &t.DataKey, &t.Size, &t.SHA256, &t.Owner, &t.Title,
+		&t.Artist, &t.Album, &t.AlbumArtist,
+		&t.Genre, &t.TrackNumber, &t.Year, &t.Explicit, &durationMS, &metadata, &createdMS,
+		&t.Version)
+	if err != nil {
+		return nil, err
+	}
+	t.Duration = time.Duration(durationMS) * time.Millisecond
+	t.Created = time.UnixMilli(createdMS)
+	if err := json.Unmarshal([]byte(metadata), &t.Metadata); err != nil {
+		return nil, fmt.Errorf("invalid metadata of track %s: %w", t.Key, err)
+	}
+	return &t, nil
+}
+
+// Track returns the track of the upload stored under key, or ErrNotFound.
+func (c *Catalog) Track(ctx context.Context, key string) (*Track, error) {
+	t, err := scanTrack(c.db.QueryRowContext(ctx, `SELECT `+trackColumns+` `+trackJoins+` WHERE t.key = ?`, key))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return t, err
+}
+
+// TrackFilter narrows down the tracks listed. Empty fields match every
+// track.
+type TrackFilter struct {
+	Artist string
+	Album  string
+	Owner  string
+	// Keys are the keys of the tracks to list.
+	Keys []string
+}
+
+// Tracks lists the tracks matching filter, ordered by key.
+func (c *Catalog) Tracks(ctx context.Context, filter TrackFilter) ([]Track, error) {
+	var where []string
+	var args []any
+	if filter.Artist != "" {
+		where = append(where, "(a.name = ? OR aa.name = ?)")
+		args = append(args, filter.Artist, filter.Artist)
+	}
+	if filter.Album != "" {
+		where = append(where, "al.title = ?")
+		args = append(args, filter.Album)
+	}
+	if filter.Owner != "" {
+		where = append(where, "t.owner = ?")
+		args = append(args, filter.Owner)
+	}
+	if len(filter.Keys) > 0 {
+		where = append(where, "t.key IN (?"+strings.Repeat(", ?", len(filter.Keys)-1)+")")
+		for _, key := range filter.Keys {
+			args = append(args, key)
+		}
+	}
+	query := `SELECT ` + trackColumns + ` ` + trackJoins
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	rows, err := c.db.QueryContext(ctx, query+` ORDER BY t.key`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tracks: %w", err)
+	}
+	defer rows.Close()
+
+	tracks := make([]Track, 0)
+	for rows.Next() {
+		t, err := scanTrack(rows)
+		if err != nil {
+			return nil, err
+		}
+		tracks = append(tracks, *t)
+	}
+	return tracks, rows.Err()
+}
+
+// CountTracks returns how many tracks the catalog holds.
+func (c *Catalog) CountTracks(ctx context.Context) (int, error) {
+	var n int
+	err := c.db.QueryRowContext(ctx, `SELECT count(*) FROM tracks`).Scan(&n)
+	return n, err
+}
+
+// PutTrack adds t to the catalog or replaces the track with its key,
+// filing it under its artist and album. A replaced track keeps the time it
+// was first cataloged, and moves on to its next version unless t changes
+// nothing about it.
+func (c *Catalog) PutTrack(ctx context.Context, t *Track) error {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := putTrack(ctx, tx, t); err != nil {
+		return err
+	}
+	if err := prune(ctx, tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// putTrack stores t and reports whether that added or changed a track.
+func putTrack(ctx context.Context, tx *sql.Tx, t *Track) (bool, error) {
+	metadata, err := json.Marshal(t.Metadata)
+	if err != nil {
+		return false, err
+	}
+	if t.Metadata == nil {
+		metadata = []byte("{}")
+	}
+	created := t.Created
+	if created.IsZero() {
+		created = time.Now()
+	}
+
+	artistID, err := artistID(ctx, tx, t.Artist)
+	if err != nil {
+		return false, err
+	}
+	albumArtist := t.AlbumArtist
+	if albumArtist == "" {
+		albumArtist = t.Artist
+	}
+	albumID, err := albumID(ctx, tx, t.Album, albumArtist)
+	if err != nil {
+		return false, err
+	}
+	res, err := tx.ExecContext(ctx, `
+INSERT INTO tracks (key, name, data_key, size, sha256, owner, title, artist_id, album_id,
+	genre, track_number, year, explicit, duration_ms, metadata, created_ms)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT (key) DO UPDATE SET
+	name = excluded.name, data_key = excluded.data_key, size = excluded.size,
+	sha256 = excluded.sha256, owner = excluded.owner, title = excluded.title,
+	artist_id = excluded.artist_id, album_id = excluded.album_id, genre = excluded.genre,
+	track_number = excluded.track_number, year = excluded.year, explicit = excluded.explicit,
+	duration_ms = excluded.duration_ms, metadata = excluded.metadata, version = version + 1
+WHERE (name, data_key, size, sha256, owner, title, artist_id, album_id,
+	genre, track_number, year, explicit, duration_ms, metadata)
+IS NOT (excluded.name, excluded.data_key, excluded.size, excluded.sha256, excluded.owner, excluded.title, excluded.artist_id, excluded.album_id,
+	excluded.genre, excluded.track_number, excluded.year, excluded.explicit, excluded.duration_ms, excluded.metadata)`,
+		t.Key, t.Name, t.DataKey, t.Size, t.SHA256, t.Owner, t.Title, artistID, albumID,
+		t.Genre, t.TrackNumber, t.Year, t.Explicit, t.Duration.Milliseconds(), string(metadata), created.UnixMilli())
+	if err != nil {
+		return false, fmt.Errorf("failed to store track %s: %w", t.Key, err)
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// DeleteTrack removes the track of the upload stored under key, if any,
+// along with its edits and albums and artists left without tracks.
+func (c *Catalog) DeleteTrack(ctx context.Context, key string) error {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `DELETE FROM tracks WHERE key = ?`, key); err != nil {
+		return fmt.Errorf("failed to delete track %s: %w", key, err)
+	}
+	if err := prune(ctx, tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Artists lists the artists in the catalog by name, with the number of
+// tracks they are the artist of.
+func (c *Catalog) Artists(ctx context.Context) ([]Artist, error) {
+	rows, err := c.db.QueryContext(ctx, `
+SELECT a.id, a.name, count(t.key) FROM artists a
+LEFT JOIN tracks t ON t.artist_id = a.id
+GROUP BY a.id ORDER BY a.name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list artists: %w", err)
+	}
+	defer rows.Close()
+	artists := make([]Artist, 0)
+	for rows.Next() {
+		var a Artist
+		if err := rows.Scan(&a.ID, &a.Name, &a.Tracks); err != nil {
+			return nil, err
+		}
+		artists = append(artists, a)
+	}
+	return artists, rows.Err()
+}
+
+// Albums lists the albums in the catalog by title, with their number of
+// tracks.
+func (c *Catalog) Albums(ctx context.Context) ([]Album, error) {
+	rows, err := c.db.QueryContext(ctx, `
+SELECT al.id, al.title, coalesce(a.name, ''), count(t.key) FROM albums al
+LEFT JOIN artists a ON a.id = al.artist_id
+LEFT JOIN tracks t ON t.album_id = al.id
+GROUP BY al.id ORDER BY al.title, a.name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list albums: %w", err)
+	}
+	defer rows.Close()
+	albums := make([]Album, 0)
+	for rows.Next() {
+		var a Album
+		if err := rows.Scan(&a.ID, &a.Title, &a.Artist, &a.Tracks); err != nil {
+			return nil, err
+		}
+		albums = append(albums, a)
+	}
+	return albums, rows.Err()
+}
+
+// artistID returns the ID of the artist called name, adding it if needed,
+// or nil for an empty name.
+func artistID(ctx context.Context, tx *sql.Tx, name string) (any, error) {
+	if name == "" {
+		return nil, nil
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO artists (name) VALUES (?) ON CONFLICT DO NOTHING`, name); err != nil {
+		return nil, fmt.Errorf("failed to add artist: %w", err)
+	}
+	var id int64
+	err := tx.QueryRowContext(ctx, `SELECT id FROM artists WHERE name = ?`, name).Scan(&id)
+	return id, err
+}
+
+// albumID returns the ID of the album with title by artist, adding it if
+// needed, or nil for an empty title.
+func albumID(ctx context.Context, tx *sql.Tx, title, artist string) (any, error) {
+	if title == "" {
+		return nil, nil
+	}
+	artistID, err := artistID(ctx, tx, artist)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO albums (title, artist_id) VALUES (?, ?) ON CONFLICT DO NOTHING`, title, artistID); err != nil {
+		return nil, fmt.Errorf("failed to add album: %w", err)
+	}
+	var id int64
+	err = tx.QueryRowContext(ctx, `SELECT id FROM albums WHERE title = ? AND artist_id IS ?`, title, artistID).Scan(&id)
+	return id, err
+}
+
+// prune removes albums without tracks and artists without tracks or
+// albums.
+func prune(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+DELETE FROM albums WHERE id NOT IN (SELECT album_id FROM tracks WHERE album_id IS NOT NULL);
+DELETE FROM artists WHERE id NOT IN (SELECT artist_id FROM tracks WHERE artist_id IS NOT NULL)
+	AND id NOT IN (SELECT artist_id FROM albums WHERE artist_id IS NOT NULL);`)
+	if err != nil {
+		return fmt.Errorf("failed to prune catalog: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+// Package cors implements the cross-origin policy for the upload server.
+package cors
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultAllowHeaders are the request headers used by tus clients and the
+// track editing endpoint.
+var DefaultAllowHeaders = []string{
+	"Tus-Resumable", "Upload-Length", "Upload-Metadata", "Upload-Offset",
+	"Upload-Defer-Length", "Upload-Concat", "Upload-Checksum", "Content-Type", "Location",
+	"X-HTTP-Method-Override", "X-Requested-With", "traceparent", "tracestate", "If-Match",
+}
+
+// DefaultExposeHeaders are the response headers tus clients need to read,
+// and the ETag of tracks and downloads.
+var DefaultExposeHeaders = []string{
+	"Tus-Resumable", "Tus-Version", "Tus-Extension", "Tus-Max-Size", "Tus-Checksum-Algorithm",
+	"Upload-Length", "Upload-Metadata", "Upload-Offset", "Upload-Defer-Length",
+	"Upload-Concat", "Upload-Expires", "Location", "ETag",
+}
+
+// DefaultAllowMethods are the methods tus and the listing endpoint use.
+var DefaultAllowMethods = []string{
+	http.MethodGet, http.MethodPost, http.MethodPatch, http.MethodPut,
+	http.MethodDelete, http.MethodOptions, http.MethodHead,
+}
+
+// Config describes which cross-origin requests are permitted.
+type Config struct {
+	// AllowedOrigins lists exact origins ("https://app.example.com"), wildcard
+	// subdomains ("https://*.example.com") or "*" for any origin.
+	AllowedOrigins []string
+	// AllowCredentials lets the allowed origins send cookies and
+	// credentials, except for origins only allowed by "*": any site could
+	// then act with the credentials of its visitors.
+	AllowCredentials bool
+	AllowMethods     []string
+	AllowHeaders     []string
+	ExposeHeaders    []string
+	// MaxAge is how long browsers may cache a preflight response.
+	MaxAge time.Duration
+}
+
+// ConfigFromEnv reads the policy from CORS_* environment variables. Without
+// CORS_ALLOWED_ORIGINS every origin is allowed, as before.
+func ConfigFromEnv() Config {
+	cfg := Config{
+		AllowedOrigins: splitList(os.Getenv("CORS_ALLOWED_ORIGINS")),
+		AllowMethods:   DefaultAllowMethods,
+		AllowHeaders:   DefaultAllowHeaders,
+		ExposeHeaders:  DefaultExposeHeaders,
+		MaxAge:         24 * time.Hour,
+	}
+	if len(cfg.AllowedOrigins) == 0 {
+		cfg.AllowedOrigins = []string{"*"}
+	}
+	if v, err := strconv.ParseBool(os.Getenv("CORS_ALLOW_CREDENTIALS")); err == nil {
+		cfg.AllowCredentials = v
+	}
+	if extra := splitList(os.Getenv("CORS_ALLOW_HEADERS")); len(extra) > 0 {
+		cfg.AllowHeaders = append(append([]string{}, DefaultAllowHeaders...), extra...)
+	}
+	if v := os.Getenv("CORS_MAX_AGE"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			cfg.MaxAge = d
+		} else if secs, err := strconv.Atoi(v); err == nil {
+			cfg.MaxAge = time.Duration(secs) * time.Second
+		}
+	}
+	return cfg
+}
+
+// Policy applies a Config to HTTP handlers.
+type Policy struct {
+	cfg           Config
+	anyOrigin     bool
+	exact         map[string]bool
+	wildcards     []wildcard
+	allowMethods  string
+	allowHeaders  string
+	exposeHeaders string
+	maxAge        string
+}
+
+type wildcard struct {
+	scheme string // e.g. "https://", empty to match any scheme
+	suffix string // e.g. ".example.com"
+}
+
+// New compiles a Config into a Policy.
+func New(cfg Config) *Policy {
+	p := &Policy{
+		cfg:           cfg,
+		exact:         make(map[string]bool),
+		allowMethods:  strings.Join(cfg.AllowMethods, ", "),
+		allowHeaders:  strings.Join(cfg.AllowHeaders, ", "),
+		exposeHeaders: strings.Join(cfg.ExposeHeaders, ", "),
+	}
+	if cfg.MaxAge > 0 {
+		p.maxAge = strconv.Itoa(int(cfg.MaxAge.Seconds()))
+	}
+
+	for _, origin := range cfg.AllowedOrigins {
+		origin = strings.ToLower(strings.TrimSuffix(origin, "/"))
+		switch {
+		case origin == "*":
+			p.anyOrigin = true
+		case strings.Contains(origin, "*."):
+			i := strings.Index(origin, "*.")
+			p.wildcards = append(p.wildcards, wildcard{scheme: origin[:i], suffix: origin[i+1:]})
+		default:
+			p.exact[origin] = true
+		}
+	}
+	return p
+}
+
+// AllowsOrigin reports whether the given Origin header value is permitted.
+func (p *Policy) AllowsOrigin(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	return p.anyOrigin || p.listed(origin)
+}
+
+// listed reports whether origin is allowed other than by "*".
+func (p *Policy) listed(origin string) bool {
+	origin = strings.ToLower(origin)
+	if p.exact[origin] {
+		return true
+	}
+	for _, w := range p.wildcards {
+		host := origin
+		if w.scheme != "" {
+			var ok bool
+			if host, ok = strings.CutPrefix(origin, w.scheme); !ok {
+				continue
+			}
+		} else if i := strings.Index(origin, "://"); i >= 0 {
+			host = origin[i+3:]
+		}
+		if len(host) > len(w.suffix) && strings.HasSuffix(host, w.suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler wraps next with the policy. CORS preflight requests are answered
+// directly; tus discovery requests (plain OPTIONS) still reach next.
+func (p *Policy) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		h := w.Header()
+		h.Add("Vary", "Origin")
+
+		allowed := p.AllowsOrigin(origin)
+		if allowed && p.listed(origin) {
+			h.Set("Access-Control-Allow-Origin", origin)
+			if p.cfg.AllowCredentials {
+				h.Set("Access-Control-Allow-Credentials", "true")
+			}
+		} else if allowed {
+			h.Set("Access-Control-Allow-Origin", "*")
+		}
+
+		if isPreflight(r) {
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+			if allowed {
+				h.Set("Access-Control-Allow-Methods", p.allowMethods)
+				h.Set("Access-Control-Allow-Headers", p.allowHeaders)
+				if p.maxAge != "" {
+					h.Set("Access-Control-Max-Age", p.maxAge)
+				}
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if allowed {
+			h.Set("Access-Control-Expose-Headers", p.exposeHeaders)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions &&
+		r.Header.Get("Origin") != "" &&
+		r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+func splitList(v string) []string {
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
@@ -0,0 +1,121 @@
+package cors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestPolicy(origins []string, credentials bool) *Policy {
+	return New(Config{
+		AllowedOrigins:   origins,
+		AllowCredentials: credentials,
+		AllowMethods:     DefaultAllowMethods,
+		AllowHeaders:     DefaultAllowHeaders,
+		ExposeHeaders:    DefaultExposeHeaders,
+		MaxAge:           10 * time.Minute,
+	})
+}
+
+func TestAllowsOrigin(t *testing.T) {
+	p := newTestPolicy([]string{"https://app.example.com", "https://*.labels.example.com", "*.cdn.test"}, false)
+
+	assert.True(t, p.AllowsOrigin("https://app.example.com"))
+	assert.True(t, p.AllowsOrigin("https://APP.example.com"))
+	assert.True(t, p.AllowsOrigin("https://acme.labels.example.com"))
+	assert.True(t, p.AllowsOrigin("http://eu.cdn.test"))
+	assert.False(t, p.AllowsOrigin("http://acme.labels.example.com"))
+	assert.False(t, p.AllowsOrigin("https://labels.example.com"))
+	assert.False(t, p.AllowsOrigin("https://evil-labels.example.com.attacker.io"))
+	assert.False(t, p.AllowsOrigin(""))
+}
+
+func TestHandler_PreflightShortCircuits(t *testing.T) {
+	p := newTestPolicy([]string{"https://app.example.com"}, true)
+	called := false
+	h := p.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true }))
+
+	req := httptest.NewRequest(http.MethodOptions, "/files/", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", "PATCH")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	assert.False(t, called)
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	assert.Equal(t, "https://app.example.com", rr.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", rr.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, "600", rr.Header().Get("Access-Control-Max-Age"))
+	assert.Contains(t, rr.Header().Get("Access-Control-Allow-Headers"), "Upload-Offset")
+	assert.Contains(t, rr.Header().Values("Vary"), "Origin")
+}
+
+func TestHandler_TusDiscoveryReachesHandler(t *testing.T) {
+	p := newTestPolicy([]string{"*"}, false)
+	called := false
+	h := p.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true }))
+
+	req := httptest.NewRequest(http.MethodOptions, "/files/", nil)
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	req.Header.Set("Origin", "https://anywhere.test")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	assert.True(t, called)
+	assert.Equal(t, "*", rr.Header().Get("Access-Control-Allow-Origin"))
+	assert.Contains(t, rr.Header().Get("Access-Control-Expose-Headers"), "Upload-Offset")
+}
+
+func TestHandler_DisallowedOrigin(t *testing.T) {
+	p := newTestPolicy([]string{"https://app.example.com"}, false)
+	h := p.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	req := httptest.NewRequest(http.MethodGet, "/files/", nil)
+	req.Header.Set("Origin", "https://evil.test")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	assert.Empty(t, rr.Header().Get("Access-Control-Allow-Origin"))
+	assert.Contains(t, rr.Header().Values("Vary"), "Origin")
+}
+
+func TestHandler_WildcardWithCredentialsOmitsCredentials(t *testing.T) {
+	p := newTestPolicy([]string{"*"}, true)
+	h := p.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	req := httptest.NewRequest(http.MethodGet, "/files/", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	assert.Equal(t, "*", rr.Header().Get("Access-Control-Allow-Origin"))
+	assert.Empty(t, rr.Header().Get("Access-Control-Allow-Credentials"))
+
+	// Origins listed besides "*" keep their credentials.
+	p = newTestPolicy([]string{"*", "https://app.example.com"}, true)
+	rr = httptest.NewRecorder()
+	p.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(rr, req)
+	assert.Equal(t, "https://app.example.com", rr.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", rr.Header().Get("Access-Control-Allow-Credentials"))
+}
+
+func TestHandler_PreflightCreationWithUpload(t *testing.T) {
+	p := newTestPolicy([]string{"https://app.example.com"}, false)
+	h := p.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	req := httptest.NewRequest(http.MethodOptions, "/files/", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	req.Header.Set("Access-Control-Request-Headers", "content-type, upload-checksum, upload-length, upload-offset")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	assert.Contains(t, rr.Header().Get("Access-Control-Allow-Methods"), "POST")
+	for _, header := range []string{"Content-Type", "Upload-Checksum", "Upload-Length", "Upload-Offset"} {
+		assert.Contains(t, rr.Header().Get("Access-Control-Allow-Headers"), header)
+	}
+}
@@ -0,0 +1,187 @@
+// Package identity determines who is making a request to the upload server.
+package identity
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Headers set by the authenticating gateway in front of the server.
+const (
+	DefaultUserHeader = "X-User-Id"
+	DefaultTierHeader = "X-Account-Tier"
+)
+
+// Client identifies the caller of a request.
+type Client struct {
+	// UserID is empty for anonymous requests.
+	UserID string
+	// IP is the remote address, or the address the gateway forwarded the
+	// request for.
+	IP string
+	// Tier is the account tier (e.g. "label" or "free"), empty if unknown
+	// or not set by a trusted gateway.
+	Tier string
+}
+
+// Key returns a stable key for per-client bookkeeping: the user when known,
+// otherwise the IP address.
+func (c Client) Key() string {
+	if c.UserID != "" {
+		return "user:" + c.UserID
+	}
+	return "ip:" + c.IP
+}
+
+// Resolver extracts a Client from incoming requests.
+type Resolver struct {
+	// UserHeader carries the authenticated user ID.
+	UserHeader string
+	// TierHeader carries the account tier of the authenticated user.
+	TierHeader string
+	// TrustGatewayHeaders trusts UserHeader and TierHeader. They are only
+	// set by an authenticating gateway in front of the server; without one,
+	// any client could send them, so requests are anonymous.
+	TrustGatewayHeaders bool
+	// RespectForwardedHeaders takes the client IP from X-Forwarded-For or
+	// Forwarded. Like the user header, they are only trusted with
+	// TrustGatewayHeaders. It should match the tus handler's setting of the
+	// same name.
+	RespectForwardedHeaders bool
+	// TrustedProxies are the proxies between the gateway and the server.
+	// Their hops are skipped in the forwarding headers, so that the client
+	// IP is the one the gateway appended.
+	TrustedProxies []netip.Prefix
+}
+
+// NewResolverFromEnv creates a Resolver, reading USER_ID_HEADER,
+// ACCOUNT_TIER_HEADER, TRUST_GATEWAY_HEADERS and TRUSTED_PROXIES, a comma
+// separated list of addresses or CIDR prefixes.
+func NewResolverFromEnv(respectForwardedHeaders bool) (Resolver, error) {
+	res := Resolver{
+		UserHeader:              os.Getenv("USER_ID_HEADER"),
+		TierHeader:              os.Getenv("ACCOUNT_TIER_HEADER"),
+		RespectForwardedHeaders: respectForwardedHeaders,
+	}
+	res.TrustGatewayHeaders, _ = strconv.ParseBool(os.Getenv("TRUST_GATEWAY_HEADERS"))
+	if res.UserHeader == "" {
+		res.UserHeader = DefaultUserHeader
+	}
+	if res.TierHeader == "" {
+		res.TierHeader = DefaultTierHeader
+	}
+	if v := os.Getenv("TRUSTED_PROXIES"); v != "" {
+		for _, proxy := range strings.Split(v, ",") {
+			prefix, err := parsePrefix(strings.TrimSpace(proxy))
+			if err != nil {
+				return res, fmt.Errorf("invalid TRUSTED_PROXIES: %w", err)
+			}
+			res.TrustedProxies = append(res.TrustedProxies, prefix)
+		}
+	}
+	return res, nil
+}
+
+// parsePrefix parses a CIDR prefix or a single address.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		return netip.ParsePrefix(s)
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// Resolve returns the Client that sent r.
+func (res Resolver) Resolve(r *http.Request) Client {
+	client := Client{IP: remoteIP(r.RemoteAddr)}
+	if res.TrustGatewayHeaders {
+		if res.UserHeader != "" {
+			client.UserID = strings.TrimSpace(r.Header.Get(res.UserHeader))
+		}
+		// Only authenticated users have a tier, so that it cannot be
+		// chosen by an anonymous client.
+		if res.TierHeader != "" && client.UserID != "" {
+			client.Tier = strings.ToLower(strings.TrimSpace(r.Header.Get(res.TierHeader)))
+		}
+		if res.RespectForwardedHeaders {
+			if ip := res.forwardedIP(r.Header); ip != "" {
+				client.IP = ip
+			}
+		}
+	}
+	return client
+}
+
+func remoteIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// forwardedIP returns the client address from the Forwarded or
+// X-Forwarded-For headers, whichever is present. Clients can send either
+// with any addresses in them, so only the rightmost hop that is not a
+// trusted proxy is taken, as that is the one the gateway appended.
+func (res Resolver) forwardedIP(h http.Header) string {
+	hops := forwardedHops(h)
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !res.trusted(hops[i]) {
+			return hops[i]
+		}
+	}
+	// Every hop was a trusted proxy, so the request came from within.
+	if len(hops) > 0 {
+		return hops[0]
+	}
+	return ""
+}
+
+// forwardedHops returns the addresses in the Forwarded or X-Forwarded-For
+// headers, from the client to the last proxy.
+func forwardedHops(h http.Header) []string {
+	var hops []string
+	if fwd := h.Values("Forwarded"); len(fwd) > 0 {
+		for _, element := range strings.Split(strings.Join(fwd, ","), ",") {
+			for _, pair := range strings.Split(element, ";") {
+				name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(name, "for") {
+					value = strings.Trim(value, `"`)
+					value = strings.TrimSuffix(strings.TrimPrefix(remoteIP(value), "["), "]")
+					hops = append(hops, value)
+				}
+			}
+		}
+		return hops
+	}
+	for _, xff := range h.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(xff, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	return hops
+}
+
+// trusted reports whether hop is the address of a trusted proxy.
+func (res Resolver) trusted(hop string) bool {
+	addr, err := netip.ParseAddr(hop)
+	if err != nil {
+		return false
+	}
+	for _, prefix := range res.TrustedProxies {
+		if prefix.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
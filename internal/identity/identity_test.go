@@ -0,0 +1,57 @@
+package identity
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolve(t *testing.T) {
+	req := httptest.NewRequest("POST", "/files/", nil)
+	req.RemoteAddr = "192.168.0.1:5000"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7, 10.0.0.1")
+
+	assert.Equal(t, Client{IP: "192.168.0.1"}, Resolver{}.Resolve(req))
+	assert.Equal(t, Client{IP: "192.168.0.1"}, Resolver{RespectForwardedHeaders: true}.Resolve(req))
+	assert.Equal(t, Client{IP: "10.0.0.1"}, Resolver{TrustGatewayHeaders: true, RespectForwardedHeaders: true}.Resolve(req))
+
+	req.Header.Set(DefaultUserHeader, "artist-42")
+	client := Resolver{UserHeader: DefaultUserHeader, TrustGatewayHeaders: true}.Resolve(req)
+	assert.Equal(t, "user:artist-42", client.Key())
+
+	// Without a gateway to set them, the user and tier headers are the
+	// client's word.
+	req.Header.Set(DefaultTierHeader, "Label")
+	client = Resolver{UserHeader: DefaultUserHeader, TierHeader: DefaultTierHeader}.Resolve(req)
+	assert.Equal(t, Client{IP: "192.168.0.1"}, client)
+	client = Resolver{UserHeader: DefaultUserHeader, TierHeader: DefaultTierHeader, TrustGatewayHeaders: true}.Resolve(req)
+	assert.Equal(t, "label", client.Tier)
+}
+
+func TestResolve_ForwardedHeader(t *testing.T) {
+	req := httptest.NewRequest("POST", "/files/", nil)
+	req.Header.Set("Forwarded", `for=198.51.100.7, for="[2001:db8::1]:4711";proto=https`)
+	req.Header.Add("Forwarded", "for=10.0.0.1")
+
+	// The hops of trusted proxies are skipped to the one the gateway
+	// appended, whatever the client sent before it.
+	res := Resolver{TrustGatewayHeaders: true, RespectForwardedHeaders: true, TrustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}
+	client := res.Resolve(req)
+	assert.Equal(t, "2001:db8::1", client.IP)
+	assert.Equal(t, "ip:2001:db8::1", client.Key())
+}
+
+func TestNewResolverFromEnv(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 192.168.0.1")
+	res, err := NewResolverFromEnv(true)
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("192.168.0.1/32")}, res.TrustedProxies)
+	assert.False(t, res.TrustGatewayHeaders)
+
+	t.Setenv("TRUSTED_PROXIES", "proxy")
+	_, err = NewResolverFromEnv(true)
+	assert.Error(t, err)
+}
@@ -0,0 +1,209 @@
+// Package ratelimit protects the upload endpoint from clients that create
+// too many uploads or flood it with requests.
+package ratelimit
+
+import (
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"music-streaming/backend/internal/identity"
+)
+
+// Config holds the limits applied per client.
+type Config struct {
+	// RequestsPerSecond and Burst size the token bucket used for every request.
+	RequestsPerSecond float64
+	Burst             int
+	// CreatesPerMinute and CreateBurst size a separate bucket for POST
+	// requests, which create new uploads.
+	CreatesPerMinute float64
+	CreateBurst      int
+	// MaxConcurrentUploads caps the number of uploads a client may be
+	// transferring at the same time (in-flight POST and PATCH requests).
+	MaxConcurrentUploads int
+	// IdleTimeout is after how long unused client state is forgotten.
+	IdleTimeout time.Duration
+}
+
+// ConfigFromEnv reads RATE_LIMIT_* variables. A zero value disables a limit.
+func ConfigFromEnv() Config {
+	return Config{
+		RequestsPerSecond:    envFloat("RATE_LIMIT_RPS", 20),
+		Burst:                envInt("RATE_LIMIT_BURST", 40),
+		CreatesPerMinute:     envFloat("RATE_LIMIT_CREATES_PER_MINUTE", 30),
+		CreateBurst:          envInt("RATE_LIMIT_CREATE_BURST", 10),
+		MaxConcurrentUploads: envInt("MAX_CONCURRENT_UPLOADS_PER_USER", 4),
+		IdleTimeout:          10 * time.Minute,
+	}
+}
+
+// Limiter keeps per-client token buckets and active upload counts.
+type Limiter struct {
+	cfg      Config
+	resolver identity.Resolver
+	now      func() time.Time
+
+	mu        sync.Mutex
+	clients   map[string]*clientState
+	lastSweep time.Time
+}
+
+type clientState struct {
+	requests *rate.Limiter
+	creates  *rate.Limiter
+	active   int
+	lastSeen time.Time
+}
+
+// New creates a Limiter identifying clients with resolver.
+func New(cfg Config, resolver identity.Resolver) *Limiter {
+	return &Limiter{
+		cfg:      cfg,
+		resolver: resolver,
+		now:      time.Now,
+		clients:  make(map[string]*clientState),
+	}
+}
+
+// Handler rejects requests exceeding the client's limits with 429 Too Many
+// Requests and a Retry-After header, which tus clients treat as retryable.
+func (l *Limiter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := l.resolver.Resolve(r).Key()
+		transfer := r.Method == http.MethodPost || r.Method == http.MethodPatch
+
+		retryAfter, ok := l.acquire(key, r.Method == http.MethodPost, transfer)
+		if !ok {
+			tooManyRequests(w, retryAfter)
+			return
+		}
+		if transfer {
+			defer l.release(key)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// acquire charges the client's buckets and, for transfers, takes an active
+// upload slot. It returns how long to wait when the request is rejected.
+func (l *Limiter) acquire(key string, create, transfer bool) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	state := l.clients[key]
+	if state == nil {
+		state = &clientState{
+			requests: newBucket(l.cfg.RequestsPerSecond, l.cfg.Burst),
+			creates:  newBucket(l.cfg.CreatesPerMinute/60, l.cfg.CreateBurst),
+		}
+		l.clients[key] = state
+	}
+	state.lastSeen = now
+
+	if transfer && l.cfg.MaxConcurrentUploads > 0 && state.active >= l.cfg.MaxConcurrentUploads {
+		return time.Second, false
+	}
+	buckets := []*rate.Limiter{state.requests}
+	if create {
+		buckets = append(buckets, state.creates)
+	}
+	if wait, ok := reserve(buckets, now); !ok {
+		return wait, false
+	}
+	if transfer {
+		state.active++
+	}
+	return 0, true
+}
+
+func (l *Limiter) release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if state := l.clients[key]; state != nil && state.active > 0 {
+		state.active--
+		state.lastSeen = l.now()
+	}
+}
+
+// sweep forgets idle clients so the map does not grow without bound.
+func (l *Limiter) sweep(now time.Time) {
+	if l.cfg.IdleTimeout <= 0 || now.Sub(l.lastSweep) < l.cfg.IdleTimeout {
+		return
+	}
+	l.lastSweep = now
+	for key, state := range l.clients {
+		if state.active == 0 && now.Sub(state.lastSeen) > l.cfg.IdleTimeout {
+			delete(l.clients, key)
+		}
+	}
+}
+
+func newBucket(perSecond float64, burst int) *rate.Limiter {
+	if perSecond <= 0 {
+		return rate.NewLimiter(rate.Inf, 0)
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return rate.NewLimiter(rate.Limit(perSecond), burst)
+}
+
+// reserve takes a token from every bucket if all have one available now.
+// Otherwise no token is taken and it reports how long until they will.
+func reserve(buckets []*rate.Limiter, now time.Time) (time.Duration, bool) {
+	var wait time.Duration
+	reservations := make([]*rate.Reservation, 0, len(buckets))
+	for _, bucket := range buckets {
+		res := bucket.ReserveN(now, 1)
+		if !res.OK() {
+			wait = max(wait, time.Minute)
+			continue
+		}
+		reservations = append(reservations, res)
+		wait = max(wait, res.DelayFrom(now))
+	}
+	if wait > 0 {
+		for _, res := range reservations {
+			res.CancelAt(now)
+		}
+		return wait, false
+	}
+	return 0, true
+}
+
+func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	secs := int(math.Ceil(retryAfter.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	w.Header().Set("Tus-Resumable", "1.0.0")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write([]byte("ERR_RATE_LIMITED: too many requests, retry later\n"))
+}
+
+func envFloat(name string, def float64) float64 {
+	if v, err := strconv.ParseFloat(os.Getenv(name), 64); err == nil {
+		return v
+	}
+	return def
+}
+
+func envInt(name string, def int) int {
+	if v, err := strconv.Atoi(os.Getenv(name)); err == nil {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,150 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"music-streaming/backend/internal/identity"
+)
+
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNoContent)
+})
+
+func send(h http.Handler, method, user, remoteAddr string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/files/", nil)
+	req.RemoteAddr = remoteAddr
+	if user != "" {
+		req.Header.Set(identity.DefaultUserHeader, user)
+	}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestLimiter_RequestBucketPerClient(t *testing.T) {
+	l := New(Config{RequestsPerSecond: 1, Burst: 2}, identity.Resolver{UserHeader: identity.DefaultUserHeader, TrustGatewayHeaders: true})
+	h := l.Handler(okHandler)
+
+	assert.Equal(t, http.StatusNoContent, send(h, http.MethodHead, "alice", "10.0.0.1:1").Code)
+	assert.Equal(t, http.StatusNoContent, send(h, http.MethodHead, "alice", "10.0.0.1:1").Code)
+
+	rr := send(h, http.MethodHead, "alice", "10.0.0.1:1")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "1", rr.Header().Get("Retry-After"))
+	assert.Equal(t, "1.0.0", rr.Header().Get("Tus-Resumable"))
+
+	// Another user behind the same IP has their own bucket.
+	assert.Equal(t, http.StatusNoContent, send(h, http.MethodHead, "bob", "10.0.0.1:1").Code)
+}
+
+func TestLimiter_CreateBucket(t *testing.T) {
+	l := New(Config{CreatesPerMinute: 1, CreateBurst: 1}, identity.Resolver{})
+	h := l.Handler(okHandler)
+
+	assert.Equal(t, http.StatusNoContent, send(h, http.MethodPost, "", "10.0.0.1:1").Code)
+	rr := send(h, http.MethodPost, "", "10.0.0.1:1")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "60", rr.Header().Get("Retry-After"))
+
+	// PATCHes are not charged against the creation bucket.
+	assert.Equal(t, http.StatusNoContent, send(h, http.MethodPatch, "", "10.0.0.1:1").Code)
+	// Neither are other IPs.
+	assert.Equal(t, http.StatusNoContent, send(h, http.MethodPost, "", "10.0.0.2:1").Code)
+}
+
+func TestLimiter_ConcurrentUploads(t *testing.T) {
+	l := New(Config{MaxConcurrentUploads: 1}, identity.Resolver{UserHeader: identity.DefaultUserHeader, TrustGatewayHeaders: true})
+
+	entered := make(chan struct{})
+	unblock := make(chan struct{})
+	h := l.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-unblock
+	}))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		send(h, http.MethodPatch, "alice", "10.0.0.1:1")
+	}()
+	<-entered
+
+	assert.Equal(t, http.StatusTooManyRequests, send(h, http.MethodPatch, "alice", "10.0.0.1:1").Code)
+	close(unblock)
+	wg.Wait()
+
+	assert.Equal(t, 0, l.clients["user:alice"].active)
+}
+
+func TestLimiter_ForwardedHeadersTrust(t *testing.T) {
+	cfg := Config{RequestsPerSecond: 1, Burst: 1}
+	forwarded := func(h http.Handler, xff string) int {
+		req := httptest.NewRequest(http.MethodHead, "/files/", nil)
+		req.RemoteAddr = "192.168.0.1:1234"
+		req.Header.Set("X-Forwarded-For", xff)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	trusting := New(cfg, identity.Resolver{TrustGatewayHeaders: true, RespectForwardedHeaders: true}).Handler(okHandler)
+	assert.Equal(t, http.StatusNoContent, forwarded(trusting, "203.0.113.1"))
+	assert.Equal(t, http.StatusNoContent, forwarded(trusting, "203.0.113.2"))
+	// Addresses a client puts in front of the one the gateway appends do
+	// not make it someone else.
+	assert.Equal(t, http.StatusTooManyRequests, forwarded(trusting, "198.51.100.7, 203.0.113.2"))
+
+	// Without a trusted gateway, forwarding headers are the client's word.
+	untrusted := New(cfg, identity.Resolver{RespectForwardedHeaders: true}).Handler(okHandler)
+	assert.Equal(t, http.StatusNoContent, forwarded(untrusted, "203.0.113.1"))
+	assert.Equal(t, http.StatusTooManyRequests, forwarded(untrusted, "203.0.113.2"))
+}
+
+func TestLimiter_UntrustedUserHeader(t *testing.T) {
+	l := New(Config{RequestsPerSecond: 1, Burst: 1, MaxConcurrentUploads: 1}, identity.Resolver{UserHeader: identity.DefaultUserHeader})
+
+	entered := make(chan struct{})
+	unblock := make(chan struct{})
+	h := l.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-unblock
+	}))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		send(h, http.MethodPatch, "alice", "10.0.0.1:1")
+	}()
+	<-entered
+
+	// Without a trusted gateway, a new user ID on every request neither
+	// gets a fresh bucket nor a fresh upload slot.
+	assert.Equal(t, http.StatusTooManyRequests, send(h, http.MethodPatch, "bob", "10.0.0.1:1").Code)
+	close(unblock)
+	wg.Wait()
+	assert.Equal(t, http.StatusTooManyRequests, send(h, http.MethodHead, "carol", "10.0.0.1:1").Code)
+
+	assert.NotContains(t, l.clients, "user:alice")
+}
+
+func TestLimiter_SweepsIdleClients(t *testing.T) {
+	l := New(Config{IdleTimeout: time.Minute}, identity.Resolver{})
+	now := time.Now()
+	l.now = func() time.Time { return now }
+	h := l.Handler(okHandler)
+
+	send(h, http.MethodHead, "", "10.0.0.1:1")
+	now = now.Add(2 * time.Minute)
+	send(h, http.MethodHead, "", "10.0.0.2:1")
+
+	assert.NotContains(t, l.clients, "ip:10.0.0.1")
+	assert.Contains(t, l.clients, "ip:10.0.0.2")
+}
@@ -0,0 +1,828 @@
+// Package s3fake provides an in-memory implementation of the S3 operations
+// the service uses, so tests can run real upload flows without an S3
+// server. Buckets are created on first use.
+package s3fake
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// DefaultMinPartSize is the smallest size S3 accepts for any but the last
+// part of a multipart upload.
+const DefaultMinPartSize = 5 << 20
+
+// defaultMaxKeys is the page size of listings when the caller sets none.
+const defaultMaxKeys = 1000
+
+// Client is a stateful, concurrency-safe S3 fake.
+type Client struct {
+	// MinPartSize is enforced by CompleteMultipartUpload for all parts but
+	// the last, like S3 does.
+	MinPartSize int64
+
+	mu      sync.Mutex
+	now     func() time.Time
+	buckets map[string]map[string]*object
+	uploads map[string]*multipartUpload
+	faults  []*Fault
+	calls   map[string]int
+}
+
+type object struct {
+	data         []byte
+	etag         string
+	contentType  string
+	metadata     map[string]string
+	encryption   Encryption
+	lastModified time.Time
+}
+
+type multipartUpload struct {
+	bucket, key string
+	contentType string
+	metadata    map[string]string
+	encryption  Encryption
+	parts       map[int32]*part
+}
+
+// Encryption is the server-side encryption an object was stored with.
+type Encryption struct {
+	// SSE is "AES256" or "aws:kms" for keys managed by S3 or KMS.
+	SSE      types.ServerSideEncryption
+	KMSKeyID string
+	// CustomerKeyMD5 identifies the customer key of SSE-C, which must be
+	// given with every read of the object.
+	CustomerKeyMD5 string
+}
+
+type part struct {
+	data         []byte
+	etag         string
+	lastModified time.Time
+}
+
+// New returns an empty fake.
+func New() *Client {
+	return &Client{
+		MinPartSize: DefaultMinPartSize,
+		now:         time.Now,
+		buckets:     make(map[string]map[string]*object),
+		uploads:     make(map[string]*multipartUpload),
+		calls:       make(map[string]int),
+	}
+}
+
+// Fault makes matching calls slow down or fail.
+type Fault struct {
+	// Op is the name of the S3 operation, e.g. "UploadPart". Empty matches
+	// every operation.
+	Op string
+	// Key, if set, restricts the fault to calls on keys with this prefix.
+	Key string
+	// Delay is waited before the call is handled, or until its context is
+	// cancelled.
+	Delay time.Duration
+	// Err, if set, is returned instead of handling the call.
+	Err error
+	// Times is how many calls the fault applies to. Zero means all.
+	Times int
+}
+
+// Inject adds a fault. Faults are checked in the order they were added and
+// the first matching one applies.
+func (c *Client) Inject(fault Fault) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.faults = append(c.faults, &fault)
+}
+
+// ClearFaults removes all injected faults.
+func (c *Client) ClearFaults() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.faults = nil
+}
+
+// Calls returns how often the operation op has been called.
+func (c *Client) Calls(op string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.calls[op]
+}
+
+// Object returns the content of the object stored under key.
+func (c *Client) Object(bucket, key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	obj, ok := c.buckets[bucket][key]
+	if !ok {
+		return nil, false
+	}
+	return bytes.Clone(obj.data), true
+}
+
+// ObjectEncryption returns the encryption of the object stored under key.
+func (c *Client) ObjectEncryption(bucket, key string) (Encryption, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	obj, ok := c.buckets[bucket][key]
+	if !ok {
+		return Encryption{}, false
+	}
+	return obj.encryption, true
+}
+
+// Keys returns the sorted keys of all objects in bucket.
+func (c *Client) Keys(bucket string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sortedKeys(bucket)
+}
+
+// MultipartUploads returns how many multipart uploads are in progress in
+// bucket.
+func (c *Client) MultipartUploads(bucket string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, upload := range c.uploads {
+		if upload.bucket == bucket {
+			n++
+		}
+	}
+	return n
+}
+
+// call records a call and applies the first matching fault.
+func (c *Client) call(ctx context.Context, op string, key *string) error {
+	c.mu.Lock()
+	c.calls[op]++
+	var fault Fault
+	for i, f := range c.faults {
+		if (f.Op == "" || f.Op == op) && (f.Key == "" || strings.HasPrefix(aws.ToString(key), f.Key)) {
+			fault = *f
+			if f.Times > 0 {
+				f.Times--
+				if f.Times == 0 {
+					c.faults = append(c.faults[:i:i], c.faults[i+1:]...)
+				}
+			}
+			break
+		}
+	}
+	c.mu.Unlock()
+
+	if fault.Delay > 0 {
+		timer := time.NewTimer(fault.Delay)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return fault.Err
+}
+
+func (c *Client) bucket(name string) map[string]*object {
+	b, ok := c.buckets[name]
+	if !ok {
+		b = make(map[string]*object)
+		c.buckets[name] = b
+	}
+	return b
+}
+
+func (c *Client) sortedKeys(bucket string) []string {
+	keys := make([]string, 0, len(c.buckets[bucket]))
+	for key := range c.buckets[bucket] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (c *Client) PutObject(ctx context.Context, input *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	if err := c.call(ctx, "PutObject", input.Key); err != nil {
+		return nil, err
+	}
+	data, err := readBody(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := requestEncryption(input.ServerSideEncryption, input.SSEKMSKeyId, input.SSECustomerKey, input.SSECustomerKeyMD5)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	obj := &object{
+		data:         data,
+		etag:         etag(data),
+		contentType:  aws.ToString(input.ContentType),
+		metadata:     input.Metadata,
+		encryption:   enc,
+		lastModified: c.now(),
+	}
+	c.bucket(aws.ToString(input.Bucket))[aws.ToString(input.Key)] = obj
+	return &s3.PutObjectOutput{ETag: aws.String(obj.etag)}, nil
+}
+
+func (c *Client) GetObject(ctx context.Context, input *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	if err := c.call(ctx, "GetObject", input.Key); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	obj, ok := c.buckets[aws.ToString(input.Bucket)][aws.ToString(input.Key)]
+	if !ok {
+		return nil, &types.NoSuchKey{Message: aws.String("The specified key does not exist.")}
+	}
+	if err := checkCustomerKey(obj.encryption, input.SSECustomerKey, input.SSECustomerKeyMD5); err != nil {
+		return nil, err
+	}
+
+	size := int64(len(obj.data))
+	data := obj.data
+	output := &s3.GetObjectOutput{
+		ETag:         aws.String(obj.etag),
+		ContentType:  aws.String(obj.contentType),
+		Metadata:     obj.metadata,
+		LastModified: aws.Time(obj.lastModified),
+		AcceptRanges: aws.String("bytes"),
+	}
+	output.ServerSideEncryption, output.SSEKMSKeyId, output.SSECustomerKeyMD5 = obj.encryption.output()
+	if input.Range != nil {
+		start, end, err := parseRange(*input.Range, size)
+		if err != nil {
+			return nil, err
+		}
+		data = data[start : end+1]
+		output.ContentRange = aws.String(fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	}
+	output.Body = io.NopCloser(bytes.NewReader(bytes.Clone(data)))
+	output.ContentLength = aws.Int64(int64(len(data)))
+	return output, nil
+}
+
+func (c *Client) HeadObject(ctx context.Context, input *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	if err := c.call(ctx, "HeadObject", input.Key); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	obj, ok := c.buckets[aws.ToString(input.Bucket)][aws.ToString(input.Key)]
+	if !ok {
+		// HEAD responses have no body, so S3 can only report NotFound.
+		return nil, &types.NotFound{Message: aws.String("Not Found")}
+	}
+	if err := checkCustomerKey(obj.encryption, input.SSECustomerKey, input.SSECustomerKeyMD5); err != nil {
+		return nil, err
+	}
+	output := &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(int64(len(obj.data))),
+		ETag:          aws.String(obj.etag),
+		ContentType:   aws.String(obj.contentType),
+		Metadata:      obj.metadata,
+		LastModified:  aws.Time(obj.lastModified),
+		AcceptRanges:  aws.String("bytes"),
+	}
+	output.ServerSideEncryption, output.SSEKMSKeyId, output.SSECustomerKeyMD5 = obj.encryption.output()
+	return output, nil
+}
+
+func (c *Client) DeleteObject(ctx context.Context, input *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	if err := c.call(ctx, "DeleteObject", input.Key); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.bucket(aws.ToString(input.Bucket)), aws.ToString(input.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (c *Client) DeleteObjects(ctx context.Context, input *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	if err := c.call(ctx, "DeleteObjects", nil); err != nil {
+		return nil, err
+	}
+	if input.Delete == nil || len(input.Delete.Objects) == 0 {
+		return nil, apiError("MalformedXML", "The XML you provided was not well-formed")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b := c.bucket(aws.ToString(input.Bucket))
+	output := &s3.DeleteObjectsOutput{}
+	for _, id := range input.Delete.Objects {
+		delete(b, aws.ToString(id.Key))
+		if !aws.ToBool(input.Delete.Quiet) {
+			output.Deleted = append(output.Deleted, types.DeletedObject{Key: id.Key})
+		}
+	}
+	return output, nil
+}
+
+func (c *Client) CopyObject(ctx context.Context, input *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	if err := c.call(ctx, "CopyObject", input.Key); err != nil {
+		return nil, err
+	}
+
+	enc, err := requestEncryption(input.ServerSideEncryption, input.SSEKMSKeyId, input.SSECustomerKey, input.SSECustomerKeyMD5)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	src, err := c.copySource(input.CopySource)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCustomerKey(src.encryption, input.CopySourceSSECustomerKey, input.CopySourceSSECustomerKeyMD5); err != nil {
+		return nil, err
+	}
+	obj := &object{
+		data:         src.data,
+		etag:         src.etag,
+		contentType:  src.contentType,
+		metadata:     src.metadata,
+		encryption:   enc,
+		lastModified: c.now(),
+	}
+	c.bucket(aws.ToString(input.Bucket))[aws.ToString(input.Key)] = obj
+	return &s3.CopyObjectOutput{CopyObjectResult: &types.CopyObjectResult{
+		ETag:         aws.String(obj.etag),
+		LastModified: aws.Time(obj.lastModified),
+	}}, nil
+}
+
+// copySource resolves a "bucket/key" copy source, which may be URL-encoded.
+func (c *Client) copySource(source *string) (*object, error) {
+	decoded, err := url.PathUnescape(strings.TrimPrefix(aws.ToString(source), "/"))
+	if err != nil {
+		return nil, apiError("InvalidArgument", "invalid copy source")
+	}
+	bucket, key, ok := strings.Cut(decoded, "/")
+	if !ok {
+		return nil, apiError("InvalidArgument", "invalid copy source")
+	}
+	obj, ok := c.buckets[bucket][key]
+	if !ok {
+		return nil, &types.NoSuchKey{Message: aws.String("The specified key does not exist.")}
+	}
+	return obj, nil
+}
+
+func (c *Client) ListObjectsV2(ctx context.Context, input *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	if err := c.call(ctx, "ListObjectsV2", input.Prefix); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	bucket := aws.ToString(input.Bucket)
+	prefix := aws.ToString(input.Prefix)
+	delimiter := aws.ToString(input.Delimiter)
+	maxKeys := int(aws.ToInt32(input.MaxKeys))
+	if input.MaxKeys == nil {
+		maxKeys = defaultMaxKeys
+	}
+
+	after := aws.ToString(input.StartAfter)
+	if input.ContinuationToken != nil {
+		token, err := base64.StdEncoding.DecodeString(*input.ContinuationToken)
+		if err != nil {
+			return nil, apiError("InvalidArgument", "The continuation token provided is incorrect")
+		}
+		after = string(token)
+	}
+
+	output := &s3.ListObjectsV2Output{
+		Name:              input.Bucket,
+		Prefix:            input.Prefix,
+		Delimiter:         input.Delimiter,
+		MaxKeys:           aws.Int32(int32(maxKeys)),
+		StartAfter:        input.StartAfter,
+		ContinuationToken: input.ContinuationToken,
+		IsTruncated:       aws.Bool(false),
+	}
+	last := ""
+	count := 0
+	for _, key := range c.sortedKeys(bucket) {
+		if !strings.HasPrefix(key, prefix) || key <= after {
+			continue
+		}
+		entry := key
+		isPrefix := false
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				entry = key[:len(prefix)+i+len(delimiter)]
+				isPrefix = true
+			}
+		}
+		// A common prefix is listed once, including across pages.
+		if isPrefix && (entry == last || strings.HasPrefix(after, entry)) {
+			continue
+		}
+		if count == maxKeys {
+			output.IsTruncated = aws.Bool(true)
+			output.NextContinuationToken = aws.String(base64.StdEncoding.EncodeToString([]byte(last)))
+			break
+		}
+		if isPrefix {
+			output.CommonPrefixes = append(output.CommonPrefixes, types.CommonPrefix{Prefix: aws.String(entry)})
+		} else {
+			obj := c.buckets[bucket][key]
+			output.Contents = append(output.Contents, types.Object{
+				Key:          aws.String(key),
+				Size:         aws.Int64(int64(len(obj.data))),
+				ETag:         aws.String(obj.etag),
+				LastModified: aws.Time(obj.lastModified),
+				StorageClass: types.ObjectStorageClassStandard,
+			})
+		}
+		last = entry
+		count++
+	}
+	output.KeyCount = aws.Int32(int32(count))
+	return output, nil
+}
+
+func (c *Client) CreateMultipartUpload(ctx context.Context, input *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	if err := c.call(ctx, "CreateMultipartUpload", input.Key); err != nil {
+		return nil, err
+	}
+
+	enc, err := requestEncryption(input.ServerSideEncryption, input.SSEKMSKeyId, input.SSECustomerKey, input.SSECustomerKeyMD5)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id := randomID()
+	c.uploads[id] = &multipartUpload{
+		bucket:      aws.ToString(input.Bucket),
+		key:         aws.ToString(input.Key),
+		contentType: aws.ToString(input.ContentType),
+		metadata:    input.Metadata,
+		encryption:  enc,
+		parts:       make(map[int32]*part),
+	}
+	return &s3.CreateMultipartUploadOutput{
+		Bucket:   input.Bucket,
+		Key:      input.Key,
+		UploadId: aws.String(id),
+	}, nil
+}
+
+// upload returns the multipart upload with the given ID on bucket and key.
+func (c *Client) upload(bucket, key, id *string) (*multipartUpload, error) {
+	upload, ok := c.uploads[aws.ToString(id)]
+	if !ok || upload.bucket != aws.ToString(bucket) || upload.key != aws.ToString(key) {
+		return nil, &types.NoSuchUpload{Message: aws.String("The specified upload does not exist.")}
+	}
+	return upload, nil
+}
+
+func (c *Client) UploadPart(ctx context.Context, input *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	if err := c.call(ctx, "UploadPart", input.Key); err != nil {
+		return nil, err
+	}
+	data, err := readBody(input.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	upload, err := c.upload(input.Bucket, input.Key, input.UploadId)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCustomerKey(upload.encryption, input.SSECustomerKey, input.SSECustomerKeyMD5); err != nil {
+		return nil, err
+	}
+	p, err := c.putPart(upload, input.PartNumber, data)
+	if err != nil {
+		return nil, err
+	}
+	return &s3.UploadPartOutput{ETag: aws.String(p.etag)}, nil
+}
+
+func (c *Client) UploadPartCopy(ctx context.Context, input *s3.UploadPartCopyInput, optFns ...func(*s3.Options)) (*s3.UploadPartCopyOutput, error) {
+	if err := c.call(ctx, "UploadPartCopy", input.Key); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	upload, err := c.upload(input.Bucket, input.Key, input.UploadId)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCustomerKey(upload.encryption, input.SSECustomerKey, input.SSECustomerKeyMD5); err != nil {
+		return nil, err
+	}
+	src, err := c.copySource(input.CopySource)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCustomerKey(src.encryption, input.CopySourceSSECustomerKey, input.CopySourceSSECustomerKeyMD5); err != nil {
+		return nil, err
+	}
+	data := src.data
+	if input.CopySourceRange != nil {
+		start, end, err := parseRange(*input.CopySourceRange, int64(len(data)))
+		if err != nil {
+			return nil, err
+		}
+		data = data[start : end+1]
+	}
+	p, err := c.putPart(upload, input.PartNumber, bytes.Clone(data))
+	if err != nil {
+		return nil, err
+	}
+	return &s3.UploadPartCopyOutput{CopyPartResult: &types.CopyPartResult{
+		ETag:         aws.String(p.etag),
+		LastModified: aws.Time(p.lastModified),
+	}}, nil
+}
+
+func (c *Client) putPart(upload *multipartUpload, number *int32, data []byte) (*part, error) {
+	n := aws.ToInt32(number)
+	if n < 1 || n > 10000 {
+		return nil, apiError("InvalidArgument", "Part number must be an integer between 1 and 10000, inclusive")
+	}
+	p := &part{data: data, etag: etag(data), lastModified: c.now()}
+	upload.parts[n] = p
+	return p, nil
+}
+
+func (c *Client) ListParts(ctx context.Context, input *s3.ListPartsInput, optFns ...func(*s3.Options)) (*s3.ListPartsOutput, error) {
+	if err := c.call(ctx, "ListParts", input.Key); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	upload, err := c.upload(input.Bucket, input.Key, input.UploadId)
+	if err != nil {
+		return nil, err
+	}
+
+	marker := int32(0)
+	if input.PartNumberMarker != nil {
+		m, err := strconv.ParseInt(*input.PartNumberMarker, 10, 32)
+		if err != nil {
+			return nil, apiError("InvalidArgument", "invalid part number marker")
+		}
+		marker = int32(m)
+	}
+	maxParts := int(aws.ToInt32(input.MaxParts))
+	if input.MaxParts == nil {
+		maxParts = defaultMaxKeys
+	}
+
+	numbers := make([]int32, 0, len(upload.parts))
+	for n := range upload.parts {
+		if n > marker {
+			numbers = append(numbers, n)
+		}
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+
+	output := &s3.ListPartsOutput{
+		Bucket:      input.Bucket,
+		Key:         input.Key,
+		UploadId:    input.UploadId,
+		MaxParts:    aws.Int32(int32(maxParts)),
+		IsTruncated: aws.Bool(len(numbers) > maxParts),
+	}
+	if len(numbers) > maxParts {
+		numbers = numbers[:maxParts]
+		output.NextPartNumberMarker = aws.String(strconv.Itoa(int(numbers[len(numbers)-1])))
+	}
+	for _, n := range numbers {
+		p := upload.parts[n]
+		output.Parts = append(output.Parts, types.Part{
+			PartNumber:   aws.Int32(n),
+			Size:         aws.Int64(int64(len(p.data))),
+			ETag:         aws.String(p.etag),
+			LastModified: aws.Time(p.lastModified),
+		})
+	}
+	return output, nil
+}
+
+func (c *Client) CompleteMultipartUpload(ctx context.Context, input *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	if err := c.call(ctx, "CompleteMultipartUpload", input.Key); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	upload, err := c.upload(input.Bucket, input.Key, input.UploadId)
+	if err != nil {
+		return nil, err
+	}
+	if input.MultipartUpload == nil || len(input.MultipartUpload.Parts) == 0 {
+		return nil, apiError("MalformedXML", "The XML you provided was not well-formed")
+	}
+
+	completed := input.MultipartUpload.Parts
+	var data []byte
+	sums := md5.New()
+	for i := 1; i < len(completed); i++ {
+		if aws.ToInt32(completed[i].PartNumber) <= aws.ToInt32(completed[i-1].PartNumber) {
+			return nil, apiError("InvalidPartOrder", "The list of parts was not in ascending order")
+		}
+	}
+	for i, completedPart := range completed {
+		n := aws.ToInt32(completedPart.PartNumber)
+		p, ok := upload.parts[n]
+		if !ok || strings.Trim(aws.ToString(completedPart.ETag), `"`) != strings.Trim(p.etag, `"`) {
+			return nil, apiError("InvalidPart", fmt.Sprintf("part %d could not be found", n))
+		}
+		if i < len(completed)-1 && int64(len(p.data)) < c.MinPartSize {
+			return nil, apiError("EntityTooSmall", "Your proposed upload is smaller than the minimum allowed object size")
+		}
+		data = append(data, p.data...)
+		sum, _ := hex.DecodeString(strings.Trim(p.etag, `"`))
+		sums.Write(sum)
+	}
+
+	obj := &object{
+		data:         data,
+		etag:         fmt.Sprintf(`"%x-%d"`, sums.Sum(nil), len(completed)),
+		contentType:  upload.contentType,
+		metadata:     upload.metadata,
+		encryption:   upload.encryption,
+		lastModified: c.now(),
+	}
+	c.bucket(upload.bucket)[upload.key] = obj
+	delete(c.uploads, aws.ToString(input.UploadId))
+	return &s3.CompleteMultipartUploadOutput{
+		Bucket: input.Bucket,
+		Key:    input.Key,
+		ETag:   aws.String(obj.etag),
+	}, nil
+}
+
+func (c *Client) AbortMultipartUpload(ctx context.Context, input *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	if err := c.call(ctx, "AbortMultipartUpload", input.Key); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.upload(input.Bucket, input.Key, input.UploadId); err != nil {
+		return nil, err
+	}
+	delete(c.uploads, aws.ToString(input.UploadId))
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func readBody(body io.Reader) ([]byte, error) {
+	if body == nil {
+		return nil, nil
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request body: %w", err)
+	}
+	return data, nil
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestEncryption returns the encryption a write asks for.
+func requestEncryption(sse types.ServerSideEncryption, kmsKeyID, customerKey, customerKeyMD5 *string) (Encryption, error) {
+	keySum, err := keyMD5(customerKey, customerKeyMD5)
+	if err != nil {
+		return Encryption{}, err
+	}
+	if keySum != "" && sse != "" {
+		return Encryption{}, apiError("InvalidArgument", "Server Side Encryption with Customer provided key is incompatible with the encryption method specified")
+	}
+	if kmsKeyID != nil && sse != types.ServerSideEncryptionAwsKms {
+		return Encryption{}, apiError("InvalidArgument", "Specifying a KMS key ID requires aws:kms encryption")
+	}
+	return Encryption{SSE: sse, KMSKeyID: aws.ToString(kmsKeyID), CustomerKeyMD5: keySum}, nil
+}
+
+// checkCustomerKey checks that a request gives the customer key enc was
+// written with, if any, and no key otherwise.
+func checkCustomerKey(enc Encryption, customerKey, customerKeyMD5 *string) error {
+	keySum, err := keyMD5(customerKey, customerKeyMD5)
+	if err != nil {
+		return err
+	}
+	switch {
+	case enc.CustomerKeyMD5 == "" && keySum != "":
+		return apiError("InvalidRequest", "The encryption parameters are not applicable to this object.")
+	case enc.CustomerKeyMD5 != "" && keySum == "":
+		return apiError("InvalidRequest", "The object was stored using a form of Server Side Encryption. The correct parameters must be provided to retrieve the object.")
+	case enc.CustomerKeyMD5 != keySum:
+		return apiError("AccessDenied", "Access Denied")
+	}
+	return nil
+}
+
+// keyMD5 returns the base64 MD5 of a base64 SSE-C key, checking it against
+// the MD5 sent along if there is one.
+func keyMD5(key, sentMD5 *string) (string, error) {
+	if key == nil {
+		return "", nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(*key)
+	if err != nil || len(raw) != 32 {
+		return "", apiError("InvalidArgument", "The secret key was invalid for the specified algorithm.")
+	}
+	sum := md5.Sum(raw)
+	keySum := base64.StdEncoding.EncodeToString(sum[:])
+	if sentMD5 != nil && *sentMD5 != keySum {
+		return "", apiError("InvalidArgument", "The calculated MD5 hash of the key did not match the hash that was provided.")
+	}
+	return keySum, nil
+}
+
+func (enc Encryption) output() (types.ServerSideEncryption, *string, *string) {
+	var kmsKeyID, customerKeyMD5 *string
+	if enc.KMSKeyID != "" {
+		kmsKeyID = aws.String(enc.KMSKeyID)
+	}
+	if enc.CustomerKeyMD5 != "" {
+		customerKeyMD5 = aws.String(enc.CustomerKeyMD5)
+	}
+	return enc.SSE, kmsKeyID, customerKeyMD5
+}
+
+func apiError(code, message string) error {
+	return &smithy.GenericAPIError{Code: code, Message: message}
+}
+
+// parseRange parses a single HTTP byte range against an object of size
+// bytes and returns the inclusive bounds.
+func parseRange(header string, size int64) (start, end int64, err error) {
+	invalid := apiError("InvalidRange", "The requested range is not satisfiable")
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return 0, 0, invalid
+	}
+	first, last, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, 0, invalid
+	}
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 || size == 0 {
+			return 0, 0, invalid
+		}
+		return max(size-n, 0), size - 1, nil
+	}
+	start, err = strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, invalid
+	}
+	end = size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, invalid
+		}
+		end = min(end, size-1)
+	}
+	return start, end, nil
+}
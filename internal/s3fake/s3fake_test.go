@@ -0,0 +1,282 @@
+package s3fake
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func put(t *testing.T, c *Client, key, content string) {
+	_, err := c.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket: aws.String("b"),
+		Key:    aws.String(key),
+		Body:   strings.NewReader(content),
+	})
+	require.NoError(t, err)
+}
+
+func get(t *testing.T, c *Client, key, rng string) string {
+	input := &s3.GetObjectInput{Bucket: aws.String("b"), Key: aws.String(key)}
+	if rng != "" {
+		input.Range = aws.String(rng)
+	}
+	output, err := c.GetObject(context.Background(), input)
+	require.NoError(t, err)
+	data, err := io.ReadAll(output.Body)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), aws.ToInt64(output.ContentLength))
+	return string(data)
+}
+
+func TestObjects(t *testing.T) {
+	ctx := context.Background()
+	c := New()
+	put(t, c, "song", "0123456789")
+
+	assert.Equal(t, "0123456789", get(t, c, "song", ""))
+	assert.Equal(t, "234", get(t, c, "song", "bytes=2-4"))
+	assert.Equal(t, "789", get(t, c, "song", "bytes=-3"))
+	assert.Equal(t, "89", get(t, c, "song", "bytes=8-"))
+
+	head, err := c.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String("b"), Key: aws.String("song")})
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), aws.ToInt64(head.ContentLength))
+
+	_, err = c.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String("b"),
+		Key:        aws.String("copy"),
+		CopySource: aws.String("b/song"),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789", get(t, c, "copy", ""))
+
+	_, err = c.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String("b"), Key: aws.String("song")})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"copy"}, c.Keys("b"))
+}
+
+func TestMissingObjects(t *testing.T) {
+	ctx := context.Background()
+	c := New()
+
+	_, err := c.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("b"), Key: aws.String("missing")})
+	var noSuchKey *types.NoSuchKey
+	assert.ErrorAs(t, err, &noSuchKey)
+
+	_, err = c.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String("b"), Key: aws.String("missing")})
+	var notFound *types.NotFound
+	assert.ErrorAs(t, err, &notFound)
+
+	put(t, c, "song", "data")
+	_, err = c.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("b"), Key: aws.String("song"), Range: aws.String("bytes=4-")})
+	assert.ErrorContains(t, err, "InvalidRange")
+}
+
+func TestListObjectsV2(t *testing.T) {
+	ctx := context.Background()
+	c := New()
+	for _, key := range []string{"a", "b.info", "blobs/1", "blobs/2", "blobs/3", "c"} {
+		put(t, c, key, "x")
+	}
+
+	// Page through everything two entries at a time.
+	var keys []string
+	input := &s3.ListObjectsV2Input{Bucket: aws.String("b"), MaxKeys: aws.Int32(2)}
+	for {
+		output, err := c.ListObjectsV2(ctx, input)
+		require.NoError(t, err)
+		for _, obj := range output.Contents {
+			keys = append(keys, aws.ToString(obj.Key))
+		}
+		if !aws.ToBool(output.IsTruncated) {
+			break
+		}
+		input.ContinuationToken = output.NextContinuationToken
+	}
+	assert.Equal(t, []string{"a", "b.info", "blobs/1", "blobs/2", "blobs/3", "c"}, keys)
+
+	output, err := c.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: aws.String("b"), Prefix: aws.String("blobs/")})
+	require.NoError(t, err)
+	assert.Len(t, output.Contents, 3)
+
+	output, err = c.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: aws.String("b"), Delimiter: aws.String("/")})
+	require.NoError(t, err)
+	assert.Len(t, output.Contents, 3)
+	require.Len(t, output.CommonPrefixes, 1)
+	assert.Equal(t, "blobs/", aws.ToString(output.CommonPrefixes[0].Prefix))
+}
+
+func TestMultipartUpload(t *testing.T) {
+	ctx := context.Background()
+	c := New()
+	c.MinPartSize = 4
+	bucket, key := aws.String("b"), aws.String("song")
+	put(t, c, "src", "abcdefgh")
+
+	created, err := c.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{Bucket: bucket, Key: key})
+	require.NoError(t, err)
+	id := created.UploadId
+
+	first, err := c.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket: bucket, Key: key, UploadId: id, PartNumber: aws.Int32(1),
+		Body: bytes.NewReader([]byte("0123")),
+	})
+	require.NoError(t, err)
+	second, err := c.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+		Bucket: bucket, Key: key, UploadId: id, PartNumber: aws.Int32(2),
+		CopySource: aws.String("b/src"), CopySourceRange: aws.String("bytes=4-5"),
+	})
+	require.NoError(t, err)
+
+	parts, err := c.ListParts(ctx, &s3.ListPartsInput{Bucket: bucket, Key: key, UploadId: id, MaxParts: aws.Int32(1)})
+	require.NoError(t, err)
+	require.Len(t, parts.Parts, 1)
+	assert.True(t, aws.ToBool(parts.IsTruncated))
+	parts, err = c.ListParts(ctx, &s3.ListPartsInput{Bucket: bucket, Key: key, UploadId: id, PartNumberMarker: parts.NextPartNumberMarker})
+	require.NoError(t, err)
+	require.Len(t, parts.Parts, 1)
+	assert.Equal(t, int32(2), aws.ToInt32(parts.Parts[0].PartNumber))
+
+	_, err = c.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket: bucket, Key: key, UploadId: id,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: []types.CompletedPart{
+			{PartNumber: aws.Int32(2), ETag: second.CopyPartResult.ETag},
+			{PartNumber: aws.Int32(1), ETag: first.ETag},
+		}},
+	})
+	assert.ErrorContains(t, err, "InvalidPartOrder")
+
+	_, err = c.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket: bucket, Key: key, UploadId: id,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: []types.CompletedPart{
+			{PartNumber: aws.Int32(1), ETag: first.ETag},
+			{PartNumber: aws.Int32(2), ETag: second.CopyPartResult.ETag},
+		}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "0123ef", get(t, c, "song", ""))
+	assert.Zero(t, c.MultipartUploads("b"))
+
+	_, err = c.ListParts(ctx, &s3.ListPartsInput{Bucket: bucket, Key: key, UploadId: id})
+	var noSuchUpload *types.NoSuchUpload
+	assert.ErrorAs(t, err, &noSuchUpload)
+}
+
+func TestMultipartUpload_PartTooSmall(t *testing.T) {
+	ctx := context.Background()
+	c := New()
+	bucket, key := aws.String("b"), aws.String("song")
+	created, err := c.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{Bucket: bucket, Key: key})
+	require.NoError(t, err)
+
+	var completed []types.CompletedPart
+	for n := int32(1); n <= 2; n++ {
+		part, err := c.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket: bucket, Key: key, UploadId: created.UploadId, PartNumber: aws.Int32(n),
+			Body: strings.NewReader("small"),
+		})
+		require.NoError(t, err)
+		completed = append(completed, types.CompletedPart{PartNumber: aws.Int32(n), ETag: part.ETag})
+	}
+
+	_, err = c.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket: bucket, Key: key, UploadId: created.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
+	assert.ErrorContains(t, err, "EntityTooSmall")
+
+	_, err = c.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{Bucket: bucket, Key: key, UploadId: created.UploadId})
+	require.NoError(t, err)
+	assert.Zero(t, c.MultipartUploads("b"))
+}
+
+func TestCustomerKeys(t *testing.T) {
+	ctx := context.Background()
+	c := New()
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	other := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))
+	_, err := c.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:               aws.String("b"),
+		Key:                  aws.String("secret"),
+		Body:                 strings.NewReader("data"),
+		SSECustomerAlgorithm: aws.String("AES256"),
+		SSECustomerKey:       aws.String(key),
+	})
+	require.NoError(t, err)
+	put(t, c, "plain", "data")
+
+	for _, tc := range []struct {
+		key, sentKey string
+		code         string
+	}{
+		{"secret", key, ""},
+		{"secret", "", "InvalidRequest"},
+		{"secret", other, "AccessDenied"},
+		{"plain", key, "InvalidRequest"},
+	} {
+		input := &s3.HeadObjectInput{Bucket: aws.String("b"), Key: aws.String(tc.key)}
+		if tc.sentKey != "" {
+			input.SSECustomerAlgorithm, input.SSECustomerKey = aws.String("AES256"), aws.String(tc.sentKey)
+		}
+		_, err := c.HeadObject(ctx, input)
+		if tc.code == "" {
+			assert.NoError(t, err)
+			continue
+		}
+		var apiErr smithy.APIError
+		require.ErrorAs(t, err, &apiErr)
+		assert.Equal(t, tc.code, apiErr.ErrorCode(), "%s with key %q", tc.key, tc.sentKey)
+	}
+
+	// Copies are decrypted with the source key and stored as requested.
+	_, err = c.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:                         aws.String("b"),
+		Key:                            aws.String("copy"),
+		CopySource:                     aws.String("b/secret"),
+		CopySourceSSECustomerAlgorithm: aws.String("AES256"),
+		CopySourceSSECustomerKey:       aws.String(key),
+		ServerSideEncryption:           types.ServerSideEncryptionAwsKms,
+		SSEKMSKeyId:                    aws.String("alias/masters"),
+	})
+	require.NoError(t, err)
+	enc, ok := c.ObjectEncryption("b", "copy")
+	require.True(t, ok)
+	assert.Equal(t, Encryption{SSE: types.ServerSideEncryptionAwsKms, KMSKeyID: "alias/masters"}, enc)
+	assert.Equal(t, "data", get(t, c, "copy", ""))
+}
+
+func TestFaults(t *testing.T) {
+	ctx := context.Background()
+	c := New()
+	boom := errors.New("boom")
+	c.Inject(Fault{Op: "PutObject", Key: "blobs/", Err: boom, Times: 1})
+
+	_, err := c.PutObject(ctx, &s3.PutObjectInput{Bucket: aws.String("b"), Key: aws.String("blobs/1")})
+	assert.ErrorIs(t, err, boom)
+	// Other keys are unaffected and the fault is used up after one call.
+	put(t, c, "song", "")
+	put(t, c, "blobs/1", "")
+	assert.Equal(t, 3, c.Calls("PutObject"))
+
+	c.Inject(Fault{Delay: time.Hour})
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = c.HeadObject(cancelled, &s3.HeadObjectInput{Bucket: aws.String("b"), Key: aws.String("song")})
+	assert.ErrorIs(t, err, context.Canceled)
+
+	c.ClearFaults()
+	_, err = c.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String("b"), Key: aws.String("song")})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,332 @@
+// Package search is an in-memory full-text index of the tracks of the
+// service, searched by words, their prefixes and near misses of them.
+package search
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Document is what is indexed of a track.
+type Document struct {
+	// Key is the storage key of the upload.
+	Key         string
+	Name        string
+	Title       string
+	Artist      string
+	Album       string
+	AlbumArtist string
+	Genre       string
+}
+
+// Result is a document matching a query, scored by how well it does.
+type Result struct {
+	Key   string
+	Score float64
+}
+
+// Weights of the fields of a document, so that e.g. a word in the title
+// counts for more than one in the file name.
+const (
+	titleWeight  = 3
+	artistWeight = 2
+	albumWeight  = 1.5
+	otherWeight  = 1
+)
+
+// Scores of a word matching a term of a document, by how it matches.
+const (
+	exactScore  = 1
+	prefixScore = 0.5
+	fuzzyScore  = 0.6
+)
+
+// Limits of a query, as every word of it is compared with every term of
+// the index to find near misses of it.
+const (
+	// MaxQueryWords is how many words of a query are searched for.
+	MaxQueryWords = 8
+	// MaxWordLength is how many letters of a word are searched for.
+	MaxWordLength = 64
+)
+
+// Index is a full-text index of documents. It is safe for concurrent use.
+type Index struct {
+	mu sync.RWMutex
+	// postings maps terms to the weight they have in the documents they
+	// are in, by key.
+	postings map[string]map[string]float64
+	// terms are the keys of postings, sorted to find those with a prefix.
+	terms []string
+	// docs holds the terms of every document, to remove them again.
+	docs map[string][]string
+}
+
+// New returns an empty index.
+func New() *Index {
+	return &Index{postings: make(map[string]map[string]float64), docs: make(map[string][]string)}
+}
+
+// Len returns how many documents the index holds.
+func (x *Index) Len() int {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return len(x.docs)
+}
+
+// Add indexes doc, replacing the document with its key.
+func (x *Index) Add(doc Document) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.remove(doc.Key)
+	x.add(doc)
+}
+
+// Remove removes the document with key, if any.
+func (x *Index) Remove(key string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.remove(key)
+}
+
+// Reset replaces the documents of the index by docs.
+func (x *Index) Reset(docs []Document) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.postings = make(map[string]map[string]float64)
+	x.terms = nil
+	x.docs = make(map[string][]string, len(docs))
+	for _, doc := range docs {
+		x.remove(doc.Key)
+		x.add(doc)
+	}
+}
+
+func (x *Index) add(doc Document) {
+	weights := make(map[string]float64)
+	for _, field := range []struct {
+		text   string
+		weight float64
+	}{
+		{doc.Title, titleWeight},
+		{doc.Artist, artistWeight},
+		{doc.AlbumArtist, artistWeight},
+		{doc.Album, albumWeight},
+		{doc.Genre, otherWeight},
+		{doc.Name, otherWeight},
+	} {
+		for _, term := range Tokenize(field.text) {
+			weights[term] = max(weights[term], field.weight)
+		}
+	}
+
+	terms := make([]string, 0, len(weights))
+	for term, weight := range weights {
+		posting := x.postings[term]
+		if posting == nil {
+			posting = make(map[string]float64)
+			x.postings[term] = posting
+			i, _ := slices.BinarySearch(x.terms, term)
+			x.terms = slices.Insert(x.terms, i, term)
+		}
+		posting[doc.Key] = weight
+		terms = append(terms, term)
+	}
+	x.docs[doc.Key] = terms
+}
+
+func (x *Index) remove(key string) {
+	terms, ok := x.docs[key]
+	if !ok {
+		return
+	}
+	for _, term := range terms {
+		posting := x.postings[term]
+		delete(posting, key)
+		if len(posting) == 0 {
+			delete(x.postings, term)
+			if i, found := slices.BinarySearch(x.terms, term); found {
+				x.terms = slices.Delete(x.terms, i, i+1)
+			}
+		}
+	}
+	delete(x.docs, key)
+}
+
+// Search returns the documents matching every word of query, best first,
+// at most limit of them. Words match the terms of a document that equal
+// them, start with them, or, for words of four or more letters, are an
+// edit or two away from them. Only the first MaxQueryWords words of query
+// are searched for, each cut to MaxWordLength letters.
+func (x *Index) Search(query string, limit int) []Result {
+	words := Tokenize(query)
+	words = words[:min(len(words), MaxQueryWords)]
+	for i, word := range words {
+		if w := []rune(word); len(w) > MaxWordLength {
+			words[i] = string(w[:MaxWordLength])
+		}
+	}
+	slices.Sort(words)
+	words = slices.Compact(words)
+	if len(words) == 0 {
+		return nil
+	}
+
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	var scores map[string]float64
+	for _, word := range words {
+		matches := x.match(word)
+		if scores == nil {
+			scores = matches
+			continue
+		}
+		for key := range scores {
+			if score, ok := matches[key]; ok {
+				scores[key] += score
+			} else {
+				delete(scores, key)
+			}
+		}
+	}
+
+	results := make([]Result, 0, len(scores))
+	for key, score := range scores {
+		results = append(results, Result{Key: key, Score: score})
+	}
+	slices.SortFunc(results, func(a, b Result) int {
+		if c := cmp.Compare(b.Score, a.Score); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Key, b.Key)
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// match returns the best score of word in the documents it matches, by
+// key.
+func (x *Index) match(word string) map[string]float64 {
+	matches := make(map[string]float64)
+	add := func(term string, score float64) {
+		for key, weight := range x.postings[term] {
+			matches[key] = max(matches[key], score*weight)
+		}
+	}
+
+	// Terms with word as prefix follow word in sorted order; the longer
+	// their rest, the less they count.
+	i, _ := slices.BinarySearch(x.terms, word)
+	for _, term := range x.terms[i:] {
+		if !strings.HasPrefix(term, word) {
+			break
+		}
+		if term == word {
+			add(term, exactScore)
+		} else {
+			add(term, prefixScore+prefixScore*float64(len(word))/float64(len(term)))
+		}
+	}
+
+	distance := maxDistance(word)
+	if distance == 0 {
+		return matches
+	}
+	w := []rune(word)
+	for _, term := range x.terms {
+		t := []rune(term)
+		if abs(len(t)-len(w)) > distance || strings.HasPrefix(term, word) {
+			continue
+		}
+		if d := editDistance(w, t, distance); d <= distance {
+			add(term, fuzzyScore/float64(d))
+		}
+	}
+	return matches
+}
+
+// maxDistance returns how many edits a word may be away from a term to
+// match it: none for short words, which would match too much.
+func maxDistance(word string) int {
+	switch n := len([]rune(word)); {
+	case n >= 8:
+		return 2
+	case n >= 4:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// editDistance returns the optimal string alignment distance of a and b,
+// the number of insertions, deletions, substitutions and transpositions of
+// adjacent letters turning one into the other, or limit+1 once it exceeds
+// limit.
+func editDistance(a, b []rune, limit int) int {
+	prev2 := make([]int, len(b)+1)
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		best := cur[0]
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+			best = min(best, cur[j])
+		}
+		if best > limit {
+			return limit + 1
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(b)]
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// folds spells letters that do not decompose into a base letter and a
+// diacritic with plain letters.
+var folds = strings.NewReplacer(
+	"ß", "ss", "æ", "ae", "œ", "oe", "ø", "o", "đ", "d", "ð", "d",
+	"ł", "l", "þ", "th", "ı", "i",
+	// Apostrophes join the parts of words like "don't".
+	"'", "", "’", "",
+)
+
+// Tokenize splits text into the terms the index holds: runs of letters and
+// digits, lower-cased and with their diacritics removed, so "Beyoncé"
+// matches "beyonce".
+func Tokenize(text string) []string {
+	// Transformers keep state, so every call needs a chain of its own.
+	folder := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	folded, _, err := transform.String(folder, strings.ToLower(text))
+	if err != nil {
+		folded = strings.ToLower(text)
+	}
+	return strings.FieldsFunc(folds.Replace(folded), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
@@ -0,0 +1,68 @@
+package search
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func keys(results []Result) []string {
+	keys := make([]string, len(results))
+	for i, r := range results {
+		keys[i] = r.Key
+	}
+	return keys
+}
+
+func TestTokenize(t *testing.T) {
+	assert.Equal(t, []string{"beyonce", "halo", "live", "mp3"}, Tokenize("Beyoncé - Halo (Live).mp3"))
+	assert.Equal(t, []string{"motorhead", "strasse", "sigur", "ros", "dont"}, Tokenize("Motörhead STRAẞE Sigur_Rós Don’t"))
+	assert.Empty(t, Tokenize(" -- "))
+}
+
+func TestIndex_Search(t *testing.T) {
+	x := New()
+	x.Add(Document{Key: "a", Name: "halo.flac", Title: "Halo", Artist: "Beyoncé", Album: "I Am... Sasha Fierce"})
+	x.Add(Document{Key: "b", Name: "crazy.mp3", Title: "Crazy in Love", Artist: "Beyoncé", Genre: "R&B"})
+	x.Add(Document{Key: "c", Name: "beyond.wav", Title: "Beyond the Sea", Artist: "Bobby Darin"})
+	x.Add(Document{Key: "d", Name: "halo-demo.wav"})
+	assert.Equal(t, 4, x.Len())
+
+	// Titles count for more than file names.
+	assert.Equal(t, []string{"a", "d"}, keys(x.Search("halo", 0)))
+	// Diacritics are folded, and every word must match.
+	assert.Equal(t, []string{"a"}, keys(x.Search("beyonce halo", 0)))
+	// Words match terms they start, exact matches first.
+	assert.Equal(t, []string{"c", "a", "b"}, keys(x.Search("beyon", 0)))
+	// Longer words match with a typo or two.
+	assert.Equal(t, []string{"b"}, keys(x.Search("crzay lvoe", 0)))
+	assert.Equal(t, []string{"a", "b"}, keys(x.Search("beyoncee", 0)))
+	assert.Empty(t, x.Search("cat", 0))
+	assert.Empty(t, x.Search("", 0))
+	assert.Len(t, x.Search("b", 1), 1)
+	// Words beyond the limits of a query are left out.
+	assert.Equal(t, []string{"a"}, keys(x.Search("halo beyonce sasha fierce i am halo halo cat", 0)))
+	x.Add(Document{Key: "long", Title: strings.Repeat("a", MaxWordLength)})
+	assert.Equal(t, []string{"long"}, keys(x.Search(strings.Repeat("a", 2*MaxWordLength), 0)))
+	x.Remove("long")
+
+	// Replacing a document drops its old terms.
+	x.Add(Document{Key: "a", Title: "Single Ladies", Artist: "Beyoncé"})
+	assert.Equal(t, []string{"d"}, keys(x.Search("halo", 0)))
+	x.Remove("a")
+	x.Remove("a")
+	assert.Empty(t, x.Search("ladies", 0))
+	assert.Equal(t, 3, x.Len())
+
+	x.Reset([]Document{{Key: "e", Title: "Halo"}})
+	assert.Equal(t, []string{"e"}, keys(x.Search("halo", 0)))
+	assert.Equal(t, 1, x.Len())
+}
+
+func TestEditDistance(t *testing.T) {
+	assert.Equal(t, 0, editDistance([]rune("love"), []rune("love"), 2))
+	assert.Equal(t, 1, editDistance([]rune("lvoe"), []rune("love"), 2))
+	assert.Equal(t, 2, editDistance([]rune("kitten"), []rune("sittin"), 2))
+	assert.Equal(t, 2, editDistance([]rune("abcdef"), []rune("uvwxyz"), 1))
+}
@@ -0,0 +1,149 @@
+// Package server wires the uploader and the policies in front of it into the
+// service's HTTP handler.
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+
+	"music-streaming/backend/internal/cors"
+	"music-streaming/backend/internal/identity"
+	"music-streaming/backend/internal/ratelimit"
+	"music-streaming/backend/internal/throttle"
+	"music-streaming/backend/internal/uploader"
+)
+
+// Config holds the policies applied to requests before they reach the
+// uploader.
+type Config struct {
+	CORS      cors.Config
+	RateLimit ratelimit.Config
+	Throttle  throttle.Config
+	// Resolver identifies clients for rate limiting and throttling.
+	Resolver identity.Resolver
+}
+
+// ConfigFromEnv reads the configuration of every policy from environment
+// variables.
+func ConfigFromEnv() (Config, error) {
+	throttleConfig, err := throttle.ConfigFromEnv()
+	if err != nil {
+		return Config{}, err
+	}
+	resolver, err := identity.NewResolverFromEnv(uploader.RespectForwardedHeaders)
+	if err != nil {
+		return Config{}, err
+	}
+	return Config{
+		CORS:      cors.ConfigFromEnv(),
+		RateLimit: ratelimit.ConfigFromEnv(),
+		Throttle:  throttleConfig,
+		Resolver:  resolver,
+	}, nil
+}
+
+// New returns the handler serving app. Metrics are registered with and
+// exposed from registry.
+func New(app *uploader.App, cfg Config, registry *prometheus.Registry) (http.Handler, error) {
+	mux := http.NewServeMux()
+
+	// Just a simple health check on root
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+	})
+
+	// Wrap the uploader handler to support GET for listing and downloads
+	filesHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Specific check for the listing endpoint
+		if r.Method == http.MethodGet && r.URL.Path == "/files/" {
+			app.ListFilesHandler(w, r)
+			return
+		}
+		if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/waveform") {
+			app.WaveformHandler(w, r)
+			return
+		}
+		if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/duplicates") {
+			app.DuplicatesHandler(w, r)
+			return
+		}
+		// Downloads go through the storage backend rather than tusd
+		if r.Method == http.MethodGet {
+			app.DownloadHandler(w, r)
+			return
+		}
+
+		// Fallback to Tus handler for everything else
+		app.TusHandler.ServeHTTP(w, r)
+	})
+
+	corsPolicy := cors.New(cfg.CORS)
+	limiter := ratelimit.New(cfg.RateLimit, cfg.Resolver)
+	throttler := throttle.New(cfg.Throttle, cfg.Resolver)
+	if err := registry.Register(throttler); err != nil {
+		return nil, err
+	}
+
+	mux.Handle("/files/", corsPolicy.Handler(limiter.Handler(throttler.Handler(filesHandler))))
+	// HLS playlists and segments are fetched by players in the browser, so
+	// preflight requests reach the CORS policy too.
+	mux.Handle("/hls/", corsPolicy.Handler(limiter.Handler(http.HandlerFunc(app.HLSHandler))))
+	mux.Handle("/tracks/", corsPolicy.Handler(limiter.Handler(http.HandlerFunc(app.TracksHandler))))
+	mux.Handle("/search", corsPolicy.Handler(limiter.Handler(http.HandlerFunc(app.SearchHandler))))
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+	return Tracing(mux), nil
+}
+
+// NewRegistry returns a metrics registry with the Go runtime and process
+// collectors the default registry has.
+func NewRegistry() *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return registry
+}
+
+// Tracing starts a server span for every incoming request, continuing any
+// W3C trace context sent by the client.
+func Tracing(next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, "http.server",
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return r.Method + " " + routeOf(r)
+		}),
+		otelhttp.WithFilter(func(r *http.Request) bool {
+			return r.URL.Path != "/health" && r.URL.Path != "/metrics"
+		}),
+	)
+}
+
+// routeOf collapses upload IDs so span names stay low-cardinality.
+func routeOf(r *http.Request) string {
+	if strings.HasPrefix(r.URL.Path, "/files/") && strings.HasSuffix(r.URL.Path, "/waveform") {
+		return "/files/{id}/waveform"
+	}
+	if strings.HasPrefix(r.URL.Path, "/files/") && strings.HasSuffix(r.URL.Path, "/duplicates") {
+		return "/files/{id}/duplicates"
+	}
+	if strings.HasPrefix(r.URL.Path, "/files/") && r.URL.Path != "/files/" {
+		return "/files/{id}"
+	}
+	if strings.HasPrefix(r.URL.Path, "/hls/") {
+		return "/hls/{id}/{file}"
+	}
+	if strings.HasPrefix(r.URL.Path, "/tracks/") && strings.HasSuffix(r.URL.Path, "/history") {
+		return "/tracks/{id}/history"
+	}
+	if strings.HasPrefix(r.URL.Path, "/tracks/") {
+		return "/tracks/{id}"
+	}
+	return r.URL.Path
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"music-streaming/backend/internal/catalog"
+	"music-streaming/backend/internal/storage"
+	"music-streaming/backend/internal/uploader"
+)
+
+func newTestHandler(t *testing.T) http.Handler {
+	store, err := storage.NewFile(t.TempDir())
+	require.NoError(t, err)
+	cfg, err := ConfigFromEnv()
+	require.NoError(t, err)
+	tusHandler, err := uploader.NewTusHandler(store, cfg.Resolver)
+	require.NoError(t, err)
+	cat, err := catalog.Open(":memory:")
+	require.NoError(t, err)
+	t.Cleanup(func() { cat.Close() })
+	handler, err := New(&uploader.App{TusHandler: tusHandler, Store: store, Catalog: cat}, cfg, NewRegistry())
+	require.NoError(t, err)
+	return handler
+}
+
+func TestNew_Routes(t *testing.T) {
+	handler := newTestHandler(t)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/health", nil))
+	assert.Equal(t, "OK", rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/files/", nil))
+	assert.JSONEq(t, `[]`, rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/files/missing", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	req := httptest.NewRequest("POST", "/files/", nil)
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	req.Header.Set("Upload-Length", "4")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	location := rr.Header().Get("Location")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", location[strings.Index(location, "/files/"):]+"/waveform", nil))
+	assert.Contains(t, rr.Body.String(), "ERR_WAVEFORM_NOT_FOUND")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", location[strings.Index(location, "/files/"):]+"/duplicates", nil))
+	assert.Contains(t, rr.Body.String(), "ERR_FINGERPRINT_NOT_FOUND")
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/hls/missing/master.m3u8", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/tracks/missing", nil))
+	assert.Contains(t, rr.Body.String(), "ERR_TRACK_NOT_FOUND")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/search?q=song", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, "[]", rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	assert.True(t, strings.Contains(rr.Body.String(), "go_goroutines"))
+}
+
+func TestNew_CrossOriginCreationWithUpload(t *testing.T) {
+	handler := newTestHandler(t)
+
+	req := httptest.NewRequest("POST", "/files/", strings.NewReader("data"))
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	req.Header.Set("Upload-Length", "4")
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	// The browser needs to read where the upload went and how much of it
+	// was stored.
+	require.Equal(t, http.StatusCreated, rr.Code)
+	assert.Equal(t, "4", rr.Header().Get("Upload-Offset"))
+	assert.NotEmpty(t, rr.Header().Get("Location"))
+	exposed := rr.Header().Get("Access-Control-Expose-Headers")
+	assert.Contains(t, exposed, "Upload-Offset")
+	assert.Contains(t, exposed, "Location")
+}
+
+func TestRouteOf(t *testing.T) {
+	assert.Equal(t, "/files/", routeOf(httptest.NewRequest("GET", "/files/", nil)))
+	assert.Equal(t, "/files/{id}", routeOf(httptest.NewRequest("PATCH", "/files/abc+def", nil)))
+	assert.Equal(t, "/files/{id}/waveform", routeOf(httptest.NewRequest("GET", "/files/abc+def/waveform", nil)))
+	assert.Equal(t, "/files/{id}/duplicates", routeOf(httptest.NewRequest("GET", "/files/abc+def/duplicates", nil)))
+	assert.Equal(t, "/health", routeOf(httptest.NewRequest("GET", "/health", nil)))
+	assert.Equal(t, "/hls/{id}/{file}", routeOf(httptest.NewRequest("GET", "/hls/abc/aac-128k/segment00000.ts", nil)))
+	assert.Equal(t, "/tracks/{id}", routeOf(httptest.NewRequest("PATCH", "/tracks/abc", nil)))
+	assert.Equal(t, "/tracks/{id}/history", routeOf(httptest.NewRequest("GET", "/tracks/abc/history", nil)))
+}
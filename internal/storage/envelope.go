@@ -0,0 +1,825 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/tus/tusd/v2/pkg/handler"
+)
+
+// MetadataEnvelopeKey is the upload metadata key under which Envelope keeps
+// the wrapped data key of an upload in its .info. It is never shown to
+// clients.
+const MetadataEnvelopeKey = "envelope_key"
+
+const (
+	// envelopeChunkSize is how much plaintext each encrypted chunk holds.
+	envelopeChunkSize = 64 << 10
+	// envelopeSealedChunkSize is the size of a full chunk once encrypted,
+	// which adds a GCM tag.
+	envelopeSealedChunkSize = envelopeChunkSize + 16
+)
+
+// Envelope encrypts the data of every upload before it reaches the store
+// it wraps. Each upload gets a data key of its own, used with AES-GCM on
+// chunks of 64 KiB so that any range can be decrypted by reading only the
+// chunks covering it. The data key is wrapped with a master key and kept in
+// the upload's .info, or in a .key object next to copies of the data.
+//
+// Clients see plaintext everywhere: sizes, offsets and .info objects are
+// translated on the way through. Data still arriving in a chunk that is not
+// complete waits, encrypted, in a .tail object. Data objects put directly,
+// like renditions, HLS segments and blobs with rewritten tags, are
+// encrypted the same way, with a data key of their own kept in a .key
+// object. Only .info and .refs objects are stored as given.
+//
+// Concatenation is not supported, as the parts would be encrypted with
+// different keys.
+type Envelope struct {
+	Inner  Store
+	master cipher.AEAD
+}
+
+// linkingEnvelope is an Envelope on a store that can link objects.
+type linkingEnvelope struct {
+	*Envelope
+}
+
+// NewEnvelope creates a store encrypting uploads to inner with data keys
+// wrapped by the 256-bit masterKey. The store links objects if inner does.
+func NewEnvelope(inner Store, masterKey []byte) (Store, error) {
+	if len(masterKey) != 32 {
+		return nil, fmt.Errorf("master key has %d bytes, want 32", len(masterKey))
+	}
+	master, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	e := &Envelope{Inner: inner, master: master}
+	if _, ok := inner.(Linker); ok {
+		return linkingEnvelope{e}, nil
+	}
+	return e, nil
+}
+
+// LoadMasterKey reads a base64 encoded master key from a file.
+func LoadMasterKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid master key in %s: %w", path, err)
+	}
+	return key, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// newDataKey returns a fresh data key, along with its wrapped form.
+func (e *Envelope) newDataKey() (cipher.AEAD, string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, "", err
+	}
+	nonce := make([]byte, e.master.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, "", err
+	}
+	wrapped := e.master.Seal(nonce, nonce, key, nil)
+	aead, err := newGCM(key)
+	return aead, base64.StdEncoding.EncodeToString(wrapped), err
+}
+
+func (e *Envelope) unwrapKey(wrapped string) (cipher.AEAD, error) {
+	data, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil || len(data) < e.master.NonceSize() {
+		return nil, errors.New("envelope: malformed data key")
+	}
+	nonceSize := e.master.NonceSize()
+	key, err := e.master.Open(nil, data[:nonceSize], data[nonceSize:], nil)
+	if err != nil {
+		return nil, errors.New("envelope: data key does not match the master key")
+	}
+	return newGCM(key)
+}
+
+// chunkNonce is the nonce of the chunk at index. Nonces never repeat for a
+// data key, as every upload has its own.
+func chunkNonce(index int64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], uint64(index))
+	return nonce
+}
+
+// sealedSize is the size of size bytes of plaintext once encrypted.
+func sealedSize(size int64) int64 {
+	chunks := (size + envelopeChunkSize - 1) / envelopeChunkSize
+	return size + chunks*(envelopeSealedChunkSize-envelopeChunkSize)
+}
+
+// openedSize is the size of the plaintext of size bytes of whole chunks.
+func openedSize(size int64) int64 {
+	chunks := (size + envelopeSealedChunkSize - 1) / envelopeSealedChunkSize
+	return size - chunks*(envelopeSealedChunkSize-envelopeChunkSize)
+}
+
+// holdsData reports whether key may be an encrypted data object rather than
+// one of the objects kept next to it.
+func holdsData(key string) bool {
+	for _, suffix := range []string{".info", ".part", ".refs", ".key", ".tail"} {
+		if strings.HasSuffix(key, suffix) {
+			return false
+		}
+	}
+	return true
+}
+
+// readInfo reads the .info of the upload stored under key as written.
+func (e *Envelope) readInfo(ctx context.Context, key string) (handler.FileInfo, error) {
+	var info handler.FileInfo
+	data, err := ReadAll(ctx, e.Inner, key+".info")
+	if err != nil {
+		return info, err
+	}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return info, fmt.Errorf("%s.info: %w", key, err)
+	}
+	return info, nil
+}
+
+// wrappedKey returns the wrapped data key of the object under key. A .key
+// object takes precedence over the .info, as copies and links replace the
+// data of an upload with that of another. An empty key means the object
+// is not encrypted.
+func (e *Envelope) wrappedKey(ctx context.Context, key string) (string, error) {
+	if !holdsData(key) {
+		return "", nil
+	}
+	data, err := ReadAll(ctx, e.Inner, key+".key")
+	if err == nil {
+		return string(data), nil
+	}
+	if !IsNotFound(err) {
+		return "", err
+	}
+	info, err := e.readInfo(ctx, key)
+	if IsNotFound(err) {
+		return "", nil
+	}
+	return info.MetaData[MetadataEnvelopeKey], err
+}
+
+// dataKey returns the data key of the object under key, or nil if it is not
+// encrypted.
+func (e *Envelope) dataKey(ctx context.Context, key string) (cipher.AEAD, error) {
+	wrapped, err := e.wrappedKey(ctx, key)
+	if err != nil || wrapped == "" {
+		return nil, err
+	}
+	return e.unwrapKey(wrapped)
+}
+
+// List reports plaintext sizes and hides the objects Envelope keeps next to
+// the data. Uploads are told apart from unencrypted objects by their .info,
+// which is read for every upload listed.
+func (e *Envelope) List(ctx context.Context, prefix string) ([]Object, error) {
+	objects, err := e.Inner.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	exists := make(map[string]bool, len(objects))
+	for _, obj := range objects {
+		exists[obj.Key] = true
+	}
+
+	listed := objects[:0]
+	for _, obj := range objects {
+		if strings.HasSuffix(obj.Key, ".key") || strings.HasSuffix(obj.Key, ".tail") {
+			continue
+		}
+		encrypted := false
+		if holdsData(obj.Key) && exists[obj.Key+".key"] {
+			encrypted = true
+		} else if holdsData(obj.Key) && exists[obj.Key+".info"] {
+			info, err := e.readInfo(ctx, obj.Key)
+			if err != nil && !IsNotFound(err) {
+				return nil, err
+			}
+			encrypted = info.MetaData[MetadataEnvelopeKey] != ""
+		}
+		if encrypted {
+			obj.Size = openedSize(obj.Size)
+		}
+		listed = append(listed, obj)
+	}
+	return listed, nil
+}
+
+func (e *Envelope) Stat(ctx context.Context, key string) (Object, error) {
+	obj, err := e.Inner.Stat(ctx, key)
+	if err != nil {
+		return obj, err
+	}
+	wrapped, err := e.wrappedKey(ctx, key)
+	if err != nil {
+		return obj, err
+	}
+	if wrapped != "" {
+		obj.Size = openedSize(obj.Size)
+	}
+	return obj, nil
+}
+
+// Open decrypts encrypted objects, reading only the chunks covering the
+// requested range. A .info is returned with plaintext sizes and without the
+// data key.
+func (e *Envelope) Open(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	if strings.HasSuffix(key, ".info") && offset == 0 && length < 0 {
+		data, err := ReadAll(ctx, e.Inner, key)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(openInfo(data))), nil
+	}
+
+	aead, err := e.dataKey(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if aead == nil {
+		return e.Inner.Open(ctx, key, offset, length)
+	}
+	if length == 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+
+	first := offset / envelopeChunkSize
+	sealedLength := int64(-1)
+	if length > 0 {
+		last := (offset + length - 1) / envelopeChunkSize
+		sealedLength = (last - first + 1) * envelopeSealedChunkSize
+	}
+	body, err := e.Inner.Open(ctx, key, first*envelopeSealedChunkSize, sealedLength)
+	if err != nil {
+		return nil, err
+	}
+	return &openingReader{
+		body:      body,
+		aead:      aead,
+		index:     first,
+		skip:      offset - first*envelopeChunkSize,
+		remaining: length,
+	}, nil
+}
+
+// openInfo turns a .info as written into the form clients see.
+func openInfo(data []byte) []byte {
+	var info handler.FileInfo
+	if err := json.Unmarshal(data, &info); err != nil || info.MetaData[MetadataEnvelopeKey] == "" {
+		return data
+	}
+	if !info.SizeIsDeferred {
+		info.Size = openedSize(info.Size)
+	}
+	delete(info.MetaData, MetadataEnvelopeKey)
+	opened, err := json.Marshal(info)
+	if err != nil {
+		return data
+	}
+	return opened
+}
+
+// Put encrypts data objects under a new data key, which is stored first so
+// that the object is never read without it. The .info of encrypted
+// uploads keeps the data key of the .info it replaces.
+func (e *Envelope) Put(ctx context.Context, key string, body io.Reader, size int64) error {
+	if strings.HasSuffix(key, ".info") {
+		return e.putInfo(ctx, key, body, size)
+	}
+	if !holdsData(key) {
+		return e.Inner.Put(ctx, key, body, size)
+	}
+	aead, wrapped, err := e.newDataKey()
+	if err != nil {
+		return err
+	}
+	if err := e.Inner.Put(ctx, key+".key", strings.NewReader(wrapped), int64(len(wrapped))); err != nil {
+		return err
+	}
+	return e.Inner.Put(ctx, key, &sealingReader{src: io.LimitReader(body, size), aead: aead}, sealedSize(size))
+}
+
+func (e *Envelope) putInfo(ctx context.Context, key string, body io.Reader, size int64) error {
+	data, err := io.ReadAll(io.LimitReader(body, size))
+	if err != nil {
+		return err
+	}
+	var info handler.FileInfo
+	if json.Unmarshal(data, &info) == nil {
+		previous, err := e.readInfo(ctx, strings.TrimSuffix(key, ".info"))
+		if err != nil && !IsNotFound(err) {
+			return err
+		}
+		if wrapped := previous.MetaData[MetadataEnvelopeKey]; wrapped != "" {
+			if info.MetaData == nil {
+				info.MetaData = make(handler.MetaData)
+			}
+			info.MetaData[MetadataEnvelopeKey] = wrapped
+			if !info.SizeIsDeferred {
+				info.Size = sealedSize(info.Size)
+			}
+			if data, err = json.Marshal(info); err != nil {
+				return err
+			}
+		}
+	}
+	return e.Inner.Put(ctx, key, bytes.NewReader(data), int64(len(data)))
+}
+
+// Copy copies the encrypted data along with its wrapped data key.
+func (e *Envelope) Copy(ctx context.Context, dst, src string) error {
+	if err := e.Inner.Copy(ctx, dst, src); err != nil {
+		return err
+	}
+	return e.copyKey(ctx, dst, src)
+}
+
+func (e linkingEnvelope) Link(ctx context.Context, dst, src string) error {
+	if err := e.Inner.(Linker).Link(ctx, dst, src); err != nil {
+		return err
+	}
+	return e.copyKey(ctx, dst, src)
+}
+
+func (e *Envelope) copyKey(ctx context.Context, dst, src string) error {
+	wrapped, err := e.wrappedKey(ctx, src)
+	if err != nil {
+		return err
+	}
+	if wrapped == "" {
+		return e.Inner.Delete(ctx, dst+".key")
+	}
+	return e.Inner.Put(ctx, dst+".key", strings.NewReader(wrapped), int64(len(wrapped)))
+}
+
+// Delete removes the objects along with those Envelope keeps next to them.
+func (e *Envelope) Delete(ctx context.Context, keys ...string) error {
+	all := make([]string, 0, 3*len(keys))
+	for _, key := range keys {
+		all = append(all, key)
+		if holdsData(key) {
+			all = append(all, key+".key", key+".tail")
+		}
+	}
+	return e.Inner.Delete(ctx, all...)
+}
+
+// sealingReader encrypts src chunk by chunk.
+type sealingReader struct {
+	src    io.Reader
+	aead   cipher.AEAD
+	index  int64
+	plain  []byte
+	sealed []byte
+	done   bool
+}
+
+func (r *sealingReader) Read(p []byte) (int, error) {
+	for len(r.sealed) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if r.plain == nil {
+			r.plain = make([]byte, envelopeChunkSize)
+		}
+		n, err := io.ReadFull(r.src, r.plain)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			r.done = true
+		} else if err != nil {
+			return 0, err
+		}
+		if n > 0 {
+			r.sealed = r.aead.Seal(r.sealed[:0], chunkNonce(r.index), r.plain[:n], nil)
+			r.index++
+		}
+	}
+	n := copy(p, r.sealed)
+	r.sealed = r.sealed[n:]
+	return n, nil
+}
+
+// openingReader decrypts a run of chunks starting at index, dropping the
+// first skip bytes of plaintext and stopping after remaining bytes, unless
+// remaining is negative.
+type openingReader struct {
+	body      io.ReadCloser
+	aead      cipher.AEAD
+	index     int64
+	skip      int64
+	remaining int64
+	sealed    []byte
+	plain     []byte
+}
+
+func (r *openingReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.remaining == 0 {
+			return 0, io.EOF
+		}
+		if r.sealed == nil {
+			r.sealed = make([]byte, envelopeSealedChunkSize)
+		}
+		n, err := io.ReadFull(r.body, r.sealed)
+		if n == 0 && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+			if r.remaining > 0 {
+				return 0, io.ErrUnexpectedEOF
+			}
+			return 0, io.EOF
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		plain, err := r.aead.Open(r.sealed[:0:0], chunkNonce(r.index), r.sealed[:n], nil)
+		if err != nil {
+			return 0, fmt.Errorf("envelope: chunk %d cannot be decrypted: %w", r.index, err)
+		}
+		r.index++
+		skip := min(r.skip, int64(len(plain)))
+		plain, r.skip = plain[skip:], r.skip-skip
+		if r.remaining >= 0 && int64(len(plain)) > r.remaining {
+			plain = plain[:r.remaining]
+		}
+		r.plain = plain
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	if r.remaining > 0 {
+		r.remaining -= int64(n)
+	}
+	return n, nil
+}
+
+func (r *openingReader) Close() error {
+	return r.body.Close()
+}
+
+// UseIn registers the inner store's tus data store behind one encrypting
+// uploads. Concatenation is left out.
+func (e *Envelope) UseIn(composer *handler.StoreComposer) {
+	inner := handler.NewStoreComposer()
+	e.Inner.UseIn(inner)
+	store := envelopeStore{e: e, inner: inner}
+	composer.UseCore(store)
+	if inner.UsesTerminater {
+		composer.UseTerminater(store)
+	}
+	if inner.UsesLengthDeferrer {
+		composer.UseLengthDeferrer(store)
+	}
+	if inner.UsesLocker {
+		composer.UseLocker(inner.Locker)
+	}
+}
+
+type envelopeStore struct {
+	e     *Envelope
+	inner *handler.StoreComposer
+}
+
+func (store envelopeStore) NewUpload(ctx context.Context, info handler.FileInfo) (handler.Upload, error) {
+	if info.IsPartial || info.IsFinal {
+		return nil, handler.ErrNotImplemented
+	}
+	aead, wrapped, err := store.e.newDataKey()
+	if err != nil {
+		return nil, err
+	}
+	metadata := make(handler.MetaData, len(info.MetaData)+1)
+	for key, value := range info.MetaData {
+		metadata[key] = value
+	}
+	metadata[MetadataEnvelopeKey] = wrapped
+	info.MetaData = metadata
+	if !info.SizeIsDeferred {
+		info.Size = sealedSize(info.Size)
+	}
+
+	upload, err := store.inner.Core.NewUpload(ctx, info)
+	if err != nil {
+		return nil, err
+	}
+	return &envelopeUpload{store: store, inner: upload, aead: aead}, nil
+}
+
+// GetUpload returns uploads created before encryption was turned on as
+// they are.
+func (store envelopeStore) GetUpload(ctx context.Context, id string) (handler.Upload, error) {
+	upload, err := store.inner.Core.GetUpload(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	info, err := upload.GetInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	wrapped := info.MetaData[MetadataEnvelopeKey]
+	if wrapped == "" {
+		return upload, nil
+	}
+	aead, err := store.e.unwrapKey(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return &envelopeUpload{store: store, inner: upload, aead: aead}, nil
+}
+
+func (store envelopeStore) AsTerminatableUpload(upload handler.Upload) handler.TerminatableUpload {
+	if u, ok := upload.(*envelopeUpload); ok {
+		return u
+	}
+	return store.inner.Terminater.AsTerminatableUpload(upload)
+}
+
+func (store envelopeStore) AsLengthDeclarableUpload(upload handler.Upload) handler.LengthDeclarableUpload {
+	if u, ok := upload.(*envelopeUpload); ok {
+		return u
+	}
+	return store.inner.LengthDeferrer.AsLengthDeclarableUpload(upload)
+}
+
+// envelopeUpload encrypts the data written to an upload of the inner store.
+// The inner upload only ever receives whole chunks, plus the last one once
+// the upload's length is known, so its offset stays chunk aligned. The
+// plaintext of a chunk still being received is kept in the .tail object.
+type envelopeUpload struct {
+	store envelopeStore
+	inner handler.Upload
+	aead  cipher.AEAD
+
+	// loaded is set once info and tail have been read for this request.
+	loaded bool
+	info   handler.FileInfo
+	tail   []byte
+}
+
+// tail is the stored form of the plaintext of an incomplete chunk.
+type tail struct {
+	Index int64  `json:"index"`
+	Data  []byte `json:"data"`
+}
+
+func (u *envelopeUpload) key() string {
+	if key := u.info.Storage["Key"]; key != "" {
+		return key
+	}
+	key, _, _ := strings.Cut(u.info.ID, "+")
+	return key
+}
+
+func (u *envelopeUpload) load(ctx context.Context) error {
+	if u.loaded {
+		return nil
+	}
+	info, err := u.inner.GetInfo(ctx)
+	if err != nil {
+		return err
+	}
+	u.info, u.tail = info, nil
+	if info.Offset%envelopeSealedChunkSize == 0 {
+		if u.tail, err = u.readTail(ctx, info.Offset/envelopeSealedChunkSize); err != nil {
+			return err
+		}
+	}
+	u.loaded = true
+	return nil
+}
+
+// readTail returns the stored plaintext of the chunk at index. A tail of
+// another chunk is left over from a failed write and ignored.
+func (u *envelopeUpload) readTail(ctx context.Context, index int64) ([]byte, error) {
+	data, err := ReadAll(ctx, u.store.e.Inner, u.key()+".tail")
+	if IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	nonceSize := u.aead.NonceSize()
+	if len(data) < nonceSize {
+		return nil, errors.New("envelope: malformed tail")
+	}
+	plain, err := u.aead.Open(nil, data[:nonceSize], data[nonceSize:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("envelope: tail cannot be decrypted: %w", err)
+	}
+	var t tail
+	if err := json.Unmarshal(plain, &t); err != nil {
+		return nil, fmt.Errorf("envelope: malformed tail: %w", err)
+	}
+	if t.Index != index {
+		return nil, nil
+	}
+	return t.Data, nil
+}
+
+// saveTail stores the plaintext of the incomplete chunk at index, under a
+// random nonce as it changes with every write.
+func (u *envelopeUpload) saveTail(ctx context.Context, index int64, data []byte) error {
+	key := u.key() + ".tail"
+	if len(data) == 0 {
+		return u.store.e.Inner.Delete(ctx, key)
+	}
+	plain, err := json.Marshal(tail{Index: index, Data: data})
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, u.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := u.aead.Seal(nonce, nonce, plain, nil)
+	return u.store.e.Inner.Put(ctx, key, bytes.NewReader(sealed), int64(len(sealed)))
+}
+
+// offset is the plaintext offset of the upload. A partly written chunk,
+// left by a failed write to the inner store, is not counted; the client
+// sends it again and the part already stored is skipped.
+func (u *envelopeUpload) offset() int64 {
+	if !u.info.SizeIsDeferred && u.info.Offset == u.info.Size {
+		return openedSize(u.info.Size)
+	}
+	return u.info.Offset/envelopeSealedChunkSize*envelopeChunkSize + int64(len(u.tail))
+}
+
+func (u *envelopeUpload) GetInfo(ctx context.Context) (handler.FileInfo, error) {
+	if err := u.load(ctx); err != nil {
+		return handler.FileInfo{}, err
+	}
+	info := u.info
+	if !info.SizeIsDeferred {
+		info.Size = openedSize(info.Size)
+	}
+	info.Offset = u.offset()
+	info.MetaData = make(handler.MetaData, len(u.info.MetaData))
+	for key, value := range u.info.MetaData {
+		if key != MetadataEnvelopeKey {
+			info.MetaData[key] = value
+		}
+	}
+	return info, nil
+}
+
+// WriteChunk encrypts src chunk by chunk, passing every completed chunk on
+// to the inner upload. What is left of an incomplete chunk becomes the new
+// tail.
+func (u *envelopeUpload) WriteChunk(ctx context.Context, offset int64, src io.Reader) (int64, error) {
+	if err := u.load(ctx); err != nil {
+		return 0, err
+	}
+	start := u.info.Offset
+	index := start / envelopeSealedChunkSize
+	// Bytes of the current chunk already stored by a failed write.
+	stored := start - index*envelopeSealedChunkSize
+	size := int64(-1)
+	if !u.info.SizeIsDeferred {
+		size = openedSize(u.info.Size)
+	}
+
+	pr, pw := io.Pipe()
+	var (
+		read    int64
+		sealed  int64
+		pending []byte
+		srcErr  error
+		done    = make(chan struct{})
+	)
+	go func() {
+		defer close(done)
+		chunk := make([]byte, envelopeChunkSize)
+		n := copy(chunk, u.tail)
+		for {
+			m, err := io.ReadFull(src, chunk[n:])
+			n += m
+			read += int64(m)
+			last := size >= 0 && index*envelopeChunkSize+int64(n) == size
+			if n == envelopeChunkSize || (last && n > 0) {
+				out := u.aead.Seal(nil, chunkNonce(index), chunk[:n], nil)
+				if stored < int64(len(out)) {
+					if _, err := pw.Write(out[stored:]); err != nil {
+						return
+					}
+					sealed += int64(len(out)) - stored
+				}
+				index, n, stored = index+1, 0, 0
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF || last {
+				break
+			}
+			if err != nil {
+				srcErr = err
+				break
+			}
+		}
+		pending = bytes.Clone(chunk[:n])
+		pw.Close()
+	}()
+
+	written, err := u.inner.WriteChunk(ctx, start, pr)
+	pr.CloseWithError(io.ErrClosedPipe)
+	<-done
+
+	if err == nil && written == sealed {
+		u.info.Offset = start + written
+		u.tail = pending
+		if err := u.saveTail(ctx, index, pending); err != nil {
+			return 0, err
+		}
+		return read, srcErr
+	}
+	if err == nil {
+		err = fmt.Errorf("envelope: inner store took %d of %d bytes", written, sealed)
+	}
+	if written == 0 {
+		return 0, err
+	}
+	// The inner store may have stopped within a chunk, so the tail is
+	// dropped and the client resumes from the last complete chunk.
+	u.info.Offset = start + written
+	u.tail = nil
+	if err := u.saveTail(ctx, 0, nil); err != nil {
+		return 0, err
+	}
+	return max(0, u.offset()-offset), err
+}
+
+// GetReader decrypts the finished upload.
+func (u *envelopeUpload) GetReader(ctx context.Context) (io.ReadCloser, error) {
+	body, err := u.inner.GetReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &openingReader{body: body, aead: u.aead, remaining: -1}, nil
+}
+
+// FinishUpload stores the tail as the last chunk. Uploads with a deferred
+// length end up here with one once their length has been declared.
+func (u *envelopeUpload) FinishUpload(ctx context.Context) error {
+	if err := u.load(ctx); err != nil {
+		return err
+	}
+	if len(u.tail) > 0 {
+		index := u.info.Offset / envelopeSealedChunkSize
+		out := u.aead.Seal(nil, chunkNonce(index), u.tail, nil)
+		written, err := u.inner.WriteChunk(ctx, u.info.Offset, bytes.NewReader(out))
+		if err != nil {
+			return err
+		}
+		u.info.Offset += written
+		u.tail = nil
+		if err := u.saveTail(ctx, 0, nil); err != nil {
+			return err
+		}
+	}
+	return u.inner.FinishUpload(ctx)
+}
+
+func (u *envelopeUpload) Terminate(ctx context.Context) error {
+	if err := u.load(ctx); err != nil {
+		return err
+	}
+	if err := u.store.inner.Terminater.AsTerminatableUpload(u.inner).Terminate(ctx); err != nil {
+		return err
+	}
+	return u.store.e.Inner.Delete(ctx, u.key()+".tail", u.key()+".key")
+}
+
+func (u *envelopeUpload) DeclareLength(ctx context.Context, length int64) error {
+	if err := u.load(ctx); err != nil {
+		return err
+	}
+	declarable := u.store.inner.LengthDeferrer.AsLengthDeclarableUpload(u.inner)
+	if err := declarable.DeclareLength(ctx, sealedSize(length)); err != nil {
+		return err
+	}
+	u.info.Size, u.info.SizeIsDeferred = sealedSize(length), false
+	return nil
+}
@@ -0,0 +1,343 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tus/tusd/v2/pkg/handler"
+
+	"music-streaming/backend/internal/s3fake"
+)
+
+func newTestEnvelope(t *testing.T, inner Store) Store {
+	store, err := NewEnvelope(inner, bytes.Repeat([]byte{7}, 32))
+	require.NoError(t, err)
+	return store
+}
+
+// testData returns size bytes that differ from chunk to chunk.
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7 / 3)
+	}
+	return data
+}
+
+// uploadInChunks uploads data through the store's tus data store in writes
+// of at most chunk bytes, each on a freshly fetched upload like the tus
+// handler does. It returns the object key of the upload.
+func uploadInChunks(t *testing.T, store Store, data []byte, chunk int) string {
+	ctx := context.Background()
+	composer := handler.NewStoreComposer()
+	store.UseIn(composer)
+	upload, err := composer.Core.NewUpload(ctx, handler.FileInfo{Size: int64(len(data)), MetaData: handler.MetaData{"filename": "song.flac"}})
+	require.NoError(t, err)
+	info, err := upload.GetInfo(ctx)
+	require.NoError(t, err)
+
+	for offset := 0; offset < len(data); {
+		upload, err = composer.Core.GetUpload(ctx, info.ID)
+		require.NoError(t, err)
+		info, err = upload.GetInfo(ctx)
+		require.NoError(t, err)
+		require.Equal(t, int64(offset), info.Offset)
+
+		end := min(offset+chunk, len(data))
+		n, err := upload.WriteChunk(ctx, int64(offset), bytes.NewReader(data[offset:end]))
+		require.NoError(t, err)
+		require.Equal(t, int64(end-offset), n)
+		offset = end
+	}
+	require.NoError(t, upload.FinishUpload(ctx))
+
+	info, err = upload.GetInfo(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), info.Size)
+	assert.Equal(t, int64(len(data)), info.Offset)
+	assert.Equal(t, handler.MetaData{"filename": "song.flac"}, info.MetaData)
+	if key := info.Storage["Key"]; key != "" {
+		return key
+	}
+	return info.ID
+}
+
+func TestEnvelope_RoundTrip(t *testing.T) {
+	ctx := context.Background()
+	for _, size := range []int{0, 1000, envelopeChunkSize, 3*envelopeChunkSize + 123} {
+		for _, chunk := range []int{envelopeChunkSize, 10000} {
+			inner := newTestFile(t)
+			store := newTestEnvelope(t, inner)
+			data := testData(size)
+			key := uploadInChunks(t, store, data, chunk)
+
+			got, err := ReadAll(ctx, store, key)
+			require.NoError(t, err)
+			assert.Equal(t, data, got, "size %d in chunks of %d", size, chunk)
+
+			stored, err := ReadAll(ctx, inner, key)
+			require.NoError(t, err)
+			assert.Equal(t, sealedSize(int64(size)), int64(len(stored)))
+			if size > 0 {
+				assert.False(t, bytes.Contains(stored, data[:min(size, 64)]))
+			}
+			obj, err := store.Stat(ctx, key)
+			require.NoError(t, err)
+			assert.Equal(t, int64(size), obj.Size)
+		}
+	}
+}
+
+func TestEnvelope_Ranges(t *testing.T) {
+	ctx := context.Background()
+	store := newTestEnvelope(t, newTestFile(t))
+	data := testData(3*envelopeChunkSize + 500)
+	key := uploadInChunks(t, store, data, len(data))
+
+	for _, r := range [][2]int64{
+		{0, 10},
+		{envelopeChunkSize - 5, 10},
+		{envelopeChunkSize, envelopeChunkSize},
+		{100, 2*envelopeChunkSize + 1},
+		{3 * envelopeChunkSize, 500},
+		{3*envelopeChunkSize + 499, 1},
+		{2*envelopeChunkSize + 7, -1},
+	} {
+		body, err := store.Open(ctx, key, r[0], r[1])
+		require.NoError(t, err)
+		got, err := io.ReadAll(body)
+		require.NoError(t, err)
+		body.Close()
+		end := int64(len(data))
+		if r[1] >= 0 {
+			end = r[0] + r[1]
+		}
+		assert.Equal(t, data[r[0]:end], got, "range %v", r)
+	}
+}
+
+func TestEnvelope_Put(t *testing.T) {
+	ctx := context.Background()
+	inner := newTestFile(t)
+	store := newTestEnvelope(t, inner)
+	data := testData(2*envelopeChunkSize + 100)
+	require.NoError(t, store.Put(ctx, "hls/a/segment.ts", bytes.NewReader(data), int64(len(data))))
+	putString(t, store, "blobs/abc.refs", `{"refs":["a"]}`)
+
+	// Data objects are stored encrypted, other objects as given.
+	raw, err := ReadAll(ctx, inner, "hls/a/segment.ts")
+	require.NoError(t, err)
+	assert.Equal(t, sealedSize(int64(len(data))), int64(len(raw)))
+	assert.False(t, bytes.Contains(raw, data[:100]))
+	raw, err = ReadAll(ctx, inner, "blobs/abc.refs")
+	require.NoError(t, err)
+	assert.Equal(t, `{"refs":["a"]}`, string(raw))
+
+	obj, err := store.Stat(ctx, "hls/a/segment.ts")
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), obj.Size)
+	body, err := store.Open(ctx, "hls/a/segment.ts", envelopeChunkSize-10, 20)
+	require.NoError(t, err)
+	got, err := io.ReadAll(body)
+	require.NoError(t, err)
+	body.Close()
+	assert.Equal(t, data[envelopeChunkSize-10:envelopeChunkSize+10], got)
+
+	// Replacing an object replaces its data key.
+	putString(t, store, "hls/a/segment.ts", "")
+	got, err = ReadAll(ctx, store, "hls/a/segment.ts")
+	require.NoError(t, err)
+	assert.Empty(t, got)
+}
+
+func TestEnvelope_Info(t *testing.T) {
+	ctx := context.Background()
+	inner := newTestFile(t)
+	store := newTestEnvelope(t, inner)
+	data := testData(1000)
+	key := uploadInChunks(t, store, data, len(data))
+
+	var info handler.FileInfo
+	raw, err := ReadAll(ctx, store, key+".info")
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(raw, &info))
+	assert.Equal(t, int64(1000), info.Size)
+	assert.NotContains(t, info.MetaData, MetadataEnvelopeKey)
+
+	// Pipeline stages rewrite the .info without the data key, which is kept.
+	info.MetaData["checksum"] = "abc"
+	raw, err = json.Marshal(info)
+	require.NoError(t, err)
+	require.NoError(t, store.Put(ctx, key+".info", bytes.NewReader(raw), int64(len(raw))))
+
+	raw, err = ReadAll(ctx, inner, key+".info")
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(raw, &info))
+	assert.NotEmpty(t, info.MetaData[MetadataEnvelopeKey])
+	assert.Equal(t, "abc", info.MetaData["checksum"])
+	assert.Equal(t, sealedSize(1000), info.Size)
+
+	got, err := ReadAll(ctx, store, key)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+}
+
+func TestEnvelope_CopyListDelete(t *testing.T) {
+	ctx := context.Background()
+	for name, inner := range map[string]Store{
+		"file": newTestFile(t),
+		"s3":   NewS3("test-bucket", s3fake.New(), ""),
+	} {
+		t.Run(name, func(t *testing.T) {
+			store := newTestEnvelope(t, inner)
+			data := testData(envelopeChunkSize + 10)
+			key := uploadInChunks(t, store, data, 5000)
+			putString(t, store, "derived/waveform.json", "[]")
+
+			if linker, ok := store.(Linker); ok {
+				require.NoError(t, linker.Link(ctx, "blobs/abc", key))
+			} else {
+				require.NoError(t, store.Copy(ctx, "blobs/abc", key))
+			}
+			require.NoError(t, store.Delete(ctx, key, key+".info"))
+
+			got, err := ReadAll(ctx, store, "blobs/abc")
+			require.NoError(t, err)
+			assert.Equal(t, data, got)
+			got, err = ReadAll(ctx, store, "derived/waveform.json")
+			require.NoError(t, err)
+			assert.Equal(t, "[]", string(got))
+
+			objects, err := store.List(ctx, "")
+			require.NoError(t, err)
+			sizes := make(map[string]int64)
+			for _, obj := range objects {
+				sizes[obj.Key] = obj.Size
+			}
+			assert.Equal(t, map[string]int64{"blobs/abc": int64(len(data)), "derived/waveform.json": 2}, sizes)
+
+			require.NoError(t, store.Delete(ctx, "blobs/abc"))
+			_, err = inner.Stat(ctx, "blobs/abc.key")
+			assert.True(t, IsNotFound(err))
+		})
+	}
+}
+
+// TestEnvelope_ResumesAfterFailedPart checks that a write the inner store
+// took only part of is resumed from the last complete chunk.
+func TestEnvelope_ResumesAfterFailedPart(t *testing.T) {
+	ctx := context.Background()
+	client := s3fake.New()
+	client.MinPartSize = 1 << 10
+	inner := NewS3("test-bucket", client, "")
+	inner.SmallUploadThreshold = 0
+	inner.Parts = PartConfig{PreferredSize: 20 << 10, MinSize: 1 << 10, Concurrency: 1}
+	store := newTestEnvelope(t, inner)
+	composer := handler.NewStoreComposer()
+	store.UseIn(composer)
+
+	data := testData(4 * envelopeChunkSize)
+	upload, err := composer.Core.NewUpload(ctx, handler.FileInfo{Size: int64(len(data))})
+	require.NoError(t, err)
+	info, err := upload.GetInfo(ctx)
+	require.NoError(t, err)
+
+	// Parts fail from the middle of the third chunk on, once the six parts
+	// before have been stored. s3store reports none of them as written.
+	src := &faultingReader{r: bytes.NewReader(data), after: 2*envelopeChunkSize + 1000, fault: func() {
+		for client.Calls("UploadPart") < 6 {
+			time.Sleep(time.Millisecond)
+		}
+		client.Inject(s3fake.Fault{Op: "UploadPart", Err: io.ErrUnexpectedEOF})
+	}}
+	_, err = upload.WriteChunk(ctx, 0, src)
+	require.Error(t, err)
+	client.ClearFaults()
+
+	upload, err = composer.Core.GetUpload(ctx, info.ID)
+	require.NoError(t, err)
+	info, err = upload.GetInfo(ctx)
+	require.NoError(t, err)
+	assert.Positive(t, info.Offset)
+	assert.Zero(t, info.Offset%envelopeChunkSize)
+
+	_, err = upload.WriteChunk(ctx, info.Offset, bytes.NewReader(data[info.Offset:]))
+	require.NoError(t, err)
+	require.NoError(t, upload.FinishUpload(ctx))
+	got, err := ReadAll(ctx, store, info.Storage["Key"])
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+}
+
+// faultingReader calls fault once more than after bytes have been read.
+type faultingReader struct {
+	r     io.Reader
+	after int
+	fault func()
+	read  int
+}
+
+func (r *faultingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.read += n
+	if r.read > r.after && r.fault != nil {
+		r.fault()
+		r.fault = nil
+	}
+	return n, err
+}
+
+func TestEnvelope_DeferredLength(t *testing.T) {
+	ctx := context.Background()
+	store := newTestEnvelope(t, newTestFile(t))
+	composer := handler.NewStoreComposer()
+	store.UseIn(composer)
+
+	data := testData(envelopeChunkSize + 100)
+	upload, err := composer.Core.NewUpload(ctx, handler.FileInfo{SizeIsDeferred: true})
+	require.NoError(t, err)
+	_, err = upload.WriteChunk(ctx, 0, bytes.NewReader(data[:envelopeChunkSize+50]))
+	require.NoError(t, err)
+	require.NoError(t, composer.LengthDeferrer.AsLengthDeclarableUpload(upload).DeclareLength(ctx, int64(len(data))))
+	_, err = upload.WriteChunk(ctx, envelopeChunkSize+50, bytes.NewReader(data[envelopeChunkSize+50:]))
+	require.NoError(t, err)
+	require.NoError(t, upload.FinishUpload(ctx))
+
+	info, err := upload.GetInfo(ctx)
+	require.NoError(t, err)
+	got, err := ReadAll(ctx, store, info.ID)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+}
+
+func TestEnvelope_WrongMasterKey(t *testing.T) {
+	ctx := context.Background()
+	inner := newTestFile(t)
+	key := uploadInChunks(t, newTestEnvelope(t, inner), testData(100), 100)
+
+	other, err := NewEnvelope(inner, bytes.Repeat([]byte{8}, 32))
+	require.NoError(t, err)
+	_, err = ReadAll(ctx, other, key)
+	assert.Error(t, err)
+}
+
+func TestLoadMasterKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "master.key")
+	key := bytes.Repeat([]byte{1}, 32)
+	require.NoError(t, os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0o600))
+	loaded, err := LoadMasterKey(path)
+	require.NoError(t, err)
+	assert.Equal(t, key, loaded)
+
+	_, err = NewEnvelope(newTestFile(t), key[:16])
+	assert.Error(t, err)
+}
@@ -0,0 +1,206 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tus/tusd/v2/pkg/filestore"
+	"github.com/tus/tusd/v2/pkg/handler"
+)
+
+// tempPrefix marks files being written by Put, which List skips.
+const tempPrefix = ".tmp-"
+
+// File keeps uploads in a local directory using tusd's filestore, which
+// lays them out like s3store: the data under the upload ID and its info
+// next to it with an .info suffix.
+type File struct {
+	Dir string
+}
+
+// NewFile creates a store in dir, creating the directory if needed.
+func NewFile(dir string) (*File, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %w", err)
+	}
+	return &File{Dir: dir}, nil
+}
+
+func (f *File) UseIn(composer *handler.StoreComposer) {
+	filestore.New(f.Dir).UseIn(composer)
+}
+
+// path maps key to its file, rejecting keys that would escape the directory.
+func (f *File) path(key string) (string, error) {
+	name := filepath.FromSlash(key)
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return filepath.Join(f.Dir, name), nil
+}
+
+func (f *File) List(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+	err := filepath.WalkDir(f.Dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), tempPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(f.Dir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := entry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		objects = append(objects, Object{Key: key, Size: info.Size(), LastModified: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %w", err)
+	}
+	return objects, nil
+}
+
+func (f *File) Stat(ctx context.Context, key string) (Object, error) {
+	path, err := f.path(key)
+	if err != nil {
+		return Object{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return Object{}, fileError(key, err)
+	}
+	if info.IsDir() {
+		return Object{}, fmt.Errorf("%s: %w", key, ErrNotExist)
+	}
+	return Object{Key: key, Size: info.Size(), LastModified: info.ModTime()}, nil
+}
+
+func (f *File) Open(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	path, err := f.path(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fileError(key, err)
+	}
+	if offset > 0 {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	if length < 0 {
+		return file, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(file, length), file}, nil
+}
+
+// Put writes to a temporary file first, so readers never see a partially
+// written object.
+func (f *File) Put(ctx context.Context, key string, body io.Reader, size int64) error {
+	path, err := f.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), tempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(tmp, body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", key, err)
+	}
+	if size >= 0 && n != size {
+		return fmt.Errorf("failed to write %s: got %d bytes, expected %d", key, n, size)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (f *File) Copy(ctx context.Context, dst, src string) error {
+	obj, err := f.Stat(ctx, src)
+	if err != nil {
+		return err
+	}
+	body, err := f.Open(ctx, src, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return f.Put(ctx, dst, body, obj.Size)
+}
+
+// Link hard links dst to src, falling back to a copy where the file system
+// does not support hard links.
+func (f *File) Link(ctx context.Context, dst, src string) error {
+	srcPath, err := f.path(src)
+	if err != nil {
+		return err
+	}
+	dstPath, err := f.path(dst)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0o755); err != nil {
+		return err
+	}
+	if err := os.Remove(dstPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := os.Link(srcPath, dstPath); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return fileError(src, err)
+		}
+		return f.Copy(ctx, dst, src)
+	}
+	return nil
+}
+
+func (f *File) Delete(ctx context.Context, keys ...string) error {
+	for _, key := range keys {
+		path, err := f.path(key)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to delete %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+func fileError(key string, err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%s: %w", key, ErrNotExist)
+	}
+	return err
+}
@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestFile(t *testing.T) *File {
+	store, err := NewFile(filepath.Join(t.TempDir(), "data"))
+	require.NoError(t, err)
+	return store
+}
+
+func putString(t *testing.T, store Store, key, content string) {
+	require.NoError(t, store.Put(context.Background(), key, strings.NewReader(content), int64(len(content))))
+}
+
+func TestFile_PutOpenStat(t *testing.T) {
+	ctx := context.Background()
+	store := newTestFile(t)
+	putString(t, store, "blobs/abc", "hello world")
+
+	data, err := ReadAll(ctx, store, "blobs/abc")
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(data))
+
+	body, err := store.Open(ctx, "blobs/abc", 6, 3)
+	require.NoError(t, err)
+	defer body.Close()
+	buf := make([]byte, 10)
+	n, _ := body.Read(buf)
+	assert.Equal(t, "wor", string(buf[:n]))
+
+	obj, err := store.Stat(ctx, "blobs/abc")
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), obj.Size)
+
+	_, err = store.Stat(ctx, "missing")
+	assert.ErrorIs(t, err, ErrNotExist)
+	_, err = store.Open(ctx, "missing", 0, -1)
+	assert.True(t, IsNotFound(err))
+}
+
+func TestFile_PutRejectsShortBody(t *testing.T) {
+	store := newTestFile(t)
+	err := store.Put(context.Background(), "a", strings.NewReader("abc"), 5)
+	assert.Error(t, err)
+
+	_, err = store.Stat(context.Background(), "a")
+	assert.ErrorIs(t, err, ErrNotExist)
+}
+
+func TestFile_RejectsEscapingKeys(t *testing.T) {
+	store := newTestFile(t)
+	for _, key := range []string{"../outside", "/etc/passwd", "a/../../b"} {
+		assert.Error(t, store.Put(context.Background(), key, strings.NewReader(""), 0), key)
+	}
+}
+
+func TestFile_List(t *testing.T) {
+	store := newTestFile(t)
+	putString(t, store, "song", "1")
+	putString(t, store, "song.info", "{}")
+	putString(t, store, "blobs/abc", "22")
+	// Leftovers of an interrupted Put are not objects.
+	require.NoError(t, os.WriteFile(filepath.Join(store.Dir, tempPrefix+"x"), nil, 0o644))
+
+	objects, err := store.List(context.Background(), "")
+	require.NoError(t, err)
+	var keys []string
+	for _, obj := range objects {
+		keys = append(keys, obj.Key)
+	}
+	assert.ElementsMatch(t, []string{"song", "song.info", "blobs/abc"}, keys)
+
+	objects, err = store.List(context.Background(), "blobs/")
+	require.NoError(t, err)
+	require.Len(t, objects, 1)
+	assert.Equal(t, Object{Key: "blobs/abc", Size: 2, LastModified: objects[0].LastModified}, objects[0])
+}
+
+func TestFile_CopyLinkDelete(t *testing.T) {
+	ctx := context.Background()
+	store := newTestFile(t)
+	putString(t, store, "a", "data")
+
+	require.NoError(t, store.Copy(ctx, "b", "a"))
+	require.NoError(t, store.Link(ctx, "blobs/c", "a"))
+	for _, key := range []string{"b", "blobs/c"} {
+		data, err := ReadAll(ctx, store, key)
+		require.NoError(t, err)
+		assert.Equal(t, "data", string(data))
+	}
+
+	require.NoError(t, store.Delete(ctx, "a", "b", "missing"))
+	_, err := store.Stat(ctx, "a")
+	assert.ErrorIs(t, err, ErrNotExist)
+	// The link outlives the object it was made from.
+	_, err = store.Stat(ctx, "blobs/c")
+	assert.NoError(t, err)
+
+	assert.ErrorIs(t, store.Link(ctx, "d", "missing"), ErrNotExist)
+}
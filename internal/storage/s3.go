@@ -0,0 +1,299 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/tus/tusd/v2/pkg/handler"
+	"github.com/tus/tusd/v2/pkg/s3store"
+)
+
+// S3API defines the interface we need from the AWS S3 SDK.
+type S3API interface {
+	s3store.S3API
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error)
+}
+
+// PresignAPI is the part of the S3 presign client used to presign
+// downloads.
+type PresignAPI interface {
+	PresignGetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.PresignOptions)) (*v4.PresignedHTTPRequest, error)
+}
+
+// defaultMinPartSize is s3store's default MinPartSize, the minimum of AWS S3.
+const defaultMinPartSize = 5 << 20
+
+// deleteBatchSize is the most keys S3 accepts in a single DeleteObjects call.
+const deleteBatchSize = 1000
+
+// S3 keeps uploads in an S3 bucket using tusd's s3store.
+type S3 struct {
+	Bucket string
+	Client S3API
+	// Endpoint is the public base URL of the S3 service, used by URL.
+	Endpoint string
+	// SmallUploadThreshold is the largest upload stored with a single
+	// PutObject instead of a multipart upload. Zero disables this.
+	SmallUploadThreshold int64
+	// Parts tunes how multipart uploads are split into parts.
+	Parts PartConfig
+	// Signer presigns links for Presign. Nil disables presigning.
+	Signer PresignAPI
+
+	encryption Encryption
+}
+
+// PartConfig tunes s3store's multipart uploads. Zero fields keep s3store's
+// defaults.
+type PartConfig struct {
+	// PreferredSize is the size parts are cut to when enough data arrives.
+	PreferredSize int64
+	// MinSize is the smallest part the S3 service accepts, other than the
+	// last one.
+	MinSize int64
+	// MaxBuffered is how many parts may wait on disk for an upload to S3
+	// before the client is slowed down.
+	MaxBuffered int64
+	// TempDir holds the parts waiting on disk. Empty means the system's
+	// temporary directory.
+	TempDir string
+	// Concurrency limits the parts uploaded to S3 at once, over all uploads.
+	Concurrency int
+}
+
+// Validate reports settings s3store cannot work with.
+func (c PartConfig) Validate() error {
+	if c.PreferredSize < 0 || c.MinSize < 0 || c.MaxBuffered < 0 || c.Concurrency < 0 {
+		return errors.New("part settings must not be negative")
+	}
+	minSize := c.MinSize
+	if minSize == 0 {
+		minSize = defaultMinPartSize
+	}
+	if c.PreferredSize > 0 && c.PreferredSize < minSize {
+		return fmt.Errorf("preferred part size %d is below the minimum part size %d", c.PreferredSize, minSize)
+	}
+	return nil
+}
+
+func (c PartConfig) apply(store *s3store.S3Store) {
+	if c.MinSize > 0 {
+		store.MinPartSize = c.MinSize
+	}
+	if c.PreferredSize > 0 {
+		store.PreferredPartSize = c.PreferredSize
+	}
+	if c.MaxBuffered > 0 {
+		store.MaxBufferedParts = c.MaxBuffered
+	}
+	store.TemporaryDirectory = c.TempDir
+	if c.Concurrency > 0 {
+		store.SetConcurrentPartUploads(c.Concurrency)
+	}
+}
+
+// NewS3 creates a store on the given bucket.
+func NewS3(bucket string, client S3API, endpoint string) *S3 {
+	return &S3{
+		Bucket:               bucket,
+		Client:               client,
+		Endpoint:             endpoint,
+		SmallUploadThreshold: DefaultSmallUploadThreshold,
+	}
+}
+
+func (s *S3) UseIn(composer *handler.StoreComposer) {
+	store := s3store.New(s.Bucket, s.Client)
+	s.Parts.apply(&store)
+	if s.SmallUploadThreshold <= 0 {
+		store.UseIn(composer)
+		return
+	}
+	newSmallUploadStore(s, store).UseIn(composer)
+}
+
+func (s *S3) List(ctx context.Context, prefix string) ([]Object, error) {
+	input := &s3.ListObjectsV2Input{Bucket: aws.String(s.Bucket)}
+	if prefix != "" {
+		input.Prefix = aws.String(prefix)
+	}
+
+	var objects []Object
+	for {
+		output, err := s.Client.ListObjectsV2(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects: %w", err)
+		}
+		for _, obj := range output.Contents {
+			objects = append(objects, Object{
+				Key:          aws.ToString(obj.Key),
+				Size:         aws.ToInt64(obj.Size),
+				LastModified: aws.ToTime(obj.LastModified),
+			})
+		}
+		if !aws.ToBool(output.IsTruncated) {
+			return objects, nil
+		}
+		input.ContinuationToken = output.NextContinuationToken
+	}
+}
+
+func (s *S3) Stat(ctx context.Context, key string) (Object, error) {
+	output, err := s.Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return Object{}, s.wrapError(key, err)
+	}
+	return Object{
+		Key:          key,
+		Size:         aws.ToInt64(output.ContentLength),
+		LastModified: aws.ToTime(output.LastModified),
+	}, nil
+}
+
+func (s *S3) Open(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	}
+	if offset > 0 || length >= 0 {
+		if length == 0 {
+			return io.NopCloser(strings.NewReader("")), nil
+		}
+		rng := fmt.Sprintf("bytes=%d-", offset)
+		if length > 0 {
+			rng += fmt.Sprint(offset + length - 1)
+		}
+		input.Range = aws.String(rng)
+	}
+	output, err := s.Client.GetObject(ctx, input)
+	if err != nil {
+		return nil, s.wrapError(key, err)
+	}
+	return output.Body, nil
+}
+
+func (s *S3) Put(ctx context.Context, key string, body io.Reader, size int64) error {
+	_, err := s.Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(s.Bucket),
+		Key:           aws.String(key),
+		Body:          body,
+		ContentLength: aws.Int64(size),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put %s: %w", key, err)
+	}
+	return nil
+}
+
+func (s *S3) Copy(ctx context.Context, dst, src string) error {
+	_, err := s.Client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(s.Bucket),
+		Key:        aws.String(dst),
+		CopySource: aws.String(s.Bucket + "/" + src),
+	})
+	if err != nil {
+		return s.wrapError(src, err)
+	}
+	return nil
+}
+
+func (s *S3) Delete(ctx context.Context, keys ...string) error {
+	if len(keys) == 1 {
+		_, err := s.Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(s.Bucket),
+			Key:    aws.String(keys[0]),
+		})
+		if err != nil && !IsNotFound(err) {
+			return fmt.Errorf("failed to delete %s: %w", keys[0], err)
+		}
+		return nil
+	}
+
+	for start := 0; start < len(keys); start += deleteBatchSize {
+		batch := keys[start:min(start+deleteBatchSize, len(keys))]
+		objects := make([]types.ObjectIdentifier, len(batch))
+		for i, key := range batch {
+			objects[i] = types.ObjectIdentifier{Key: aws.String(key)}
+		}
+		_, err := s.Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(s.Bucket),
+			Delete: &types.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete objects: %w", err)
+		}
+	}
+	return nil
+}
+
+// URL returns the address of the object on the S3 endpoint. Objects
+// encrypted with KMS or customer keys cannot be fetched from there without
+// credentials or keys the client does not have.
+func (s *S3) URL(key string) (string, bool) {
+	if s.encryption.Mode == SSEKMS || s.encryption.Mode == SSECustomer {
+		return "", false
+	}
+	return fmt.Sprintf("%s/%s/%s", s.Endpoint, s.Bucket, key), true
+}
+
+// Presign returns a presigned link to the object. Objects encrypted with
+// customer keys cannot be presigned, as clients would have to send the key.
+func (s *S3) Presign(ctx context.Context, key string, expires time.Duration) (string, error) {
+	if s.Signer == nil {
+		return "", errors.New("presigning is not configured")
+	}
+	if s.encryption.Mode == SSECustomer {
+		return "", errors.New("objects encrypted with customer keys cannot be presigned")
+	}
+	req, err := s.Signer.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(expires))
+	if err != nil {
+		return "", s.wrapError(key, err)
+	}
+	return req.URL, nil
+}
+
+func (s *S3) wrapError(key string, err error) error {
+	if IsNotFound(err) {
+		return fmt.Errorf("%s: %w", key, ErrNotExist)
+	}
+	return fmt.Errorf("%s: %w", key, err)
+}
+
+// IsNotFound reports whether err means the requested object is missing,
+// either as ErrNotExist or as an S3 error.
+func IsNotFound(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrNotExist) {
+		return true
+	}
+	var noSuchKey *types.NoSuchKey
+	var notFound *types.NotFound
+	if errors.As(err, &noSuchKey) || errors.As(err, &notFound) {
+		return true
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		code := apiErr.ErrorCode()
+		return code == "NoSuchKey" || code == "NotFound"
+	}
+	return false
+}
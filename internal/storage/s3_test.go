@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tus/tusd/v2/pkg/handler"
+
+	"music-streaming/backend/internal/s3fake"
+)
+
+// uploadMultipart uploads data through s3store in a single chunk.
+func uploadMultipart(ctx context.Context, store *S3, data []byte) error {
+	composer := handler.NewStoreComposer()
+	store.UseIn(composer)
+	upload, err := composer.Core.NewUpload(ctx, handler.FileInfo{Size: int64(len(data))})
+	if err != nil {
+		return err
+	}
+	if _, err := upload.WriteChunk(ctx, 0, bytes.NewReader(data)); err != nil {
+		return err
+	}
+	return upload.FinishUpload(ctx)
+}
+
+func TestPartConfig_Validate(t *testing.T) {
+	assert.NoError(t, PartConfig{}.Validate())
+	assert.NoError(t, PartConfig{PreferredSize: 8 << 20, Concurrency: 4}.Validate())
+	assert.NoError(t, PartConfig{PreferredSize: 1 << 10, MinSize: 1 << 10}.Validate())
+	assert.Error(t, PartConfig{PreferredSize: 1 << 20}.Validate())
+	assert.Error(t, PartConfig{Concurrency: -1}.Validate())
+}
+
+func TestS3_PartConfig(t *testing.T) {
+	client := s3fake.New()
+	client.MinPartSize = 1 << 10
+	store := NewS3("test-bucket", client, "")
+	store.SmallUploadThreshold = 0
+	store.Parts = PartConfig{PreferredSize: 1 << 10, MinSize: 1 << 10, TempDir: t.TempDir()}
+
+	data := bytes.Repeat([]byte("x"), 10<<10)
+	require.NoError(t, uploadMultipart(context.Background(), store, data))
+	assert.Equal(t, 10, client.Calls("UploadPart"))
+}
+
+func TestS3_Presign(t *testing.T) {
+	ctx := context.Background()
+	store := NewS3("test-bucket", s3fake.New(), "http://s3.test")
+	_, err := store.Presign(ctx, "song", time.Minute)
+	assert.Error(t, err)
+
+	store.Signer = s3.NewPresignClient(s3.New(s3.Options{
+		Region:       "us-east-1",
+		Credentials:  credentials.NewStaticCredentialsProvider("key", "secret", ""),
+		BaseEndpoint: aws.String("http://s3.test"),
+		UsePathStyle: true,
+	}))
+	url, err := store.Presign(ctx, "derived/song/hls/aac-128k/segment00000.ts", 15*time.Minute)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(url, "http://s3.test/test-bucket/derived/song/hls/aac-128k/segment00000.ts?"), url)
+	assert.Contains(t, url, "X-Amz-Expires=900")
+
+	store.Encrypt(Encryption{Mode: SSECustomer, Keys: newTestKeyring(t, "a", "a")})
+	_, err = store.Presign(ctx, "song", time.Minute)
+	assert.Error(t, err)
+}
+
+// BenchmarkS3Upload measures multipart upload throughput against the fake
+// with each UploadPart taking a few milliseconds, like a nearby S3 service.
+func BenchmarkS3Upload(b *testing.B) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64<<16) // 64 MiB
+	for _, parts := range []PartConfig{
+		{},
+		{PreferredSize: 5 << 20, Concurrency: 1},
+		{PreferredSize: 5 << 20, Concurrency: 4},
+		{PreferredSize: 5 << 20, Concurrency: 16},
+		{PreferredSize: 16 << 20, Concurrency: 4},
+		{PreferredSize: 5 << 20, Concurrency: 16, MaxBuffered: 2},
+	} {
+		name := "defaults"
+		if parts != (PartConfig{}) {
+			name = fmt.Sprintf("part=%dMiB/concurrency=%d/buffered=%d", parts.PreferredSize>>20, parts.Concurrency, parts.MaxBuffered)
+		}
+		b.Run(name, func(b *testing.B) {
+			client := s3fake.New()
+			client.Inject(s3fake.Fault{Op: "UploadPart", Delay: 5 * time.Millisecond})
+			store := NewS3("test-bucket", client, "")
+			store.SmallUploadThreshold = 0
+			store.Parts = parts
+			store.Parts.TempDir = b.TempDir()
+
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for range b.N {
+				if err := uploadMultipart(context.Background(), store, data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
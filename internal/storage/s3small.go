@@ -0,0 +1,399 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/tus/tusd/v2/pkg/handler"
+	"github.com/tus/tusd/v2/pkg/s3store"
+)
+
+// DefaultSmallUploadThreshold is the largest upload NewS3 stores without a
+// multipart upload. It covers the typical song.
+const DefaultSmallUploadThreshold = 16 << 20
+
+var errIncompleteUpload = handler.NewError("ERR_INCOMPLETE_UPLOAD", "cannot stream non-finished upload", http.StatusBadRequest)
+
+// smallUploadStore stores uploads of known length up to the threshold with a
+// single PutObject once all their data has arrived, and leaves all others
+// to s3store. The data of a request is buffered in a local file, so an
+// upload sent in one request, as with creation-with-upload, takes just the
+// PutObject of its .info and that of its data. A request leaving the upload
+// unfinished stores its data once, in a part of its own named after the
+// offset it starts at, and the request finishing the upload puts the parts
+// in front of its data. As parts are never rewritten, the requests of an
+// upload need no lock between them and may reach any server.
+//
+// Small uploads are told apart by their ID, which unlike the
+// "objectId+multipartId" IDs of s3store has no "+".
+type smallUploadStore struct {
+	s     *S3
+	inner *handler.StoreComposer
+}
+
+type smallUpload struct {
+	store smallUploadStore
+	info  handler.FileInfo
+	// parts are the stored parts of the data before info.Offset, once
+	// looked up.
+	parts []Object
+	// offsetKnown is set once this request has seen the offset, which saves
+	// looking it up in S3.
+	offsetKnown bool
+}
+
+func newSmallUploadStore(s *S3, inner s3store.S3Store) smallUploadStore {
+	composer := handler.NewStoreComposer()
+	inner.UseIn(composer)
+	return smallUploadStore{s: s, inner: composer}
+}
+
+func (store smallUploadStore) UseIn(composer *handler.StoreComposer) {
+	composer.UseCore(store)
+	composer.UseTerminater(store)
+	composer.UseConcater(store)
+	composer.UseLengthDeferrer(store)
+	composer.UseContentServer(store)
+}
+
+// isSmall reports whether an upload described by info is stored whole.
+// Uploads taking part in concatenation are left to s3store, which
+// concatenates with multipart copies.
+func (store smallUploadStore) isSmall(info handler.FileInfo) bool {
+	return !info.SizeIsDeferred && !info.IsPartial && !info.IsFinal &&
+		info.Size <= store.s.SmallUploadThreshold
+}
+
+func (store smallUploadStore) NewUpload(ctx context.Context, info handler.FileInfo) (handler.Upload, error) {
+	if !store.isSmall(info) {
+		return store.inner.Core.NewUpload(ctx, info)
+	}
+	if info.ID == "" {
+		info.ID = newUploadID()
+	}
+	info.Storage = map[string]string{
+		"Type":   "s3store",
+		"Bucket": store.s.Bucket,
+		"Key":    info.ID,
+	}
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.s.Put(ctx, info.ID+".info", bytes.NewReader(data), int64(len(data))); err != nil {
+		return nil, fmt.Errorf("s3store: unable to create info file: %w", err)
+	}
+	return &smallUpload{store: store, info: info, offsetKnown: true}, nil
+}
+
+func (store smallUploadStore) GetUpload(ctx context.Context, id string) (handler.Upload, error) {
+	if strings.Contains(id, "+") {
+		return store.inner.Core.GetUpload(ctx, id)
+	}
+	data, err := ReadAll(ctx, store.s, id+".info")
+	if IsNotFound(err) {
+		return nil, handler.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	upload := &smallUpload{store: store}
+	if err := json.Unmarshal(data, &upload.info); err != nil {
+		return nil, fmt.Errorf("s3store: invalid info file %s.info: %w", id, err)
+	}
+	return upload, nil
+}
+
+func (store smallUploadStore) AsTerminatableUpload(upload handler.Upload) handler.TerminatableUpload {
+	if small, ok := upload.(*smallUpload); ok {
+		return small
+	}
+	return store.inner.Terminater.AsTerminatableUpload(upload)
+}
+
+func (store smallUploadStore) AsConcatableUpload(upload handler.Upload) handler.ConcatableUpload {
+	return store.inner.Concater.AsConcatableUpload(upload)
+}
+
+func (store smallUploadStore) AsLengthDeclarableUpload(upload handler.Upload) handler.LengthDeclarableUpload {
+	return store.inner.LengthDeferrer.AsLengthDeclarableUpload(upload)
+}
+
+func (store smallUploadStore) AsServableUpload(upload handler.Upload) handler.ServableUpload {
+	if small, ok := upload.(*smallUpload); ok {
+		return small
+	}
+	return store.inner.ContentServer.AsServableUpload(upload)
+}
+
+// newUploadID returns a random ID in the format s3store uses for the
+// object part of its IDs.
+func newUploadID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// partKey returns the key of the part starting at offset.
+func (upload *smallUpload) partKey(offset int64) string {
+	return upload.info.ID + "." + strconv.FormatInt(offset, 10) + ".part"
+}
+
+// partOffset returns the offset of the part stored under key, if key is
+// one of the upload's parts.
+func (upload *smallUpload) partOffset(key string) (int64, bool) {
+	rest, ok := strings.CutPrefix(key, upload.info.ID+".")
+	if !ok {
+		return 0, false
+	}
+	rest, ok = strings.CutSuffix(rest, ".part")
+	if !ok {
+		return 0, false
+	}
+	offset, err := strconv.ParseInt(rest, 10, 64)
+	return offset, err == nil && offset >= 0
+}
+
+// storedParts returns every part of the upload in S3, and those following
+// one another from the start of the data. Parts of requests that raced to
+// the same offset replace each other; as they hold the same bytes of the
+// file, the parts found are of the upload whichever request wrote them.
+func (upload *smallUpload) storedParts(ctx context.Context) (all, parts []Object, err error) {
+	objects, err := upload.store.s.List(ctx, upload.info.ID+".")
+	if err != nil {
+		return nil, nil, err
+	}
+	byOffset := make(map[int64]Object)
+	for _, obj := range objects {
+		if offset, ok := upload.partOffset(obj.Key); ok {
+			all = append(all, obj)
+			byOffset[offset] = obj
+		}
+	}
+	for offset := int64(0); ; {
+		part, ok := byOffset[offset]
+		if !ok || part.Size == 0 {
+			return all, parts, nil
+		}
+		parts = append(parts, part)
+		offset += part.Size
+	}
+}
+
+// GetInfo derives the offset from the stored data: the size of the object
+// once the upload is finished, that of its parts before. The object is
+// looked at first, as the parts are only deleted after it has been written.
+func (upload *smallUpload) GetInfo(ctx context.Context) (handler.FileInfo, error) {
+	if upload.offsetKnown {
+		return upload.info, nil
+	}
+	var offset int64
+	obj, err := upload.store.s.Stat(ctx, upload.info.ID)
+	switch {
+	case err == nil:
+		offset = obj.Size
+	case IsNotFound(err):
+		_, upload.parts, err = upload.storedParts(ctx)
+		if err != nil {
+			return upload.info, err
+		}
+		for _, part := range upload.parts {
+			offset += part.Size
+		}
+	default:
+		return upload.info, err
+	}
+	upload.info.Offset, upload.offsetKnown = offset, true
+	return upload.info, nil
+}
+
+// WriteChunk buffers the data of the request in a local file. Unless it
+// completes the upload, it is stored as a part; otherwise it is stored with
+// the parts before it as the object itself, and the parts deleted.
+func (upload *smallUpload) WriteChunk(ctx context.Context, offset int64, src io.Reader) (int64, error) {
+	s := upload.store.s
+	file, err := os.CreateTemp(s.Parts.TempDir, "tusd-s3-small-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	// The data goes where it belongs in the file, leaving room for the
+	// parts before it.
+	n, err := io.Copy(io.NewOffsetWriter(file, offset), io.LimitReader(src, upload.info.Size-offset))
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, nil
+	}
+
+	if offset+n < upload.info.Size {
+		key := upload.partKey(offset)
+		if err := s.Put(ctx, key, io.NewSectionReader(file, offset, n), n); err != nil {
+			return 0, err
+		}
+		upload.parts = append(upload.parts, Object{Key: key, Size: n})
+		upload.info.Offset = offset + n
+		return n, nil
+	}
+
+	if err := upload.readParts(ctx, file, offset); err != nil {
+		return 0, err
+	}
+	if err := upload.putObject(ctx, io.NewSectionReader(file, 0, upload.info.Size), upload.info.Size); err != nil {
+		return 0, err
+	}
+	upload.info.Offset = upload.info.Size
+	if len(upload.parts) > 0 {
+		keys := make([]string, len(upload.parts))
+		for i, part := range upload.parts {
+			keys[i] = part.Key
+		}
+		if err := s.Delete(ctx, keys...); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// readParts writes the parts of the first offset bytes of the data into
+// file.
+func (upload *smallUpload) readParts(ctx context.Context, file *os.File, offset int64) error {
+	var stored int64
+	for _, part := range upload.parts {
+		stored += part.Size
+	}
+	if stored != offset {
+		return fmt.Errorf("s3store: parts of %s hold %d bytes, expected %d", upload.info.ID, stored, offset)
+	}
+
+	var at int64
+	for _, part := range upload.parts {
+		body, err := upload.store.s.Open(ctx, part.Key, 0, -1)
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(io.NewOffsetWriter(file, at), body)
+		body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", part.Key, err)
+		}
+		if n != part.Size {
+			return fmt.Errorf("s3store: %s holds %d bytes, expected %d", part.Key, n, part.Size)
+		}
+		at += n
+	}
+	return nil
+}
+
+// putObject stores the finished upload with the content type and metadata
+// s3store gives multipart uploads.
+func (upload *smallUpload) putObject(ctx context.Context, body io.Reader, size int64) error {
+	metadata := make(map[string]string, len(upload.info.MetaData))
+	for key, value := range upload.info.MetaData {
+		metadata[key] = strings.Map(func(r rune) rune {
+			if r < 0x20 || r > 0x7e {
+				return '?'
+			}
+			return r
+		}, value)
+	}
+	input := &s3.PutObjectInput{
+		Bucket:        aws.String(upload.store.s.Bucket),
+		Key:           aws.String(upload.info.ID),
+		Body:          body,
+		ContentLength: aws.Int64(size),
+		Metadata:      metadata,
+	}
+	if fileType, ok := upload.info.MetaData["filetype"]; ok {
+		input.ContentType = aws.String(fileType)
+	}
+	if _, err := upload.store.s.Client.PutObject(ctx, input); err != nil {
+		return fmt.Errorf("failed to put %s: %w", upload.info.ID, err)
+	}
+	return nil
+}
+
+func (upload *smallUpload) GetReader(ctx context.Context) (io.ReadCloser, error) {
+	body, err := upload.store.s.Open(ctx, upload.info.ID, 0, -1)
+	if IsNotFound(err) {
+		return nil, errIncompleteUpload
+	}
+	return body, err
+}
+
+// FinishUpload stores empty uploads, which never see a chunk. All others
+// are stored by their last WriteChunk.
+func (upload *smallUpload) FinishUpload(ctx context.Context) error {
+	if upload.info.Size == 0 {
+		return upload.putObject(ctx, bytes.NewReader(nil), 0)
+	}
+	return nil
+}
+
+// Terminate deletes the upload with every part of it, including those of
+// requests that lost a race.
+func (upload *smallUpload) Terminate(ctx context.Context) error {
+	id := upload.info.ID
+	all, _, err := upload.storedParts(ctx)
+	if err != nil {
+		return err
+	}
+	keys := []string{id, id + ".info"}
+	for _, part := range all {
+		keys = append(keys, part.Key)
+	}
+	return upload.store.s.Delete(ctx, keys...)
+}
+
+// ServeContent streams the finished upload, letting S3 handle ranges.
+func (upload *smallUpload) ServeContent(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(upload.store.s.Bucket),
+		Key:    aws.String(upload.info.ID),
+	}
+	if rng := r.Header.Get("Range"); rng != "" {
+		input.Range = aws.String(rng)
+	}
+	result, err := upload.store.s.Client.GetObject(ctx, input)
+	if IsNotFound(err) {
+		w.Header().Del("Content-Type")
+		w.Header().Del("Content-Disposition")
+		return errIncompleteUpload
+	}
+	if err != nil {
+		return err
+	}
+	defer result.Body.Close()
+
+	h := w.Header()
+	h.Set("Accept-Ranges", "bytes")
+	if result.ContentLength != nil {
+		h.Set("Content-Length", strconv.FormatInt(*result.ContentLength, 10))
+	}
+	if result.ETag != nil {
+		h.Set("ETag", *result.ETag)
+	}
+	status := http.StatusOK
+	if result.ContentRange != nil {
+		h.Set("Content-Range", *result.ContentRange)
+		status = http.StatusPartialContent
+	}
+	w.WriteHeader(status)
+	_, err = io.Copy(w, result.Body)
+	return err
+}
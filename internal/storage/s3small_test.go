@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tus/tusd/v2/pkg/handler"
+
+	"music-streaming/backend/internal/s3fake"
+)
+
+func newTestSmallUploads(t *testing.T, threshold int64) (*handler.StoreComposer, *s3fake.Client) {
+	client := s3fake.New()
+	store := NewS3("test-bucket", client, "")
+	store.SmallUploadThreshold = threshold
+	composer := handler.NewStoreComposer()
+	store.UseIn(composer)
+	return composer, client
+}
+
+func TestSmallUpload_OnByDefault(t *testing.T) {
+	store := NewS3("test-bucket", s3fake.New(), "")
+	assert.EqualValues(t, DefaultSmallUploadThreshold, store.SmallUploadThreshold)
+
+	// Parts are never rewritten, so the requests of an upload need no lock
+	// held by one server.
+	composer := handler.NewStoreComposer()
+	store.UseIn(composer)
+	assert.False(t, composer.UsesLocker)
+}
+
+func TestSmallUpload_ResumesFromPart(t *testing.T) {
+	ctx := context.Background()
+	composer, client := newTestSmallUploads(t, 1024)
+
+	upload, err := composer.Core.NewUpload(ctx, handler.FileInfo{Size: 10, MetaData: handler.MetaData{"filetype": "audio/mpeg"}})
+	require.NoError(t, err)
+	info, err := upload.GetInfo(ctx)
+	require.NoError(t, err)
+	assert.NotContains(t, info.ID, "+")
+	n, err := upload.WriteChunk(ctx, 0, strings.NewReader("01234"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), n)
+
+	// A later request finds the offset from the parts.
+	upload, err = composer.Core.GetUpload(ctx, info.ID)
+	require.NoError(t, err)
+	resumed, err := upload.GetInfo(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), resumed.Offset)
+
+	_, err = upload.WriteChunk(ctx, 5, strings.NewReader("56789 and more"))
+	require.NoError(t, err)
+	data, ok := client.Object("test-bucket", info.ID)
+	require.True(t, ok)
+	assert.Equal(t, "0123456789", string(data))
+	assert.ElementsMatch(t, []string{info.ID, info.ID + ".info"}, client.Keys("test-bucket"))
+	assert.Zero(t, client.Calls("CreateMultipartUpload"))
+
+	require.NoError(t, composer.Terminater.AsTerminatableUpload(upload).Terminate(ctx))
+	assert.Empty(t, client.Keys("test-bucket"))
+}
+
+func TestSmallUpload_RacingRequests(t *testing.T) {
+	ctx := context.Background()
+	composer, client := newTestSmallUploads(t, 1024)
+	upload, err := composer.Core.NewUpload(ctx, handler.FileInfo{Size: 10})
+	require.NoError(t, err)
+	info, err := upload.GetInfo(ctx)
+	require.NoError(t, err)
+
+	// Two servers take a request at offset 0 each; the one writing last
+	// wins, and the other's later part is not taken for data.
+	write := func(offset int64, data string) {
+		upload, err := composer.Core.GetUpload(ctx, info.ID)
+		require.NoError(t, err)
+		_, err = upload.GetInfo(ctx)
+		require.NoError(t, err)
+		_, err = upload.WriteChunk(ctx, offset, strings.NewReader(data))
+		require.NoError(t, err)
+	}
+	write(0, "012345")
+	write(6, "67")
+	write(0, "0123")
+
+	upload, err = composer.Core.GetUpload(ctx, info.ID)
+	require.NoError(t, err)
+	resumed, err := upload.GetInfo(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), resumed.Offset)
+	write(4, "456789")
+	data, _ := client.Object("test-bucket", info.ID)
+	assert.Equal(t, "0123456789", string(data))
+
+	// Deleting the upload deletes the part that was left over.
+	require.NoError(t, composer.Terminater.AsTerminatableUpload(upload).Terminate(ctx))
+	assert.Empty(t, client.Keys("test-bucket"))
+}
+
+func TestSmallUpload_Empty(t *testing.T) {
+	ctx := context.Background()
+	composer, client := newTestSmallUploads(t, 1024)
+
+	upload, err := composer.Core.NewUpload(ctx, handler.FileInfo{Size: 0})
+	require.NoError(t, err)
+	require.NoError(t, upload.FinishUpload(ctx))
+	info, err := upload.GetInfo(ctx)
+	require.NoError(t, err)
+	data, ok := client.Object("test-bucket", info.ID)
+	require.True(t, ok)
+	assert.Empty(t, data)
+}
+
+func TestSmallUpload_LargeAndDeferredUseMultipart(t *testing.T) {
+	ctx := context.Background()
+	composer, client := newTestSmallUploads(t, 1024)
+
+	for _, info := range []handler.FileInfo{{Size: 1025}, {SizeIsDeferred: true}} {
+		upload, err := composer.Core.NewUpload(ctx, info)
+		require.NoError(t, err)
+		info, err = upload.GetInfo(ctx)
+		require.NoError(t, err)
+		assert.Contains(t, info.ID, "+")
+
+		// Their IDs lead back to s3store.
+		_, err = composer.Core.GetUpload(ctx, info.ID)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 2, client.Calls("CreateMultipartUpload"))
+}
@@ -0,0 +1,338 @@
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// Server-side encryption modes.
+const (
+	// SSES3 encrypts with keys managed by S3.
+	SSES3 = "s3"
+	// SSEKMS encrypts with a KMS key.
+	SSEKMS = "kms"
+	// SSECustomer encrypts with keys from a local Keyring, which S3 never
+	// stores. Such objects can only be read through the service.
+	SSECustomer = "customer"
+)
+
+// Encryption configures the server-side encryption of everything stored in
+// S3: uploads, their .info objects and derived objects alike.
+type Encryption struct {
+	// Mode is SSES3, SSEKMS, SSECustomer or empty for no encryption.
+	Mode string
+	// KMSKeyID is the KMS key of SSEKMS. Empty uses the account's default
+	// key for S3.
+	KMSKeyID string
+	// Keys holds the keys of SSECustomer.
+	Keys *Keyring
+}
+
+// Validate reports incomplete settings.
+func (e Encryption) Validate() error {
+	switch e.Mode {
+	case "", SSES3, SSEKMS:
+	case SSECustomer:
+		if e.Keys == nil {
+			return errors.New("customer-provided encryption needs a keyring")
+		}
+	default:
+		return fmt.Errorf("unknown encryption mode %q", e.Mode)
+	}
+	if e.KMSKeyID != "" && e.Mode != SSEKMS {
+		return errors.New("a KMS key ID needs KMS encryption")
+	}
+	return nil
+}
+
+// Keyring holds the keys for SSE-C. New objects are written with the
+// current key. Reads try the current key first, then the others and then
+// no key at all, so keys can be rotated and encryption turned on without
+// rewriting what is already stored.
+type Keyring struct {
+	current string
+	keys    map[string][]byte
+}
+
+// NewKeyring returns a keyring writing with the key named current. Keys
+// are 256 bits.
+func NewKeyring(current string, keys map[string][]byte) (*Keyring, error) {
+	if _, ok := keys[current]; !ok {
+		return nil, fmt.Errorf("current key %q is not in the keyring", current)
+	}
+	for id, key := range keys {
+		if len(key) != 32 {
+			return nil, fmt.Errorf("key %q has %d bytes, want 32", id, len(key))
+		}
+	}
+	return &Keyring{current: current, keys: keys}, nil
+}
+
+// LoadKeyring reads a keyring from a JSON file of the form
+//
+//	{"current": "2024-06", "keys": {"2024-01": "<base64>", "2024-06": "<base64>"}}
+func LoadKeyring(path string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Current string            `json:"current"`
+		Keys    map[string]string `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid keyring %s: %w", path, err)
+	}
+	keys := make(map[string][]byte, len(file.Keys))
+	for id, encoded := range file.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q in keyring %s: %w", id, path, err)
+		}
+		keys[id] = key
+	}
+	keyring, err := NewKeyring(file.Current, keys)
+	if err != nil {
+		return nil, fmt.Errorf("invalid keyring %s: %w", path, err)
+	}
+	return keyring, nil
+}
+
+// customerKey is an SSE-C key in the form S3 requests carry it.
+type customerKey struct {
+	algorithm, key, md5 *string
+}
+
+func newCustomerKey(key []byte) customerKey {
+	sum := md5.Sum(key)
+	return customerKey{
+		algorithm: aws.String("AES256"),
+		key:       aws.String(base64.StdEncoding.EncodeToString(key)),
+		md5:       aws.String(base64.StdEncoding.EncodeToString(sum[:])),
+	}
+}
+
+// readKeys returns the keys to read with in the order they are tried. The
+// last one is no key.
+func (k *Keyring) readKeys() []customerKey {
+	ids := make([]string, 0, len(k.keys))
+	for id := range k.keys {
+		if id != k.current {
+			ids = append(ids, id)
+		}
+	}
+	// Newer keys are more likely to be needed, given sortable names.
+	sort.Sort(sort.Reverse(sort.StringSlice(ids)))
+	keys := []customerKey{newCustomerKey(k.keys[k.current])}
+	for _, id := range ids {
+		keys = append(keys, newCustomerKey(k.keys[id]))
+	}
+	return append(keys, customerKey{})
+}
+
+// encryptedS3Client applies an Encryption to the calls it passes on.
+type encryptedS3Client struct {
+	next S3API
+	enc  Encryption
+}
+
+// Encrypt has s encrypt everything it stores from now on as enc says, and
+// send the keys needed to read it back.
+func (s *S3) Encrypt(enc Encryption) {
+	s.Client = &encryptedS3Client{next: s.Client, enc: enc}
+	s.encryption = enc
+}
+
+// sse returns the settings of a write for keys managed by S3 or KMS.
+func (c *encryptedS3Client) sse() (types.ServerSideEncryption, *string) {
+	switch c.enc.Mode {
+	case SSES3:
+		return types.ServerSideEncryptionAes256, nil
+	case SSEKMS:
+		var keyID *string
+		if c.enc.KMSKeyID != "" {
+			keyID = aws.String(c.enc.KMSKeyID)
+		}
+		return types.ServerSideEncryptionAwsKms, keyID
+	}
+	return "", nil
+}
+
+// writeKey returns the customer key new objects are written with.
+func (c *encryptedS3Client) writeKey() customerKey {
+	if c.enc.Mode != SSECustomer {
+		return customerKey{}
+	}
+	return newCustomerKey(c.enc.Keys.keys[c.enc.Keys.current])
+}
+
+// withReadKeys calls call with the keys an existing object may have been
+// written with until one is accepted. The error of the first attempt is
+// returned if none is. A request body is rewound between attempts, and
+// only the first key is tried if it cannot be.
+func (c *encryptedS3Client) withReadKeys(body io.Reader, call func(key customerKey) error) error {
+	if c.enc.Mode != SSECustomer {
+		return call(customerKey{})
+	}
+	keys := c.enc.Keys.readKeys()
+	var start int64
+	seeker, canSeek := body.(io.Seeker)
+	if body != nil {
+		if !canSeek {
+			keys = keys[:1]
+		} else if pos, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+			start = pos
+		} else {
+			keys = keys[:1]
+		}
+	}
+
+	var first error
+	for i, key := range keys {
+		if i > 0 && body != nil {
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return first
+			}
+		}
+		err := call(key)
+		if err == nil || !isWrongKey(err) {
+			return err
+		}
+		if first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// isWrongKey reports whether S3 refused a request for not giving the
+// customer key the object was written with.
+func isWrongKey(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "AccessDenied", "InvalidRequest", "Forbidden", "BadRequest":
+			return true
+		}
+	}
+	// HEAD responses carry no error code.
+	var respErr *smithyhttp.ResponseError
+	if errors.As(err, &respErr) {
+		status := respErr.HTTPStatusCode()
+		return status == 400 || status == 403
+	}
+	return false
+}
+
+func (c *encryptedS3Client) PutObject(ctx context.Context, input *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	in := *input
+	in.ServerSideEncryption, in.SSEKMSKeyId = c.sse()
+	key := c.writeKey()
+	in.SSECustomerAlgorithm, in.SSECustomerKey, in.SSECustomerKeyMD5 = key.algorithm, key.key, key.md5
+	return c.next.PutObject(ctx, &in, optFns...)
+}
+
+func (c *encryptedS3Client) CreateMultipartUpload(ctx context.Context, input *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	in := *input
+	in.ServerSideEncryption, in.SSEKMSKeyId = c.sse()
+	key := c.writeKey()
+	in.SSECustomerAlgorithm, in.SSECustomerKey, in.SSECustomerKeyMD5 = key.algorithm, key.key, key.md5
+	return c.next.CreateMultipartUpload(ctx, &in, optFns...)
+}
+
+// UploadPart sends the key of the multipart upload, which may have been
+// started before the current key was.
+func (c *encryptedS3Client) UploadPart(ctx context.Context, input *s3.UploadPartInput, optFns ...func(*s3.Options)) (output *s3.UploadPartOutput, err error) {
+	err = c.withReadKeys(input.Body, func(key customerKey) error {
+		in := *input
+		in.SSECustomerAlgorithm, in.SSECustomerKey, in.SSECustomerKeyMD5 = key.algorithm, key.key, key.md5
+		output, err = c.next.UploadPart(ctx, &in, optFns...)
+		return err
+	})
+	return output, err
+}
+
+func (c *encryptedS3Client) UploadPartCopy(ctx context.Context, input *s3.UploadPartCopyInput, optFns ...func(*s3.Options)) (output *s3.UploadPartCopyOutput, err error) {
+	err = c.withReadKeys(nil, func(dst customerKey) error {
+		return c.withReadKeys(nil, func(src customerKey) error {
+			in := *input
+			in.SSECustomerAlgorithm, in.SSECustomerKey, in.SSECustomerKeyMD5 = dst.algorithm, dst.key, dst.md5
+			in.CopySourceSSECustomerAlgorithm, in.CopySourceSSECustomerKey, in.CopySourceSSECustomerKeyMD5 = src.algorithm, src.key, src.md5
+			output, err = c.next.UploadPartCopy(ctx, &in, optFns...)
+			return err
+		})
+	})
+	return output, err
+}
+
+func (c *encryptedS3Client) GetObject(ctx context.Context, input *s3.GetObjectInput, optFns ...func(*s3.Options)) (output *s3.GetObjectOutput, err error) {
+	err = c.withReadKeys(nil, func(key customerKey) error {
+		in := *input
+		in.SSECustomerAlgorithm, in.SSECustomerKey, in.SSECustomerKeyMD5 = key.algorithm, key.key, key.md5
+		output, err = c.next.GetObject(ctx, &in, optFns...)
+		return err
+	})
+	return output, err
+}
+
+func (c *encryptedS3Client) HeadObject(ctx context.Context, input *s3.HeadObjectInput, optFns ...func(*s3.Options)) (output *s3.HeadObjectOutput, err error) {
+	err = c.withReadKeys(nil, func(key customerKey) error {
+		in := *input
+		in.SSECustomerAlgorithm, in.SSECustomerKey, in.SSECustomerKeyMD5 = key.algorithm, key.key, key.md5
+		output, err = c.next.HeadObject(ctx, &in, optFns...)
+		return err
+	})
+	return output, err
+}
+
+// CopyObject reads the source with its key and writes the copy like any
+// new object.
+func (c *encryptedS3Client) CopyObject(ctx context.Context, input *s3.CopyObjectInput, optFns ...func(*s3.Options)) (output *s3.CopyObjectOutput, err error) {
+	err = c.withReadKeys(nil, func(src customerKey) error {
+		in := *input
+		in.ServerSideEncryption, in.SSEKMSKeyId = c.sse()
+		dst := c.writeKey()
+		in.SSECustomerAlgorithm, in.SSECustomerKey, in.SSECustomerKeyMD5 = dst.algorithm, dst.key, dst.md5
+		in.CopySourceSSECustomerAlgorithm, in.CopySourceSSECustomerKey, in.CopySourceSSECustomerKeyMD5 = src.algorithm, src.key, src.md5
+		output, err = c.next.CopyObject(ctx, &in, optFns...)
+		return err
+	})
+	return output, err
+}
+
+func (c *encryptedS3Client) ListParts(ctx context.Context, input *s3.ListPartsInput, optFns ...func(*s3.Options)) (*s3.ListPartsOutput, error) {
+	return c.next.ListParts(ctx, input, optFns...)
+}
+
+func (c *encryptedS3Client) CompleteMultipartUpload(ctx context.Context, input *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	return c.next.CompleteMultipartUpload(ctx, input, optFns...)
+}
+
+func (c *encryptedS3Client) AbortMultipartUpload(ctx context.Context, input *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	return c.next.AbortMultipartUpload(ctx, input, optFns...)
+}
+
+func (c *encryptedS3Client) DeleteObject(ctx context.Context, input *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	return c.next.DeleteObject(ctx, input, optFns...)
+}
+
+func (c *encryptedS3Client) DeleteObjects(ctx context.Context, input *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	return c.next.DeleteObjects(ctx, input, optFns...)
+}
+
+func (c *encryptedS3Client) ListObjectsV2(ctx context.Context, input *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	return c.next.ListObjectsV2(ctx, input, optFns...)
+}
@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tus/tusd/v2/pkg/handler"
+
+	"music-streaming/backend/internal/s3fake"
+)
+
+func newTestKeyring(t *testing.T, current string, ids ...string) *Keyring {
+	keys := make(map[string][]byte)
+	for i, id := range ids {
+		keys[id] = bytes.Repeat([]byte{byte(i + 1)}, 32)
+	}
+	keyring, err := NewKeyring(current, keys)
+	require.NoError(t, err)
+	return keyring
+}
+
+func newEncryptedS3(client *s3fake.Client, enc Encryption) *S3 {
+	client.MinPartSize = 1 << 10
+	store := NewS3("test-bucket", client, "http://s3.test")
+	store.SmallUploadThreshold = 0
+	store.Parts = PartConfig{PreferredSize: 1 << 10, MinSize: 1 << 10}
+	store.Encrypt(enc)
+	return store
+}
+
+func TestEncryption_Validate(t *testing.T) {
+	assert.NoError(t, Encryption{}.Validate())
+	assert.NoError(t, Encryption{Mode: SSEKMS, KMSKeyID: "alias/masters"}.Validate())
+	assert.NoError(t, Encryption{Mode: SSECustomer, Keys: newTestKeyring(t, "a", "a")}.Validate())
+	assert.Error(t, Encryption{Mode: SSECustomer}.Validate())
+	assert.Error(t, Encryption{Mode: SSES3, KMSKeyID: "alias/masters"}.Validate())
+	assert.Error(t, Encryption{Mode: "rot13"}.Validate())
+}
+
+func TestLoadKeyring(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keyring.json")
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	require.NoError(t, os.WriteFile(path, []byte(`{"current": "b", "keys": {"a": "`+key+`", "b": "`+key+`"}}`), 0o600))
+	keyring, err := LoadKeyring(path)
+	require.NoError(t, err)
+	assert.Len(t, keyring.readKeys(), 3)
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"current": "c", "keys": {"a": "`+key+`"}}`), 0o600))
+	_, err = LoadKeyring(path)
+	assert.Error(t, err)
+	require.NoError(t, os.WriteFile(path, []byte(`{"current": "a", "keys": {"a": "c2hvcnQ="}}`), 0o600))
+	_, err = LoadKeyring(path)
+	assert.Error(t, err)
+}
+
+func TestS3_EncryptCustomerKey(t *testing.T) {
+	ctx := context.Background()
+	client := s3fake.New()
+	store := newEncryptedS3(client, Encryption{Mode: SSECustomer, Keys: newTestKeyring(t, "a", "a")})
+
+	data := bytes.Repeat([]byte("x"), 3<<10)
+	require.NoError(t, uploadMultipart(ctx, store, data))
+	putString(t, store, "derived/waveform.json", "[]")
+
+	for _, key := range client.Keys("test-bucket") {
+		enc, _ := client.ObjectEncryption("test-bucket", key)
+		assert.NotEmpty(t, enc.CustomerKeyMD5, key)
+
+		// Only the service, holding the key, can read it.
+		_, err := client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("test-bucket"), Key: aws.String(key)})
+		assert.Error(t, err, key)
+		_, err = ReadAll(ctx, store, key)
+		assert.NoError(t, err, key)
+	}
+	_, ok := store.URL("derived/waveform.json")
+	assert.False(t, ok)
+}
+
+func TestS3_EncryptRotatesKeys(t *testing.T) {
+	ctx := context.Background()
+	client := s3fake.New()
+	plain := NewS3("test-bucket", client, "")
+	putString(t, plain, "plain", "before encryption")
+	old := newEncryptedS3(client, Encryption{Mode: SSECustomer, Keys: newTestKeyring(t, "a", "a")})
+	putString(t, old, "old", "written with a")
+
+	// An upload started with the old key is finished with the new one.
+	composer := handler.NewStoreComposer()
+	old.UseIn(composer)
+	upload, err := composer.Core.NewUpload(ctx, handler.FileInfo{Size: 2 << 10})
+	require.NoError(t, err)
+	_, err = upload.WriteChunk(ctx, 0, bytes.NewReader(bytes.Repeat([]byte("y"), 1<<10)))
+	require.NoError(t, err)
+	info, err := upload.GetInfo(ctx)
+	require.NoError(t, err)
+
+	store := newEncryptedS3(client, Encryption{Mode: SSECustomer, Keys: newTestKeyring(t, "b", "a", "b")})
+	putString(t, store, "new", "written with b")
+	composer = handler.NewStoreComposer()
+	store.UseIn(composer)
+	upload, err = composer.Core.GetUpload(ctx, info.ID)
+	require.NoError(t, err)
+	_, err = upload.WriteChunk(ctx, 1<<10, bytes.NewReader(bytes.Repeat([]byte("y"), 1<<10)))
+	require.NoError(t, err)
+	require.NoError(t, upload.FinishUpload(ctx))
+
+	for key, want := range map[string]string{
+		"plain": "before encryption",
+		"old":   "written with a",
+		"new":   "written with b",
+	} {
+		data, err := ReadAll(ctx, store, key)
+		require.NoError(t, err, key)
+		assert.Equal(t, want, string(data))
+	}
+	data, err := ReadAll(ctx, store, info.Storage["Key"])
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("y", 2<<10), string(data))
+
+	oldEnc, _ := client.ObjectEncryption("test-bucket", "old")
+	newEnc, _ := client.ObjectEncryption("test-bucket", "new")
+	assert.NotEqual(t, oldEnc, newEnc)
+}
+
+func TestS3_EncryptKMS(t *testing.T) {
+	ctx := context.Background()
+	client := s3fake.New()
+	store := newEncryptedS3(client, Encryption{Mode: SSEKMS, KMSKeyID: "alias/masters"})
+
+	require.NoError(t, uploadMultipart(ctx, store, bytes.Repeat([]byte("x"), 2<<10)))
+	require.NoError(t, store.Copy(ctx, "copy", client.Keys("test-bucket")[0]))
+	for _, key := range client.Keys("test-bucket") {
+		enc, _ := client.ObjectEncryption("test-bucket", key)
+		assert.Equal(t, s3fake.Encryption{SSE: types.ServerSideEncryptionAwsKms, KMSKeyID: "alias/masters"}, enc, key)
+	}
+	_, ok := store.URL("copy")
+	assert.False(t, ok)
+
+	store = newEncryptedS3(client, Encryption{Mode: SSES3})
+	putString(t, store, "public", "data")
+	enc, _ := client.ObjectEncryption("test-bucket", "public")
+	assert.Equal(t, types.ServerSideEncryptionAes256, enc.SSE)
+	url, ok := store.URL("public")
+	assert.True(t, ok)
+	assert.Equal(t, "http://s3.test/test-bucket/public", url)
+}
@@ -0,0 +1,79 @@
+// Package storage abstracts where uploads and the objects derived from them
+// are kept, so the same service runs on S3, on a local directory or on a
+// combination of both.
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/tus/tusd/v2/pkg/handler"
+)
+
+// ErrNotExist is returned, possibly wrapped, for objects that do not exist.
+var ErrNotExist = errors.New("object does not exist")
+
+// Object describes a stored object.
+type Object struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// Store is a storage backend. It provides the tus data store receiving
+// uploads and plain object access to everything kept next to them: .info
+// files, finished uploads and derived objects. Keys are slash separated.
+type Store interface {
+	// UseIn registers the tus data store and its extensions in composer.
+	UseIn(composer *handler.StoreComposer)
+
+	// List returns all objects whose key starts with prefix.
+	List(ctx context.Context, prefix string) ([]Object, error)
+	// Stat returns the object stored under key.
+	Stat(ctx context.Context, key string) (Object, error)
+	// Open reads length bytes of the object starting at offset. A negative
+	// length reads to the end of the object.
+	Open(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+	// Put stores size bytes read from body under key, replacing any object
+	// already there.
+	Put(ctx context.Context, key string, body io.Reader, size int64) error
+	// Copy stores a copy of the object src under dst.
+	Copy(ctx context.Context, dst, src string) error
+	// Delete removes the objects, ignoring those that do not exist.
+	Delete(ctx context.Context, keys ...string) error
+}
+
+// Linker is implemented by stores that can make two keys share the same
+// data without storing it twice.
+type Linker interface {
+	// Link makes dst refer to the data of src, replacing any object at dst.
+	Link(ctx context.Context, dst, src string) error
+}
+
+// URLer is implemented by stores whose objects can be fetched directly by
+// clients, without going through the service.
+type URLer interface {
+	// URL returns where clients fetch the object stored under key, or false
+	// if they cannot fetch it directly.
+	URL(key string) (string, bool)
+}
+
+// Presigner is implemented by stores that can hand out links to private
+// objects which expire.
+type Presigner interface {
+	// Presign returns a link to the object stored under key that is valid
+	// for expires.
+	Presign(ctx context.Context, key string, expires time.Duration) (string, error)
+}
+
+// ReadAll reads the whole object stored under key.
+func ReadAll(ctx context.Context, store Store, key string) ([]byte, error) {
+	body, err := store.Open(ctx, key, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
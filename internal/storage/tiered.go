@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/tus/tusd/v2/pkg/handler"
+)
+
+// Tiered keeps everything in a durable primary store, typically S3, and
+// serves reads of finished objects from a fast local cache, filled on the
+// first full read. Only immutable objects are cached: the .info, .part and
+// .refs objects are rewritten in place, partly by tusd behind the Store's
+// back, so they are always read from the primary store.
+type Tiered struct {
+	Primary Store
+	Cache   Store
+}
+
+// NewTiered creates a store caching reads from primary in cache.
+func NewTiered(primary, cache Store) *Tiered {
+	return &Tiered{Primary: primary, Cache: cache}
+}
+
+// UseIn registers the primary store, which receives all uploads. Uploads
+// terminated through tusd are dropped from the cache as well.
+func (t *Tiered) UseIn(composer *handler.StoreComposer) {
+	primary := handler.NewStoreComposer()
+	t.Primary.UseIn(primary)
+	*composer = *primary
+	if primary.UsesTerminater {
+		composer.UseTerminater(tieredTerminater{TerminaterDataStore: primary.Terminater, cache: t.Cache})
+	}
+}
+
+type tieredTerminater struct {
+	handler.TerminaterDataStore
+	cache Store
+}
+
+func (d tieredTerminater) AsTerminatableUpload(upload handler.Upload) handler.TerminatableUpload {
+	return tieredUpload{
+		TerminatableUpload: d.TerminaterDataStore.AsTerminatableUpload(upload),
+		upload:             upload,
+		cache:              d.cache,
+	}
+}
+
+type tieredUpload struct {
+	handler.TerminatableUpload
+	upload handler.Upload
+	cache  Store
+}
+
+func (u tieredUpload) Terminate(ctx context.Context) error {
+	info, err := u.upload.GetInfo(ctx)
+	if err != nil {
+		return err
+	}
+	if err := u.TerminatableUpload.Terminate(ctx); err != nil {
+		return err
+	}
+	key := info.Storage["Key"]
+	if key == "" {
+		key, _, _ = strings.Cut(info.ID, "+")
+	}
+	return u.cache.Delete(ctx, key)
+}
+
+func (t *Tiered) List(ctx context.Context, prefix string) ([]Object, error) {
+	return t.Primary.List(ctx, prefix)
+}
+
+func (t *Tiered) Stat(ctx context.Context, key string) (Object, error) {
+	return t.Primary.Stat(ctx, key)
+}
+
+// Open serves from the cache when possible. On a miss, a full read copies
+// the object into the cache first, while a ranged read goes straight to the
+// primary store.
+func (t *Tiered) Open(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	if !cacheable(key) {
+		return t.Primary.Open(ctx, key, offset, length)
+	}
+	body, err := t.Cache.Open(ctx, key, offset, length)
+	if err == nil || !errors.Is(err, ErrNotExist) {
+		return body, err
+	}
+	if offset > 0 || length >= 0 {
+		return t.Primary.Open(ctx, key, offset, length)
+	}
+
+	if err := t.fill(ctx, key); err != nil {
+		return t.Primary.Open(ctx, key, offset, length)
+	}
+	return t.Cache.Open(ctx, key, offset, length)
+}
+
+func (t *Tiered) fill(ctx context.Context, key string) error {
+	obj, err := t.Primary.Stat(ctx, key)
+	if err != nil {
+		return err
+	}
+	body, err := t.Primary.Open(ctx, key, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return t.Cache.Put(ctx, key, body, obj.Size)
+}
+
+func (t *Tiered) Put(ctx context.Context, key string, body io.Reader, size int64) error {
+	if err := t.Cache.Delete(ctx, key); err != nil {
+		return err
+	}
+	return t.Primary.Put(ctx, key, body, size)
+}
+
+func (t *Tiered) Copy(ctx context.Context, dst, src string) error {
+	if err := t.Cache.Delete(ctx, dst); err != nil {
+		return err
+	}
+	return t.Primary.Copy(ctx, dst, src)
+}
+
+func (t *Tiered) Delete(ctx context.Context, keys ...string) error {
+	if err := t.Cache.Delete(ctx, keys...); err != nil {
+		return err
+	}
+	return t.Primary.Delete(ctx, keys...)
+}
+
+func cacheable(key string) bool {
+	for _, suffix := range []string{".info", ".part", ".refs", ".tail"} {
+		if strings.HasSuffix(key, suffix) {
+			return false
+		}
+	}
+	return true
+}
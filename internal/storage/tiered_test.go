@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tus/tusd/v2/pkg/handler"
+)
+
+func TestTiered_ReadThrough(t *testing.T) {
+	ctx := context.Background()
+	primary, cache := newTestFile(t), newTestFile(t)
+	store := NewTiered(primary, cache)
+	putString(t, primary, "song", "data")
+
+	// Ranged reads do not fill the cache, full reads do.
+	body, err := store.Open(ctx, "song", 1, 2)
+	require.NoError(t, err)
+	body.Close()
+	_, err = cache.Stat(ctx, "song")
+	assert.ErrorIs(t, err, ErrNotExist)
+
+	data, err := ReadAll(ctx, store, "song")
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+	_, err = cache.Stat(ctx, "song")
+	assert.NoError(t, err)
+
+	// Later reads are served from the cache.
+	require.NoError(t, primary.Delete(ctx, "song"))
+	data, err = ReadAll(ctx, store, "song")
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+}
+
+func TestTiered_MutableObjectsBypassCache(t *testing.T) {
+	ctx := context.Background()
+	primary, cache := newTestFile(t), newTestFile(t)
+	store := NewTiered(primary, cache)
+	putString(t, primary, "song.info", `{"Size":1}`)
+
+	_, err := ReadAll(ctx, store, "song.info")
+	require.NoError(t, err)
+	_, err = cache.Stat(ctx, "song.info")
+	assert.ErrorIs(t, err, ErrNotExist)
+}
+
+func TestTiered_WritesInvalidateCache(t *testing.T) {
+	ctx := context.Background()
+	primary, cache := newTestFile(t), newTestFile(t)
+	store := NewTiered(primary, cache)
+	putString(t, primary, "song", "old")
+	_, err := ReadAll(ctx, store, "song")
+	require.NoError(t, err)
+
+	putString(t, store, "song", "new")
+	data, err := ReadAll(ctx, store, "song")
+	require.NoError(t, err)
+	assert.Equal(t, "new", string(data))
+
+	require.NoError(t, store.Delete(ctx, "song"))
+	_, err = cache.Stat(ctx, "song")
+	assert.ErrorIs(t, err, ErrNotExist)
+}
+
+func TestTiered_TerminateDropsCache(t *testing.T) {
+	ctx := context.Background()
+	primary, cache := newTestFile(t), newTestFile(t)
+	store := NewTiered(primary, cache)
+	composer := handler.NewStoreComposer()
+	store.UseIn(composer)
+
+	upload, err := composer.Core.NewUpload(ctx, handler.FileInfo{ID: "song", Size: 0})
+	require.NoError(t, err)
+	putString(t, cache, "song", "cached")
+
+	require.NoError(t, composer.Terminater.AsTerminatableUpload(upload).Terminate(ctx))
+	_, err = cache.Stat(ctx, "song")
+	assert.ErrorIs(t, err, ErrNotExist)
+	_, err = primary.Stat(ctx, "song.info")
+	assert.ErrorIs(t, err, ErrNotExist)
+}
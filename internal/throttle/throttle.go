@@ -0,0 +1,277 @@
+// Package throttle limits the ingest bandwidth of upload request bodies so
+// uploads do not starve other traffic sharing the link.
+package throttle
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+
+	"music-streaming/backend/internal/identity"
+)
+
+// DefaultClass is used for clients whose tier has no class of its own.
+const DefaultClass = "default"
+
+// minBurst is the smallest token bucket size, and thereby read size, used
+// so slow limits still read in reasonably sized chunks.
+const minBurst = 32 * 1024
+
+// Class is a priority class of clients, selected by account tier.
+type Class struct {
+	// UploadBytesPerSecond limits each upload of this class. Zero is unlimited.
+	UploadBytesPerSecond int64 `json:"upload_bps"`
+	// Share is the fraction of the global limit all uploads of this class may
+	// use together. Shares may add up to more than 1; higher classes should get
+	// a larger share so that lower classes yield under contention.
+	Share float64 `json:"share"`
+}
+
+// Config holds the bandwidth limits.
+type Config struct {
+	// GlobalBytesPerSecond limits all upload bodies together. Zero is unlimited.
+	GlobalBytesPerSecond int64
+	// Classes maps account tiers to their class. DefaultClass applies to
+	// everybody else.
+	Classes map[string]Class
+}
+
+// ConfigFromEnv reads THROTTLE_GLOBAL_BPS, THROTTLE_UPLOAD_BPS and
+// THROTTLE_CLASSES, the latter being a JSON object such as
+// {"label":{"upload_bps":0,"share":1},"free":{"upload_bps":1048576,"share":0.5}}.
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{Classes: map[string]Class{}}
+
+	if v := os.Getenv("THROTTLE_GLOBAL_BPS"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid THROTTLE_GLOBAL_BPS: %w", err)
+		}
+		cfg.GlobalBytesPerSecond = n
+	}
+	if v := os.Getenv("THROTTLE_CLASSES"); v != "" {
+		if err := json.Unmarshal([]byte(v), &cfg.Classes); err != nil {
+			return cfg, fmt.Errorf("invalid THROTTLE_CLASSES: %w", err)
+		}
+	}
+	if _, ok := cfg.Classes[DefaultClass]; !ok {
+		def := Class{Share: 1}
+		if v := os.Getenv("THROTTLE_UPLOAD_BPS"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return cfg, fmt.Errorf("invalid THROTTLE_UPLOAD_BPS: %w", err)
+			}
+			def.UploadBytesPerSecond = n
+		}
+		cfg.Classes[DefaultClass] = def
+	}
+	return cfg, nil
+}
+
+// Throttler applies the bandwidth limits to request bodies.
+type Throttler struct {
+	cfg      Config
+	resolver identity.Resolver
+	global   *rate.Limiter
+	classes  map[string]*rate.Limiter
+
+	mu      sync.Mutex
+	uploads map[string]*uploadBucket
+
+	throttledSeconds *prometheus.CounterVec
+	bytesRead        *prometheus.CounterVec
+}
+
+type uploadBucket struct {
+	limiter *rate.Limiter
+	refs    int
+}
+
+// New creates a Throttler identifying clients with resolver.
+func New(cfg Config, resolver identity.Resolver) *Throttler {
+	t := &Throttler{
+		cfg:      cfg,
+		resolver: resolver,
+		global:   newBucket(float64(cfg.GlobalBytesPerSecond)),
+		classes:  make(map[string]*rate.Limiter),
+		uploads:  make(map[string]*uploadBucket),
+		throttledSeconds: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tusd_ingest_throttled_seconds_total",
+			Help: "Time PATCH request bodies spent waiting for bandwidth.",
+		}, []string{"class"}),
+		bytesRead: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tusd_ingest_bytes_total",
+			Help: "Bytes read from PATCH request bodies.",
+		}, []string{"class"}),
+	}
+	for name, class := range cfg.Classes {
+		if cfg.GlobalBytesPerSecond > 0 && class.Share > 0 {
+			t.classes[name] = newBucket(float64(cfg.GlobalBytesPerSecond) * class.Share)
+		}
+	}
+	return t
+}
+
+// Describe implements prometheus.Collector.
+func (t *Throttler) Describe(ch chan<- *prometheus.Desc) {
+	t.throttledSeconds.Describe(ch)
+	t.bytesRead.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (t *Throttler) Collect(ch chan<- prometheus.Metric) {
+	t.throttledSeconds.Collect(ch)
+	t.bytesRead.Collect(ch)
+}
+
+// Handler throttles the bodies of PATCH requests, and of POST requests
+// creating an upload with data, before they reach next.
+func (t *Throttler) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !carriesUploadData(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		className := t.classOf(t.resolver.Resolve(r))
+		uploadID := strings.TrimPrefix(r.URL.Path, "/files/")
+
+		var buckets []*rate.Limiter
+		if r.Method == http.MethodPost {
+			// The upload is only being created, so nobody shares its bucket.
+			if upload := newBucket(float64(t.cfg.Classes[className].UploadBytesPerSecond)); upload != nil {
+				buckets = append(buckets, upload)
+			}
+		} else if upload := t.acquireUpload(uploadID, className); upload != nil {
+			defer t.releaseUpload(uploadID)
+			buckets = append(buckets, upload)
+		}
+		if class := t.classes[className]; class != nil {
+			buckets = append(buckets, class)
+		}
+		if t.global != nil {
+			buckets = append(buckets, t.global)
+		}
+
+		r.Body = &reader{
+			ctx:       r.Context(),
+			body:      r.Body,
+			buckets:   buckets,
+			chunk:     chunkSize(buckets),
+			throttled: t.throttledSeconds.WithLabelValues(className),
+			bytes:     t.bytesRead.WithLabelValues(className),
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// carriesUploadData reports whether r is a PATCH, or a POST of the tus
+// creation-with-upload extension.
+func carriesUploadData(r *http.Request) bool {
+	if r.Body == nil || r.Body == http.NoBody {
+		return false
+	}
+	return r.Method == http.MethodPatch ||
+		(r.Method == http.MethodPost && r.Header.Get("Content-Type") == "application/offset+octet-stream")
+}
+
+func (t *Throttler) classOf(client identity.Client) string {
+	if _, ok := t.cfg.Classes[client.Tier]; ok && client.Tier != "" {
+		return client.Tier
+	}
+	return DefaultClass
+}
+
+// acquireUpload returns the bucket shared by all concurrent PATCH requests
+// of an upload, or nil if the class has no per-upload limit.
+func (t *Throttler) acquireUpload(id, className string) *rate.Limiter {
+	limit := t.cfg.Classes[className].UploadBytesPerSecond
+	if limit <= 0 {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	bucket := t.uploads[id]
+	if bucket == nil {
+		bucket = &uploadBucket{limiter: newBucket(float64(limit))}
+		t.uploads[id] = bucket
+	}
+	bucket.refs++
+	return bucket.limiter
+}
+
+func (t *Throttler) releaseUpload(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if bucket := t.uploads[id]; bucket != nil {
+		if bucket.refs--; bucket.refs <= 0 {
+			delete(t.uploads, id)
+		}
+	}
+}
+
+// newBucket returns a byte bucket holding roughly one second worth of data,
+// or nil for an unlimited rate.
+func newBucket(bytesPerSecond float64) *rate.Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), max(int(bytesPerSecond), minBurst))
+}
+
+func chunkSize(buckets []*rate.Limiter) int {
+	chunk := 0
+	for _, b := range buckets {
+		if chunk == 0 || b.Burst() < chunk {
+			chunk = b.Burst()
+		}
+	}
+	return chunk
+}
+
+// reader waits for tokens from every bucket for the bytes it reads.
+type reader struct {
+	ctx       context.Context
+	body      io.ReadCloser
+	buckets   []*rate.Limiter
+	chunk     int
+	throttled prometheus.Counter
+	bytes     prometheus.Counter
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if r.chunk > 0 && len(p) > r.chunk {
+		p = p[:r.chunk]
+	}
+	n, err := r.body.Read(p)
+	if n <= 0 {
+		return n, err
+	}
+	r.bytes.Add(float64(n))
+
+	start := time.Now()
+	for _, bucket := range r.buckets {
+		if werr := bucket.WaitN(r.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	if len(r.buckets) > 0 {
+		r.throttled.Add(time.Since(start).Seconds())
+	}
+	return n, err
+}
+
+func (r *reader) Close() error {
+	return r.body.Close()
+}
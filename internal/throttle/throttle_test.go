@@ -0,0 +1,125 @@
+package throttle
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"music-streaming/backend/internal/identity"
+)
+
+var testResolver = identity.Resolver{UserHeader: identity.DefaultUserHeader, TierHeader: identity.DefaultTierHeader, TrustGatewayHeaders: true}
+
+func patch(t *testing.T, h http.Handler, tier string, body []byte) time.Duration {
+	req := httptest.NewRequest(http.MethodPatch, "/files/upload-1", bytes.NewReader(body))
+	req.Header.Set(identity.DefaultUserHeader, "someone")
+	req.Header.Set(identity.DefaultTierHeader, tier)
+
+	start := time.Now()
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	return time.Since(start)
+}
+
+func drain(t *testing.T) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.Copy(io.Discard, r.Body)
+		require.NoError(t, err)
+	})
+}
+
+func TestThrottler_PerUploadLimitByClass(t *testing.T) {
+	th := New(Config{Classes: map[string]Class{
+		DefaultClass: {UploadBytesPerSecond: minBurst},
+		"label":      {},
+	}}, testResolver)
+	h := th.Handler(drain(t))
+	body := make([]byte, minBurst+minBurst/2)
+
+	// The bucket starts full, so the second half chunk waits ~0.5s.
+	elapsed := patch(t, h, "free", body)
+	assert.GreaterOrEqual(t, elapsed, 400*time.Millisecond)
+	assert.Greater(t, testutil.ToFloat64(th.throttledSeconds.WithLabelValues(DefaultClass)), 0.3)
+	assert.Equal(t, float64(len(body)), testutil.ToFloat64(th.bytesRead.WithLabelValues(DefaultClass)))
+
+	// Label accounts have no per-upload limit.
+	elapsed = patch(t, h, "label", body)
+	assert.Less(t, elapsed, 200*time.Millisecond)
+	assert.Empty(t, th.uploads)
+}
+
+func TestThrottler_UntrustedTier(t *testing.T) {
+	untrusted := testResolver
+	untrusted.TrustGatewayHeaders = false
+	th := New(Config{Classes: map[string]Class{
+		DefaultClass: {UploadBytesPerSecond: minBurst},
+		"label":      {},
+	}}, untrusted)
+	h := th.Handler(drain(t))
+	body := make([]byte, minBurst+minBurst/2)
+
+	// Clients cannot pick the label class for themselves.
+	elapsed := patch(t, h, "label", body)
+	assert.GreaterOrEqual(t, elapsed, 400*time.Millisecond)
+	assert.Equal(t, float64(len(body)), testutil.ToFloat64(th.bytesRead.WithLabelValues(DefaultClass)))
+	assert.Zero(t, testutil.ToFloat64(th.bytesRead.WithLabelValues("label")))
+}
+
+func TestThrottler_GlobalShare(t *testing.T) {
+	th := New(Config{
+		GlobalBytesPerSecond: 4 * minBurst,
+		Classes: map[string]Class{
+			DefaultClass: {Share: 0.25},
+			"label":      {Share: 1},
+		},
+	}, testResolver)
+
+	assert.Equal(t, float64(minBurst), float64(th.classes[DefaultClass].Limit()))
+	assert.Equal(t, float64(4*minBurst), float64(th.classes["label"].Limit()))
+}
+
+func TestThrottler_IgnoresOtherMethods(t *testing.T) {
+	th := New(Config{GlobalBytesPerSecond: 1}, testResolver)
+	var body io.Reader
+	h := th.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { body = r.Body }))
+
+	req := httptest.NewRequest(http.MethodPost, "/files/", bytes.NewReader([]byte("x")))
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	_, throttled := body.(*reader)
+	assert.False(t, throttled)
+}
+
+func TestThrottler_CreationWithUpload(t *testing.T) {
+	th := New(Config{Classes: map[string]Class{DefaultClass: {UploadBytesPerSecond: minBurst}}}, testResolver)
+	h := th.Handler(drain(t))
+
+	req := httptest.NewRequest(http.MethodPost, "/files/", bytes.NewReader(make([]byte, minBurst+minBurst/2)))
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	start := time.Now()
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+	assert.Empty(t, th.uploads)
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv("THROTTLE_GLOBAL_BPS", "1000000")
+	t.Setenv("THROTTLE_UPLOAD_BPS", "250000")
+	t.Setenv("THROTTLE_CLASSES", `{"label":{"upload_bps":0,"share":1}}`)
+
+	cfg, err := ConfigFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, int64(1000000), cfg.GlobalBytesPerSecond)
+	assert.Equal(t, Class{Share: 1}, cfg.Classes["label"])
+	assert.Equal(t, Class{UploadBytesPerSecond: 250000, Share: 1}, cfg.Classes[DefaultClass])
+
+	t.Setenv("THROTTLE_CLASSES", `not json`)
+	_, err = ConfigFromEnv()
+	assert.Error(t, err)
+}
@@ -0,0 +1,66 @@
+package transcode
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Fake is a Transcoder and Packager for tests. It writes the rendition's
+// name followed by the input to the output, so tests can tell renditions
+// apart. Packages consist of two segments, each holding half of that.
+type Fake struct {
+	// Err, if set, is returned instead of transcoding.
+	Err error
+
+	mu    sync.Mutex
+	calls []Rendition
+}
+
+func (f *Fake) Transcode(ctx context.Context, input, output string, r Rendition) error {
+	f.mu.Lock()
+	f.calls = append(f.calls, r)
+	f.mu.Unlock()
+	if f.Err != nil {
+		return f.Err
+	}
+	data, err := os.ReadFile(input)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(output, append([]byte(r.Name()+"\n"), data...), 0o600)
+}
+
+func (f *Fake) Package(ctx context.Context, input, dir string, r Rendition, segment time.Duration) error {
+	output := filepath.Join(dir, "rendition")
+	if err := f.Transcode(ctx, input, output, r); err != nil {
+		return err
+	}
+	defer os.Remove(output)
+	data, err := os.ReadFile(output)
+	if err != nil {
+		return err
+	}
+
+	half := len(data) / 2
+	playlist := fmt.Sprintf("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n#EXT-X-PLAYLIST-TYPE:VOD\n", int(segment.Seconds()))
+	for i, part := range [][]byte{data[:half], data[half:]} {
+		name := fmt.Sprintf("segment%05d.ts", i)
+		if err := os.WriteFile(filepath.Join(dir, name), part, 0o600); err != nil {
+			return err
+		}
+		playlist += fmt.Sprintf("#EXTINF:%.3f,\n%s\n", segment.Seconds(), name)
+	}
+	playlist += "#EXT-X-ENDLIST\n"
+	return os.WriteFile(filepath.Join(dir, MediaPlaylist), []byte(playlist), 0o600)
+}
+
+// Calls returns the renditions transcoded so far.
+func (f *Fake) Calls() []Rendition {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Rendition(nil), f.calls...)
+}
@@ -0,0 +1,200 @@
+// Package transcode converts uploaded masters into the renditions served to
+// listeners, such as AAC or Opus at a streaming bitrate.
+package transcode
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Transcoder converts the audio file at input into rendition r, written to
+// output.
+type Transcoder interface {
+	Transcode(ctx context.Context, input, output string, r Rendition) error
+}
+
+// Packager cuts the audio file at input into HLS segments of rendition r,
+// each about segment long. It writes a media playlist named
+// MediaPlaylist, and the segments it refers to, to dir.
+type Packager interface {
+	Package(ctx context.Context, input, dir string, r Rendition, segment time.Duration) error
+}
+
+// MediaPlaylist is the name of the media playlist a Packager writes.
+const MediaPlaylist = "index.m3u8"
+
+// codec describes how ffmpeg produces one of the supported codecs.
+type codec struct {
+	encoder     string
+	format      string
+	extension   string
+	contentType string
+	// hlsCodec is the codec's name in the CODECS attribute of an HLS
+	// playlist.
+	hlsCodec string
+	// hlsSegments is the HLS segment type ffmpeg writes the codec in.
+	hlsSegments string
+}
+
+var codecs = map[string]codec{
+	"aac":  {encoder: "aac", format: "adts", extension: "aac", contentType: "audio/aac", hlsCodec: "mp4a.40.2", hlsSegments: "mpegts"},
+	"opus": {encoder: "libopus", format: "ogg", extension: "opus", contentType: "audio/ogg", hlsCodec: "opus", hlsSegments: "fmp4"},
+	"mp3":  {encoder: "libmp3lame", format: "mp3", extension: "mp3", contentType: "audio/mpeg", hlsCodec: "mp4a.40.34", hlsSegments: "mpegts"},
+}
+
+// Rendition is a codec at a bitrate.
+type Rendition struct {
+	Codec string
+	// Kbps is the bitrate in kilobits per second.
+	Kbps int
+}
+
+// ParseRendition parses a rendition name such as "aac-128k".
+func ParseRendition(name string) (Rendition, error) {
+	codecName, bitrate, ok := strings.Cut(name, "-")
+	kbps, err := strconv.Atoi(strings.TrimSuffix(bitrate, "k"))
+	if !ok || err != nil || kbps <= 0 || !strings.HasSuffix(bitrate, "k") {
+		return Rendition{}, fmt.Errorf("invalid rendition %q, want e.g. aac-128k", name)
+	}
+	if _, ok := codecs[codecName]; !ok {
+		return Rendition{}, fmt.Errorf("unsupported codec %q in rendition %q", codecName, name)
+	}
+	return Rendition{Codec: codecName, Kbps: kbps}, nil
+}
+
+// ParseRenditions parses a comma separated list of rendition names.
+func ParseRenditions(list string) ([]Rendition, error) {
+	var renditions []Rendition
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		r, err := ParseRendition(name)
+		if err != nil {
+			return nil, err
+		}
+		renditions = append(renditions, r)
+	}
+	return renditions, nil
+}
+
+// Name is the rendition's name, as accepted by ParseRendition.
+func (r Rendition) Name() string {
+	return fmt.Sprintf("%s-%dk", r.Codec, r.Kbps)
+}
+
+// Extension is the file extension of the rendition, without a dot.
+func (r Rendition) Extension() string {
+	return codecs[r.Codec].extension
+}
+
+// ContentType is the media type of the rendition.
+func (r Rendition) ContentType() string {
+	return codecs[r.Codec].contentType
+}
+
+// HLSCodec is the rendition's codec as named in HLS playlists.
+func (r Rendition) HLSCodec() string {
+	return codecs[r.Codec].hlsCodec
+}
+
+// HLSVersion is the lowest HLS protocol version that playlists of the
+// rendition's segments may declare: 7 for fragmented MP4, which needs
+// EXT-X-MAP, and 3 otherwise.
+func (r Rendition) HLSVersion() int {
+	if codecs[r.Codec].hlsSegments == "fmp4" {
+		return 7
+	}
+	return 3
+}
+
+// FFmpeg transcodes and packages with a locally installed ffmpeg.
+type FFmpeg struct {
+	// Path is the ffmpeg executable, looked up in PATH if it has no slash.
+	Path string
+}
+
+// NewFFmpeg returns an FFmpeg running path, or "ffmpeg" if it is empty.
+func NewFFmpeg(path string) *FFmpeg {
+	if path == "" {
+		path = "ffmpeg"
+	}
+	return &FFmpeg{Path: path}
+}
+
+// Available reports whether the ffmpeg executable can be found.
+func (f *FFmpeg) Available() bool {
+	_, err := exec.LookPath(f.Path)
+	return err == nil
+}
+
+func (f *FFmpeg) Transcode(ctx context.Context, input, output string, r Rendition) error {
+	c, ok := codecs[r.Codec]
+	if !ok {
+		return fmt.Errorf("unsupported codec %q", r.Codec)
+	}
+	args := append(encodeArgs(input, r, c), "-f", c.format, output)
+	if err := f.run(ctx, r, args); err != nil {
+		os.Remove(output)
+		return err
+	}
+	return nil
+}
+
+// Package writes a video on demand playlist. Codecs that MPEG-TS cannot
+// carry are put in fragmented MP4 segments, with an init.mp4 section.
+func (f *FFmpeg) Package(ctx context.Context, input, dir string, r Rendition, segment time.Duration) error {
+	c, ok := codecs[r.Codec]
+	if !ok {
+		return fmt.Errorf("unsupported codec %q", r.Codec)
+	}
+	extension := "ts"
+	if c.hlsSegments == "fmp4" {
+		extension = "m4s"
+	}
+	args := append(encodeArgs(input, r, c),
+		"-f", "hls",
+		"-hls_time", strconv.FormatFloat(segment.Seconds(), 'f', -1, 64),
+		"-hls_playlist_type", "vod",
+		"-hls_segment_type", c.hlsSegments,
+		"-hls_fmp4_init_filename", "init.mp4",
+		"-hls_segment_filename", filepath.Join(dir, "segment%05d."+extension),
+		filepath.Join(dir, MediaPlaylist),
+	)
+	return f.run(ctx, r, args)
+}
+
+func (f *FFmpeg) run(ctx context.Context, r Rendition, args []string) error {
+	cmd := exec.CommandContext(ctx, f.Path, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg %s: %w: %s", r.Name(), err, lastLine(stderr.String()))
+	}
+	return nil
+}
+
+// encodeArgs keeps only the first audio stream, dropping video streams such
+// as cover art.
+func encodeArgs(input string, r Rendition, c codec) []string {
+	return []string{
+		"-nostdin", "-hide_banner", "-loglevel", "error", "-y",
+		"-i", input,
+		"-vn", "-map", "0:a:0",
+		"-c:a", c.encoder, "-b:a", strconv.Itoa(r.Kbps) + "k",
+	}
+}
+
+// lastLine returns the last non-empty line of ffmpeg's output, which holds
+// the reason it failed.
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return lines[len(lines)-1]
+}
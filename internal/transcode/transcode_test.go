@@ -0,0 +1,105 @@
+package transcode
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRenditions(t *testing.T) {
+	renditions, err := ParseRenditions("aac-128k, opus-96k,mp3-320k,")
+	require.NoError(t, err)
+	assert.Equal(t, []Rendition{{"aac", 128}, {"opus", 96}, {"mp3", 320}}, renditions)
+	assert.Equal(t, "opus-96k", renditions[1].Name())
+	assert.Equal(t, "opus", renditions[1].Extension())
+	assert.Equal(t, "audio/ogg", renditions[1].ContentType())
+
+	renditions, err = ParseRenditions("")
+	require.NoError(t, err)
+	assert.Empty(t, renditions)
+
+	for _, invalid := range []string{"aac", "aac-128", "aac-0k", "flac-900k", "aac-k"} {
+		_, err := ParseRendition(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+// fakeFFmpeg writes a script standing in for ffmpeg that records its
+// arguments and writes them to the output file, its last argument.
+func fakeFFmpeg(t *testing.T, script string) (*FFmpeg, string) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ffmpeg")
+	args := filepath.Join(dir, "args")
+	require.NoError(t, os.WriteFile(path, []byte("#!/bin/sh\necho \"$@\" > "+args+"\n"+script), 0o755))
+	return NewFFmpeg(path), args
+}
+
+func TestFFmpeg_Transcode(t *testing.T) {
+	ffmpeg, args := fakeFFmpeg(t, `for out; do :; done; echo encoded > "$out"`)
+	require.True(t, ffmpeg.Available())
+
+	output := filepath.Join(t.TempDir(), "out.opus")
+	require.NoError(t, ffmpeg.Transcode(context.Background(), "in.wav", output, Rendition{"opus", 96}))
+	data, err := os.ReadFile(output)
+	require.NoError(t, err)
+	assert.Equal(t, "encoded\n", string(data))
+
+	called, err := os.ReadFile(args)
+	require.NoError(t, err)
+	assert.Contains(t, string(called), "-i in.wav")
+	assert.Contains(t, string(called), "-c:a libopus -b:a 96k -f ogg "+output)
+}
+
+func TestFFmpeg_TranscodeFails(t *testing.T) {
+	ffmpeg, _ := fakeFFmpeg(t, "echo 'in.wav: Invalid data found when processing input' >&2\nexit 1")
+	err := ffmpeg.Transcode(context.Background(), "in.wav", filepath.Join(t.TempDir(), "out.aac"), Rendition{"aac", 128})
+	require.Error(t, err)
+	assert.True(t, strings.HasSuffix(err.Error(), "Invalid data found when processing input"), err.Error())
+
+	assert.False(t, NewFFmpeg(filepath.Join(t.TempDir(), "missing")).Available())
+}
+
+func TestFFmpeg_Package(t *testing.T) {
+	ffmpeg, args := fakeFFmpeg(t, "")
+	dir := t.TempDir()
+
+	require.NoError(t, ffmpeg.Package(context.Background(), "in.flac", dir, Rendition{"aac", 128}, 6*time.Second))
+	called, err := os.ReadFile(args)
+	require.NoError(t, err)
+	assert.Contains(t, string(called), "-c:a aac -b:a 128k -f hls -hls_time 6 -hls_playlist_type vod -hls_segment_type mpegts")
+	assert.Contains(t, string(called), filepath.Join(dir, "segment%05d.ts")+" "+filepath.Join(dir, MediaPlaylist))
+
+	require.NoError(t, ffmpeg.Package(context.Background(), "in.flac", dir, Rendition{"opus", 96}, 4*time.Second))
+	called, err = os.ReadFile(args)
+	require.NoError(t, err)
+	assert.Contains(t, string(called), "-hls_time 4 -hls_playlist_type vod -hls_segment_type fmp4")
+	assert.Contains(t, string(called), filepath.Join(dir, "segment%05d.m4s"))
+}
+
+func TestFake(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in")
+	require.NoError(t, os.WriteFile(input, []byte("master"), 0o600))
+
+	fake := &Fake{}
+	require.NoError(t, fake.Transcode(context.Background(), input, filepath.Join(dir, "out"), Rendition{"aac", 128}))
+	data, err := os.ReadFile(filepath.Join(dir, "out"))
+	require.NoError(t, err)
+	assert.Equal(t, "aac-128k\nmaster", string(data))
+	assert.Equal(t, []Rendition{{"aac", 128}}, fake.Calls())
+
+	packaged := t.TempDir()
+	require.NoError(t, fake.Package(context.Background(), input, packaged, Rendition{"aac", 64}, 6*time.Second))
+	playlist, err := os.ReadFile(filepath.Join(packaged, MediaPlaylist))
+	require.NoError(t, err)
+	assert.Contains(t, string(playlist), "#EXTINF:6.000,\nsegment00001.ts\n")
+	entries, err := os.ReadDir(packaged)
+	require.NoError(t, err)
+	assert.Len(t, entries, 3)
+}
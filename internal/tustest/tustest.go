@@ -0,0 +1,415 @@
+// Package tustest checks that an HTTP handler implements the tus 1.0.0
+// protocol, independently of the store behind it.
+//
+// Extensions are tested if the handler advertises them in its Tus-Extension
+// header and skipped otherwise.
+package tustest
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Version is the protocol version the suite checks.
+const Version = "1.0.0"
+
+// StatusChecksumMismatch is the status the checksum extension defines for a
+// chunk not matching its checksum.
+const StatusChecksumMismatch = 460
+
+// Config describes the handler under test.
+type Config struct {
+	// BasePath is the path uploads are created at, e.g. "/files/".
+	BasePath string
+	// NewHandler returns the handler to test. It is called once per test, so
+	// that tests do not see each other's uploads.
+	NewHandler func(t *testing.T) http.Handler
+}
+
+// Run runs the conformance suite as subtests of t.
+func Run(t *testing.T, cfg Config) {
+	tests := []struct {
+		name      string
+		extension string
+		fn        func(t *testing.T, c *client)
+	}{
+		{"core/options", "", testOptions},
+		{"core/version", "", testVersion},
+		{"core/head", "", testHead},
+		{"core/head-unknown", "", testHeadUnknown},
+		{"core/resume", "", testResume},
+		{"core/offset-mismatch", "", testOffsetMismatch},
+		{"core/content-type", "", testContentType},
+		{"core/exceeds-length", "", testExceedsLength},
+		{"core/patch-unknown", "", testPatchUnknown},
+		{"creation/create", "creation", testCreate},
+		{"creation/invalid-length", "creation", testInvalidLength},
+		{"creation/metadata", "creation", testMetadata},
+		{"creation-with-upload", "creation-with-upload", testCreationWithUpload},
+		{"creation-defer-length", "creation-defer-length", testDeferLength},
+		{"termination", "termination", testTermination},
+		{"checksum", "checksum", testChecksum},
+		{"concatenation", "concatenation", testConcatenation},
+		{"expiration", "expiration", testExpiration},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &client{t: t, handler: cfg.NewHandler(t), basePath: cfg.BasePath}
+			if tt.extension != "" && !c.supports(tt.extension) {
+				t.Skipf("extension %s is not supported", tt.extension)
+			}
+			tt.fn(t, c)
+		})
+	}
+}
+
+// client sends requests to the handler under test.
+type client struct {
+	t        *testing.T
+	handler  http.Handler
+	basePath string
+}
+
+// do sends a request with the Tus-Resumable header and the given header
+// name/value pairs.
+func (c *client) do(method, path string, body string, headers ...string) *http.Response {
+	c.t.Helper()
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, path, r)
+	req.Header.Set("Tus-Resumable", Version)
+	for i := 0; i+1 < len(headers); i += 2 {
+		if headers[i+1] == "" {
+			req.Header.Del(headers[i])
+		} else {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+	}
+	rr := httptest.NewRecorder()
+	c.handler.ServeHTTP(rr, req)
+	resp := rr.Result()
+	resp.Request = req
+	return resp
+}
+
+func (c *client) supports(extension string) bool {
+	c.t.Helper()
+	resp := c.do("OPTIONS", c.basePath, "")
+	for _, ext := range strings.Split(resp.Header.Get("Tus-Extension"), ",") {
+		if strings.TrimSpace(ext) == extension {
+			return true
+		}
+	}
+	return false
+}
+
+// create creates an upload of size bytes and returns its path.
+func (c *client) create(size int, headers ...string) string {
+	c.t.Helper()
+	resp := c.do("POST", c.basePath, "", append([]string{"Upload-Length", strconv.Itoa(size)}, headers...)...)
+	expectStatus(c.t, resp, http.StatusCreated)
+	return c.location(resp)
+}
+
+// location returns the path of the upload a response points to.
+func (c *client) location(resp *http.Response) string {
+	c.t.Helper()
+	location := resp.Header.Get("Location")
+	u, err := url.Parse(location)
+	if err != nil || location == "" {
+		c.t.Fatalf("invalid Location header %q", location)
+	}
+	return u.Path
+}
+
+func (c *client) patch(path string, offset int, data string, headers ...string) *http.Response {
+	c.t.Helper()
+	return c.do("PATCH", path, data, append([]string{
+		"Content-Type", "application/offset+octet-stream",
+		"Upload-Offset", strconv.Itoa(offset),
+	}, headers...)...)
+}
+
+// offset returns the Upload-Offset reported by HEAD.
+func (c *client) offset(path string) int {
+	c.t.Helper()
+	resp := c.do("HEAD", path, "")
+	expectStatus(c.t, resp, http.StatusOK)
+	return expectOffset(c.t, resp)
+}
+
+func expectStatus(t *testing.T, resp *http.Response, want ...int) {
+	t.Helper()
+	for _, status := range want {
+		if resp.StatusCode == status {
+			return
+		}
+	}
+	body, _ := io.ReadAll(resp.Body)
+	t.Fatalf("%s %s: got status %d, want %v (body %q)", resp.Request.Method, resp.Request.URL.Path, resp.StatusCode, want, body)
+}
+
+func expectClientError(t *testing.T, resp *http.Response) {
+	t.Helper()
+	if resp.StatusCode < 400 || resp.StatusCode >= 500 {
+		t.Fatalf("%s %s: got status %d, want a client error", resp.Request.Method, resp.Request.URL.Path, resp.StatusCode)
+	}
+}
+
+func expectHeader(t *testing.T, resp *http.Response, name, want string) {
+	t.Helper()
+	if got := resp.Header.Get(name); got != want {
+		t.Fatalf("%s %s: got %s %q, want %q", resp.Request.Method, resp.Request.URL.Path, name, got, want)
+	}
+}
+
+func expectOffset(t *testing.T, resp *http.Response) int {
+	t.Helper()
+	offset, err := strconv.Atoi(resp.Header.Get("Upload-Offset"))
+	if err != nil {
+		t.Fatalf("%s %s: invalid Upload-Offset %q", resp.Request.Method, resp.Request.URL.Path, resp.Header.Get("Upload-Offset"))
+	}
+	return offset
+}
+
+func testOptions(t *testing.T, c *client) {
+	resp := c.do("OPTIONS", c.basePath, "", "Tus-Resumable", "")
+	expectStatus(t, resp, http.StatusOK, http.StatusNoContent)
+	if !strings.Contains(resp.Header.Get("Tus-Version"), Version) {
+		t.Fatalf("Tus-Version %q does not list %s", resp.Header.Get("Tus-Version"), Version)
+	}
+}
+
+func testVersion(t *testing.T, c *client) {
+	resp := c.do("POST", c.basePath, "", "Tus-Resumable", "0.2.0", "Upload-Length", "1")
+	expectStatus(t, resp, http.StatusPreconditionFailed)
+	if resp.Header.Get("Tus-Version") == "" {
+		t.Fatal("412 response without Tus-Version")
+	}
+}
+
+func testHead(t *testing.T, c *client) {
+	path := c.create(10)
+	resp := c.do("HEAD", path, "")
+	expectStatus(t, resp, http.StatusOK)
+	expectHeader(t, resp, "Tus-Resumable", Version)
+	expectHeader(t, resp, "Upload-Offset", "0")
+	expectHeader(t, resp, "Upload-Length", "10")
+	expectHeader(t, resp, "Cache-Control", "no-store")
+}
+
+func testHeadUnknown(t *testing.T, c *client) {
+	resp := c.do("HEAD", c.basePath+"unknown", "")
+	expectStatus(t, resp, http.StatusNotFound, http.StatusGone)
+}
+
+func testResume(t *testing.T, c *client) {
+	path := c.create(10)
+	resp := c.patch(path, 0, "01234")
+	expectStatus(t, resp, http.StatusNoContent)
+	expectHeader(t, resp, "Tus-Resumable", Version)
+	expectHeader(t, resp, "Upload-Offset", "5")
+
+	offset := c.offset(path)
+	if offset != 5 {
+		t.Fatalf("HEAD reported offset %d after writing 5 bytes", offset)
+	}
+	resp = c.patch(path, offset, "56789")
+	expectStatus(t, resp, http.StatusNoContent)
+	expectHeader(t, resp, "Upload-Offset", "10")
+}
+
+func testOffsetMismatch(t *testing.T, c *client) {
+	path := c.create(10)
+	expectStatus(t, c.patch(path, 0, "01234"), http.StatusNoContent)
+	expectStatus(t, c.patch(path, 3, "34567"), http.StatusConflict)
+	if offset := c.offset(path); offset != 5 {
+		t.Fatalf("offset changed to %d by a rejected PATCH", offset)
+	}
+}
+
+func testContentType(t *testing.T, c *client) {
+	path := c.create(10)
+	resp := c.patch(path, 0, "01234", "Content-Type", "application/octet-stream")
+	// 415 is recommended, but not required.
+	expectStatus(t, resp, http.StatusUnsupportedMediaType, http.StatusBadRequest)
+}
+
+func testExceedsLength(t *testing.T, c *client) {
+	path := c.create(4)
+	expectClientError(t, c.patch(path, 0, "01234"))
+	if offset := c.offset(path); offset != 0 {
+		t.Fatalf("offset changed to %d by a PATCH beyond Upload-Length", offset)
+	}
+}
+
+func testPatchUnknown(t *testing.T, c *client) {
+	expectStatus(t, c.patch(c.basePath+"unknown", 0, "data"), http.StatusNotFound, http.StatusGone)
+}
+
+func testCreate(t *testing.T, c *client) {
+	resp := c.do("POST", c.basePath, "", "Upload-Length", "10")
+	expectStatus(t, resp, http.StatusCreated)
+	expectHeader(t, resp, "Tus-Resumable", Version)
+	path := c.location(resp)
+	if !strings.HasPrefix(path, c.basePath) {
+		t.Fatalf("Location %q is outside of %s", path, c.basePath)
+	}
+	if second := c.create(10); second == path {
+		t.Fatal("two uploads got the same Location")
+	}
+}
+
+func testInvalidLength(t *testing.T, c *client) {
+	expectStatus(t, c.do("POST", c.basePath, ""), http.StatusBadRequest)
+	expectStatus(t, c.do("POST", c.basePath, "", "Upload-Length", "-1"), http.StatusBadRequest)
+	expectStatus(t, c.do("POST", c.basePath, "", "Upload-Length", "ten"), http.StatusBadRequest)
+}
+
+func testMetadata(t *testing.T, c *client) {
+	encoded := base64.StdEncoding.EncodeToString([]byte("song.mp3"))
+	path := c.create(10, "Upload-Metadata", "filename "+encoded+",is_confidential")
+	resp := c.do("HEAD", path, "")
+	expectStatus(t, resp, http.StatusOK)
+	metadata := resp.Header.Get("Upload-Metadata")
+	for _, pair := range []string{"filename " + encoded, "is_confidential"} {
+		found := false
+		for _, got := range strings.Split(metadata, ",") {
+			found = found || strings.TrimSpace(got) == pair
+		}
+		if !found {
+			t.Fatalf("Upload-Metadata %q does not contain %q", metadata, pair)
+		}
+	}
+}
+
+func testCreationWithUpload(t *testing.T, c *client) {
+	resp := c.do("POST", c.basePath, "01234",
+		"Upload-Length", "10",
+		"Content-Type", "application/offset+octet-stream")
+	expectStatus(t, resp, http.StatusCreated)
+	expectHeader(t, resp, "Upload-Offset", "5")
+	path := c.location(resp)
+	if offset := c.offset(path); offset != 5 {
+		t.Fatalf("HEAD reported offset %d after creating with 5 bytes", offset)
+	}
+	expectStatus(t, c.patch(path, 5, "56789"), http.StatusNoContent)
+}
+
+func testDeferLength(t *testing.T, c *client) {
+	expectStatus(t, c.do("POST", c.basePath, "", "Upload-Defer-Length", "2"), http.StatusBadRequest)
+
+	resp := c.do("POST", c.basePath, "", "Upload-Defer-Length", "1")
+	expectStatus(t, resp, http.StatusCreated)
+	path := c.location(resp)
+
+	resp = c.do("HEAD", path, "")
+	expectStatus(t, resp, http.StatusOK)
+	expectHeader(t, resp, "Upload-Defer-Length", "1")
+	expectHeader(t, resp, "Upload-Length", "")
+
+	expectStatus(t, c.patch(path, 0, "01234"), http.StatusNoContent)
+	resp = c.patch(path, 5, "56789", "Upload-Length", "10")
+	expectStatus(t, resp, http.StatusNoContent)
+	expectHeader(t, resp, "Upload-Offset", "10")
+
+	resp = c.do("HEAD", path, "")
+	expectStatus(t, resp, http.StatusOK)
+	expectHeader(t, resp, "Upload-Length", "10")
+	expectHeader(t, resp, "Upload-Defer-Length", "")
+}
+
+func testTermination(t *testing.T, c *client) {
+	path := c.create(10)
+	expectStatus(t, c.patch(path, 0, "01234"), http.StatusNoContent)
+
+	resp := c.do("DELETE", path, "")
+	expectStatus(t, resp, http.StatusNoContent)
+	expectHeader(t, resp, "Tus-Resumable", Version)
+	expectStatus(t, c.do("HEAD", path, ""), http.StatusNotFound, http.StatusGone)
+	expectStatus(t, c.do("DELETE", c.basePath+"unknown", ""), http.StatusNotFound, http.StatusGone)
+}
+
+func testChecksum(t *testing.T, c *client) {
+	resp := c.do("OPTIONS", c.basePath, "")
+	algorithms := strings.Split(resp.Header.Get("Tus-Checksum-Algorithm"), ",")
+	supportsSHA1 := false
+	for _, algorithm := range algorithms {
+		supportsSHA1 = supportsSHA1 || strings.TrimSpace(algorithm) == "sha1"
+	}
+	if !supportsSHA1 {
+		// The protocol requires every server with the extension to support it.
+		t.Fatalf("Tus-Checksum-Algorithm %q does not list sha1", resp.Header.Get("Tus-Checksum-Algorithm"))
+	}
+
+	path := c.create(10)
+	sum := sha1.Sum([]byte("01234"))
+	checksum := "sha1 " + base64.StdEncoding.EncodeToString(sum[:])
+
+	expectStatus(t, c.patch(path, 0, "01235", "Upload-Checksum", checksum), StatusChecksumMismatch)
+	if offset := c.offset(path); offset != 0 {
+		t.Fatalf("offset changed to %d by a chunk with a wrong checksum", offset)
+	}
+	expectStatus(t, c.patch(path, 0, "01234", "Upload-Checksum", "unknown "+base64.StdEncoding.EncodeToString(sum[:])), http.StatusBadRequest)
+
+	resp = c.patch(path, 0, "01234", "Upload-Checksum", checksum)
+	expectStatus(t, resp, http.StatusNoContent)
+	expectHeader(t, resp, "Upload-Offset", "5")
+}
+
+func testConcatenation(t *testing.T, c *client) {
+	first := c.create(5, "Upload-Concat", "partial")
+	second := c.create(5, "Upload-Concat", "partial")
+	expectStatus(t, c.patch(first, 0, "01234"), http.StatusNoContent)
+
+	resp := c.do("HEAD", first, "")
+	expectStatus(t, resp, http.StatusOK)
+	expectHeader(t, resp, "Upload-Concat", "partial")
+
+	// Partial uploads must be finished before they are concatenated.
+	expectClientError(t, c.do("POST", c.basePath, "", "Upload-Concat", "final;"+first+" "+second))
+	expectStatus(t, c.patch(second, 0, "56789"), http.StatusNoContent)
+	expectClientError(t, c.do("POST", c.basePath, "", "Upload-Concat", "final;"+first+" "+c.basePath+"unknown"))
+
+	resp = c.do("POST", c.basePath, "", "Upload-Concat", "final;"+first+" "+second)
+	expectStatus(t, resp, http.StatusCreated)
+	final := c.location(resp)
+
+	resp = c.do("HEAD", final, "")
+	expectStatus(t, resp, http.StatusOK)
+	expectHeader(t, resp, "Upload-Length", "10")
+	expectHeader(t, resp, "Upload-Offset", "10")
+	if concat := resp.Header.Get("Upload-Concat"); !strings.HasPrefix(concat, "final;") {
+		t.Fatalf("Upload-Concat %q of a final upload", concat)
+	}
+
+	// Final uploads cannot be written to.
+	expectStatus(t, c.patch(final, 10, "x"), http.StatusForbidden)
+}
+
+func testExpiration(t *testing.T, c *client) {
+	resp := c.do("POST", c.basePath, "", "Upload-Length", "10")
+	expectStatus(t, resp, http.StatusCreated)
+	path := c.location(resp)
+
+	resp = c.patch(path, 0, "01234")
+	expectStatus(t, resp, http.StatusNoContent)
+	expires, err := http.ParseTime(resp.Header.Get("Upload-Expires"))
+	if err != nil {
+		t.Fatalf("invalid Upload-Expires %q", resp.Header.Get("Upload-Expires"))
+	}
+	if !expires.After(time.Now()) {
+		t.Fatalf("unfinished upload already expired at %s", expires)
+	}
+}
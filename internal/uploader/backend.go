@@ -0,0 +1,181 @@
+package uploader
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"music-streaming/backend/internal/storage"
+)
+
+// Storage backends selectable with STORAGE_BACKEND.
+const (
+	BackendS3     = "s3"
+	BackendFile   = "file"
+	BackendTiered = "tiered"
+)
+
+// NewStoreFromEnv creates the storage backend named by STORAGE_BACKEND:
+//   - "s3" (default) stores everything in S3_BUCKET;
+//   - "file" stores everything in FILESTORE_DIR (default ./data), for
+//     local development without S3;
+//   - "tiered" stores everything in S3_BUCKET and caches finished files in
+//     CACHE_DIR (default ./cache).
+//
+// S3_SMALL_UPLOAD_THRESHOLD overrides the size up to which S3 uploads are
+// stored with a single PutObject, 16 MiB by default; 0 always uses multipart
+// uploads. Their data waits in S3_PART_TEMP_DIR as well. Multipart uploads
+// are tuned with S3_PREFERRED_PART_SIZE, S3_MIN_PART_SIZE,
+// S3_MAX_BUFFERED_PARTS, S3_PART_TEMP_DIR and S3_CONCURRENT_PART_UPLOADS.
+//
+// S3_SSE turns on server-side encryption: "s3", "kms" with the key
+// S3_SSE_KMS_KEY_ID, or "customer" with the keys in the keyring file
+// S3_SSE_KEYRING.
+//
+// ENVELOPE_KEY_FILE turns on client-side encryption of uploads on any
+// backend, with data keys wrapped by the master key in the file.
+func NewStoreFromEnv() (storage.Store, error) {
+	store, err := newBackendFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	path := os.Getenv("ENVELOPE_KEY_FILE")
+	if path == "" {
+		return store, nil
+	}
+	key, err := storage.LoadMasterKey(path)
+	if err != nil {
+		return nil, err
+	}
+	return storage.NewEnvelope(store, key)
+}
+
+func newBackendFromEnv() (storage.Store, error) {
+	backend := os.Getenv("STORAGE_BACKEND")
+	switch backend {
+	case "", BackendS3:
+		return newS3StoreFromEnv()
+	case BackendFile:
+		return storage.NewFile(envOr("FILESTORE_DIR", "./data"))
+	case BackendTiered:
+		primary, err := newS3StoreFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		cache, err := storage.NewFile(envOr("CACHE_DIR", "./cache"))
+		if err != nil {
+			return nil, err
+		}
+		return storage.NewTiered(primary, cache), nil
+	}
+	return nil, fmt.Errorf("unknown STORAGE_BACKEND %q", backend)
+}
+
+func newS3StoreFromEnv() (*storage.S3, error) {
+	accessKey := os.Getenv("AWS_ACCESS_KEY_ID")
+	secretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
+	s3Endpoint := os.Getenv("S3_ENDPOINT")
+	region := os.Getenv("AWS_REGION")
+	bucketName := os.Getenv("S3_BUCKET")
+
+	// 1. Configure AWS SDK v2
+	customResolver := aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
+		if s3Endpoint != "" {
+			return aws.Endpoint{
+				PartitionID:   "aws",
+				URL:           s3Endpoint,
+				SigningRegion: region,
+			}, nil
+		}
+		return aws.Endpoint{}, &aws.EndpointNotFoundError{}
+	})
+
+	cfg, err := config.LoadDefaultConfig(context.TODO(),
+		config.WithRegion(region),
+		config.WithEndpointResolverWithOptions(customResolver),
+		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(accessKey, secretKey, "")),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load SDK config: %w", err)
+	}
+
+	// 2. Create S3 Client, tracing every call
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.UsePathStyle = true
+	})
+
+	store := storage.NewS3(bucketName, TraceS3(client), s3Endpoint)
+	store.Signer = s3.NewPresignClient(client)
+	if err := s3TuningFromEnv(store); err != nil {
+		return nil, err
+	}
+	enc, err := s3EncryptionFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if enc.Mode != "" {
+		store.Encrypt(enc)
+	}
+	return store, nil
+}
+
+func s3EncryptionFromEnv() (storage.Encryption, error) {
+	enc := storage.Encryption{
+		Mode:     os.Getenv("S3_SSE"),
+		KMSKeyID: os.Getenv("S3_SSE_KMS_KEY_ID"),
+	}
+	if path := os.Getenv("S3_SSE_KEYRING"); path != "" {
+		keys, err := storage.LoadKeyring(path)
+		if err != nil {
+			return enc, err
+		}
+		enc.Keys = keys
+	}
+	if err := enc.Validate(); err != nil {
+		return enc, fmt.Errorf("invalid S3 encryption settings: %w", err)
+	}
+	return enc, nil
+}
+
+// s3TuningFromEnv applies the size and concurrency settings of store given
+// in the environment.
+func s3TuningFromEnv(store *storage.S3) error {
+	var concurrency int64
+	settings := map[string]*int64{
+		"S3_SMALL_UPLOAD_THRESHOLD":  &store.SmallUploadThreshold,
+		"S3_PREFERRED_PART_SIZE":     &store.Parts.PreferredSize,
+		"S3_MIN_PART_SIZE":           &store.Parts.MinSize,
+		"S3_MAX_BUFFERED_PARTS":      &store.Parts.MaxBuffered,
+		"S3_CONCURRENT_PART_UPLOADS": &concurrency,
+	}
+	for name, setting := range settings {
+		v := os.Getenv(name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid %s %q", name, v)
+		}
+		*setting = n
+	}
+	store.Parts.Concurrency = int(concurrency)
+	store.Parts.TempDir = os.Getenv("S3_PART_TEMP_DIR")
+	if err := store.Parts.Validate(); err != nil {
+		return fmt.Errorf("invalid S3 part settings: %w", err)
+	}
+	return nil
+}
+
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
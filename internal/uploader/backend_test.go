@@ -0,0 +1,124 @@
+package uploader
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"music-streaming/backend/internal/identity"
+	"music-streaming/backend/internal/s3fake"
+	"music-streaming/backend/internal/storage"
+	"music-streaming/backend/internal/tustest"
+)
+
+func TestNewStoreFromEnv(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	t.Setenv("STORAGE_BACKEND", BackendFile)
+	t.Setenv("FILESTORE_DIR", dir)
+	store, err := NewStoreFromEnv()
+	require.NoError(t, err)
+	require.Equal(t, dir, store.(*storage.File).Dir)
+
+	t.Setenv("STORAGE_BACKEND", BackendS3)
+	t.Setenv("S3_SMALL_UPLOAD_THRESHOLD", "1024")
+	store, err = NewStoreFromEnv()
+	require.NoError(t, err)
+	require.Equal(t, int64(1024), store.(*storage.S3).SmallUploadThreshold)
+
+	t.Setenv("S3_PREFERRED_PART_SIZE", "16777216")
+	t.Setenv("S3_CONCURRENT_PART_UPLOADS", "4")
+	t.Setenv("S3_PART_TEMP_DIR", dir)
+	store, err = NewStoreFromEnv()
+	require.NoError(t, err)
+	require.Equal(t, storage.PartConfig{PreferredSize: 16 << 20, Concurrency: 4, TempDir: dir}, store.(*storage.S3).Parts)
+
+	t.Setenv("S3_PREFERRED_PART_SIZE", "1024")
+	_, err = NewStoreFromEnv()
+	require.Error(t, err)
+	t.Setenv("S3_PREFERRED_PART_SIZE", "")
+
+	t.Setenv("S3_SMALL_UPLOAD_THRESHOLD", "-1")
+	_, err = NewStoreFromEnv()
+	require.Error(t, err)
+	t.Setenv("S3_SMALL_UPLOAD_THRESHOLD", "")
+
+	t.Setenv("S3_SSE", storage.SSECustomer)
+	_, err = NewStoreFromEnv()
+	require.Error(t, err, "customer keys need a keyring")
+	keyring := filepath.Join(t.TempDir(), "keyring.json")
+	require.NoError(t, os.WriteFile(keyring, []byte(`{"current": "a", "keys": {"a": "`+strings.Repeat("A", 43)+`="}}`), 0o600))
+	t.Setenv("S3_SSE_KEYRING", keyring)
+	store, err = NewStoreFromEnv()
+	require.NoError(t, err)
+	_, ok := store.(*storage.S3).URL("song")
+	require.False(t, ok)
+	t.Setenv("S3_SSE", "")
+
+	t.Setenv("ENVELOPE_KEY_FILE", filepath.Join(t.TempDir(), "missing.key"))
+	_, err = NewStoreFromEnv()
+	require.Error(t, err)
+	masterKey := filepath.Join(t.TempDir(), "master.key")
+	require.NoError(t, os.WriteFile(masterKey, []byte(strings.Repeat("A", 43)+"="), 0o600))
+	t.Setenv("ENVELOPE_KEY_FILE", masterKey)
+	store, err = NewStoreFromEnv()
+	require.NoError(t, err)
+	_, ok = store.(storage.URLer)
+	require.False(t, ok, "envelope encrypted data cannot be served from the bucket")
+	t.Setenv("ENVELOPE_KEY_FILE", "")
+
+	t.Setenv("STORAGE_BACKEND", "ftp")
+	_, err = NewStoreFromEnv()
+	require.Error(t, err)
+}
+
+// TestTusConformance checks the tus handler against the protocol on every
+// storage backend.
+func TestTusConformance(t *testing.T) {
+	backends := map[string]func(t *testing.T) storage.Store{
+		BackendS3: func(t *testing.T) storage.Store {
+			return storage.NewS3("test-bucket", s3fake.New(), "")
+		},
+		"s3-multipart": func(t *testing.T) storage.Store {
+			return newMultipartStore(s3fake.New())
+		},
+		BackendFile: func(t *testing.T) storage.Store {
+			store, err := storage.NewFile(t.TempDir())
+			require.NoError(t, err)
+			return store
+		},
+		"envelope": func(t *testing.T) storage.Store {
+			store, err := storage.NewEnvelope(newMultipartStore(s3fake.New()), bytes.Repeat([]byte{1}, 32))
+			require.NoError(t, err)
+			return store
+		},
+		BackendTiered: func(t *testing.T) storage.Store {
+			cache, err := storage.NewFile(t.TempDir())
+			require.NoError(t, err)
+			return storage.NewTiered(storage.NewS3("test-bucket", s3fake.New(), ""), cache)
+		},
+	}
+
+	for name, newStore := range backends {
+		t.Run(name, func(t *testing.T) {
+			tustest.Run(t, tustest.Config{
+				BasePath: "/files/",
+				NewHandler: func(t *testing.T) http.Handler {
+					// Only identified users may concatenate uploads, so the
+					// handler is run as behind the gateway.
+					resolver := identity.Resolver{UserHeader: identity.DefaultUserHeader, TrustGatewayHeaders: true}
+					handler, err := NewTusHandler(newStore(t), resolver)
+					require.NoError(t, err)
+					return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						r.Header.Set(identity.DefaultUserHeader, "tester")
+						handler.ServeHTTP(w, r)
+					})
+				},
+			})
+		})
+	}
+}
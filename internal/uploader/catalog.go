@@ -0,0 +1,168 @@
+package uploader
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tus/tusd/v2/pkg/handler"
+
+	"music-streaming/backend/internal/catalog"
+)
+
+// defaultCatalogPath is where the catalog is kept unless CATALOG_PATH says
+// otherwise.
+const defaultCatalogPath = "catalog.db"
+
+// OpenCatalogFromEnv opens the catalog database at CATALOG_PATH.
+func OpenCatalogFromEnv() (*catalog.Catalog, error) {
+	path := os.Getenv("CATALOG_PATH")
+	if path == "" {
+		path = defaultCatalogPath
+	}
+	return catalog.Open(path)
+}
+
+// CatalogStage adds completed uploads to the App's catalog, filed under the
+// artist and album of their tags, and to its search index. It runs after
+// every other stage, so the catalog holds what they recorded.
+type CatalogStage struct{}
+
+func (CatalogStage) Name() string { return "catalog" }
+
+func (CatalogStage) Process(ctx context.Context, upload *CompletedUpload) error {
+	if upload.App.Catalog == nil {
+		return nil
+	}
+	key := objectKey(upload.Info)
+	dataKey := key
+	if blob := upload.Info.MetaData[MetadataBlob]; blob != "" {
+		dataKey = blob
+	}
+	if err := upload.App.Catalog.PutTrack(ctx, trackOf(key, dataKey, upload.Info.Size, upload.Info.MetaData)); err != nil {
+		return err
+	}
+	return upload.App.indexTrack(ctx, key)
+}
+
+// Terminate removes the upload from the catalog and the search index.
+func (CatalogStage) Terminate(ctx context.Context, upload *CompletedUpload) error {
+	app := upload.App
+	if app.Catalog == nil {
+		return nil
+	}
+	key := objectKey(upload.Info)
+	if app.Search != nil {
+		app.Search.Remove(key)
+	}
+	return app.Catalog.DeleteTrack(ctx, key)
+}
+
+// trackOf returns the catalog track of the upload stored under key.
+func trackOf(key, dataKey string, size int64, metadata handler.MetaData) *catalog.Track {
+	t := &catalog.Track{
+		Key:         key,
+		Name:        key,
+		DataKey:     dataKey,
+		Size:        size,
+		SHA256:      metadata[MetadataSHA256],
+		Owner:       metadata[MetadataOwner],
+		Title:       metadata[MetadataTitle],
+		Artist:      metadata[MetadataArtist],
+		Album:       metadata[MetadataAlbum],
+		AlbumArtist: metadata[MetadataAlbumArtist],
+		Genre:       metadata[MetadataGenre],
+		Explicit:    metadata[MetadataExplicit] == "true",
+		Metadata:    metadata,
+	}
+	if filename := metadata["filename"]; filename != "" {
+		t.Name = filename
+	}
+	t.TrackNumber, _ = strconv.Atoi(metadata[MetadataTrackNumber])
+	t.Year, _ = strconv.Atoi(metadata[MetadataYear])
+	if seconds, err := strconv.ParseFloat(metadata[MetadataDuration], 64); err == nil {
+		t.Duration = time.Duration(seconds * float64(time.Second))
+	}
+	return t
+}
+
+// RebuildCatalog makes the catalog match the uploads in the store: every
+// completed upload is cataloged from its .info, including those whose data
+// has been deduplicated into a shared blob, and tracks of uploads that are
+// gone are removed. The search index is rebuilt along with it. It runs on
+// startup when the catalog is empty, e.g. the first time the service runs
+// with one.
+func (a *App) RebuildCatalog(ctx context.Context) error {
+	objects, err := a.Store.List(ctx, "")
+	if err != nil {
+		return fmt.Errorf("failed to list objects: %w", err)
+	}
+
+	sizes := make(map[string]int64, len(objects))
+	for _, obj := range objects {
+		sizes[obj.Key] = obj.Size
+	}
+
+	found := make(map[string]bool)
+	for _, obj := range objects {
+		key := obj.Key
+		// Only include files (not directories, tus .part files, blobs or
+		// derived objects)
+		if key == "" || strings.HasPrefix(key, blobPrefix) || strings.HasPrefix(key, derivedPrefix) || strings.HasSuffix(key, ".part") {
+			continue
+		}
+		deduplicated := false
+		if strings.HasSuffix(key, ".info") {
+			// An .info without its data object is either still uploading or
+			// has been deduplicated; only the latter is listed.
+			key = strings.TrimSuffix(key, ".info")
+			if _, ok := sizes[key]; ok {
+				continue
+			}
+			deduplicated = true
+		}
+
+		dataKey, size := key, obj.Size
+		metadata := handler.MetaData{}
+		if info, err := a.loadInfo(ctx, key); err == nil {
+			// Partial uploads are only building blocks of a final upload.
+			if info.IsPartial {
+				continue
+			}
+			// Stores that write uploads in place hold unfinished data too.
+			if !deduplicated && (info.SizeIsDeferred || obj.Size < info.Size) {
+				continue
+			}
+			metadata = info.MetaData
+			if blob := metadata[MetadataBlob]; blob != "" {
+				// Blobs of edited tracks differ in size from the upload.
+				dataKey = blob
+				size = sizes[blob]
+			}
+		}
+		if deduplicated && dataKey == key {
+			continue
+		}
+
+		if err := a.Catalog.PutTrack(ctx, trackOf(key, dataKey, size, metadata)); err != nil {
+			return err
+		}
+		found[key] = true
+	}
+
+	tracks, err := a.Catalog.Tracks(ctx, catalog.TrackFilter{})
+	if err != nil {
+		return err
+	}
+	for _, t := range tracks {
+		if !found[t.Key] {
+			if err := a.Catalog.DeleteTrack(ctx, t.Key); err != nil {
+				return err
+			}
+		}
+	}
+	return a.ReindexSearch(ctx)
+}
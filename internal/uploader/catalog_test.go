@@ -0,0 +1,65 @@
+package uploader
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"music-streaming/backend/internal/catalog"
+)
+
+// newTestCatalog returns an empty in-memory catalog.
+func newTestCatalog(t *testing.T) *catalog.Catalog {
+	c, err := catalog.Open(":memory:")
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestCatalogStage(t *testing.T) {
+	ctx := context.Background()
+	app, tusHandler := newFileApp(t)
+	stages := []Stage{ChecksumStage{}, DedupStage{}, ProbeStage{}, TagStage{}, CatalogStage{}}
+	song := processUpload(t, app, tusHandler, string(taggedMP3("TIT2", "Song", "TPE1", "Band", "TALB", "Record", "TRCK", "2")), stages...)
+	processUpload(t, app, tusHandler, string(taggedMP3("TIT2", "Other", "TPE1", "Someone")), stages...)
+
+	track, err := app.Catalog.Track(ctx, song)
+	require.NoError(t, err)
+	assert.Equal(t, "Song", track.Title)
+	assert.Equal(t, "Band", track.AlbumArtist)
+	assert.Positive(t, track.Duration)
+	assert.NotEmpty(t, track.SHA256)
+	assert.Equal(t, track.Metadata[MetadataBlob], track.DataKey)
+
+	files := listFiles(t, app, "")
+	assert.Len(t, files, 2)
+	files = listFiles(t, app, "?artist=Band&album=Record")
+	assert.Equal(t, []listedFile{{Key: song, Name: song, Title: "Song", Artist: "Band", Album: "Record", TrackNumber: 2, Format: formatOf(track.Metadata)}}, files)
+
+	info, err := app.loadInfo(ctx, song)
+	require.NoError(t, err)
+	require.NoError(t, CatalogStage{}.Terminate(ctx, &CompletedUpload{App: app, Info: info}))
+	assert.Empty(t, listFiles(t, app, "?artist=Band"))
+	artists, err := app.Catalog.Artists(ctx)
+	require.NoError(t, err)
+	require.Len(t, artists, 1)
+	assert.Equal(t, "Someone", artists[0].Name)
+}
+
+func TestRebuildCatalog(t *testing.T) {
+	ctx := context.Background()
+	app, tusHandler := newFileApp(t)
+	id := processUpload(t, app, tusHandler, string(taggedMP3("TIT2", "Song")), ChecksumStage{}, DedupStage{}, TagStage{})
+	createUpload(t, tusHandler, 10, "01234", "")
+	require.NoError(t, app.Catalog.PutTrack(ctx, &catalog.Track{Key: "gone", Name: "gone.mp3", DataKey: "gone"}))
+
+	// Completed uploads are cataloged from their .info, and tracks of
+	// uploads that are gone removed.
+	require.NoError(t, app.RebuildCatalog(ctx))
+	files := listFiles(t, app, "")
+	require.Len(t, files, 1)
+	assert.Equal(t, id, files[0].Key)
+	assert.Equal(t, "Song", files[0].Title)
+}
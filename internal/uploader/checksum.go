@@ -0,0 +1,256 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/tus/tusd/v2/pkg/handler"
+)
+
+// StatusChecksumMismatch is the status code the tus checksum extension
+// defines for a PATCH whose body does not match its Upload-Checksum.
+const StatusChecksumMismatch = 460
+
+// MetadataSHA256 is the upload metadata key holding the hex SHA-256 of the
+// whole file, set once the upload completes.
+const MetadataSHA256 = "sha256"
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"md5":    md5.New,
+	"crc32c": func() hash.Hash { return crc32.New(crc32cTable) },
+}
+
+// ChecksumAlgorithms is the value of the Tus-Checksum-Algorithm header.
+const ChecksumAlgorithms = "sha1,sha256,md5,crc32c"
+
+// withChecksums implements the tus checksum extension in front of tusd,
+// which does not support it itself. A PATCH, or a POST creating an upload
+// with data, carrying Upload-Checksum is spooled to a temporary file and
+// only handed to tusd if it matches, so a corrupted chunk never reaches the
+// store. The spooled body may not exceed what limit allows for its upload.
+func withChecksums(next http.Handler, limit bodyLimit) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			next.ServeHTTP(&extensionWriter{ResponseWriter: w}, r)
+			return
+		}
+
+		header := r.Header.Get("Upload-Checksum")
+		withData := r.Method == http.MethodPatch ||
+			(r.Method == http.MethodPost && r.Header.Get("Content-Type") == "application/offset+octet-stream")
+		if !withData || header == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		algorithm, expected, err := parseChecksumHeader(header)
+		if err != nil {
+			writeTusError(w, http.StatusBadRequest, "ERR_INVALID_CHECKSUM", err.Error())
+			return
+		}
+
+		remaining, err := limit(r)
+		var tusErr handler.Error
+		if errors.As(err, &tusErr) {
+			writeTusError(w, tusErr.HTTPResponse.StatusCode, tusErr.ErrorCode, tusErr.Message)
+			return
+		}
+		if err != nil {
+			writeTusError(w, http.StatusInternalServerError, "ERR_INTERNAL_SERVER_ERROR", err.Error())
+			return
+		}
+		src := r.Body
+		if remaining >= 0 {
+			src = http.MaxBytesReader(w, r.Body, remaining)
+		}
+
+		body, err := spoolVerified(src, checksumAlgorithms[algorithm](), expected)
+		var maxBytesErr *http.MaxBytesError
+		switch {
+		case errors.Is(err, errChecksumMismatch):
+			writeTusError(w, StatusChecksumMismatch, "ERR_CHECKSUM_MISMATCH", "checksum mismatch")
+			return
+		case errors.As(err, &maxBytesErr):
+			writeTusError(w, http.StatusRequestEntityTooLarge, handler.ErrSizeExceeded.ErrorCode, handler.ErrSizeExceeded.Message)
+			return
+		case err != nil:
+			writeTusError(w, http.StatusInternalServerError, "ERR_INTERNAL_SERVER_ERROR", err.Error())
+			return
+		}
+		defer body.Close()
+
+		r.Body = body
+		r.ContentLength = body.size
+		next.ServeHTTP(w, r)
+	})
+}
+
+// bodyLimit returns the most bytes the body of r may carry, or -1 if it is
+// not limited.
+type bodyLimit func(r *http.Request) (int64, error)
+
+// remainingLength limits a request body to what is left of the upload it
+// writes to: up to its length, or up to maxDeferred while its length is
+// deferred. A maxDeferred of zero leaves such uploads unlimited.
+func remainingLength(composer *handler.StoreComposer, maxDeferred int64) bodyLimit {
+	return func(r *http.Request) (int64, error) {
+		var size, offset int64
+		var deferred bool
+		if r.Method == http.MethodPost {
+			deferred = r.Header.Get("Upload-Defer-Length") == "1"
+			if !deferred {
+				var err error
+				size, err = strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+				if err != nil || size < 0 {
+					return 0, handler.ErrInvalidUploadLength
+				}
+			}
+		} else {
+			upload, err := composer.Core.GetUpload(r.Context(), strings.Trim(r.URL.Path, "/"))
+			if err != nil {
+				return 0, err
+			}
+			info, err := upload.GetInfo(r.Context())
+			if err != nil {
+				return 0, err
+			}
+			size, offset, deferred = info.Size, info.Offset, info.SizeIsDeferred
+		}
+		if deferred {
+			if maxDeferred <= 0 {
+				return -1, nil
+			}
+			size = maxDeferred
+		}
+		return max(size-offset, 0), nil
+	}
+}
+
+func parseChecksumHeader(header string) (algorithm string, digest []byte, err error) {
+	algorithm, encoded, ok := strings.Cut(strings.TrimSpace(header), " ")
+	if !ok {
+		return "", nil, fmt.Errorf("invalid Upload-Checksum header")
+	}
+	algorithm = strings.ToLower(algorithm)
+	if _, ok := checksumAlgorithms[algorithm]; !ok {
+		return "", nil, fmt.Errorf("unsupported checksum algorithm %q", algorithm)
+	}
+	digest, err = base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid Upload-Checksum digest: %w", err)
+	}
+	return algorithm, digest, nil
+}
+
+var errChecksumMismatch = fmt.Errorf("checksum mismatch")
+
+// spoolVerified copies src to a temporary file while hashing it and returns
+// the file rewound to its start if the digest matches.
+func spoolVerified(src io.Reader, h hash.Hash, expected []byte) (*spooledBody, error) {
+	f, err := os.CreateTemp("", "tus-patch-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	body := &spooledBody{File: f}
+
+	n, err := io.Copy(io.MultiWriter(f, h), src)
+	if err != nil {
+		body.Close()
+		return nil, fmt.Errorf("failed to read request body: %w", err)
+	}
+	if !bytes.Equal(h.Sum(nil), expected) {
+		body.Close()
+		return nil, errChecksumMismatch
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		body.Close()
+		return nil, err
+	}
+	body.size = n
+	return body, nil
+}
+
+// spooledBody is a request body backed by a temporary file that is removed
+// once closed.
+type spooledBody struct {
+	*os.File
+	size int64
+}
+
+func (b *spooledBody) Close() error {
+	err := b.File.Close()
+	os.Remove(b.File.Name())
+	return err
+}
+
+// extensionWriter adds the checksum extension to tusd's discovery response.
+type extensionWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *extensionWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		h := w.Header()
+		if ext := h.Get("Tus-Extension"); ext != "" {
+			h.Set("Tus-Extension", ext+",checksum")
+			h.Set("Tus-Checksum-Algorithm", ChecksumAlgorithms)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *extensionWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func writeTusError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Tus-Resumable", "1.0.0")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%s: %s\n", code, message)
+}
+
+// ChecksumStage computes the SHA-256 of the completed file and stores it in
+// the upload metadata so clients and the catalog can verify integrity.
+type ChecksumStage struct{}
+
+func (ChecksumStage) Name() string { return "checksum" }
+
+func (ChecksumStage) Process(ctx context.Context, upload *CompletedUpload) error {
+	app := upload.App
+	body, err := app.Store.Open(ctx, objectKey(upload.Info), 0, -1)
+	if err != nil {
+		return fmt.Errorf("failed to read object: %w", err)
+	}
+	defer body.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, body); err != nil {
+		return fmt.Errorf("failed to hash object: %w", err)
+	}
+	upload.Info.MetaData[MetadataSHA256] = hex.EncodeToString(h.Sum(nil))
+	return nil
+}
@@ -0,0 +1,187 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/tus/tusd/v2/pkg/handler"
+
+	"music-streaming/backend/internal/identity"
+	"music-streaming/backend/internal/storage"
+)
+
+func checksumHeader(algorithm string, digest []byte) string {
+	return algorithm + " " + base64.StdEncoding.EncodeToString(digest)
+}
+
+func unlimited(*http.Request) (int64, error) { return -1, nil }
+
+func TestWithChecksums_Mismatch(t *testing.T) {
+	app, tusHandler := newFileApp(t)
+	id := createUpload(t, tusHandler, 9, "", "")
+
+	sum := sha1.Sum([]byte("other data"))
+	req := newPatchRequest(id, "some data")
+	req.Header.Set("Upload-Checksum", checksumHeader("sha1", sum[:]))
+	rr := httptest.NewRecorder()
+	tusHandler.ServeHTTP(rr, req)
+
+	// The chunk is rejected before it reaches the store.
+	assert.Equal(t, StatusChecksumMismatch, rr.Code)
+	assert.Contains(t, rr.Body.String(), "ERR_CHECKSUM_MISMATCH")
+	info, err := app.loadInfo(context.Background(), id)
+	require.NoError(t, err)
+	assert.Zero(t, info.Offset)
+}
+
+func TestWithChecksums_LimitsBody(t *testing.T) {
+	store, err := storage.NewFile(t.TempDir())
+	require.NoError(t, err)
+	tusHandler, composer, err := newHandler(store, identity.Resolver{}, NewDeferredUploads(DeferredConfig{}), nil)
+	require.NoError(t, err)
+	h := protocolHandler(tusHandler, composer, 4)
+	data := "0123456789"
+	sum := sha1.Sum([]byte(data))
+
+	// A body larger than what is left of the upload is not spooled.
+	id := createUpload(t, h, 4, "", "")
+	req := newPatchRequest(id, data)
+	req.Header.Set("Upload-Checksum", checksumHeader("sha1", sum[:]))
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+	assert.Contains(t, rr.Body.String(), "ERR_UPLOAD_SIZE_EXCEEDED")
+
+	// Neither is one larger than an upload with deferred length may grow.
+	req = httptest.NewRequest("POST", "/files/", strings.NewReader(data))
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	req.Header.Set("Upload-Defer-Length", "1")
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Checksum", checksumHeader("sha1", sum[:]))
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+
+	req = newPatchRequest("unknown", data)
+	req.Header.Set("Upload-Checksum", checksumHeader("sha1", sum[:]))
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestWithChecksums_CreationWithUpload(t *testing.T) {
+	_, tusHandler, client := newS3App(t, testSmallUploadThreshold)
+	sum := sha1.Sum([]byte("0123456789"))
+
+	post := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/files/", strings.NewReader(body))
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		req.Header.Set("Upload-Length", "10")
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set("Upload-Checksum", checksumHeader("sha1", sum[:]))
+		rr := httptest.NewRecorder()
+		tusHandler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// A corrupted body does not even create the upload.
+	assert.Equal(t, StatusChecksumMismatch, post("0123456788").Code)
+	assert.Empty(t, client.Keys("test-bucket"))
+
+	rr := post("0123456789")
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.Equal(t, "10", rr.Header().Get("Upload-Offset"))
+}
+
+func TestWithChecksums_UnsupportedAlgorithm(t *testing.T) {
+	h := withChecksums(http.NotFoundHandler(), unlimited)
+
+	req, _ := http.NewRequest("PATCH", "abc", strings.NewReader("some data"))
+	req.Header.Set("Upload-Checksum", "whirlpool AAAA")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestWithChecksums_MatchingAlgorithms(t *testing.T) {
+	data := []byte("some data")
+	sha := sha256.Sum256(data)
+	crc := binary.BigEndian.AppendUint32(nil, crc32.Checksum(data, crc32cTable))
+
+	for algorithm, digest := range map[string][]byte{"sha256": sha[:], "crc32c": crc} {
+		var received []byte
+		h := withChecksums(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received, _ = io.ReadAll(r.Body)
+			assert.Equal(t, int64(len(data)), r.ContentLength)
+			w.WriteHeader(http.StatusNoContent)
+		}), unlimited)
+
+		req, _ := http.NewRequest("PATCH", "abc", bytes.NewReader(data))
+		req.Header.Set("Upload-Checksum", checksumHeader(algorithm, digest))
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusNoContent, rr.Code, algorithm)
+		assert.Equal(t, data, received, algorithm)
+	}
+}
+
+func TestWithChecksums_AdvertisedInOptions(t *testing.T) {
+	h, _ := NewTusHandler(newMultipartStore(new(MockS3Client)), identity.Resolver{})
+
+	req, _ := http.NewRequest("OPTIONS", "/files/", nil)
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	assert.Contains(t, rr.Header().Get("Tus-Extension"), "checksum")
+	assert.Equal(t, ChecksumAlgorithms, rr.Header().Get("Tus-Checksum-Algorithm"))
+}
+
+func TestChecksumStage_StoresSHA256(t *testing.T) {
+	mockS3 := new(MockS3Client)
+	app := &App{Store: storage.NewS3("test-bucket", mockS3, "")}
+
+	mockS3.On("GetObject", mock.Anything, mock.MatchedBy(func(input *s3.GetObjectInput) bool {
+		return *input.Key == "abc"
+	}), mock.Anything).Return(&s3.GetObjectOutput{
+		Body: io.NopCloser(strings.NewReader("whole file")),
+	}, nil)
+
+	mockS3.On("HeadObject", mock.Anything, keyIs("abc.info"), mock.Anything).Return(&s3.HeadObjectOutput{}, nil)
+	var saved handler.FileInfo
+	mockS3.On("PutObject", mock.Anything, mock.MatchedBy(func(input *s3.PutObjectInput) bool {
+		return *input.Key == "abc.info"
+	}), mock.Anything).Run(func(args mock.Arguments) {
+		input := args.Get(1).(*s3.PutObjectInput)
+		require.NoError(t, json.NewDecoder(input.Body).Decode(&saved))
+	}).Return(&s3.PutObjectOutput{}, nil)
+
+	pipeline := &Pipeline{Stages: []Stage{ChecksumStage{}}}
+	pipeline.Process(context.Background(), app, handler.FileInfo{
+		ID:       "abc+upload-id",
+		MetaData: handler.MetaData{"filename": "song.mp3"},
+		Storage:  map[string]string{"Key": "abc"},
+	})
+
+	sum := sha256.Sum256([]byte("whole file"))
+	assert.Equal(t, hex.EncodeToString(sum[:]), saved.MetaData[MetadataSHA256])
+	assert.Equal(t, "song.mp3", saved.MetaData["filename"])
+	mockS3.AssertExpectations(t)
+}
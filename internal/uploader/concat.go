@@ -0,0 +1,35 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ConcatStage removes the partial uploads of a final upload once they have
+// been concatenated, as they are no longer needed.
+type ConcatStage struct{}
+
+func (ConcatStage) Name() string { return "concat" }
+
+func (ConcatStage) Process(ctx context.Context, upload *CompletedUpload) error {
+	if !upload.Info.IsFinal {
+		return nil
+	}
+	composer := upload.App.composer
+	if composer == nil || !composer.UsesTerminater {
+		return fmt.Errorf("store does not support termination")
+	}
+
+	var errs []error
+	for _, id := range upload.Info.PartialUploads {
+		partial, err := composer.Core.GetUpload(ctx, id)
+		if err == nil {
+			err = composer.Terminater.AsTerminatableUpload(partial).Terminate(ctx)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove partial upload %s: %w", id, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,172 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"music-streaming/backend/internal/storage"
+)
+
+// MetadataBlob is the upload metadata key pointing at the content-addressed
+// object holding the upload's data once it has been deduplicated.
+const MetadataBlob = "blob"
+
+// blobPrefix is where content-addressed blobs and their reference records live.
+const blobPrefix = "blobs/"
+
+func blobKey(sha256 string) string     { return blobPrefix + sha256 }
+func blobRefsKey(sha256 string) string { return blobPrefix + sha256 + ".refs" }
+
+// blobRefs is the reference record of a blob: the uploads sharing it.
+type blobRefs struct {
+	Refs []string `json:"refs"`
+}
+
+// DedupStage moves completed uploads into content-addressed blobs keyed by
+// their SHA-256, so identical files are stored once. Each upload keeps its
+// own .info and is recorded in the blob's reference record; the blob is
+// removed when the last upload referencing it is deleted. On stores that
+// can link objects, the upload's data is replaced by a link to the blob
+// instead of being removed, since their tus store needs it in place.
+//
+// The reference record of a blob is updated under the App's lock of its
+// checksum, which only guards against the updates of the same process.
+type DedupStage struct{}
+
+func (DedupStage) Name() string { return "dedup" }
+
+func (DedupStage) Process(ctx context.Context, upload *CompletedUpload) error {
+	app := upload.App
+	sum := upload.Info.MetaData[MetadataSHA256]
+	if sum == "" {
+		return fmt.Errorf("upload has no %s checksum", MetadataSHA256)
+	}
+	key := objectKey(upload.Info)
+	linker, canLink := app.Store.(storage.Linker)
+
+	defer app.blobLocks.Lock(sum)()
+	refs, err := app.loadBlobRefs(ctx, sum)
+	if err != nil {
+		return err
+	}
+	if len(refs.Refs) > 0 {
+		// Guard against a reference record whose blob has gone missing.
+		if _, err := app.Store.Stat(ctx, blobKey(sum)); storage.IsNotFound(err) {
+			refs.Refs = nil
+		} else if err != nil {
+			return fmt.Errorf("failed to check blob: %w", err)
+		}
+	}
+
+	created := len(refs.Refs) == 0
+	if created {
+		if canLink {
+			err = linker.Link(ctx, blobKey(sum), key)
+		} else {
+			err = app.Store.Copy(ctx, blobKey(sum), key)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create blob: %w", err)
+		}
+	}
+
+	if !slices.Contains(refs.Refs, key) {
+		refs.Refs = append(refs.Refs, key)
+	}
+	if err := app.saveBlobRefs(ctx, sum, refs); err != nil {
+		return err
+	}
+	upload.Info.MetaData[MetadataBlob] = blobKey(sum)
+
+	if canLink {
+		if !created {
+			if err := linker.Link(ctx, key, blobKey(sum)); err != nil {
+				return fmt.Errorf("failed to link deduplicated object: %w", err)
+			}
+		}
+		return nil
+	}
+	// The .info must point at the blob before the data is gone, lest the
+	// upload be lost if the process stops in between.
+	if err := app.saveInfo(ctx, upload.Info); err != nil {
+		return err
+	}
+	if err := app.Store.Delete(ctx, key); err != nil {
+		return fmt.Errorf("failed to remove deduplicated object: %w", err)
+	}
+	return nil
+}
+
+// Terminate drops the upload's references to its blob and to those of
+// earlier versions of its data, and deletes each blob once nothing
+// references it anymore.
+func (DedupStage) Terminate(ctx context.Context, upload *CompletedUpload) error {
+	app := upload.App
+	sum := upload.Info.MetaData[MetadataSHA256]
+	if upload.Info.MetaData[MetadataBlob] == "" || sum == "" {
+		return nil
+	}
+	key := objectKey(upload.Info)
+
+	sums := []string{sum}
+	if versions := upload.Info.MetaData[MetadataVersions]; versions != "" {
+		sums = append(sums, strings.Split(versions, ",")...)
+	}
+	slices.Sort(sums)
+	for _, sum := range slices.Compact(sums) {
+		if err := app.releaseBlob(ctx, sum, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseBlob drops the reference of the upload stored under key to the
+// blob of sum, and deletes the blob once nothing references it anymore.
+func (a *App) releaseBlob(ctx context.Context, sum, key string) error {
+	defer a.blobLocks.Lock(sum)()
+	refs, err := a.loadBlobRefs(ctx, sum)
+	if err != nil {
+		return err
+	}
+	refs.Refs = slices.DeleteFunc(refs.Refs, func(ref string) bool { return ref == key })
+	if len(refs.Refs) > 0 {
+		return a.saveBlobRefs(ctx, sum, refs)
+	}
+	if err := a.Store.Delete(ctx, blobKey(sum), blobRefsKey(sum)); err != nil {
+		return fmt.Errorf("failed to delete blob: %w", err)
+	}
+	return nil
+}
+
+func (a *App) loadBlobRefs(ctx context.Context, sum string) (blobRefs, error) {
+	var refs blobRefs
+	body, err := a.Store.Open(ctx, blobRefsKey(sum), 0, -1)
+	if storage.IsNotFound(err) {
+		return refs, nil
+	}
+	if err != nil {
+		return refs, fmt.Errorf("failed to read blob references: %w", err)
+	}
+	defer body.Close()
+
+	if err := json.NewDecoder(body).Decode(&refs); err != nil {
+		return refs, fmt.Errorf("failed to decode blob references: %w", err)
+	}
+	return refs, nil
+}
+
+func (a *App) saveBlobRefs(ctx context.Context, sum string, refs blobRefs) error {
+	body, err := json.Marshal(refs)
+	if err != nil {
+		return err
+	}
+	if err := a.Store.Put(ctx, blobRefsKey(sum), bytes.NewReader(body), int64(len(body))); err != nil {
+		return fmt.Errorf("failed to save blob references: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package uploader
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/tus/tusd/v2/pkg/handler"
+
+	"music-streaming/backend/internal/audio"
+	"music-streaming/backend/internal/identity"
+	"music-streaming/backend/internal/storage"
+)
+
+func keyIs(key string) interface{} {
+	return mock.MatchedBy(func(input interface{}) bool {
+		switch in := input.(type) {
+		case *s3.GetObjectInput:
+			return *in.Key == key
+		case *s3.PutObjectInput:
+			return *in.Key == key
+		case *s3.HeadObjectInput:
+			return *in.Key == key
+		case *s3.DeleteObjectInput:
+			return *in.Key == key
+		case *s3.CopyObjectInput:
+			return *in.Key == key
+		}
+		return false
+	})
+}
+
+func dedupUpload(app *App, key string) *CompletedUpload {
+	return &CompletedUpload{App: app, Info: handler.FileInfo{
+		ID:       key + "+upload-id",
+		Size:     10,
+		MetaData: handler.MetaData{MetadataSHA256: "cafe"},
+		Storage:  map[string]string{"Key": key},
+	}}
+}
+
+func TestDedupStage_FirstCopyCreatesBlob(t *testing.T) {
+	mockS3 := new(MockS3Client)
+	app := &App{Store: storage.NewS3("test-bucket", mockS3, "")}
+
+	mockS3.On("GetObject", mock.Anything, keyIs("blobs/cafe.refs"), mock.Anything).Return(nil, &types.NoSuchKey{})
+	mockS3.On("CopyObject", mock.Anything, mock.MatchedBy(func(input *s3.CopyObjectInput) bool {
+		return *input.Key == "blobs/cafe" && *input.CopySource == "test-bucket/first"
+	}), mock.Anything).Return(&s3.CopyObjectOutput{}, nil)
+	var refs blobRefs
+	mockS3.On("PutObject", mock.Anything, keyIs("blobs/cafe.refs"), mock.Anything).Run(func(args mock.Arguments) {
+		require.NoError(t, json.NewDecoder(args.Get(1).(*s3.PutObjectInput).Body).Decode(&refs))
+	}).Return(&s3.PutObjectOutput{}, nil)
+	// The .info points at the blob before the data is deleted.
+	var info handler.FileInfo
+	mockS3.On("PutObject", mock.Anything, keyIs("first.info"), mock.Anything).Run(func(args mock.Arguments) {
+		require.NoError(t, json.NewDecoder(args.Get(1).(*s3.PutObjectInput).Body).Decode(&info))
+	}).Return(&s3.PutObjectOutput{}, nil)
+	mockS3.On("DeleteObject", mock.Anything, keyIs("first"), mock.Anything).Run(func(mock.Arguments) {
+		assert.Equal(t, "blobs/cafe", info.MetaData[MetadataBlob])
+	}).Return(&s3.DeleteObjectOutput{}, nil)
+
+	upload := dedupUpload(app, "first")
+	require.NoError(t, DedupStage{}.Process(context.Background(), upload))
+
+	assert.Equal(t, []string{"first"}, refs.Refs)
+	assert.Equal(t, "blobs/cafe", upload.Info.MetaData[MetadataBlob])
+	mockS3.AssertExpectations(t)
+}
+
+func TestDedupStage_DuplicateReusesBlob(t *testing.T) {
+	mockS3 := new(MockS3Client)
+	app := &App{Store: storage.NewS3("test-bucket", mockS3, "")}
+
+	mockS3.On("GetObject", mock.Anything, keyIs("blobs/cafe.refs"), mock.Anything).Return(&s3.GetObjectOutput{
+		Body: io.NopCloser(strings.NewReader(`{"refs":["first"]}`)),
+	}, nil)
+	mockS3.On("HeadObject", mock.Anything, keyIs("blobs/cafe"), mock.Anything).Return(&s3.HeadObjectOutput{}, nil)
+	var refs blobRefs
+	mockS3.On("PutObject", mock.Anything, keyIs("blobs/cafe.refs"), mock.Anything).Run(func(args mock.Arguments) {
+		require.NoError(t, json.NewDecoder(args.Get(1).(*s3.PutObjectInput).Body).Decode(&refs))
+	}).Return(&s3.PutObjectOutput{}, nil)
+	mockS3.On("PutObject", mock.Anything, keyIs("second.info"), mock.Anything).Return(&s3.PutObjectOutput{}, nil)
+	mockS3.On("DeleteObject", mock.Anything, keyIs("second"), mock.Anything).Return(&s3.DeleteObjectOutput{}, nil)
+
+	upload := dedupUpload(app, "second")
+	require.NoError(t, DedupStage{}.Process(context.Background(), upload))
+
+	assert.Equal(t, []string{"first", "second"}, refs.Refs)
+	mockS3.AssertNotCalled(t, "CopyObject", mock.Anything, mock.Anything, mock.Anything)
+	mockS3.AssertExpectations(t)
+}
+
+func TestDedupStage_TerminateKeepsSharedBlob(t *testing.T) {
+	mockS3 := new(MockS3Client)
+	app := &App{Store: storage.NewS3("test-bucket", mockS3, "")}
+
+	mockS3.On("GetObject", mock.Anything, keyIs("blobs/cafe.refs"), mock.Anything).Return(&s3.GetObjectOutput{
+		Body: io.NopCloser(strings.NewReader(`{"refs":["first","second"]}`)),
+	}, nil).Once()
+	var refs blobRefs
+	mockS3.On("PutObject", mock.Anything, keyIs("blobs/cafe.refs"), mock.Anything).Run(func(args mock.Arguments) {
+		require.NoError(t, json.NewDecoder(args.Get(1).(*s3.PutObjectInput).Body).Decode(&refs))
+	}).Return(&s3.PutObjectOutput{}, nil)
+
+	upload := dedupUpload(app, "first")
+	upload.Info.MetaData[MetadataBlob] = "blobs/cafe"
+	require.NoError(t, DedupStage{}.Terminate(context.Background(), upload))
+	assert.Equal(t, []string{"second"}, refs.Refs)
+
+	// Deleting the last reference removes the blob.
+	mockS3.On("GetObject", mock.Anything, keyIs("blobs/cafe.refs"), mock.Anything).Return(&s3.GetObjectOutput{
+		Body: io.NopCloser(strings.NewReader(`{"refs":["second"]}`)),
+	}, nil).Once()
+	mockS3.On("DeleteObjects", mock.Anything, mock.MatchedBy(func(input *s3.DeleteObjectsInput) bool {
+		return len(input.Delete.Objects) == 2 && *input.Delete.Objects[0].Key == "blobs/cafe"
+	}), mock.Anything).Return(&s3.DeleteObjectsOutput{}, nil)
+
+	upload = dedupUpload(app, "second")
+	upload.Info.MetaData[MetadataBlob] = "blobs/cafe"
+	require.NoError(t, DedupStage{}.Terminate(context.Background(), upload))
+	mockS3.AssertExpectations(t)
+}
+
+func TestListFiles_Deduplicated(t *testing.T) {
+	mockS3 := new(MockS3Client)
+	app := &App{Store: storage.NewS3("test-bucket", mockS3, "http://localhost:9000"), Catalog: newTestCatalog(t)}
+
+	mockS3.On("ListObjectsV2", mock.Anything, mock.Anything, mock.Anything).Return(&s3.ListObjectsV2Output{
+		Contents: []types.Object{
+			{Key: aws.String("blobs/cafe"), Size: aws.Int64(10)},
+			{Key: aws.String("blobs/cafe.refs"), Size: aws.Int64(20)},
+			{Key: aws.String("first.info"), Size: aws.Int64(100)},
+			{Key: aws.String("second.info"), Size: aws.Int64(100)},
+			{Key: aws.String("pending.info"), Size: aws.Int64(100)},
+			{Key: aws.String("pending.part"), Size: aws.Int64(5)},
+		},
+	}, nil)
+	for key, name := range map[string]string{"first": "Take 1.wav", "second": "Take 1 (copy).wav"} {
+		mockS3.On("GetObject", mock.Anything, keyIs(key+".info"), mock.Anything).Return(&s3.GetObjectOutput{
+			Body: io.NopCloser(strings.NewReader(`{"Size":10,"MetaData":{"filename":"` + name + `","sha256":"cafe","blob":"blobs/cafe"}}`)),
+		}, nil)
+	}
+	mockS3.On("GetObject", mock.Anything, keyIs("pending.info"), mock.Anything).Return(&s3.GetObjectOutput{
+		Body: io.NopCloser(strings.NewReader(`{"Size":10,"MetaData":{"filename":"pending.wav"}}`)),
+	}, nil)
+
+	require.NoError(t, app.RebuildCatalog(context.Background()))
+	req, _ := http.NewRequest("GET", "/files/", nil)
+	rr := httptest.NewRecorder()
+	app.ListFilesHandler(rr, req)
+
+	var files []struct {
+		Key  string `json:"key"`
+		Name string `json:"name"`
+		Size int64  `json:"size"`
+		URL  string `json:"url"`
+	}
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&files))
+	require.Len(t, files, 2)
+	assert.Equal(t, "first", files[0].Key)
+	assert.Equal(t, "Take 1.wav", files[0].Name)
+	assert.Equal(t, int64(10), files[0].Size)
+	assert.Equal(t, "http://localhost:9000/test-bucket/blobs/cafe", files[0].URL)
+	assert.Equal(t, "second", files[1].Key)
+	assert.Equal(t, files[0].URL, files[1].URL)
+}
+
+func TestDelete_WaitsForProcessing(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store, err := storage.NewFile(t.TempDir())
+	require.NoError(t, err)
+	entered := make(chan struct{})
+	unblock := make(chan struct{})
+	app, err := NewApp(ctx, store, newTestCatalog(t), DeferredConfig{}, identity.Resolver{},
+		funcStage{"slow", func(ctx context.Context, upload *CompletedUpload) error {
+			close(entered)
+			<-unblock
+			return nil
+		}})
+	require.NoError(t, err)
+
+	wav := audio.EncodeWAV(8000, 1, audio.Sine(8000, 1, 200, 0.5, 0.1))
+	id := createUpload(t, app.TusHandler, len(wav), string(wav), "filename dGFrZS53YXY=")
+	<-entered
+
+	deleted := make(chan int)
+	go func() {
+		req := httptest.NewRequest("DELETE", "/files/"+id, nil)
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		rr := httptest.NewRecorder()
+		app.TusHandler.ServeHTTP(rr, req)
+		deleted <- rr.Code
+	}()
+	select {
+	case <-deleted:
+		t.Fatal("upload deleted while it was processed")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(unblock)
+	require.Equal(t, http.StatusNoContent, <-deleted)
+
+	// Once the pipeline has cleaned up, nothing of the upload is left: no
+	// .info saved after the deletion, and no blob or waveform the stages
+	// added after tusd read the .info.
+	assert.Eventually(t, func() bool {
+		objects, err := store.List(ctx, "")
+		return err == nil && len(objects) == 0
+	}, 10*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,403 @@
+package uploader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tus/tusd/v2/pkg/handler"
+)
+
+// Actions taken on a deferred-length upload that has been idle for longer
+// than DeferredConfig.Timeout.
+const (
+	// DeferredFinalize declares the bytes received so far as the upload's
+	// length and completes it, as if the recording had ended.
+	DeferredFinalize = "finalize"
+	// DeferredExpire deletes the upload.
+	DeferredExpire = "expire"
+)
+
+// ErrDeferredSizeExceeded is returned when an upload whose length is deferred
+// grows beyond DeferredConfig.MaxSize.
+var ErrDeferredSizeExceeded = handler.NewError("ERR_DEFERRED_SIZE_EXCEEDED", "maximum size of an upload with deferred length exceeded", http.StatusRequestEntityTooLarge)
+
+// defaultDeferredMaxSize is the default for DeferredConfig.MaxSize.
+const defaultDeferredMaxSize = 4 << 30
+
+// DeferredConfig limits uploads created with Upload-Defer-Length, such as
+// live recordings whose final size is only known once they end.
+type DeferredConfig struct {
+	// MaxSize is the most bytes an upload may receive while, and after, its
+	// length is deferred. Zero means no limit.
+	MaxSize int64
+	// Timeout is how long a deferred upload may go without receiving data
+	// before Action is applied to it. Zero disables the timeout.
+	Timeout time.Duration
+	// Action is DeferredFinalize or DeferredExpire. Uploads that received no
+	// data at all are always expired.
+	Action string
+}
+
+// DeferredConfigFromEnv reads DEFERRED_MAX_SIZE (bytes, default 4 GiB),
+// DEFERRED_UPLOAD_TIMEOUT (default 1h) and DEFERRED_TIMEOUT_ACTION
+// ("finalize" or "expire", default "finalize").
+func DeferredConfigFromEnv() (DeferredConfig, error) {
+	cfg := DeferredConfig{
+		MaxSize: defaultDeferredMaxSize,
+		Timeout: time.Hour,
+		Action:  DeferredFinalize,
+	}
+	if v := os.Getenv("DEFERRED_MAX_SIZE"); v != "" {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || size < 0 {
+			return cfg, fmt.Errorf("invalid DEFERRED_MAX_SIZE %q", v)
+		}
+		cfg.MaxSize = size
+	}
+	if v := os.Getenv("DEFERRED_UPLOAD_TIMEOUT"); v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil || timeout < 0 {
+			return cfg, fmt.Errorf("invalid DEFERRED_UPLOAD_TIMEOUT %q", v)
+		}
+		cfg.Timeout = timeout
+	}
+	if v := os.Getenv("DEFERRED_TIMEOUT_ACTION"); v != "" {
+		cfg.Action = strings.ToLower(v)
+	}
+	if cfg.Action != DeferredFinalize && cfg.Action != DeferredExpire {
+		return cfg, fmt.Errorf("invalid DEFERRED_TIMEOUT_ACTION %q", cfg.Action)
+	}
+	return cfg, nil
+}
+
+// DeferredUploads enforces a DeferredConfig. It decorates the tus store to
+// cap the size of deferred uploads and keeps track of when each one last
+// received data, so Run can finalize or expire those that went idle.
+type DeferredUploads struct {
+	cfg    DeferredConfig
+	now    func() time.Time
+	Logger *slog.Logger
+
+	mu     sync.Mutex
+	active map[string]*deferredActivity
+}
+
+type deferredActivity struct {
+	last    time.Time
+	writing int
+}
+
+// NewDeferredUploads creates the limits for deferred uploads.
+func NewDeferredUploads(cfg DeferredConfig) *DeferredUploads {
+	return &DeferredUploads{
+		cfg:    cfg,
+		now:    time.Now,
+		active: make(map[string]*deferredActivity),
+	}
+}
+
+// wrapStore returns a store enforcing the limits on top of inner.
+func (d *DeferredUploads) wrapStore(inner *handler.StoreComposer) storeWrapper {
+	return storeWrapper{
+		inner: inner,
+		wrap: func(upload handler.Upload) handler.Upload {
+			return &deferredUpload{Upload: upload, inner: inner, limits: d}
+		},
+		created: func(ctx context.Context, info handler.FileInfo) {
+			if info.SizeIsDeferred {
+				d.touch(info.ID, d.now())
+			}
+		},
+	}
+}
+
+// touch records activity on a deferred upload. It is a no-op when there is
+// no timeout, so nothing accumulates without Run sweeping it.
+func (d *DeferredUploads) touch(id string, at time.Time) {
+	if d.cfg.Timeout <= 0 {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	activity, ok := d.active[id]
+	if !ok {
+		activity = &deferredActivity{}
+		d.active[id] = activity
+	}
+	if at.After(activity.last) {
+		activity.last = at
+	}
+}
+
+// startWrite marks a deferred upload as receiving data until the returned
+// function is called, so it is not reaped in the middle of a long PATCH.
+func (d *DeferredUploads) startWrite(id string) func() {
+	if d.cfg.Timeout <= 0 {
+		return func() {}
+	}
+	d.touch(id, d.now())
+	d.mu.Lock()
+	d.active[id].writing++
+	d.mu.Unlock()
+	return func() {
+		d.mu.Lock()
+		if activity, ok := d.active[id]; ok {
+			activity.writing--
+		}
+		d.mu.Unlock()
+		d.touch(id, d.now())
+	}
+}
+
+func (d *DeferredUploads) forget(id string) {
+	d.mu.Lock()
+	delete(d.active, id)
+	d.mu.Unlock()
+}
+
+// tracked reports whether activity on the upload is being tracked, which
+// idle stopped for the uploads it returned.
+func (d *DeferredUploads) tracked(id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.active[id]
+	return ok
+}
+
+// idle returns and stops tracking the uploads that have not received data
+// for longer than the timeout.
+func (d *DeferredUploads) idle(now time.Time) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var ids []string
+	for id, activity := range d.active {
+		if activity.writing == 0 && now.Sub(activity.last) > d.cfg.Timeout {
+			ids = append(ids, id)
+			delete(d.active, id)
+		}
+	}
+	return ids
+}
+
+// Run applies the timeout until ctx is cancelled. Deferred uploads left over
+// from a previous run are picked up from the bucket first, using the time
+// their .info was last written as their last activity.
+func (d *DeferredUploads) Run(ctx context.Context, app *App) {
+	if d.cfg.Timeout <= 0 {
+		return
+	}
+	if err := d.seed(ctx, app); err != nil {
+		d.logger().Error("DeferredUploadScanFailed", "error", err)
+	}
+
+	ticker := time.NewTicker(min(d.cfg.Timeout/2, time.Minute))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.sweep(ctx, app)
+		}
+	}
+}
+
+// seed tracks the deferred uploads found in the bucket.
+func (d *DeferredUploads) seed(ctx context.Context, app *App) error {
+	objects, err := app.Store.List(ctx, "")
+	if err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		if !strings.HasSuffix(obj.Key, ".info") || strings.HasPrefix(obj.Key, blobPrefix) {
+			continue
+		}
+		info, err := app.loadInfo(ctx, strings.TrimSuffix(obj.Key, ".info"))
+		if err != nil || !info.SizeIsDeferred {
+			continue
+		}
+		d.touch(info.ID, obj.LastModified)
+	}
+	return nil
+}
+
+// sweep finalizes or expires every deferred upload that went idle.
+func (d *DeferredUploads) sweep(ctx context.Context, app *App) {
+	for _, id := range d.idle(d.now()) {
+		if err := d.reap(ctx, app, id); err != nil {
+			d.logger().Error("DeferredUploadReapFailed", "id", id, "error", err)
+		}
+	}
+}
+
+// reap applies the timeout action to a single upload. The upload is locked
+// like tusd locks it for requests, and left alone if it received data while
+// the lock was taken or had its length declared in the meantime.
+func (d *DeferredUploads) reap(ctx context.Context, app *App, id string) error {
+	lock, err := app.composer.Locker.NewLock(id)
+	if err != nil {
+		return err
+	}
+	if err := lock.Lock(ctx, func() {}); err != nil {
+		return fmt.Errorf("failed to lock upload: %w", err)
+	}
+	defer lock.Unlock()
+	if d.tracked(id) {
+		return nil
+	}
+
+	upload, err := app.composer.Core.GetUpload(ctx, id)
+	if err != nil {
+		return err
+	}
+	info, err := upload.GetInfo(ctx)
+	if err != nil {
+		return err
+	}
+	if !info.SizeIsDeferred {
+		return nil
+	}
+
+	if d.cfg.Action == DeferredFinalize && info.Offset > 0 {
+		if err := finalizeDeferred(ctx, app.composer, upload, info.Offset); err != nil {
+			return err
+		}
+		info, err = upload.GetInfo(ctx)
+		if err != nil {
+			return err
+		}
+		d.logger().Info("DeferredUploadFinalized", "id", id, "size", info.Size)
+		if app.Pipeline != nil && !info.IsPartial {
+			app.Pipeline.enqueue(func() { app.Pipeline.Process(ctx, app, info) })
+		}
+		return nil
+	}
+
+	if err := app.composer.Terminater.AsTerminatableUpload(upload).Terminate(ctx); err != nil {
+		return err
+	}
+	d.logger().Info("DeferredUploadExpired", "id", id, "offset", info.Offset)
+	if app.Pipeline != nil {
+		app.Pipeline.enqueue(func() { app.Pipeline.Terminate(ctx, app, info) })
+	}
+	return nil
+}
+
+// finalizeDeferred declares length as the size of the upload and completes
+// it. The empty write makes the store flush data it held back waiting for a
+// full part, which would otherwise be dropped when the upload is finished.
+func finalizeDeferred(ctx context.Context, composer *handler.StoreComposer, upload handler.Upload, length int64) error {
+	if err := composer.LengthDeferrer.AsLengthDeclarableUpload(upload).DeclareLength(ctx, length); err != nil {
+		return fmt.Errorf("failed to declare length: %w", err)
+	}
+	if _, err := upload.WriteChunk(ctx, length, strings.NewReader("")); err != nil {
+		return fmt.Errorf("failed to flush pending data: %w", err)
+	}
+	if err := upload.FinishUpload(ctx); err != nil {
+		return fmt.Errorf("failed to finish upload: %w", err)
+	}
+	return nil
+}
+
+func (d *DeferredUploads) logger() *slog.Logger {
+	if d.Logger != nil {
+		return d.Logger
+	}
+	return slog.Default()
+}
+
+// deferredUpload caps the data written to an upload while its length is
+// deferred, and the length eventually declared for it.
+type deferredUpload struct {
+	handler.Upload
+	inner  *handler.StoreComposer
+	limits *DeferredUploads
+
+	// id and sizeIsDeferred are kept from the first GetInfo, which tusd
+	// calls before writing, so chunks are written without reading the
+	// info again. They are valid once known is set.
+	known          bool
+	id             string
+	sizeIsDeferred bool
+}
+
+func (u *deferredUpload) Unwrap() handler.Upload { return u.Upload }
+
+func (u *deferredUpload) GetInfo(ctx context.Context) (handler.FileInfo, error) {
+	info, err := u.Upload.GetInfo(ctx)
+	if err == nil {
+		u.known, u.id, u.sizeIsDeferred = true, info.ID, info.SizeIsDeferred
+	}
+	return info, err
+}
+
+// load reads the upload's info unless GetInfo already did.
+func (u *deferredUpload) load(ctx context.Context) error {
+	if u.known {
+		return nil
+	}
+	_, err := u.GetInfo(ctx)
+	return err
+}
+
+func (u *deferredUpload) WriteChunk(ctx context.Context, offset int64, src io.Reader) (int64, error) {
+	if err := u.load(ctx); err != nil {
+		return 0, err
+	}
+	if !u.sizeIsDeferred {
+		return u.Upload.WriteChunk(ctx, offset, src)
+	}
+
+	defer u.limits.startWrite(u.id)()
+	if max := u.limits.cfg.MaxSize; max > 0 {
+		if offset >= max {
+			return 0, ErrDeferredSizeExceeded
+		}
+		src = &capReader{r: src, remaining: max - offset}
+	}
+	return u.Upload.WriteChunk(ctx, offset, src)
+}
+
+func (u *deferredUpload) DeclareLength(ctx context.Context, length int64) error {
+	if max := u.limits.cfg.MaxSize; max > 0 && length > max {
+		return ErrDeferredSizeExceeded
+	}
+	if err := u.load(ctx); err != nil {
+		return err
+	}
+	if err := u.inner.LengthDeferrer.AsLengthDeclarableUpload(u.Upload).DeclareLength(ctx, length); err != nil {
+		return err
+	}
+	u.sizeIsDeferred = false
+	u.limits.forget(u.id)
+	return nil
+}
+
+// capReader fails with ErrDeferredSizeExceeded once more than remaining
+// bytes are read from r.
+type capReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (c *capReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > c.remaining+1 {
+		p = p[:c.remaining+1]
+	}
+	n, err := c.r.Read(p)
+	if int64(n) > c.remaining {
+		n = int(c.remaining)
+		c.remaining = 0
+		return n, ErrDeferredSizeExceeded
+	}
+	c.remaining -= int64(n)
+	return n, err
+}
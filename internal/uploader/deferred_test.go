@@ -0,0 +1,216 @@
+package uploader
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/tus/tusd/v2/pkg/handler"
+
+	"music-streaming/backend/internal/identity"
+	"music-streaming/backend/internal/storage"
+)
+
+func newDeferredApp(t *testing.T, mockS3 *MockS3Client, cfg DeferredConfig) (*App, *DeferredUploads) {
+	deferred := NewDeferredUploads(cfg)
+	_, composer, err := newHandler(newMultipartStore(mockS3), identity.Resolver{}, deferred, nil)
+	require.NoError(t, err)
+	return &App{Store: storage.NewS3("test-bucket", mockS3, ""), composer: composer}, deferred
+}
+
+func TestDeferredConfigFromEnv(t *testing.T) {
+	cfg, err := DeferredConfigFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, DeferredConfig{MaxSize: 4 << 30, Timeout: time.Hour, Action: DeferredFinalize}, cfg)
+
+	t.Setenv("DEFERRED_MAX_SIZE", "1024")
+	t.Setenv("DEFERRED_UPLOAD_TIMEOUT", "10m")
+	t.Setenv("DEFERRED_TIMEOUT_ACTION", "Expire")
+	cfg, err = DeferredConfigFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, DeferredConfig{MaxSize: 1024, Timeout: 10 * time.Minute, Action: DeferredExpire}, cfg)
+
+	t.Setenv("DEFERRED_TIMEOUT_ACTION", "keep")
+	_, err = DeferredConfigFromEnv()
+	assert.Error(t, err)
+}
+
+func TestDeferredUploads_Idle(t *testing.T) {
+	now := time.Unix(1000, 0)
+	d := NewDeferredUploads(DeferredConfig{Timeout: time.Minute})
+	d.now = func() time.Time { return now }
+
+	d.touch("quiet", now.Add(-2*time.Minute))
+	d.touch("recent", now.Add(-30*time.Second))
+	d.touch("writing", now.Add(-2*time.Minute))
+	done := d.startWrite("writing")
+	d.touch("declared", now.Add(-2*time.Minute))
+	d.forget("declared")
+
+	// A write in progress keeps an upload alive, however long it takes.
+	now = now.Add(time.Hour)
+	assert.ElementsMatch(t, []string{"quiet", "recent"}, d.idle(now))
+	assert.Empty(t, d.idle(now))
+
+	done()
+	assert.Empty(t, d.idle(now))
+	assert.Equal(t, []string{"writing"}, d.idle(now.Add(2*time.Minute)))
+}
+
+func TestDeferredUploads_Seed(t *testing.T) {
+	mockS3 := new(MockS3Client)
+	app, d := newDeferredApp(t, mockS3, DeferredConfig{Timeout: time.Minute})
+	modified := time.Unix(1000, 0)
+
+	mockS3.On("ListObjectsV2", mock.Anything, mock.Anything, mock.Anything).Return(&s3.ListObjectsV2Output{
+		Contents: []types.Object{
+			{Key: aws.String("rec.info"), LastModified: aws.Time(modified)},
+			{Key: aws.String("song.info"), LastModified: aws.Time(modified)},
+			{Key: aws.String("song")},
+		},
+	}, nil)
+	mockS3.On("GetObject", mock.Anything, keyIs("rec.info"), mock.Anything).Return(&s3.GetObjectOutput{
+		Body: io.NopCloser(strings.NewReader(deferredInfo)),
+	}, nil)
+	mockS3.On("GetObject", mock.Anything, keyIs("song.info"), mock.Anything).Return(&s3.GetObjectOutput{
+		Body: io.NopCloser(strings.NewReader(`{"ID":"song+mp","Size":5}`)),
+	}, nil)
+
+	require.NoError(t, d.seed(context.Background(), app))
+
+	assert.Empty(t, d.idle(modified.Add(time.Minute)))
+	assert.Equal(t, []string{"rec+mp"}, d.idle(modified.Add(2*time.Minute)))
+}
+
+func TestDeferredUploads_ReapFinalizes(t *testing.T) {
+	mockS3 := new(MockS3Client)
+	app, d := newDeferredApp(t, mockS3, DeferredConfig{Timeout: time.Minute, Action: DeferredFinalize})
+
+	// Five bytes were received, too few for a part, so they wait in rec.part.
+	mockS3.On("GetObject", mock.Anything, keyIs("rec.info"), mock.Anything).Return(&s3.GetObjectOutput{
+		Body: io.NopCloser(strings.NewReader(deferredInfo)),
+	}, nil).Once()
+	mockS3.On("ListParts", mock.Anything, mock.Anything, mock.Anything).Return(&s3.ListPartsOutput{}, nil)
+	mockS3.On("HeadObject", mock.Anything, keyIs("rec.part"), mock.Anything).Return(&s3.HeadObjectOutput{
+		ContentLength: aws.Int64(5),
+	}, nil)
+
+	var declared string
+	mockS3.On("PutObject", mock.Anything, keyIs("rec.info"), mock.Anything).Run(func(args mock.Arguments) {
+		body, _ := io.ReadAll(args.Get(1).(*s3.PutObjectInput).Body)
+		declared = string(body)
+	}).Return(&s3.PutObjectOutput{}, nil).Once()
+	mockS3.On("GetObject", mock.Anything, keyIs("rec.part"), mock.Anything).Return(&s3.GetObjectOutput{
+		Body:          io.NopCloser(strings.NewReader("hello")),
+		ContentLength: aws.Int64(5),
+	}, nil).Once()
+	mockS3.On("DeleteObject", mock.Anything, keyIs("rec.part"), mock.Anything).Return(&s3.DeleteObjectOutput{}, nil).Once()
+	mockS3.On("UploadPart", mock.Anything, mock.MatchedBy(func(input *s3.UploadPartInput) bool {
+		body, _ := io.ReadAll(input.Body)
+		return *input.PartNumber == 1 && string(body) == "hello"
+	}), mock.Anything).Return(&s3.UploadPartOutput{ETag: aws.String("etag-1")}, nil).Once()
+	mockS3.On("CompleteMultipartUpload", mock.Anything, mock.Anything, mock.Anything).Return(&s3.CompleteMultipartUploadOutput{}, nil).Once()
+	mockS3.On("HeadObject", mock.Anything, keyIs("rec.info"), mock.Anything).Return(&s3.HeadObjectOutput{}, nil)
+
+	processed := make(chan string, 1)
+	app.Pipeline = &Pipeline{Stages: []Stage{
+		funcStage{"record", func(ctx context.Context, upload *CompletedUpload) error {
+			processed <- upload.Info.ID
+			return nil
+		}},
+	}}
+
+	require.NoError(t, d.reap(context.Background(), app, "rec+mp"))
+
+	assert.Contains(t, declared, `"Size":5`)
+	assert.Equal(t, "rec+mp", <-processed)
+	mockS3.AssertExpectations(t)
+}
+
+func TestDeferredUploads_ReapExpires(t *testing.T) {
+	// Uploads that never received data are expired even when finalizing.
+	for _, action := range []string{DeferredFinalize, DeferredExpire} {
+		t.Run(action, func(t *testing.T) {
+			mockS3 := new(MockS3Client)
+			app, d := newDeferredApp(t, mockS3, DeferredConfig{Timeout: time.Minute, Action: action})
+			mockDeferredUpload(mockS3)
+			mockS3.On("AbortMultipartUpload", mock.Anything, mock.Anything, mock.Anything).Return(&s3.AbortMultipartUploadOutput{}, nil).Once()
+			mockS3.On("DeleteObjects", mock.Anything, mock.Anything, mock.Anything).Return(&s3.DeleteObjectsOutput{}, nil).Once()
+
+			require.NoError(t, d.reap(context.Background(), app, "rec+mp"))
+
+			mockS3.AssertExpectations(t)
+			mockS3.AssertNotCalled(t, "CompleteMultipartUpload", mock.Anything, mock.Anything, mock.Anything)
+		})
+	}
+}
+
+func TestDeferredUploads_ReapSkipsDeclared(t *testing.T) {
+	mockS3 := new(MockS3Client)
+	app, d := newDeferredApp(t, mockS3, DeferredConfig{Timeout: time.Minute, Action: DeferredExpire})
+	mockFinishedUpload(mockS3, "rec", `{"ID":"rec+mp","Size":5}`, 1)
+
+	require.NoError(t, d.reap(context.Background(), app, "rec+mp"))
+
+	mockS3.AssertNotCalled(t, "AbortMultipartUpload", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestDeferredUploads_ReapSkipsWrittenWhileLocked(t *testing.T) {
+	mockS3 := new(MockS3Client)
+	app, d := newDeferredApp(t, mockS3, DeferredConfig{Timeout: time.Minute, Action: DeferredExpire})
+
+	// The request holding the upload writes to it before giving up its lock.
+	lock, err := app.composer.Locker.NewLock("rec+mp")
+	require.NoError(t, err)
+	require.NoError(t, lock.Lock(context.Background(), func() {
+		d.touch("rec+mp", time.Now())
+		lock.Unlock()
+	}))
+
+	require.NoError(t, d.reap(context.Background(), app, "rec+mp"))
+	mockS3.AssertNotCalled(t, "GetObject", mock.Anything, mock.Anything, mock.Anything)
+}
+
+// infoCountingUpload is an upload counting how often its info is read.
+type infoCountingUpload struct {
+	handler.Upload
+	info  handler.FileInfo
+	reads int
+}
+
+func (u *infoCountingUpload) GetInfo(context.Context) (handler.FileInfo, error) {
+	u.reads++
+	return u.info, nil
+}
+
+func (u *infoCountingUpload) WriteChunk(ctx context.Context, offset int64, src io.Reader) (int64, error) {
+	return io.Copy(io.Discard, src)
+}
+
+func TestDeferredUpload_WriteChunk(t *testing.T) {
+	ctx := context.Background()
+	inner := &infoCountingUpload{info: handler.FileInfo{ID: "rec", SizeIsDeferred: true}}
+	upload := &deferredUpload{Upload: inner, limits: NewDeferredUploads(DeferredConfig{MaxSize: 10})}
+
+	// The info tusd reads before writing is not read again for each chunk.
+	_, err := upload.GetInfo(ctx)
+	require.NoError(t, err)
+	for offset := int64(0); offset < 8; offset += 4 {
+		n, err := upload.WriteChunk(ctx, offset, strings.NewReader("data"))
+		require.NoError(t, err)
+		assert.EqualValues(t, 4, n)
+	}
+	assert.Equal(t, 1, inner.reads)
+
+	n, err := upload.WriteChunk(ctx, 8, strings.NewReader("data"))
+	assert.Equal(t, ErrDeferredSizeExceeded, err)
+	assert.EqualValues(t, 2, n)
+}
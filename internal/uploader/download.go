@@ -0,0 +1,162 @@
+package uploader
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"music-streaming/backend/internal/storage"
+)
+
+// DownloadHandler serves the data of a finished upload at /files/{id},
+// resolving deduplicated uploads to their blob. A single byte range may be
+// requested with the Range header, and a rendition of the upload with the
+// rendition query parameter.
+func (a *App) DownloadHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/files/")
+	key, _, _ := strings.Cut(id, "+")
+	if key == "" || strings.Contains(key, "/") {
+		writeTusError(w, http.StatusNotFound, "ERR_UPLOAD_NOT_FOUND", "upload not found")
+		return
+	}
+
+	info, err := a.loadInfo(r.Context(), key)
+	if storage.IsNotFound(err) {
+		writeTusError(w, http.StatusNotFound, "ERR_UPLOAD_NOT_FOUND", "upload not found")
+		return
+	}
+	if err != nil {
+		writeTusError(w, http.StatusInternalServerError, "ERR_INTERNAL_SERVER_ERROR", err.Error())
+		return
+	}
+
+	dataKey, filetype, name := key, info.MetaData["filetype"], info.MetaData["filename"]
+	if blob := info.MetaData[MetadataBlob]; blob != "" {
+		dataKey = blob
+	}
+	master := true
+	if rendition := r.URL.Query().Get("rendition"); rendition != "" {
+		found, ok := findRendition(info.MetaData, rendition)
+		if !ok {
+			writeTusError(w, http.StatusNotFound, "ERR_RENDITION_NOT_FOUND", "rendition not found")
+			return
+		}
+		dataKey, filetype, master = renditionKey(key, found), found.ContentType(), false
+		if name != "" {
+			name = strings.TrimSuffix(name, path.Ext(name)) + "." + found.Extension()
+		}
+	}
+	obj, err := a.Store.Stat(r.Context(), dataKey)
+	// Blobs are complete, and once tags are written back, of another size.
+	unfinished := master && dataKey == key && (info.SizeIsDeferred || obj.Size < info.Size)
+	if storage.IsNotFound(err) || (err == nil && unfinished) {
+		writeTusError(w, http.StatusNotFound, "ERR_UPLOAD_NOT_FINISHED", "upload is not finished")
+		return
+	}
+	if err != nil {
+		writeTusError(w, http.StatusInternalServerError, "ERR_INTERNAL_SERVER_ERROR", err.Error())
+		return
+	}
+
+	h := w.Header()
+	h.Set("Accept-Ranges", "bytes")
+	contentType, disposition := servedAs(filetype)
+	h.Set("Content-Type", contentType)
+	h.Set("X-Content-Type-Options", "nosniff")
+	var params map[string]string
+	if name != "" {
+		params = map[string]string{"filename": name}
+	}
+	h.Set("Content-Disposition", mime.FormatMediaType(disposition, params))
+	if sum := info.MetaData[MetadataSHA256]; sum != "" && master {
+		h.Set("ETag", `"`+sum+`"`)
+	}
+
+	offset, length, partial, ok := parseRange(r.Header.Get("Range"), obj.Size)
+	if !ok {
+		h.Set("Content-Range", fmt.Sprintf("bytes */%d", obj.Size))
+		writeTusError(w, http.StatusRequestedRangeNotSatisfiable, "ERR_INVALID_RANGE", "invalid range")
+		return
+	}
+
+	body, err := a.Store.Open(r.Context(), dataKey, offset, length)
+	if err != nil {
+		writeTusError(w, http.StatusInternalServerError, "ERR_INTERNAL_SERVER_ERROR", err.Error())
+		return
+	}
+	defer body.Close()
+
+	h.Set("Content-Length", strconv.FormatInt(length, 10))
+	status := http.StatusOK
+	if partial {
+		h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, obj.Size))
+		status = http.StatusPartialContent
+	}
+	w.WriteHeader(status)
+	io.Copy(w, body)
+}
+
+// inlineImageTypes are the image types tusd serves inline, besides audio.
+var inlineImageTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/bmp":  true,
+	"image/webp": true,
+}
+
+// servedAs returns the content type and disposition of a download of the
+// client supplied filetype. Only audio and a few image types are served as
+// themselves, inline; anything else, such as HTML or SVG, could run as
+// active content from this origin and is a binary attachment.
+func servedAs(filetype string) (contentType, disposition string) {
+	mediaType, _, err := mime.ParseMediaType(filetype)
+	if err != nil || !(strings.HasPrefix(mediaType, "audio/") || inlineImageTypes[mediaType]) {
+		return "application/octet-stream", "attachment"
+	}
+	return filetype, "inline"
+}
+
+// parseRange parses a Range header holding a single byte range. Without a
+// header the whole object is returned, with partial unset.
+func parseRange(header string, size int64) (offset, length int64, partial, ok bool) {
+	if header == "" {
+		return 0, size, false, true
+	}
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false, false
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false, false
+	}
+
+	if first == "" {
+		// A suffix range: the last n bytes.
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 || size == 0 {
+			return 0, 0, false, false
+		}
+		n = min(n, size)
+		return size - n, n, true, true
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false, false
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false, false
+		}
+		end = min(end, size-1)
+	}
+	return start, end - start + 1, true, true
+}
@@ -0,0 +1,289 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"music-streaming/backend/internal/identity"
+	"music-streaming/backend/internal/s3fake"
+	"music-streaming/backend/internal/search"
+	"music-streaming/backend/internal/storage"
+)
+
+// newFileApp returns an App storing uploads in a temporary directory, with
+// its tus handler.
+func newFileApp(t *testing.T) (*App, http.Handler) {
+	store, err := storage.NewFile(t.TempDir())
+	require.NoError(t, err)
+	resolver := identity.Resolver{UserHeader: identity.DefaultUserHeader, TrustGatewayHeaders: true}
+	tusHandler, composer, err := newHandler(store, resolver, NewDeferredUploads(DeferredConfig{}), nil)
+	require.NoError(t, err)
+	app := &App{
+		Store:    store,
+		Catalog:  newTestCatalog(t),
+		Search:   search.New(),
+		Resolver: resolver,
+		composer: composer,
+	}
+	app.TusHandler = protocolHandler(tusHandler, composer, 0)
+	return app, app.TusHandler
+}
+
+// createUpload creates an upload of size bytes as alice and writes data to
+// it, returning its ID.
+func createUpload(t *testing.T, tusHandler http.Handler, size int, data, metadata string) string {
+	req := httptest.NewRequest("POST", "/files/", nil)
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	req.Header.Set(identity.DefaultUserHeader, "alice")
+	req.Header.Set("Upload-Length", strconv.Itoa(size))
+	req.Header.Set("Upload-Metadata", metadata)
+	rr := httptest.NewRecorder()
+	tusHandler.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusCreated, rr.Code)
+	id := rr.Header().Get("Location")[strings.LastIndex(rr.Header().Get("Location"), "/")+1:]
+
+	req = newPatchRequest(id, data)
+	rr = httptest.NewRecorder()
+	tusHandler.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusNoContent, rr.Code)
+	return id
+}
+
+func download(app *App, id, rng string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/files/"+id, nil)
+	if rng != "" {
+		req.Header.Set("Range", rng)
+	}
+	rr := httptest.NewRecorder()
+	app.DownloadHandler(rr, req)
+	return rr
+}
+
+func TestDownload_FileStore(t *testing.T) {
+	app, tusHandler := newFileApp(t)
+	// filename song.mp3, filetype audio/mpeg
+	id := createUpload(t, tusHandler, 10, "0123456789", "filename c29uZy5tcDM=,filetype YXVkaW8vbXBlZw==")
+
+	rr := download(app, id, "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "0123456789", rr.Body.String())
+	assert.Equal(t, "audio/mpeg", rr.Header().Get("Content-Type"))
+	assert.Equal(t, `inline; filename=song.mp3`, rr.Header().Get("Content-Disposition"))
+	assert.Equal(t, "nosniff", rr.Header().Get("X-Content-Type-Options"))
+
+	rr = download(app, id, "bytes=2-4")
+	assert.Equal(t, http.StatusPartialContent, rr.Code)
+	assert.Equal(t, "234", rr.Body.String())
+	assert.Equal(t, "bytes 2-4/10", rr.Header().Get("Content-Range"))
+
+	rr = download(app, id, "bytes=20-")
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, rr.Code)
+
+	assert.Equal(t, http.StatusNotFound, download(app, "missing", "").Code)
+}
+
+func TestDownload_ContentTypes(t *testing.T) {
+	app, tusHandler := newFileApp(t)
+	tests := []struct {
+		filetype, contentType, disposition string
+	}{
+		{"audio/flac", "audio/flac", "inline"},
+		{"image/png", "image/png", "inline"},
+		// Uploads that would run as active content are downloaded instead.
+		{"text/html", "application/octet-stream", "attachment"},
+		{"image/svg+xml", "application/octet-stream", "attachment"},
+		{"not a type", "application/octet-stream", "attachment"},
+		{"", "application/octet-stream", "attachment"},
+	}
+	for _, tt := range tests {
+		metadata := "filetype " + base64.StdEncoding.EncodeToString([]byte(tt.filetype))
+		id := createUpload(t, tusHandler, 4, "data", metadata)
+		rr := download(app, id, "")
+		require.Equal(t, http.StatusOK, rr.Code, tt.filetype)
+		assert.Equal(t, tt.contentType, rr.Header().Get("Content-Type"), tt.filetype)
+		assert.Equal(t, tt.disposition, rr.Header().Get("Content-Disposition"), tt.filetype)
+		assert.Equal(t, "nosniff", rr.Header().Get("X-Content-Type-Options"), tt.filetype)
+	}
+}
+
+func TestDownload_UnfinishedUpload(t *testing.T) {
+	app, tusHandler := newFileApp(t)
+	id := createUpload(t, tusHandler, 10, "01234", "")
+
+	rr := download(app, id, "")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Contains(t, rr.Body.String(), "ERR_UPLOAD_NOT_FINISHED")
+
+	require.NoError(t, app.RebuildCatalog(context.Background()))
+	rr = httptest.NewRecorder()
+	app.ListFilesHandler(rr, httptest.NewRequest("GET", "/files/", nil))
+	assert.JSONEq(t, `[]`, rr.Body.String())
+}
+
+func TestListFiles_FileStore(t *testing.T) {
+	app, tusHandler := newFileApp(t)
+	id := createUpload(t, tusHandler, 4, "data", "filename YS5tcDM=")
+	require.NoError(t, app.RebuildCatalog(context.Background()))
+
+	rr := httptest.NewRecorder()
+	app.ListFilesHandler(rr, httptest.NewRequest("GET", "/files/", nil))
+
+	var files []map[string]interface{}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &files))
+	require.Len(t, files, 1)
+	assert.Equal(t, "a.mp3", files[0]["name"])
+	// Without public URLs on the store, files are fetched through the service.
+	assert.Equal(t, "/files/"+id, files[0]["url"])
+}
+
+func TestDedupStage_LinksOnFileStore(t *testing.T) {
+	ctx := context.Background()
+	app, tusHandler := newFileApp(t)
+	app.Pipeline = &Pipeline{Stages: []Stage{ChecksumStage{}, DedupStage{}}}
+	first := createUpload(t, tusHandler, 4, "same", "")
+	second := createUpload(t, tusHandler, 4, "same", "")
+
+	for _, id := range []string{first, second} {
+		info, err := app.loadInfo(ctx, id)
+		require.NoError(t, err)
+		app.Pipeline.Process(ctx, app, info)
+	}
+
+	// Both uploads stay readable through tusd and the download endpoint.
+	for _, id := range []string{first, second} {
+		info, err := app.loadInfo(ctx, id)
+		require.NoError(t, err)
+		assert.NotEmpty(t, info.MetaData[MetadataBlob])
+		assert.Equal(t, "same", download(app, id, "").Body.String())
+
+		req := httptest.NewRequest("HEAD", "/files/"+id, nil)
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		rr := httptest.NewRecorder()
+		tusHandler.ServeHTTP(rr, req)
+		assert.Equal(t, "4", rr.Header().Get("Upload-Offset"))
+	}
+
+	objects, err := app.Store.List(ctx, blobPrefix)
+	require.NoError(t, err)
+	assert.Len(t, objects, 2) // the blob and its references
+}
+
+func TestDownload_CustomerEncryptedS3(t *testing.T) {
+	ctx := context.Background()
+	client := s3fake.New()
+	store := storage.NewS3("test-bucket", client, "http://s3.test")
+	store.SmallUploadThreshold = 0
+	keys, err := storage.NewKeyring("k1", map[string][]byte{"k1": bytes.Repeat([]byte{7}, 32)})
+	require.NoError(t, err)
+	store.Encrypt(storage.Encryption{Mode: storage.SSECustomer, Keys: keys})
+	tusHandler, composer, err := newHandler(store, identity.Resolver{}, NewDeferredUploads(DeferredConfig{}), nil)
+	require.NoError(t, err)
+	app := &App{Store: store, Catalog: newTestCatalog(t), composer: composer, TusHandler: protocolHandler(tusHandler, composer, 0)}
+	app.Pipeline = &Pipeline{Stages: []Stage{ChecksumStage{}, DedupStage{}, CatalogStage{}}}
+
+	id := createUpload(t, app.TusHandler, 10, "0123456789", "filename c29uZy5tcDM=")
+	key, _, _ := strings.Cut(id, "+")
+	info, err := app.loadInfo(ctx, key)
+	require.NoError(t, err)
+	app.Pipeline.Process(ctx, app, info)
+
+	// Everything at rest, including .info and blob objects, is encrypted.
+	for _, key := range client.Keys("test-bucket") {
+		enc, _ := client.ObjectEncryption("test-bucket", key)
+		assert.NotEmpty(t, enc.CustomerKeyMD5, key)
+	}
+
+	rr := download(app, id, "bytes=2-4")
+	assert.Equal(t, http.StatusPartialContent, rr.Code)
+	assert.Equal(t, "234", rr.Body.String())
+
+	// Clients cannot send the key, so they are not sent to S3 directly.
+	rr = httptest.NewRecorder()
+	app.ListFilesHandler(rr, httptest.NewRequest("GET", "/files/", nil))
+	var files []map[string]interface{}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &files))
+	require.Len(t, files, 1)
+	assert.Equal(t, "/files/"+key, files[0]["url"])
+}
+
+func TestDownload_Envelope(t *testing.T) {
+	ctx := context.Background()
+	inner, err := storage.NewFile(t.TempDir())
+	require.NoError(t, err)
+	store, err := storage.NewEnvelope(inner, bytes.Repeat([]byte{7}, 32))
+	require.NoError(t, err)
+	tusHandler, composer, err := newHandler(store, identity.Resolver{}, NewDeferredUploads(DeferredConfig{}), nil)
+	require.NoError(t, err)
+	app := &App{Store: store, Catalog: newTestCatalog(t), composer: composer, TusHandler: protocolHandler(tusHandler, composer, 0)}
+	app.Pipeline = &Pipeline{Stages: []Stage{ChecksumStage{}, DedupStage{}, CatalogStage{}}}
+
+	data := strings.Repeat("0123456789", 20000)
+	id := createUpload(t, app.TusHandler, len(data), data, "filename c29uZy5tcDM=")
+	info, err := app.loadInfo(ctx, id)
+	require.NoError(t, err)
+	app.Pipeline.Process(ctx, app, info)
+	info, err = app.loadInfo(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), info.Size)
+	assert.NotEmpty(t, info.MetaData[MetadataBlob])
+
+	// Nothing at rest holds the plaintext.
+	objects, err := inner.List(ctx, "")
+	require.NoError(t, err)
+	for _, obj := range objects {
+		stored, err := storage.ReadAll(ctx, inner, obj.Key)
+		require.NoError(t, err)
+		assert.NotContains(t, string(stored), "0123456789", obj.Key)
+	}
+
+	rr := download(app, id, "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, data, rr.Body.String())
+	rr = download(app, id, "bytes=65530-65545")
+	assert.Equal(t, http.StatusPartialContent, rr.Code)
+	assert.Equal(t, data[65530:65546], rr.Body.String())
+	assert.Equal(t, "bytes 65530-65545/200000", rr.Header().Get("Content-Range"))
+
+	rr = httptest.NewRecorder()
+	app.ListFilesHandler(rr, httptest.NewRequest("GET", "/files/", nil))
+	var files []map[string]interface{}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &files))
+	require.Len(t, files, 1)
+	assert.Equal(t, "/files/"+id, files[0]["url"])
+}
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header          string
+		offset, length  int64
+		partial, wantOK bool
+	}{
+		{"", 0, 10, false, true},
+		{"bytes=0-0", 0, 1, true, true},
+		{"bytes=5-", 5, 5, true, true},
+		{"bytes=8-20", 8, 2, true, true},
+		{"bytes=-3", 7, 3, true, true},
+		{"bytes=-30", 0, 10, true, true},
+		{"bytes=10-", 0, 0, false, false},
+		{"bytes=4-2", 0, 0, false, false},
+		{"bytes=0-1,3-4", 0, 0, false, false},
+		{"items=0-1", 0, 0, false, false},
+	}
+	for _, tt := range tests {
+		offset, length, partial, ok := parseRange(tt.header, 10)
+		assert.Equal(t, tt.wantOK, ok, tt.header)
+		if ok {
+			assert.Equal(t, []interface{}{tt.offset, tt.length, tt.partial}, []interface{}{offset, length, partial}, tt.header)
+		}
+	}
+}
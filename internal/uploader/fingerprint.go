@@ -0,0 +1,381 @@
+package uploader
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"music-streaming/backend/internal/audio"
+	"music-streaming/backend/internal/catalog"
+	"music-streaming/backend/internal/storage"
+)
+
+// Upload metadata keys of the acoustic fingerprint of a track: the storage
+// key of the fingerprint, and the uploads that sounded alike when it was
+// computed, as comma separated key:similarity pairs.
+const (
+	MetadataFingerprint = "fingerprint"
+	MetadataDuplicates  = "duplicates"
+)
+
+// fingerprintLength is how much of an upload is fingerprinted. Recordings
+// that start alike for this long are taken to be the same.
+const fingerprintLength = 2 * time.Minute
+
+// DefaultDuplicateThreshold is the similarity from which uploads are
+// reported as duplicates. Unrelated recordings score well below it, while
+// re-encodings of a recording score above it.
+const DefaultDuplicateThreshold = 0.6
+
+// fingerprintKey is where the fingerprint of the upload stored under key
+// lives.
+func fingerprintKey(key string) string {
+	return derivedPrefix + key + "/fingerprint"
+}
+
+// Duplicate is an upload that sounds like another one.
+type Duplicate struct {
+	Key        string
+	Similarity float64
+}
+
+// fingerprintHash is what the FingerprintIndex looks sub-fingerprints up
+// by: which pitch classes are stronger than their neighbour. Unlike the
+// whole sub-fingerprint, it mostly survives re-encoding.
+func fingerprintHash(v uint32) uint32 {
+	return v & 0xfff
+}
+
+// maxFingerprintCandidates is how many uploads sharing the most hashes
+// with a fingerprint are compared with it. maxHashUploads is how many
+// uploads a hash may be in to count: hashes that common, e.g. that of
+// silence, tell uploads apart no better than chance.
+const (
+	maxFingerprintCandidates = 100
+	maxHashUploads           = 1000
+)
+
+// FingerprintIndex holds the fingerprints of uploads in memory to find
+// near-duplicates among them. It is rebuilt from the store on startup.
+type FingerprintIndex struct {
+	// Threshold is the similarity from which uploads are duplicates,
+	// DefaultDuplicateThreshold if zero.
+	Threshold float64
+
+	mu      sync.RWMutex
+	entries map[string]audio.Fingerprint
+	// uploads maps the hashes of sub-fingerprints to the keys of the
+	// uploads whose fingerprint has them.
+	uploads map[uint32]map[string]struct{}
+}
+
+// NewFingerprintIndex returns an empty index.
+func NewFingerprintIndex() *FingerprintIndex {
+	return &FingerprintIndex{
+		entries: make(map[string]audio.Fingerprint),
+		uploads: make(map[uint32]map[string]struct{}),
+	}
+}
+
+// Add indexes the fingerprint of the upload stored under key.
+func (x *FingerprintIndex) Add(key string, fp audio.Fingerprint) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.remove(key)
+	x.entries[key] = fp
+	for _, v := range fp {
+		h := fingerprintHash(v)
+		keys := x.uploads[h]
+		if keys == nil {
+			keys = make(map[string]struct{})
+			x.uploads[h] = keys
+		}
+		keys[key] = struct{}{}
+	}
+}
+
+// Remove drops the upload stored under key from the index.
+func (x *FingerprintIndex) Remove(key string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.remove(key)
+}
+
+func (x *FingerprintIndex) remove(key string) {
+	for _, v := range x.entries[key] {
+		h := fingerprintHash(v)
+		delete(x.uploads[h], key)
+		if len(x.uploads[h]) == 0 {
+			delete(x.uploads, h)
+		}
+	}
+	delete(x.entries, key)
+}
+
+// Get returns the indexed fingerprint of the upload stored under key.
+func (x *FingerprintIndex) Get(key string) (audio.Fingerprint, bool) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	fp, ok := x.entries[key]
+	return fp, ok
+}
+
+// Match returns the uploads other than key that fp is a duplicate of, most
+// similar first. Rather than with every upload, fp is only compared with
+// the maxFingerprintCandidates uploads sharing the most hashes with it.
+func (x *FingerprintIndex) Match(key string, fp audio.Fingerprint) []Duplicate {
+	threshold := x.Threshold
+	if threshold == 0 {
+		threshold = DefaultDuplicateThreshold
+	}
+
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	hashes := make(map[uint32]struct{})
+	for _, v := range fp {
+		hashes[fingerprintHash(v)] = struct{}{}
+	}
+	shared := make(map[string]int)
+	for h := range hashes {
+		keys := x.uploads[h]
+		if len(keys) > maxHashUploads {
+			continue
+		}
+		for other := range keys {
+			if other != key {
+				shared[other]++
+			}
+		}
+	}
+	candidates := make([]string, 0, len(shared))
+	for other := range shared {
+		candidates = append(candidates, other)
+	}
+	slices.SortFunc(candidates, func(a, b string) int {
+		if c := cmp.Compare(shared[b], shared[a]); c != 0 {
+			return c
+		}
+		return strings.Compare(a, b)
+	})
+	if len(candidates) > maxFingerprintCandidates {
+		candidates = candidates[:maxFingerprintCandidates]
+	}
+
+	var duplicates []Duplicate
+	for _, other := range candidates {
+		if s := fp.Similarity(x.entries[other]); s >= threshold {
+			duplicates = append(duplicates, Duplicate{Key: other, Similarity: s})
+		}
+	}
+	slices.SortFunc(duplicates, func(a, b Duplicate) int {
+		if c := cmp.Compare(b.Similarity, a.Similarity); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Key, b.Key)
+	})
+	return duplicates
+}
+
+// Load indexes the fingerprints kept in store.
+func (x *FingerprintIndex) Load(ctx context.Context, store storage.Store) error {
+	objects, err := store.List(ctx, derivedPrefix)
+	if err != nil {
+		return fmt.Errorf("failed to list fingerprints: %w", err)
+	}
+	for _, obj := range objects {
+		key, ok := strings.CutSuffix(obj.Key, "/fingerprint")
+		if !ok {
+			continue
+		}
+		fp, err := loadFingerprint(ctx, store, obj.Key)
+		if err != nil {
+			return err
+		}
+		x.Add(strings.TrimPrefix(key, derivedPrefix), fp)
+	}
+	return nil
+}
+
+// encodeFingerprint serializes fp as little-endian 32-bit words.
+func encodeFingerprint(fp audio.Fingerprint) []byte {
+	data := make([]byte, 0, 4*len(fp))
+	for _, v := range fp {
+		data = binary.LittleEndian.AppendUint32(data, v)
+	}
+	return data
+}
+
+func loadFingerprint(ctx context.Context, store storage.Store, objKey string) (audio.Fingerprint, error) {
+	body, err := store.Open(ctx, objKey, 0, -1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fingerprint: %w", err)
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fingerprint: %w", err)
+	}
+	fp := make(audio.Fingerprint, len(data)/4)
+	for i := range fp {
+		fp[i] = binary.LittleEndian.Uint32(data[4*i:])
+	}
+	return fp, nil
+}
+
+// FingerprintStage computes an acoustic fingerprint of the start of
+// completed WAV, FLAC and MP3 uploads and stores it next to the upload.
+// Uploads that sound like ones in the App's FingerprintIndex are recorded
+// as their duplicates, whatever their encoding. Uploads in other formats
+// are skipped.
+type FingerprintStage struct{}
+
+func (FingerprintStage) Name() string { return "fingerprint" }
+
+func (FingerprintStage) Process(ctx context.Context, upload *CompletedUpload) error {
+	app := upload.App
+	key := objectKey(upload.Info)
+	dataKey := key
+	if blob := upload.Info.MetaData[MetadataBlob]; blob != "" {
+		dataKey = blob
+	}
+
+	body, err := app.Store.Open(ctx, dataKey, 0, -1)
+	if err != nil {
+		return fmt.Errorf("failed to read upload: %w", err)
+	}
+	defer body.Close()
+	d, err := audio.Decode(body)
+	if errors.Is(err, audio.ErrUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fp, err := audio.ComputeFingerprint(d, fingerprintLength)
+	if err != nil {
+		return fmt.Errorf("failed to decode %s: %w", d.Format, err)
+	}
+	if len(fp) == 0 {
+		return nil
+	}
+
+	data := encodeFingerprint(fp)
+	if err := app.Store.Put(ctx, fingerprintKey(key), bytes.NewReader(data), int64(len(data))); err != nil {
+		return fmt.Errorf("failed to store fingerprint: %w", err)
+	}
+	metadata := upload.Info.MetaData
+	metadata[MetadataFingerprint] = fingerprintKey(key)
+	if app.Fingerprints == nil {
+		return nil
+	}
+	var pairs []string
+	for _, dup := range app.Fingerprints.Match(key, fp) {
+		pairs = append(pairs, dup.Key+":"+strconv.FormatFloat(dup.Similarity, 'f', 2, 64))
+	}
+	if len(pairs) > 0 {
+		metadata[MetadataDuplicates] = strings.Join(pairs, ",")
+	}
+	app.Fingerprints.Add(key, fp)
+	return nil
+}
+
+// Terminate drops the upload from the index and deletes its fingerprint.
+// Like that of the waveform, its key is derived from the upload's rather
+// than read from the metadata.
+func (FingerprintStage) Terminate(ctx context.Context, upload *CompletedUpload) error {
+	if upload.Info.MetaData[MetadataFingerprint] == "" {
+		return nil
+	}
+	key := objectKey(upload.Info)
+	if upload.App.Fingerprints != nil {
+		upload.App.Fingerprints.Remove(key)
+	}
+	if err := upload.App.Store.Delete(ctx, fingerprintKey(key)); err != nil && !storage.IsNotFound(err) {
+		return fmt.Errorf("failed to delete fingerprint: %w", err)
+	}
+	return nil
+}
+
+// DuplicatesHandler lists the uploads that sound like an upload at
+// /files/{id}/duplicates, most similar first. Unlike the duplicates in its
+// metadata, the list includes uploads completed after it and leaves out
+// deleted ones, which the catalog no longer holds.
+func (a *App) DuplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/files/"), "/duplicates")
+	key, _, _ := strings.Cut(id, "+")
+	if key == "" || strings.Contains(key, "/") {
+		writeTusError(w, http.StatusNotFound, "ERR_UPLOAD_NOT_FOUND", "upload not found")
+		return
+	}
+
+	info, err := a.loadInfo(r.Context(), key)
+	if storage.IsNotFound(err) {
+		writeTusError(w, http.StatusNotFound, "ERR_UPLOAD_NOT_FOUND", "upload not found")
+		return
+	}
+	if err != nil {
+		writeTusError(w, http.StatusInternalServerError, "ERR_INTERNAL_SERVER_ERROR", err.Error())
+		return
+	}
+	var fp audio.Fingerprint
+	var ok bool
+	if a.Fingerprints != nil {
+		fp, ok = a.Fingerprints.Get(key)
+	}
+	if !ok || info.MetaData[MetadataFingerprint] == "" {
+		writeTusError(w, http.StatusNotFound, "ERR_FINGERPRINT_NOT_FOUND", "fingerprint not found")
+		return
+	}
+
+	type DuplicateInfo struct {
+		Key        string  `json:"key"`
+		Name       string  `json:"name"`
+		URL        string  `json:"url"`
+		Similarity float64 `json:"similarity"`
+	}
+	duplicates := a.Fingerprints.Match(key, fp)
+	keys := make([]string, len(duplicates))
+	for i, dup := range duplicates {
+		keys[i] = dup.Key
+	}
+	tracks := make(map[string]catalog.Track)
+	if len(keys) > 0 {
+		found, err := a.Catalog.Tracks(r.Context(), catalog.TrackFilter{Keys: keys})
+		if err != nil {
+			writeTusError(w, http.StatusInternalServerError, "ERR_INTERNAL_SERVER_ERROR", err.Error())
+			return
+		}
+		for _, t := range found {
+			tracks[t.Key] = t
+		}
+	}
+	list := make([]DuplicateInfo, 0)
+	for _, dup := range duplicates {
+		t, ok := tracks[dup.Key]
+		if !ok {
+			continue
+		}
+		list = append(list, DuplicateInfo{
+			Key:        dup.Key,
+			Name:       t.Name,
+			URL:        a.fileURL(dup.Key, t.DataKey),
+			Similarity: dup.Similarity,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(list); err != nil {
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+	}
+}
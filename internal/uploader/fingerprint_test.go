@@ -0,0 +1,110 @@
+package uploader
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"music-streaming/backend/internal/audio"
+)
+
+// tune renders notes, as semitones above A3, of a quarter second each.
+func tune(sampleRate int, amplitude float64, notes ...int) []byte {
+	var samples []float64
+	for _, note := range notes {
+		samples = append(samples, audio.Sine(sampleRate, 1, 220*math.Pow(2, float64(note)/12), amplitude, 0.25)...)
+	}
+	return audio.EncodeWAV(sampleRate, 1, samples)
+}
+
+func getDuplicates(app *App, id string) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	app.DuplicatesHandler(rr, httptest.NewRequest("GET", "/files/"+id+"/duplicates", nil))
+	return rr
+}
+
+func TestFingerprintStage(t *testing.T) {
+	ctx := context.Background()
+	app, tusHandler := newFileApp(t)
+	app.Fingerprints = NewFingerprintIndex()
+	stages := []Stage{ChecksumStage{}, DedupStage{}, FingerprintStage{}, CatalogStage{}}
+	notes := []int{0, 4, 7, 12, 7, 4, 0, 2, 5, 9, 5, 2, 0, 7, 3, 10, 3, 10, 0, 4}
+
+	original := processUpload(t, app, tusHandler, string(tune(44100, 0.5, notes...)), stages...)
+	copied := processUpload(t, app, tusHandler, string(tune(22050, 0.2, notes...)), stages...)
+	processUpload(t, app, tusHandler, string(tune(44100, 0.5, 1, 8, 3, 11, 6, 1, 9, 4, 11, 2, 8, 6, 1, 10, 5, 3, 11, 8, 2, 6)), stages...)
+	processUpload(t, app, tusHandler, "master", stages...)
+
+	// The copy is flagged when it completes.
+	info, err := app.loadInfo(ctx, copied)
+	require.NoError(t, err)
+	assert.Regexp(t, `^`+original+`:(0\.[6-9]\d|1\.00)$`, info.MetaData[MetadataDuplicates])
+
+	// Both recordings list each other, but not unrelated ones.
+	for _, pair := range [][2]string{{original, copied}, {copied, original}} {
+		rr := getDuplicates(app, pair[0])
+		require.Equal(t, http.StatusOK, rr.Code)
+		var duplicates []struct {
+			Key        string  `json:"key"`
+			URL        string  `json:"url"`
+			Similarity float64 `json:"similarity"`
+		}
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &duplicates))
+		require.Len(t, duplicates, 1)
+		assert.Equal(t, pair[1], duplicates[0].Key)
+		assert.Equal(t, "/files/"+pair[1], duplicates[0].URL)
+		assert.GreaterOrEqual(t, duplicates[0].Similarity, DefaultDuplicateThreshold)
+	}
+
+	// The index is rebuilt from the store.
+	index := NewFingerprintIndex()
+	require.NoError(t, index.Load(ctx, app.Store))
+	fp, ok := index.Get(original)
+	require.True(t, ok)
+	assert.Len(t, index.Match(original, fp), 1)
+
+	// Deleted uploads are left out even before their fingerprint is.
+	info, err = app.loadInfo(ctx, original)
+	require.NoError(t, err)
+	require.NoError(t, CatalogStage{}.Terminate(ctx, &CompletedUpload{App: app, Info: info}))
+	assert.Equal(t, "[]\n", getDuplicates(app, copied).Body.String())
+	require.NoError(t, FingerprintStage{}.Terminate(ctx, &CompletedUpload{App: app, Info: info}))
+	_, ok = app.Fingerprints.Get(original)
+	assert.False(t, ok)
+	assert.Equal(t, "[]\n", getDuplicates(app, copied).Body.String())
+	assert.Contains(t, getDuplicates(app, original).Body.String(), "ERR_FINGERPRINT_NOT_FOUND")
+}
+
+func TestDuplicatesHandler_NotFound(t *testing.T) {
+	app, tusHandler := newFileApp(t)
+	app.Fingerprints = NewFingerprintIndex()
+	id := processUpload(t, app, tusHandler, "master", ChecksumStage{}, FingerprintStage{})
+
+	rr := getDuplicates(app, id)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Contains(t, rr.Body.String(), "ERR_FINGERPRINT_NOT_FOUND")
+	assert.Contains(t, getDuplicates(app, "missing").Body.String(), "ERR_UPLOAD_NOT_FOUND")
+}
+
+func TestFingerprintIndex_Match(t *testing.T) {
+	x := NewFingerprintIndex()
+	fp := audio.Fingerprint{0x1001, 0x2002, 0x3003, 0x4004, 0x5005, 0x6006, 0x7007, 0x8008, 0x9009, 0xa00a}
+	x.Add("a", fp)
+	x.Add("b", audio.Fingerprint{0x1fff, 0x2fff, 0x3fff, 0x4fff, 0x5fff, 0x6fff, 0x7fff, 0x8fff, 0x9fff, 0xafff})
+	x.Add("c", fp)
+
+	assert.Equal(t, []Duplicate{{Key: "c", Similarity: 1}}, x.Match("a", fp))
+	// Uploads without a hash in common are not compared.
+	assert.Empty(t, x.Match("a", audio.Fingerprint{0x1ff1, 0x2ff2, 0x3ff3, 0x4ff4, 0x5ff5, 0x6ff6, 0x7ff7, 0x8ff8, 0x9ff9, 0xaffa}))
+
+	x.Add("c", audio.Fingerprint{0xf00f})
+	x.Remove("a")
+	assert.Empty(t, x.Match("", fp))
+	assert.Len(t, x.uploads, 2)
+}
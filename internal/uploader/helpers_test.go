@@ -0,0 +1,45 @@
+package uploader
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// processUpload creates an upload of data and runs it through stages,
+// returning its ID.
+func processUpload(t *testing.T, app *App, tusHandler http.Handler, data string, stages ...Stage) string {
+	ctx := context.Background()
+	app.Pipeline = &Pipeline{Stages: stages}
+	id := createUpload(t, tusHandler, len(data), data, "")
+	key, _, _ := strings.Cut(id, "+")
+	info, err := app.loadInfo(ctx, key)
+	require.NoError(t, err)
+	app.Pipeline.Process(ctx, app, info)
+	return id
+}
+
+// listedFile is an entry of the file list, with what the stages recorded.
+type listedFile struct {
+	Key         string        `json:"key"`
+	Name        string        `json:"name"`
+	Title       string        `json:"title"`
+	Artist      string        `json:"artist"`
+	Album       string        `json:"album"`
+	TrackNumber int           `json:"track_number"`
+	Format      *formatInfo   `json:"format"`
+	Loudness    *loudnessInfo `json:"loudness"`
+}
+
+func listFiles(t *testing.T, app *App, query string) []listedFile {
+	rr := httptest.NewRecorder()
+	app.ListFilesHandler(rr, httptest.NewRequest("GET", "/files/"+query, nil))
+	var files []listedFile
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &files))
+	return files
+}
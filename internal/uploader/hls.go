@@ -0,0 +1,319 @@
+package uploader
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"music-streaming/backend/internal/storage"
+	"music-streaming/backend/internal/transcode"
+)
+
+// MetadataHLS is the upload metadata key listing the names of the renditions
+// packaged for HLS, separated by commas.
+const MetadataHLS = "hls"
+
+// masterPlaylist is the name of the playlist listing an upload's HLS
+// renditions.
+const masterPlaylist = "master.m3u8"
+
+// defaultSegmentDuration is the default for HLSStage.SegmentDuration.
+const defaultSegmentDuration = 6 * time.Second
+
+// hlsPrefix is where the HLS playlists and segments of the upload stored
+// under key live.
+func hlsPrefix(key string) string {
+	return derivedPrefix + key + "/hls/"
+}
+
+// HLSStage packages completed uploads for HLS streaming. Every rendition
+// gets a media playlist and segments under its name, and a master playlist
+// lists them from the lowest bitrate up. Renditions are packaged
+// Concurrency at a time, one per CPU if zero. A rendition that fails is
+// left out and logged.
+type HLSStage struct {
+	Packager        transcode.Packager
+	Renditions      []transcode.Rendition
+	SegmentDuration time.Duration
+	Concurrency     int
+}
+
+// HLSStageFromEnv returns a stage packaging the renditions listed in
+// HLS_RENDITIONS, such as "aac-64k,aac-128k,aac-256k", in segments of
+// HLS_SEGMENT_DURATION (default 6s), with the ffmpeg at FFMPEG_PATH,
+// running at most FFMPEG_CONCURRENCY at once. Without renditions it
+// returns nil.
+func HLSStageFromEnv() (*HLSStage, error) {
+	list, err := transcode.ParseRenditions(os.Getenv("HLS_RENDITIONS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid HLS_RENDITIONS: %w", err)
+	}
+	if len(list) == 0 {
+		return nil, nil
+	}
+	stage := &HLSStage{Renditions: list, SegmentDuration: defaultSegmentDuration}
+	if v := os.Getenv("HLS_SEGMENT_DURATION"); v != "" {
+		stage.SegmentDuration, err = time.ParseDuration(v)
+		if err != nil || stage.SegmentDuration < time.Second {
+			return nil, fmt.Errorf("invalid HLS_SEGMENT_DURATION %q", v)
+		}
+	}
+	if stage.Concurrency, err = ffmpegConcurrencyFromEnv(); err != nil {
+		return nil, err
+	}
+	ffmpeg := transcode.NewFFmpeg(os.Getenv("FFMPEG_PATH"))
+	if !ffmpeg.Available() {
+		return nil, fmt.Errorf("HLS_RENDITIONS needs ffmpeg, %q was not found", ffmpeg.Path)
+	}
+	stage.Packager = ffmpeg
+	return stage, nil
+}
+
+func (HLSStage) Name() string { return "hls" }
+
+func (s HLSStage) Process(ctx context.Context, upload *CompletedUpload) error {
+	app := upload.App
+	key := objectKey(upload.Info)
+	master, err := upload.localCopy(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read master: %w", err)
+	}
+	dir, err := os.MkdirTemp("", "hls-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	renditions := slices.Clone(s.Renditions)
+	slices.SortStableFunc(renditions, func(a, b transcode.Rendition) int { return a.Kbps - b.Kbps })
+	var done []transcode.Rendition
+	var errs []error
+	results := forEachRendition(renditions, s.Concurrency, func(r transcode.Rendition) error {
+		return s.packageRendition(ctx, app.Store, master, filepath.Join(dir, r.Name()), key, r)
+	})
+	for i, err := range results {
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		done = append(done, renditions[i])
+	}
+
+	if len(done) > 0 {
+		playlist := masterPlaylistFor(done)
+		if err := app.Store.Put(ctx, hlsPrefix(key)+masterPlaylist, bytes.NewReader(playlist), int64(len(playlist))); err != nil {
+			return fmt.Errorf("failed to store master playlist: %w", err)
+		}
+		names := make([]string, len(done))
+		for i, r := range done {
+			names[i] = r.Name()
+		}
+		upload.Info.MetaData[MetadataHLS] = strings.Join(names, ",")
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to package %d of %d renditions: %w", len(errs), len(s.Renditions), errs[0])
+	}
+	return nil
+}
+
+func (s HLSStage) packageRendition(ctx context.Context, store storage.Store, master, dir, key string, r transcode.Rendition) error {
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		return err
+	}
+	segment := s.SegmentDuration
+	if segment == 0 {
+		segment = defaultSegmentDuration
+	}
+	if err := s.Packager.Package(ctx, master, dir, r, segment); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	// The media playlist goes last, so it never refers to missing segments.
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Name() != transcode.MediaPlaylist {
+			names = append(names, entry.Name())
+		}
+	}
+	names = append(names, transcode.MediaPlaylist)
+	for _, name := range names {
+		if err := putFile(ctx, store, hlsPrefix(key)+r.Name()+"/"+name, filepath.Join(dir, name)); err != nil {
+			return fmt.Errorf("failed to store %s of %s: %w", name, r.Name(), err)
+		}
+	}
+	return nil
+}
+
+// masterPlaylistFor lists the renditions by their nominal bitrate. It
+// declares the highest version any of their media playlists needs.
+func masterPlaylistFor(renditions []transcode.Rendition) []byte {
+	version := 3
+	for _, r := range renditions {
+		version = max(version, r.HLSVersion())
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:%d\n#EXT-X-INDEPENDENT-SEGMENTS\n", version)
+	for _, r := range renditions {
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d,CODECS=\"%s\"\n%s/%s\n", r.Kbps*1000, r.HLSCodec(), r.Name(), transcode.MediaPlaylist)
+	}
+	return b.Bytes()
+}
+
+// Terminate deletes the playlists and segments of the upload.
+func (HLSStage) Terminate(ctx context.Context, upload *CompletedUpload) error {
+	if upload.Info.MetaData[MetadataHLS] == "" {
+		return nil
+	}
+	objects, err := upload.App.Store.List(ctx, hlsPrefix(objectKey(upload.Info)))
+	if err != nil {
+		return fmt.Errorf("failed to list HLS objects: %w", err)
+	}
+	keys := make([]string, len(objects))
+	for i, obj := range objects {
+		keys[i] = obj.Key
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	if err := upload.App.Store.Delete(ctx, keys...); err != nil {
+		return fmt.Errorf("failed to delete HLS objects: %w", err)
+	}
+	return nil
+}
+
+// putFile stores the file at path under key.
+func putFile(ctx context.Context, store storage.Store, key, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return store.Put(ctx, key, f, stat.Size())
+}
+
+var hlsContentTypes = map[string]string{
+	".m3u8": "application/vnd.apple.mpegurl",
+	".ts":   "video/mp2t",
+	".m4s":  "audio/mp4",
+	".mp4":  "audio/mp4",
+}
+
+// HLSHandler serves the HLS playlists and segments of an upload at
+// /hls/{id}/master.m3u8 and /hls/{id}/{rendition}/{file}. If HLSPresignExpiry
+// is set and the store can presign links to them, media playlists point at
+// the segments in the store; otherwise segments are served from here too.
+func (a *App) HLSHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, file, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/hls/"), "/")
+	key, _, _ := strings.Cut(id, "+")
+	if key == "" {
+		writeTusError(w, http.StatusNotFound, "ERR_UPLOAD_NOT_FOUND", "upload not found")
+		return
+	}
+
+	info, err := a.loadInfo(r.Context(), key)
+	if storage.IsNotFound(err) {
+		writeTusError(w, http.StatusNotFound, "ERR_UPLOAD_NOT_FOUND", "upload not found")
+		return
+	}
+	if err != nil {
+		writeTusError(w, http.StatusInternalServerError, "ERR_INTERNAL_SERVER_ERROR", err.Error())
+		return
+	}
+
+	rendition, name, nested := strings.Cut(file, "/")
+	packaged := strings.Split(info.MetaData[MetadataHLS], ",")
+	valid := file == masterPlaylist ||
+		(nested && slices.Contains(packaged, rendition) && name != "" && !strings.ContainsAny(name, "/\\") && name != "..")
+	if info.MetaData[MetadataHLS] == "" || !valid {
+		writeTusError(w, http.StatusNotFound, "ERR_HLS_NOT_FOUND", "HLS playlist or segment not found")
+		return
+	}
+
+	objKey := hlsPrefix(key) + file
+	body, err := a.Store.Open(r.Context(), objKey, 0, -1)
+	if storage.IsNotFound(err) {
+		writeTusError(w, http.StatusNotFound, "ERR_HLS_NOT_FOUND", "HLS playlist or segment not found")
+		return
+	}
+	if err != nil {
+		writeTusError(w, http.StatusInternalServerError, "ERR_INTERNAL_SERVER_ERROR", err.Error())
+		return
+	}
+	defer body.Close()
+
+	h := w.Header()
+	h.Set("Content-Type", hlsContentTypes[path.Ext(file)])
+	presigner, canPresign := a.Store.(storage.Presigner)
+	if name != transcode.MediaPlaylist || a.HLSPresignExpiry <= 0 || !canPresign {
+		io.Copy(w, body)
+		return
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		writeTusError(w, http.StatusInternalServerError, "ERR_INTERNAL_SERVER_ERROR", err.Error())
+		return
+	}
+	// Stores that cannot presign this object still serve the segments.
+	if playlist, err := presignPlaylist(r.Context(), data, presigner, hlsPrefix(key)+rendition+"/", a.HLSPresignExpiry); err == nil {
+		data = playlist
+		// The links expire, so the playlist must not be kept for as long.
+		h.Set("Cache-Control", "private, max-age="+strconv.Itoa(int(a.HLSPresignExpiry.Seconds()/2)))
+	}
+	h.Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+// presignPlaylist replaces the segment and init section URIs of a media
+// playlist, which are relative to prefix, with presigned links.
+func presignPlaylist(ctx context.Context, playlist []byte, presigner storage.Presigner, prefix string, expires time.Duration) ([]byte, error) {
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(playlist))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-MAP:"):
+			before, rest, found := strings.Cut(line, `URI="`)
+			uri, after, closed := strings.Cut(rest, `"`)
+			if found && closed {
+				url, err := presigner.Presign(ctx, prefix+uri, expires)
+				if err != nil {
+					return nil, err
+				}
+				line = before + `URI="` + url + `"` + after
+			}
+		case line != "" && !strings.HasPrefix(line, "#"):
+			url, err := presigner.Presign(ctx, prefix+line, expires)
+			if err != nil {
+				return nil, err
+			}
+			line = url
+		}
+		out.WriteString(line)
+		out.WriteByte('\n')
+	}
+	return out.Bytes(), scanner.Err()
+}
@@ -0,0 +1,137 @@
+package uploader
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"music-streaming/backend/internal/storage"
+	"music-streaming/backend/internal/transcode"
+)
+
+func getHLS(app *App, path string) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	app.HLSHandler(rr, httptest.NewRequest("GET", path, nil))
+	return rr
+}
+
+// packageUpload creates an upload and runs it through an HLSStage with two
+// renditions, returning its ID.
+func packageUpload(t *testing.T, app *App, tusHandler http.Handler) (string, HLSStage) {
+	ctx := context.Background()
+	stage := HLSStage{
+		Packager:   &transcode.Fake{},
+		Renditions: []transcode.Rendition{{Codec: "aac", Kbps: 128}, {Codec: "aac", Kbps: 64}},
+	}
+	app.Pipeline = &Pipeline{Stages: []Stage{ChecksumStage{}, DedupStage{}, stage}}
+	id := createUpload(t, tusHandler, 6, "master", "")
+	key, _, _ := strings.Cut(id, "+")
+	info, err := app.loadInfo(ctx, key)
+	require.NoError(t, err)
+	app.Pipeline.Process(ctx, app, info)
+	return id, stage
+}
+
+func TestHLSStage(t *testing.T) {
+	ctx := context.Background()
+	app, tusHandler := newFileApp(t)
+	id, stage := packageUpload(t, app, tusHandler)
+
+	rr := getHLS(app, "/hls/"+id+"/master.m3u8")
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/vnd.apple.mpegurl", rr.Header().Get("Content-Type"))
+	assert.Equal(t, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-INDEPENDENT-SEGMENTS\n"+
+		"#EXT-X-STREAM-INF:BANDWIDTH=64000,CODECS=\"mp4a.40.2\"\naac-64k/index.m3u8\n"+
+		"#EXT-X-STREAM-INF:BANDWIDTH=128000,CODECS=\"mp4a.40.2\"\naac-128k/index.m3u8\n", rr.Body.String())
+
+	// Without presigning, segments are referred to relative to the playlist
+	// and served from here.
+	rr = getHLS(app, "/hls/"+id+"/aac-64k/index.m3u8")
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), "\nsegment00000.ts\n")
+	assert.Empty(t, rr.Header().Get("Cache-Control"))
+
+	rr = getHLS(app, "/hls/"+id+"/aac-64k/segment00000.ts")
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "video/mp2t", rr.Header().Get("Content-Type"))
+	assert.Equal(t, "aac-64k", rr.Body.String())
+	assert.Equal(t, "\nmaster", getHLS(app, "/hls/"+id+"/aac-64k/segment00001.ts").Body.String())
+
+	for _, path := range []string{
+		"/hls/" + id + "/aac-256k/index.m3u8",
+		"/hls/" + id + "/aac-64k/missing.ts",
+		"/hls/" + id + "/aac-64k/../../" + id + ".info",
+		"/hls/" + id + "/",
+		"/hls/missing/master.m3u8",
+	} {
+		assert.Equal(t, http.StatusNotFound, getHLS(app, path).Code, path)
+	}
+
+	info, err := app.loadInfo(ctx, id)
+	require.NoError(t, err)
+	require.NoError(t, stage.Terminate(ctx, &CompletedUpload{App: app, Info: info}))
+	objects, err := app.Store.List(ctx, derivedPrefix)
+	require.NoError(t, err)
+	assert.Empty(t, objects)
+}
+
+func TestHLSHandler_Presigned(t *testing.T) {
+	app, tusHandler, _ := newS3App(t, 0)
+	store := app.Store.(*storage.S3)
+	store.Signer = s3.NewPresignClient(s3.New(s3.Options{
+		Region:       "us-east-1",
+		Credentials:  credentials.NewStaticCredentialsProvider("key", "secret", ""),
+		BaseEndpoint: aws.String("http://s3.test"),
+		UsePathStyle: true,
+	}))
+	app.HLSPresignExpiry = 10 * time.Minute
+	id, _ := packageUpload(t, app, tusHandler)
+	key, _, _ := strings.Cut(id, "+")
+
+	rr := getHLS(app, "/hls/"+id+"/aac-128k/index.m3u8")
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), "\nhttp://s3.test/test-bucket/derived/"+key+"/hls/aac-128k/segment00000.ts?")
+	assert.Contains(t, rr.Body.String(), "X-Amz-Expires=600")
+	assert.Equal(t, "private, max-age=300", rr.Header().Get("Cache-Control"))
+
+	// The master playlist refers to the media playlists, which stay here.
+	rr = getHLS(app, "/hls/"+id+"/master.m3u8")
+	assert.Contains(t, rr.Body.String(), "\naac-128k/index.m3u8\n")
+
+	// Stores that cannot presign fall back to serving segments.
+	store.Signer = nil
+	rr = getHLS(app, "/hls/"+id+"/aac-128k/index.m3u8")
+	assert.Contains(t, rr.Body.String(), "\nsegment00000.ts\n")
+}
+
+func TestMasterPlaylistFor_Version(t *testing.T) {
+	aac := transcode.Rendition{Codec: "aac", Kbps: 128}
+	opus := transcode.Rendition{Codec: "opus", Kbps: 96}
+	assert.Contains(t, string(masterPlaylistFor([]transcode.Rendition{aac})), "\n#EXT-X-VERSION:3\n")
+	// Opus is packaged in fragmented MP4, whose EXT-X-MAP needs version 7.
+	assert.Contains(t, string(masterPlaylistFor([]transcode.Rendition{aac, opus})), "\n#EXT-X-VERSION:7\n")
+}
+
+func TestHLSStageFromEnv(t *testing.T) {
+	stage, err := HLSStageFromEnv()
+	require.NoError(t, err)
+	assert.Nil(t, stage)
+
+	t.Setenv("FFMPEG_PATH", "/nonexistent/ffmpeg")
+	t.Setenv("HLS_RENDITIONS", "aac-64k")
+	_, err = HLSStageFromEnv()
+	assert.Error(t, err)
+
+	t.Setenv("HLS_SEGMENT_DURATION", "10ms")
+	_, err = HLSStageFromEnv()
+	assert.Error(t, err)
+}
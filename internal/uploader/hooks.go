@@ -0,0 +1,153 @@
+package uploader
+
+import (
+	"context"
+	"maps"
+	"net/http"
+
+	"github.com/tus/tusd/v2/pkg/handler"
+
+	"music-streaming/backend/internal/identity"
+	"music-streaming/backend/internal/storage"
+)
+
+// MetadataOwner is the upload metadata key holding the ID of the user that
+// created the upload.
+const MetadataOwner = "owner"
+
+// serverMetadataKeys are upload metadata keys only the server may set.
+var serverMetadataKeys = []string{
+	MetadataSHA256, MetadataBlob, MetadataOwner, storage.MetadataEnvelopeKey,
+	MetadataRenditions, MetadataHLS, MetadataWaveform,
+	MetadataContainer, MetadataCodec, MetadataSampleRate, MetadataBitDepth,
+	MetadataChannels, MetadataBitrate, MetadataVBR, MetadataDuration,
+	MetadataLoudness, MetadataLoudnessRange, MetadataTruePeak,
+	MetadataReplayGainGain, MetadataReplayGainPeak,
+	MetadataFingerprint, MetadataDuplicates,
+	MetadataTitle, MetadataArtist, MetadataAlbum, MetadataAlbumArtist,
+	MetadataGenre, MetadataTrackNumber, MetadataYear, MetadataExplicit,
+	MetadataVersions,
+}
+
+// ErrConcatForbidden is returned when a final upload references uploads that
+// are not partial uploads of the same user, or is created anonymously.
+var ErrConcatForbidden = handler.NewError("ERR_CONCAT_FORBIDDEN", "partial uploads must be partial and belong to the requesting user", http.StatusForbidden)
+
+// uploadHooks holds the callbacks tusd runs while handling requests.
+type uploadHooks struct {
+	composer *handler.StoreComposer
+	resolver identity.Resolver
+	// app, if set, has its uploads locked while tusd deletes them.
+	app *App
+}
+
+// preUploadCreate replaces server-owned keys in client supplied metadata,
+// records the owner and checks that a final upload only concatenates partial
+// uploads of the same owner. Anonymous uploads cannot be concatenated, since
+// they cannot be told apart from those of other anonymous clients.
+func (h uploadHooks) preUploadCreate(hook handler.HookEvent) (handler.HTTPResponse, handler.FileInfoChanges, error) {
+	var changes handler.FileInfoChanges
+	owner := h.resolver.Resolve(hookRequest(hook)).UserID
+
+	metadata := maps.Clone(hook.Upload.MetaData)
+	if metadata == nil {
+		metadata = make(handler.MetaData)
+	}
+	for _, key := range serverMetadataKeys {
+		delete(metadata, key)
+	}
+	if owner != "" {
+		metadata[MetadataOwner] = owner
+	}
+	if !maps.Equal(metadata, hook.Upload.MetaData) {
+		changes.MetaData = metadata
+	}
+
+	if hook.Upload.IsFinal {
+		if owner == "" {
+			return handler.HTTPResponse{}, changes, ErrConcatForbidden
+		}
+		for _, id := range hook.Upload.PartialUploads {
+			upload, err := h.composer.Core.GetUpload(hook.Context, id)
+			if err != nil {
+				return handler.HTTPResponse{}, changes, err
+			}
+			info, err := upload.GetInfo(hook.Context)
+			if err != nil {
+				return handler.HTTPResponse{}, changes, err
+			}
+			if !info.IsPartial || info.MetaData[MetadataOwner] != owner {
+				return handler.HTTPResponse{}, changes, ErrConcatForbidden
+			}
+		}
+	}
+
+	return handler.HTTPResponse{}, changes, nil
+}
+
+// preUploadTerminate takes the lock of the upload a DELETE request is about
+// to delete, and holds it until withDeletionLocks sees the request done, so
+// that the upload is not deleted while it is processed or edited. The .info
+// is read again under the lock for the pipeline to clean up after, as the
+// one tusd read before may lack what processing added since.
+func (h uploadHooks) preUploadTerminate(hook handler.HookEvent) (handler.HTTPResponse, error) {
+	deletion, ok := hook.Context.Value(deletionKey{}).(*deletion)
+	if h.app == nil || !ok {
+		return handler.HTTPResponse{}, nil
+	}
+	deletion.unlock = h.app.uploadLocks.Lock(objectKey(hook.Upload))
+
+	upload, err := h.composer.Core.GetUpload(hook.Context, hook.Upload.ID)
+	if err != nil {
+		return handler.HTTPResponse{}, err
+	}
+	info, err := upload.GetInfo(hook.Context)
+	if err != nil {
+		return handler.HTTPResponse{}, err
+	}
+	deletion.info = &info
+	return handler.HTTPResponse{}, nil
+}
+
+// deletionKey is the context key of the *deletion of a request.
+type deletionKey struct{}
+
+// deletion is what preUploadTerminate keeps for the rest of the request.
+type deletion struct {
+	unlock func()
+	// info is the .info of the upload once it was locked.
+	info *handler.FileInfo
+}
+
+// deletedInfo returns the .info preUploadTerminate read for the request
+// behind ctx, if it deleted an upload.
+func deletedInfo(ctx context.Context) (handler.FileInfo, bool) {
+	if deletion, ok := ctx.Value(deletionKey{}).(*deletion); ok && deletion.info != nil {
+		return *deletion.info, true
+	}
+	return handler.FileInfo{}, false
+}
+
+// withDeletionLocks releases the lock preUploadTerminate takes once tusd is
+// done with the request. Every request gets the chance, since tusd also
+// takes DELETE from X-HTTP-Method-Override.
+func withDeletionLocks(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deletion := &deletion{}
+		defer func() {
+			if deletion.unlock != nil {
+				deletion.unlock()
+			}
+		}()
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), deletionKey{}, deletion)))
+	})
+}
+
+// hookRequest rebuilds enough of the HTTP request behind a hook event for
+// identifying the client.
+func hookRequest(hook handler.HookEvent) *http.Request {
+	return &http.Request{
+		Header:     http.Header(hook.HTTPRequest.Header),
+		RemoteAddr: hook.HTTPRequest.RemoteAddr,
+	}
+}
@@ -0,0 +1,159 @@
+package uploader
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/tus/tusd/v2/pkg/handler"
+	"github.com/tus/tusd/v2/pkg/s3store"
+
+	"music-streaming/backend/internal/identity"
+	"music-streaming/backend/internal/storage"
+)
+
+func newTestComposer(s3Client s3store.S3API) *handler.StoreComposer {
+	composer := handler.NewStoreComposer()
+	s3store.New("test-bucket", s3Client).UseIn(composer)
+	return composer
+}
+
+func newTestHooks(s3Client s3store.S3API) uploadHooks {
+	return uploadHooks{
+		composer: newTestComposer(s3Client),
+		resolver: identity.Resolver{UserHeader: identity.DefaultUserHeader, TrustGatewayHeaders: true},
+	}
+}
+
+func hookFor(user string, info handler.FileInfo) handler.HookEvent {
+	header := http.Header{}
+	if user != "" {
+		header.Set(identity.DefaultUserHeader, user)
+	}
+	return handler.HookEvent{
+		Context:     context.Background(),
+		Upload:      info,
+		HTTPRequest: handler.HTTPRequest{Header: header, RemoteAddr: "10.0.0.1:1234"},
+	}
+}
+
+// mockFinishedUpload scripts the calls s3store makes to read the info of a
+// finished upload, which may happen up to times times.
+func mockFinishedUpload(mockS3 *MockS3Client, objectID, infoJSON string, times int) {
+	for i := 0; i < times; i++ {
+		mockS3.On("GetObject", mock.Anything, keyIs(objectID+".info"), mock.Anything).Return(&s3.GetObjectOutput{
+			Body: io.NopCloser(strings.NewReader(infoJSON)),
+		}, nil).Once()
+	}
+	mockS3.On("ListParts", mock.Anything, mock.MatchedBy(func(input *s3.ListPartsInput) bool {
+		return *input.Key == objectID
+	}), mock.Anything).Return(nil, &types.NoSuchUpload{})
+	mockS3.On("HeadObject", mock.Anything, keyIs(objectID+".part"), mock.Anything).Return(nil, &types.NotFound{})
+}
+
+func TestPreUploadCreate_StripsServerMetadata(t *testing.T) {
+	hooks := newTestHooks(new(MockS3Client))
+
+	_, changes, err := hooks.preUploadCreate(hookFor("", handler.FileInfo{
+		MetaData: handler.MetaData{
+			"filename":                  "a.mp3",
+			MetadataSHA256:              "forged",
+			MetadataOwner:               "mallory",
+			MetadataWaveform:            "someone-else",
+			MetadataDuration:            "1",
+			MetadataDuplicates:          "someone-else:1.00",
+			MetadataTitle:               "Forged",
+			storage.MetadataEnvelopeKey: "forged",
+		},
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, handler.MetaData{"filename": "a.mp3"}, changes.MetaData)
+
+	_, changes, _ = hooks.preUploadCreate(hookFor("", handler.FileInfo{
+		MetaData: handler.MetaData{"filename": "a.mp3"},
+	}))
+	assert.Nil(t, changes.MetaData)
+}
+
+func TestPreUploadCreate_RecordsOwner(t *testing.T) {
+	hooks := newTestHooks(new(MockS3Client))
+
+	_, changes, err := hooks.preUploadCreate(hookFor("alice", handler.FileInfo{
+		MetaData: handler.MetaData{"filename": "a.mp3"},
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, "alice", changes.MetaData[MetadataOwner])
+}
+
+func TestPreUploadCreate_FinalUploadOwnership(t *testing.T) {
+	mockS3 := new(MockS3Client)
+	hooks := newTestHooks(mockS3)
+	mockFinishedUpload(mockS3, "p1", `{"ID":"p1+m1","Size":5,"IsPartial":true,"MetaData":{"owner":"alice"}}`, 3)
+	mockFinishedUpload(mockS3, "p2", `{"ID":"p2+m2","Size":5,"IsPartial":true,"MetaData":{"owner":"bob"}}`, 1)
+	mockFinishedUpload(mockS3, "whole", `{"ID":"whole+m3","Size":5,"IsPartial":false,"MetaData":{"owner":"alice"}}`, 1)
+	mockFinishedUpload(mockS3, "anon", `{"ID":"anon+m4","Size":5,"IsPartial":true,"MetaData":{}}`, 1)
+
+	final := func(ids ...string) handler.FileInfo {
+		return handler.FileInfo{IsFinal: true, PartialUploads: ids}
+	}
+
+	_, _, err := hooks.preUploadCreate(hookFor("alice", final("p1+m1")))
+	assert.NoError(t, err)
+
+	_, _, err = hooks.preUploadCreate(hookFor("alice", final("p1+m1", "p2+m2")))
+	assert.Equal(t, ErrConcatForbidden, err)
+
+	_, _, err = hooks.preUploadCreate(hookFor("", final("p1+m1")))
+	assert.Equal(t, ErrConcatForbidden, err)
+
+	_, _, err = hooks.preUploadCreate(hookFor("alice", final("whole+m3")))
+	assert.Equal(t, ErrConcatForbidden, err)
+
+	// Partial uploads without an owner are not anyone's to concatenate.
+	_, _, err = hooks.preUploadCreate(hookFor("", final("anon+m4")))
+	assert.Equal(t, ErrConcatForbidden, err)
+}
+
+func TestConcatStage_RemovesPartials(t *testing.T) {
+	mockS3 := new(MockS3Client)
+	app := &App{Store: storage.NewS3("test-bucket", mockS3, ""), composer: newTestComposer(mockS3)}
+
+	for _, objectID := range []string{"p1", "p2"} {
+		objectID := objectID
+		mockS3.On("AbortMultipartUpload", mock.Anything, mock.MatchedBy(func(input *s3.AbortMultipartUploadInput) bool {
+			return *input.Key == objectID
+		}), mock.Anything).Return(&s3.AbortMultipartUploadOutput{}, nil).Once()
+		mockS3.On("DeleteObjects", mock.Anything, mock.MatchedBy(func(input *s3.DeleteObjectsInput) bool {
+			return *input.Delete.Objects[0].Key == objectID
+		}), mock.Anything).Return(&s3.DeleteObjectsOutput{}, nil).Once()
+	}
+
+	err := ConcatStage{}.Process(context.Background(), &CompletedUpload{App: app, Info: handler.FileInfo{
+		ID:             "final+m",
+		IsFinal:        true,
+		PartialUploads: []string{"p1+m1", "p2+m2"},
+	}})
+	require.NoError(t, err)
+	mockS3.AssertExpectations(t)
+
+	// Non-final uploads are left alone.
+	require.NoError(t, ConcatStage{}.Process(context.Background(), &CompletedUpload{App: app, Info: handler.FileInfo{ID: "x+m"}}))
+}
+
+func TestTusHandler_AdvertisesConcatenation(t *testing.T) {
+	h, _ := NewTusHandler(newMultipartStore(new(MockS3Client)), identity.Resolver{})
+
+	req, _ := http.NewRequest("OPTIONS", "/files/", nil)
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	assert.Contains(t, strings.Split(rr.Header().Get("Tus-Extension"), ","), "concatenation")
+}
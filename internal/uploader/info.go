@@ -0,0 +1,67 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/tus/tusd/v2/pkg/handler"
+
+	"music-streaming/backend/internal/storage"
+)
+
+// objectKey returns the key of the object holding the upload's data.
+func objectKey(info handler.FileInfo) string {
+	if key := info.Storage["Key"]; key != "" {
+		return key
+	}
+	objectID, _, _ := strings.Cut(info.ID, "+")
+	return objectID
+}
+
+// infoKey returns the key of the .info object tusd keeps next to the data.
+func infoKey(objectKey string) string {
+	return objectKey + ".info"
+}
+
+// loadInfo reads the .info object of the upload stored under key.
+func (a *App) loadInfo(ctx context.Context, key string) (handler.FileInfo, error) {
+	var info handler.FileInfo
+	body, err := a.Store.Open(ctx, infoKey(key), 0, -1)
+	if err != nil {
+		return info, err
+	}
+	defer body.Close()
+
+	if err := json.NewDecoder(body).Decode(&info); err != nil {
+		return info, fmt.Errorf("failed to decode upload info: %w", err)
+	}
+	return info, nil
+}
+
+// saveInfo overwrites the .info object of an upload, in the same format
+// tusd's stores write it.
+func (a *App) saveInfo(ctx context.Context, info handler.FileInfo) error {
+	body, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	err = a.Store.Put(ctx, infoKey(objectKey(info)), bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return fmt.Errorf("failed to save upload info: %w", err)
+	}
+	return nil
+}
+
+// uploadExists reports whether the upload stored under key has not been
+// deleted, by the presence of its .info.
+func (a *App) uploadExists(ctx context.Context, key string) (bool, error) {
+	_, err := a.Store.Stat(ctx, infoKey(key))
+	if storage.IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
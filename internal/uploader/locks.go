@@ -0,0 +1,42 @@
+package uploader
+
+import "sync"
+
+// keyedMutex is a set of mutexes by key, created as they are needed and
+// dropped once nothing holds or waits for them. The zero value is ready
+// to use.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	// users counts the goroutines holding or waiting for the lock.
+	users int
+}
+
+// Lock locks the mutex of key and returns the function unlocking it.
+func (m *keyedMutex) Lock(key string) (unlock func()) {
+	m.mu.Lock()
+	if m.locks == nil {
+		m.locks = make(map[string]*keyedLock)
+	}
+	l := m.locks[key]
+	if l == nil {
+		l = &keyedLock{}
+		m.locks[key] = l
+	}
+	l.users++
+	m.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		m.mu.Lock()
+		if l.users--; l.users == 0 {
+			delete(m.locks, key)
+		}
+		m.mu.Unlock()
+	}
+}
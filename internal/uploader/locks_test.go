@@ -0,0 +1,25 @@
+package uploader
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyedMutex(t *testing.T) {
+	var m keyedMutex
+	var counts [2]int
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer m.Lock([]string{"a", "b"}[i%2])()
+			counts[i%2]++
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, [2]int{50, 50}, counts)
+	assert.Empty(t, m.locks)
+}
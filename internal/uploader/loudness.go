@@ -0,0 +1,100 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"music-streaming/backend/internal/audio"
+)
+
+// Upload metadata keys of the loudness of a track. Loudness is in LUFS, its
+// range in LU and the true peak in dBTP; the ReplayGain 2.0 gain is in dB
+// and its peak linear.
+const (
+	MetadataLoudness       = "loudness_integrated"
+	MetadataLoudnessRange  = "loudness_range"
+	MetadataTruePeak       = "loudness_true_peak"
+	MetadataReplayGainGain = "replaygain_track_gain"
+	MetadataReplayGainPeak = "replaygain_track_peak"
+)
+
+// LoudnessStage measures the EBU R128 loudness of completed WAV, FLAC and
+// MP3 uploads, so players can normalize their volume. Uploads in other
+// formats and silent ones are skipped.
+type LoudnessStage struct{}
+
+func (LoudnessStage) Name() string { return "loudness" }
+
+func (LoudnessStage) Process(ctx context.Context, upload *CompletedUpload) error {
+	dataKey := objectKey(upload.Info)
+	if blob := upload.Info.MetaData[MetadataBlob]; blob != "" {
+		dataKey = blob
+	}
+
+	body, err := upload.App.Store.Open(ctx, dataKey, 0, -1)
+	if err != nil {
+		return fmt.Errorf("failed to read upload: %w", err)
+	}
+	defer body.Close()
+	d, err := audio.Decode(body)
+	if errors.Is(err, audio.ErrUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	l, err := audio.MeasureLoudness(d)
+	if err != nil {
+		return fmt.Errorf("failed to decode %s: %w", d.Format, err)
+	}
+	if math.IsInf(l.Integrated, -1) {
+		return nil
+	}
+
+	gain, peak := l.ReplayGain()
+	metadata := upload.Info.MetaData
+	metadata[MetadataLoudness] = strconv.FormatFloat(l.Integrated, 'f', 2, 64)
+	metadata[MetadataLoudnessRange] = strconv.FormatFloat(l.Range, 'f', 2, 64)
+	metadata[MetadataTruePeak] = strconv.FormatFloat(l.TruePeak, 'f', 2, 64)
+	metadata[MetadataReplayGainGain] = strconv.FormatFloat(gain, 'f', 2, 64) + " dB"
+	metadata[MetadataReplayGainPeak] = strconv.FormatFloat(peak, 'f', 6, 64)
+	return nil
+}
+
+// loudnessInfo is the loudness of a track in the file listing.
+type loudnessInfo struct {
+	Integrated     float64 `json:"integrated_lufs"`
+	Range          float64 `json:"range_lu"`
+	TruePeak       float64 `json:"true_peak_dbtp"`
+	ReplayGainGain float64 `json:"replaygain_track_gain_db"`
+	ReplayGainPeak float64 `json:"replaygain_track_peak"`
+}
+
+// loudnessOf returns the loudness recorded in metadata, or nil if the
+// upload was not measured.
+func loudnessOf(metadata map[string]string) *loudnessInfo {
+	var l loudnessInfo
+	for key, field := range map[string]*float64{
+		MetadataLoudness:       &l.Integrated,
+		MetadataLoudnessRange:  &l.Range,
+		MetadataTruePeak:       &l.TruePeak,
+		MetadataReplayGainPeak: &l.ReplayGainPeak,
+	} {
+		v, err := strconv.ParseFloat(metadata[key], 64)
+		if err != nil {
+			return nil
+		}
+		*field = v
+	}
+	gain, _, _ := strings.Cut(metadata[MetadataReplayGainGain], " ")
+	v, err := strconv.ParseFloat(gain, 64)
+	if err != nil {
+		return nil
+	}
+	l.ReplayGainGain = v
+	return &l
+}
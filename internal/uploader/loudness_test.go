@@ -0,0 +1,55 @@
+package uploader
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"music-streaming/backend/internal/audio"
+)
+
+func TestLoudnessStage(t *testing.T) {
+	tone := func(sampleRate, channels int, dBFS float64) []byte {
+		return audio.EncodeWAV(sampleRate, channels, audio.Sine(sampleRate, channels, 1000, math.Pow(10, dBFS/20), 3))
+	}
+	tests := []struct {
+		name string
+		data []byte
+		// want is nil for uploads left unmeasured.
+		want *loudnessInfo
+	}{
+		// A stereo tone at -23 dBFS reads -23 LUFS.
+		{"stereo WAV", tone(48000, 2, -23), &loudnessInfo{Integrated: -23, TruePeak: -23, ReplayGainGain: 5, ReplayGainPeak: 0.0708}},
+		// A single channel is 3 dB quieter than two at the same level.
+		{"mono WAV", tone(44100, 1, -17), &loudnessInfo{Integrated: -20, TruePeak: -17, ReplayGainGain: 2, ReplayGainPeak: 0.1413}},
+		{"MP3", silentMP3(), nil},
+		{"not audio", []byte("master"), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, tusHandler := newFileApp(t)
+			id := processUpload(t, app, tusHandler, string(tt.data), ChecksumStage{}, LoudnessStage{}, CatalogStage{})
+
+			files := listFiles(t, app, "")
+			require.Len(t, files, 1)
+			got := files[0].Loudness
+			if tt.want == nil {
+				assert.Nil(t, got)
+				return
+			}
+			require.NotNil(t, got)
+			assert.InDelta(t, tt.want.Integrated, got.Integrated, 0.1)
+			assert.InDelta(t, tt.want.TruePeak, got.TruePeak, 0.1)
+			assert.InDelta(t, tt.want.ReplayGainGain, got.ReplayGainGain, 0.1)
+			assert.InDelta(t, tt.want.ReplayGainPeak, got.ReplayGainPeak, 0.001)
+
+			info, err := app.loadInfo(context.Background(), id)
+			require.NoError(t, err)
+			assert.Regexp(t, `^-\d+\.\d\d$`, info.MetaData[MetadataLoudness])
+			assert.Regexp(t, `^-?\d+\.\d\d dB$`, info.MetaData[MetadataReplayGainGain])
+		})
+	}
+}
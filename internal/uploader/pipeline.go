@@ -0,0 +1,234 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"sync"
+
+	"github.com/tus/tusd/v2/pkg/handler"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"music-streaming/backend/internal/telemetry"
+)
+
+// Stage is a single step of post-upload processing. Stages run in order
+// once tusd reports an upload as complete.
+type Stage interface {
+	Name() string
+	Process(ctx context.Context, upload *CompletedUpload) error
+}
+
+// ErrRejected is returned, wrapped with the reason, by stages finding that
+// a completed upload must not be kept. The remaining stages are skipped and
+// the upload is deleted.
+var ErrRejected = errors.New("upload rejected")
+
+// CompletedUpload is the upload handed to each Stage of the Pipeline.
+// Stages record their results in Info.MetaData, which is persisted to the
+// upload's .info object once all stages have run.
+type CompletedUpload struct {
+	App  *App
+	Info handler.FileInfo
+
+	// local is a temporary copy of the data under localKey, shared by the
+	// stages needing a file; see localCopy.
+	local    string
+	localKey string
+}
+
+// Pipeline runs the configured stages for every completed upload.
+type Pipeline struct {
+	Stages []Stage
+	Logger *slog.Logger
+
+	jobsOnce sync.Once
+	jobs     chan func()
+}
+
+// Terminator is implemented by stages that keep state outside of the
+// upload's own objects and must clean it up when the upload is deleted.
+type Terminator interface {
+	Terminate(ctx context.Context, upload *CompletedUpload) error
+}
+
+// pipelineQueueSize bounds how many events may wait for processing before
+// tusd's notifications, and thereby the requests sending them, block.
+const pipelineQueueSize = 256
+
+// Run consumes completion and termination events until both channels are
+// closed. Events are handled one at a time, in order, on a separate
+// goroutine so that slow stages do not hold up requests. Partial uploads are
+// skipped, they are processed as part of their final upload.
+func (p *Pipeline) Run(app *App, completed, terminated <-chan handler.HookEvent) {
+	for completed != nil || terminated != nil {
+		select {
+		case event, ok := <-completed:
+			if !ok {
+				completed = nil
+			} else if !event.Upload.IsPartial {
+				p.enqueue(func() { p.Process(event.Context, app, event.Upload) })
+			}
+		case event, ok := <-terminated:
+			if !ok {
+				terminated = nil
+			} else {
+				p.enqueue(func() { p.Terminate(event.Context, app, event.Upload) })
+			}
+		}
+	}
+}
+
+// enqueue schedules job on the pipeline's worker, which runs jobs one at a
+// time in the order they were queued.
+func (p *Pipeline) enqueue(job func()) {
+	p.jobsOnce.Do(func() {
+		p.jobs = make(chan func(), pipelineQueueSize)
+		go func() {
+			for job := range p.jobs {
+				job()
+			}
+		}()
+	})
+	p.jobs <- job
+}
+
+// Process runs all stages for a single upload. The trace of the request that
+// completed the upload is kept as parent, but its cancellation is not, since
+// processing outlives the request.
+func (p *Pipeline) Process(ctx context.Context, app *App, info handler.FileInfo) *CompletedUpload {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx = context.WithoutCancel(ctx)
+
+	ctx, span := telemetry.Tracer().Start(ctx, "upload.postprocess",
+		trace.WithAttributes(attribute.String("upload.id", info.ID)),
+	)
+	defer span.End()
+
+	upload := &CompletedUpload{App: app, Info: info}
+	upload.Info.MetaData = maps.Clone(info.MetaData)
+	if upload.Info.MetaData == nil {
+		upload.Info.MetaData = make(handler.MetaData)
+	}
+
+	if p.runStages(ctx, upload) {
+		p.reject(ctx, app, upload)
+	}
+	return upload
+}
+
+// runStages runs all stages on upload and saves its .info if they changed
+// it, holding the upload's lock so that track edits and deletion wait for
+// them. An upload deleted before the lock was taken is left alone, so its
+// .info is not saved again. It reports whether a stage rejected the upload.
+func (p *Pipeline) runStages(ctx context.Context, upload *CompletedUpload) (rejected bool) {
+	app, info := upload.App, upload.Info
+	defer app.uploadLocks.Lock(objectKey(info))()
+	if exists, err := app.uploadExists(ctx, objectKey(info)); err != nil {
+		p.logger().Error("PostProcessingLookupFailed", "id", info.ID, "error", err)
+	} else if !exists {
+		p.logger().Info("PostProcessingSkipped", "id", info.ID, "reason", "upload deleted")
+		return false
+	}
+	defer upload.removeLocalCopy()
+	metadata := maps.Clone(info.MetaData)
+	for _, stage := range p.Stages {
+		err := p.runStage(ctx, stage, upload)
+		if errors.Is(err, ErrRejected) {
+			p.logger().Warn("UploadRejected", "id", info.ID, "stage", stage.Name(), "reason", err)
+			return true
+		}
+		if err != nil {
+			p.logger().Error("PostProcessingStageFailed", "id", info.ID, "stage", stage.Name(), "error", err)
+		}
+	}
+
+	if !maps.Equal(metadata, upload.Info.MetaData) {
+		if err := app.saveInfo(ctx, upload.Info); err != nil {
+			trace.SpanFromContext(ctx).RecordError(err)
+			p.logger().Error("PostProcessingSaveFailed", "id", info.ID, "error", err)
+		}
+	}
+	return false
+}
+
+// Terminate gives every Terminator stage the chance to clean up after a
+// deleted upload. When ctx is that of a DELETE request, they are given the
+// .info read once the upload was locked for deletion instead of info.
+func (p *Pipeline) Terminate(ctx context.Context, app *App, info handler.FileInfo) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx = context.WithoutCancel(ctx)
+	if deleted, ok := deletedInfo(ctx); ok {
+		info = deleted
+	}
+
+	ctx, span := telemetry.Tracer().Start(ctx, "upload.terminate",
+		trace.WithAttributes(attribute.String("upload.id", info.ID)),
+	)
+	defer span.End()
+
+	defer app.uploadLocks.Lock(objectKey(info))()
+	upload := &CompletedUpload{App: app, Info: info}
+	for _, stage := range p.Stages {
+		terminator, ok := stage.(Terminator)
+		if !ok {
+			continue
+		}
+		if err := terminator.Terminate(ctx, upload); err != nil {
+			span.RecordError(err)
+			p.logger().Error("PostProcessingCleanupFailed", "id", info.ID, "stage", stage.Name(), "error", err)
+		}
+	}
+}
+
+// reject deletes a rejected upload, and whatever the stages that already
+// ran keep for it.
+func (p *Pipeline) reject(ctx context.Context, app *App, upload *CompletedUpload) {
+	if app.composer != nil && app.composer.UsesTerminater {
+		tusUpload, err := app.composer.Core.GetUpload(ctx, upload.Info.ID)
+		if err == nil {
+			err = app.composer.Terminater.AsTerminatableUpload(tusUpload).Terminate(ctx)
+		}
+		if err != nil {
+			trace.SpanFromContext(ctx).RecordError(err)
+			p.logger().Error("UploadRejectFailed", "id", upload.Info.ID, "error", err)
+		}
+	}
+	p.Terminate(ctx, app, upload.Info)
+}
+
+// runStage runs stage on upload. A stage that panics, e.g. on a file
+// crafted to trip up a parser, fails like one returning an error, rather
+// than taking the worker and the server down with it.
+func (p *Pipeline) runStage(ctx context.Context, stage Stage, upload *CompletedUpload) (err error) {
+	ctx, span := telemetry.Tracer().Start(ctx, "stage."+stage.Name(),
+		trace.WithAttributes(attribute.String("upload.id", upload.Info.ID)),
+	)
+	defer span.End()
+
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("stage panicked: %v", v)
+		}
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+	}()
+	return stage.Process(ctx, upload)
+}
+
+func (p *Pipeline) logger() *slog.Logger {
+	if p.Logger != nil {
+		return p.Logger
+	}
+	return slog.Default()
+}
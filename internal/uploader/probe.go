@@ -0,0 +1,194 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"music-streaming/backend/internal/audio"
+	"music-streaming/backend/internal/storage"
+)
+
+// Upload metadata keys of the technical format of a track. The bitrate is
+// in bits per second and the duration in seconds.
+const (
+	MetadataContainer  = "format_container"
+	MetadataCodec      = "format_codec"
+	MetadataSampleRate = "format_sample_rate"
+	MetadataBitDepth   = "format_bit_depth"
+	MetadataChannels   = "format_channels"
+	MetadataBitrate    = "format_bitrate"
+	MetadataVBR        = "format_vbr"
+	MetadataDuration   = "duration"
+)
+
+// FormatPolicy decides whether a completed upload is kept, given its
+// probed format, or nil for uploads that are not audio in a known format.
+// Uploads it returns an error for are rejected.
+type FormatPolicy func(format *audio.Format) error
+
+// AcceptFormats returns a policy keeping audio whose container or codec is
+// listed, such as "flac" or "aac", and rejecting everything else.
+func AcceptFormats(formats ...string) FormatPolicy {
+	return func(format *audio.Format) error {
+		if format == nil {
+			return errors.New("not audio in a known format")
+		}
+		if !slices.Contains(formats, format.Container) && !slices.Contains(formats, format.Codec) {
+			return fmt.Errorf("%s audio in %s is not accepted", format.Codec, format.Container)
+		}
+		return nil
+	}
+}
+
+// FormatPolicyFromEnv returns a policy accepting the comma separated
+// formats in ACCEPTED_FORMATS, or nil to keep every upload.
+func FormatPolicyFromEnv() FormatPolicy {
+	var formats []string
+	for _, format := range strings.Split(os.Getenv("ACCEPTED_FORMATS"), ",") {
+		if format = strings.ToLower(strings.TrimSpace(format)); format != "" {
+			formats = append(formats, format)
+		}
+	}
+	if len(formats) == 0 {
+		return nil
+	}
+	return AcceptFormats(formats...)
+}
+
+// ProbeStage records the container, codec, stream parameters and duration
+// of completed uploads, reading only the headers it needs. Uploads the
+// App's FormatPolicy refuses are rejected.
+type ProbeStage struct{}
+
+func (ProbeStage) Name() string { return "probe" }
+
+func (ProbeStage) Process(ctx context.Context, upload *CompletedUpload) error {
+	app := upload.App
+	dataKey := objectKey(upload.Info)
+	if blob := upload.Info.MetaData[MetadataBlob]; blob != "" {
+		dataKey = blob
+	}
+
+	obj, err := app.Store.Stat(ctx, dataKey)
+	if err != nil {
+		return fmt.Errorf("failed to read upload: %w", err)
+	}
+	format, err := audio.Probe(&storeReaderAt{ctx: ctx, store: app.Store, key: dataKey, size: obj.Size}, obj.Size)
+	if err != nil && !errors.Is(err, audio.ErrUnsupported) {
+		// Broken files are rejected like those in an unknown format, but the
+		// reason is kept.
+		if app.FormatPolicy != nil {
+			return fmt.Errorf("%w: %v", ErrRejected, err)
+		}
+		return err
+	}
+	if app.FormatPolicy != nil {
+		if err := app.FormatPolicy(format); err != nil {
+			return fmt.Errorf("%w: %v", ErrRejected, err)
+		}
+	}
+	if format == nil {
+		return nil
+	}
+
+	metadata := upload.Info.MetaData
+	metadata[MetadataContainer] = format.Container
+	metadata[MetadataCodec] = format.Codec
+	metadata[MetadataSampleRate] = strconv.Itoa(format.SampleRate)
+	metadata[MetadataChannels] = strconv.Itoa(format.Channels)
+	metadata[MetadataBitrate] = strconv.Itoa(format.Bitrate)
+	metadata[MetadataVBR] = strconv.FormatBool(format.VBR)
+	metadata[MetadataDuration] = strconv.FormatFloat(format.Duration.Seconds(), 'f', 3, 64)
+	if format.BitDepth > 0 {
+		metadata[MetadataBitDepth] = strconv.Itoa(format.BitDepth)
+	}
+	return nil
+}
+
+// formatInfo is the technical format of a track in the file listing.
+type formatInfo struct {
+	Container  string  `json:"container"`
+	Codec      string  `json:"codec"`
+	SampleRate int     `json:"sample_rate"`
+	BitDepth   int     `json:"bit_depth,omitempty"`
+	Channels   int     `json:"channels"`
+	Bitrate    int     `json:"bitrate"`
+	VBR        bool    `json:"vbr"`
+	Duration   float64 `json:"duration"`
+}
+
+// formatOf returns the format recorded in metadata, or nil if the upload
+// was not probed.
+func formatOf(metadata map[string]string) *formatInfo {
+	if metadata[MetadataContainer] == "" {
+		return nil
+	}
+	f := &formatInfo{
+		Container: metadata[MetadataContainer],
+		Codec:     metadata[MetadataCodec],
+		VBR:       metadata[MetadataVBR] == "true",
+	}
+	f.SampleRate, _ = strconv.Atoi(metadata[MetadataSampleRate])
+	f.BitDepth, _ = strconv.Atoi(metadata[MetadataBitDepth])
+	f.Channels, _ = strconv.Atoi(metadata[MetadataChannels])
+	f.Bitrate, _ = strconv.Atoi(metadata[MetadataBitrate])
+	f.Duration, _ = strconv.ParseFloat(metadata[MetadataDuration], 64)
+	return f
+}
+
+// storeReaderBlock is how much storeReaderAt reads from the store at once.
+const storeReaderBlock = 256 << 10
+
+// storeReaderAt reads an object with ranged requests, keeping the last
+// block read, since probing mostly reads small headers close together.
+type storeReaderAt struct {
+	ctx   context.Context
+	store storage.Store
+	key   string
+	size  int64
+
+	offset int64
+	block  []byte
+}
+
+func (r *storeReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos < r.offset || pos >= r.offset+int64(len(r.block)) {
+			if pos >= r.size {
+				return n, io.EOF
+			}
+			if err := r.fill(pos, max(storeReaderBlock, int64(len(p)-n))); err != nil {
+				return n, err
+			}
+		}
+		n += copy(p[n:], r.block[pos-r.offset:])
+	}
+	return n, nil
+}
+
+// fill reads the block of length bytes at off, or up to the end of the
+// object.
+func (r *storeReaderAt) fill(off, length int64) error {
+	body, err := r.store.Open(r.ctx, r.key, off, min(length, r.size-off))
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	block, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	if len(block) == 0 {
+		return io.ErrUnexpectedEOF
+	}
+	r.offset, r.block = off, block
+	return nil
+}
@@ -0,0 +1,135 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"music-streaming/backend/internal/audio"
+	"music-streaming/backend/internal/storage"
+)
+
+func TestProbeStage(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		// want is nil for uploads left unprobed.
+		want     *formatInfo
+		duration string
+	}{
+		{"stereo WAV", audio.EncodeWAV(44100, 2, make([]float64, 2*44100*3/2)), &formatInfo{
+			Container:  "wav",
+			Codec:      "pcm",
+			SampleRate: 44100,
+			BitDepth:   16,
+			Channels:   2,
+			Bitrate:    1411200,
+			Duration:   1.5,
+		}, "1.500"},
+		{"mono WAV", audio.EncodeWAV(8000, 1, make([]float64, 8000/4)), &formatInfo{
+			Container:  "wav",
+			Codec:      "pcm",
+			SampleRate: 8000,
+			BitDepth:   16,
+			Channels:   1,
+			Bitrate:    128000,
+			Duration:   0.25,
+		}, "0.250"},
+		{"MP3", silentMP3(), &formatInfo{
+			Container:  "mp3",
+			Codec:      "mp3",
+			SampleRate: 44100,
+			Channels:   2,
+			Bitrate:    127706,
+			Duration:   1.019,
+		}, "1.019"},
+		{"not audio", []byte("master"), nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, tusHandler := newFileApp(t)
+			id := processUpload(t, app, tusHandler, string(tt.data), ChecksumStage{}, ProbeStage{}, CatalogStage{})
+
+			files := listFiles(t, app, "")
+			require.Len(t, files, 1)
+			assert.Equal(t, tt.want, files[0].Format)
+
+			info, err := app.loadInfo(context.Background(), id)
+			require.NoError(t, err)
+			assert.Equal(t, tt.duration, info.MetaData[MetadataDuration])
+		})
+	}
+}
+
+func TestProbeStage_Rejects(t *testing.T) {
+	ctx := context.Background()
+	app, tusHandler := newFileApp(t)
+	app.FormatPolicy = AcceptFormats("flac", "mp3")
+	stages := []Stage{ChecksumStage{}, DedupStage{}, ProbeStage{}, WaveformStage{}}
+
+	wav := audio.EncodeWAV(8000, 1, audio.Sine(8000, 1, 440, 0.5, 0.1))
+	for _, data := range []string{string(wav), "master"} {
+		id := processUpload(t, app, tusHandler, data, stages...)
+		_, err := app.loadInfo(ctx, id)
+		assert.True(t, storage.IsNotFound(err), err)
+	}
+	// Nothing is kept for rejected uploads, and later stages never ran.
+	objects, err := app.Store.List(ctx, "")
+	require.NoError(t, err)
+	assert.Empty(t, objects)
+
+	mp3 := silentMP3()
+	id := processUpload(t, app, tusHandler, string(mp3), stages...)
+	info, err := app.loadInfo(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, "mp3", info.MetaData[MetadataCodec])
+}
+
+// silentMP3 returns a second of silent MP3 frames.
+func silentMP3() []byte {
+	frame := make([]byte, 417)
+	copy(frame, []byte{0xFF, 0xFB, 0x90, 0x64})
+	return bytes.Repeat(frame, 39)
+}
+
+func TestFormatPolicyFromEnv(t *testing.T) {
+	assert.Nil(t, FormatPolicyFromEnv())
+
+	t.Setenv("ACCEPTED_FORMATS", "FLAC, aac")
+	policy := FormatPolicyFromEnv()
+	require.NotNil(t, policy)
+	assert.NoError(t, policy(&audio.Format{Container: "flac", Codec: "flac"}))
+	assert.NoError(t, policy(&audio.Format{Container: "mp4", Codec: "aac"}))
+	assert.Error(t, policy(&audio.Format{Container: "mp4", Codec: "alac"}))
+	assert.Error(t, policy(nil))
+}
+
+func TestStoreReaderAt(t *testing.T) {
+	ctx := context.Background()
+	app, _, _ := newS3App(t, 0)
+	data := make([]byte, storeReaderBlock+1000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	require.NoError(t, app.Store.Put(ctx, "object", bytes.NewReader(data), int64(len(data))))
+	r := &storeReaderAt{ctx: ctx, store: app.Store, key: "object", size: int64(len(data))}
+
+	// Reads span blocks, and may end past the object.
+	buf := make([]byte, 100)
+	n, err := r.ReadAt(buf, storeReaderBlock-50)
+	require.NoError(t, err)
+	assert.Equal(t, 100, n)
+	assert.Equal(t, data[storeReaderBlock-50:storeReaderBlock+50], buf)
+
+	n, err = r.ReadAt(buf, int64(len(data))-10)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, data[len(data)-10:], buf[:n])
+
+	n, err = r.ReadAt(buf[:10], 5)
+	require.NoError(t, err)
+	assert.Equal(t, data[5:15], buf[:n])
+}
@@ -0,0 +1,131 @@
+package uploader
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"music-streaming/backend/internal/catalog"
+	"music-streaming/backend/internal/search"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// documentOf returns what the search index holds of a track. File names
+// are indexed without their extension, which every track of a format
+// shares.
+func documentOf(t *catalog.Track) search.Document {
+	return search.Document{
+		Key:         t.Key,
+		Name:        strings.TrimSuffix(t.Name, path.Ext(t.Name)),
+		Title:       t.Title,
+		Artist:      t.Artist,
+		Album:       t.Album,
+		AlbumArtist: t.AlbumArtist,
+		Genre:       t.Genre,
+	}
+}
+
+// indexTrack adds the cataloged track stored under key to the search
+// index, if the App has one.
+func (a *App) indexTrack(ctx context.Context, key string) error {
+	if a.Search == nil {
+		return nil
+	}
+	t, err := a.Catalog.Track(ctx, key)
+	if err != nil {
+		return err
+	}
+	a.Search.Add(documentOf(t))
+	return nil
+}
+
+// ReindexSearch fills the search index with the tracks in the catalog. As
+// the index is kept in memory, it runs on startup; RebuildCatalog reindexes
+// too, rebuilding the index from the bucket.
+func (a *App) ReindexSearch(ctx context.Context) error {
+	if a.Search == nil {
+		return nil
+	}
+	tracks, err := a.Catalog.Tracks(ctx, catalog.TrackFilter{})
+	if err != nil {
+		return err
+	}
+	docs := make([]search.Document, len(tracks))
+	for i := range tracks {
+		docs[i] = documentOf(&tracks[i])
+	}
+	a.Search.Reset(docs)
+	return nil
+}
+
+// SearchHandler returns a JSON list of the tracks matching the q query
+// parameter by their file name and tags, best first, at most limit (20 by
+// default) of them.
+func (a *App) SearchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	q := strings.TrimSpace(query.Get("q"))
+	if q == "" {
+		writeTusError(w, http.StatusBadRequest, "ERR_INVALID_QUERY", "q is required")
+		return
+	}
+	words := search.Tokenize(q)
+	if len(words) > search.MaxQueryWords {
+		writeTusError(w, http.StatusBadRequest, "ERR_INVALID_QUERY", fmt.Sprintf("q must have at most %d words", search.MaxQueryWords))
+		return
+	}
+	for _, word := range words {
+		if utf8.RuneCountInString(word) > search.MaxWordLength {
+			writeTusError(w, http.StatusBadRequest, "ERR_INVALID_QUERY", fmt.Sprintf("words of q must have at most %d letters", search.MaxWordLength))
+			return
+		}
+	}
+	limit := defaultSearchLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxSearchLimit {
+			writeTusError(w, http.StatusBadRequest, "ERR_INVALID_QUERY", fmt.Sprintf("limit must be between 1 and %d", maxSearchLimit))
+			return
+		}
+		limit = n
+	}
+
+	type Result struct {
+		fileInfo
+		Score float64 `json:"score"`
+	}
+	results := make([]Result, 0)
+	if a.Search != nil {
+		for _, match := range a.Search.Search(q, limit) {
+			t, err := a.Catalog.Track(r.Context(), match.Key)
+			if errors.Is(err, catalog.ErrNotFound) {
+				// Deleted since it was found.
+				continue
+			}
+			if err != nil {
+				http.Error(w, fmt.Errorf("failed to read track: %w", err).Error(), http.StatusInternalServerError)
+				return
+			}
+			results = append(results, Result{fileInfo: a.fileInfo(*t), Score: match.Score})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,88 @@
+package uploader
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"music-streaming/backend/internal/catalog"
+	"music-streaming/backend/internal/identity"
+	"music-streaming/backend/internal/search"
+	"music-streaming/backend/internal/storage"
+)
+
+// searchTracks returns the titles of the tracks found for q.
+func searchTracks(t *testing.T, app *App, q string) []string {
+	rr := httptest.NewRecorder()
+	app.SearchHandler(rr, httptest.NewRequest("GET", "/search?q="+url.QueryEscape(q), nil))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var results []struct {
+		Title string  `json:"title"`
+		Score float64 `json:"score"`
+	}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &results))
+	titles := make([]string, len(results))
+	for i, r := range results {
+		titles[i] = r.Title
+	}
+	return titles
+}
+
+func TestSearchHandler(t *testing.T) {
+	ctx := context.Background()
+	app, tusHandler := newFileApp(t)
+	stages := []Stage{ChecksumStage{}, DedupStage{}, TagStage{}, CatalogStage{}}
+	halo := processUpload(t, app, tusHandler, string(taggedMP3("TIT2", "Halo", "TPE1", "Beyoncé")), stages...)
+	processUpload(t, app, tusHandler, string(taggedMP3("TIT2", "Beyond the Sea", "TPE1", "Bobby Darin")), stages...)
+
+	assert.Equal(t, []string{"Halo"}, searchTracks(t, app, "beyonce"))
+	assert.Equal(t, []string{"Beyond the Sea", "Halo"}, searchTracks(t, app, "beyon"))
+	assert.Equal(t, []string{"Beyond the Sea"}, searchTracks(t, app, "bobby darni"))
+	assert.Empty(t, searchTracks(t, app, "love"))
+
+	// Edits are searchable right away.
+	rr := trackRequest(app, "PATCH", "/tracks/"+halo, "*", `{"title":"Crazy in Love"}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, []string{"Crazy in Love"}, searchTracks(t, app, "love"))
+	assert.Empty(t, searchTracks(t, app, "halo"))
+
+	// The index can be rebuilt from the bucket.
+	app.Search = search.New()
+	assert.Empty(t, searchTracks(t, app, "love"))
+	require.NoError(t, app.RebuildCatalog(ctx))
+	assert.Equal(t, []string{"Crazy in Love"}, searchTracks(t, app, "love"))
+
+	info, err := app.loadInfo(ctx, halo)
+	require.NoError(t, err)
+	require.NoError(t, CatalogStage{}.Terminate(ctx, &CompletedUpload{App: app, Info: info}))
+	assert.Empty(t, searchTracks(t, app, "love"))
+
+	long := "?q=" + strings.Repeat("a", search.MaxWordLength+1)
+	many := "?q=" + strings.Repeat("a+", search.MaxQueryWords+1)
+	for _, query := range []string{"", "?q=+", "?q=x&limit=0", "?q=x&limit=1000", long, many} {
+		rr := httptest.NewRecorder()
+		app.SearchHandler(rr, httptest.NewRequest("GET", "/search"+query, nil))
+		assert.Equal(t, http.StatusBadRequest, rr.Code, query)
+	}
+}
+
+func TestNewApp_IndexesCatalog(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cat := newTestCatalog(t)
+	require.NoError(t, cat.PutTrack(ctx, &catalog.Track{Key: "halo", Name: "halo.mp3", DataKey: "halo", Title: "Halo"}))
+	store, err := storage.NewFile(t.TempDir())
+	require.NoError(t, err)
+
+	// Searches find the tracks in the catalog as soon as the App exists.
+	app, err := NewApp(ctx, store, cat, DeferredConfig{}, identity.Resolver{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Halo"}, searchTracks(t, app, "halo"))
+}
@@ -6,158 +6,351 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/credentials"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/tus/tusd/v2/pkg/handler"
-	"github.com/tus/tusd/v2/pkg/s3store"
+	"github.com/tus/tusd/v2/pkg/memorylocker"
+
+	"music-streaming/backend/internal/catalog"
+	"music-streaming/backend/internal/identity"
+	"music-streaming/backend/internal/search"
+	"music-streaming/backend/internal/storage"
+	"music-streaming/backend/internal/transcode"
 )
 
 // S3API defines the interface we need from the AWS S3 SDK.
-type S3API interface {
-	s3store.S3API
-	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
-	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
-}
+type S3API = storage.S3API
+
+// RespectForwardedHeaders controls whether X-Forwarded-* and Forwarded headers
+// from the reverse proxy are trusted, both by tusd and by client identification
+// behind a trusted gateway.
+const RespectForwardedHeaders = true
 
 // App holds the dependencies for the uploader service.
 type App struct {
 	TusHandler http.Handler
-	S3Client   S3API
-	BucketName string
-	S3Endpoint string
+	Store      storage.Store
+	Pipeline   *Pipeline
+	Deferred   *DeferredUploads
+	// HLSPresignExpiry, if set, makes HLS media playlists link to presigned
+	// segments valid this long, rather than to segments served by the App.
+	HLSPresignExpiry time.Duration
+	// FormatPolicy, if set, rejects completed uploads by their format.
+	FormatPolicy FormatPolicy
+	// Fingerprints indexes the fingerprints of uploads to find duplicates.
+	Fingerprints *FingerprintIndex
+	// Catalog holds the tracks, albums and artists of completed uploads.
+	Catalog *catalog.Catalog
+	// Search indexes the tracks in the catalog by their file names and
+	// tags.
+	Search *search.Index
+	// Resolver identifies who edits tracks.
+	Resolver identity.Resolver
+	// AllowOwnerlessEdits lets any identified user edit tracks uploaded
+	// anonymously, which otherwise cannot be edited.
+	AllowOwnerlessEdits bool
+
+	// composer gives access to the tus data store, e.g. to terminate uploads.
+	composer *handler.StoreComposer
+	// blobLocks serializes the updates of the reference record of a blob,
+	// by checksum.
+	blobLocks keyedMutex
+	// uploadLocks serializes the processing, edits and deletion of an
+	// upload, by key.
+	uploadLocks keyedMutex
 }
 
 // NewAppFromEnv initializes the App using environment variables.
 func NewAppFromEnv() (*App, error) {
-	accessKey := os.Getenv("AWS_ACCESS_KEY_ID")
-	secretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
-	s3Endpoint := os.Getenv("S3_ENDPOINT")
-	region := os.Getenv("AWS_REGION")
-	bucketName := os.Getenv("S3_BUCKET")
-
-	// 1. Configure AWS SDK v2
-	customResolver := aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
-		if s3Endpoint != "" {
-			return aws.Endpoint{
-				PartitionID:   "aws",
-				URL:           s3Endpoint,
-				SigningRegion: region,
-			}, nil
+	store, err := NewStoreFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	deferredConfig, err := DeferredConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	var stages []Stage
+	transcodeStage, err := TranscodeStageFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if transcodeStage != nil {
+		stages = append(stages, transcodeStage)
+	}
+	hlsStage, err := HLSStageFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if hlsStage != nil {
+		stages = append(stages, hlsStage)
+	}
+	var presignExpiry time.Duration
+	if v := os.Getenv("HLS_PRESIGN_EXPIRY"); v != "" {
+		presignExpiry, err = time.ParseDuration(v)
+		if err != nil || presignExpiry < 2*time.Second {
+			return nil, fmt.Errorf("invalid HLS_PRESIGN_EXPIRY %q", v)
 		}
-		return aws.Endpoint{}, &aws.EndpointNotFoundError{}
-	})
+	}
 
-	cfg, err := config.LoadDefaultConfig(context.TODO(),
-		config.WithRegion(region),
-		config.WithEndpointResolverWithOptions(customResolver),
-		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(accessKey, secretKey, "")),
-	)
+	resolver, err := identity.NewResolverFromEnv(RespectForwardedHeaders)
 	if err != nil {
-		return nil, fmt.Errorf("unable to load SDK config: %w", err)
+		return nil, err
+	}
+	var allowOwnerlessEdits bool
+	if v := os.Getenv("ALLOW_OWNERLESS_EDITS"); v != "" {
+		allowOwnerlessEdits, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ALLOW_OWNERLESS_EDITS %q", v)
+		}
 	}
 
-	// 2. Create S3 Client
-	s3Client := s3.NewFromConfig(cfg, func(o *s3.Options) {
-		o.UsePathStyle = true
-	})
+	cat, err := OpenCatalogFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	app, err := NewApp(context.Background(), store, cat, deferredConfig, resolver, stages...)
+	if err != nil {
+		cat.Close()
+		return nil, err
+	}
+	app.HLSPresignExpiry = presignExpiry
+	app.FormatPolicy = FormatPolicyFromEnv()
+	app.AllowOwnerlessEdits = allowOwnerlessEdits
+	return app, nil
+}
+
+// NewApp initializes the App on top of store and starts its background
+// work. Idle deferred uploads are reaped until ctx is cancelled. Completed
+// uploads run through stages after being checksummed, deduplicated, probed,
+// tagged, analysed for their waveform and loudness and fingerprinted, and
+// are added to cat last. An empty cat is rebuilt from store.
+func NewApp(ctx context.Context, store storage.Store, cat *catalog.Catalog, deferredConfig DeferredConfig, resolver identity.Resolver, stages ...Stage) (*App, error) {
+	deferred := NewDeferredUploads(deferredConfig)
+	app := &App{
+		Store: store,
+		Pipeline: &Pipeline{Stages: append(append([]Stage{
+			ConcatStage{},
+			ChecksumStage{},
+			DedupStage{},
+			ProbeStage{},
+			TagStage{},
+			WaveformStage{},
+			LoudnessStage{},
+			FingerprintStage{},
+		}, stages...), CatalogStage{})},
+		Deferred:     deferred,
+		Fingerprints: NewFingerprintIndex(),
+		Catalog:      cat,
+		Search:       search.New(),
+		Resolver:     resolver,
+	}
+	tusHandler, composer, err := newHandler(store, resolver, deferred, app)
+	if err != nil {
+		return nil, err
+	}
+	app.TusHandler = protocolHandler(tusHandler, composer, deferredConfig.MaxSize)
+	app.composer = composer
+
+	// The search index is filled before the App serves requests, rather
+	// than once the pipeline gets to it. An empty catalog is rebuilt
+	// instead, queued with completed uploads so that it cannot miss one.
+	n, err := cat.CountTracks(ctx)
+	switch {
+	case err != nil:
+		app.Pipeline.logger().Error("CatalogRebuildFailed", "error", err)
+	case n == 0:
+		app.Pipeline.enqueue(func() {
+			if err := app.RebuildCatalog(ctx); err != nil {
+				app.Pipeline.logger().Error("CatalogRebuildFailed", "error", err)
+			}
+		})
+	default:
+		if err := app.ReindexSearch(ctx); err != nil {
+			app.Pipeline.logger().Error("SearchIndexFailed", "error", err)
+		}
+	}
+	go func() {
+		if err := app.Fingerprints.Load(ctx, store); err != nil {
+			app.Pipeline.logger().Error("FingerprintIndexLoadFailed", "error", err)
+		}
+	}()
+	go app.Pipeline.Run(app, tusHandler.CompleteUploads, tusHandler.TerminatedUploads)
+	go app.Deferred.Run(ctx, app)
 
-	tusHandler, err := NewTusHandler(bucketName, s3Client)
+	return app, nil
+}
+
+// NewTusHandler creates a Tus handler storing uploads in store, identifying
+// clients with resolver.
+func NewTusHandler(store storage.Store, resolver identity.Resolver) (http.Handler, error) {
+	// Without a running App there is nothing to reap idle uploads, so only
+	// the size limit applies.
+	deferred := NewDeferredUploads(DeferredConfig{MaxSize: defaultDeferredMaxSize})
+	tusHandler, composer, err := newHandler(store, resolver, deferred, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	return &App{
-		TusHandler: tusHandler,
-		S3Client:   s3Client,
-		BucketName: bucketName,
-		S3Endpoint: s3Endpoint,
-	}, nil
+	return protocolHandler(tusHandler, composer, defaultDeferredMaxSize), nil
 }
 
-// NewTusHandler creates a Tus handler with a provided S3 client.
-func NewTusHandler(bucketName string, s3Client s3store.S3API) (http.Handler, error) {
-	// 3. Create S3 Store
-	store := s3store.New(bucketName, s3Client)
+// protocolHandler serves tusHandler at /files/ with the parts of the tus
+// protocol tusd lacks added in front of it. Uploads are looked up in
+// composer, and those with a deferred length limited to maxDeferred bytes.
+func protocolHandler(tusHandler http.Handler, composer *handler.StoreComposer, maxDeferred int64) http.Handler {
+	return http.StripPrefix("/files/", withTusVersion(withDeletionLocks(withChecksums(tusHandler, remainingLength(composer, maxDeferred)))))
+}
 
-	// 4. Create Tus Handler
+// withTusVersion adds the Tus-Version header tusd leaves out when it rejects
+// a request for an unsupported protocol version.
+func withTusVersion(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v := r.Header.Get("Tus-Resumable"); v != "" && v != "1.0.0" {
+			w.Header().Set("Tus-Version", "1.0.0")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// newHandler builds the tusd handler and the store composer behind it. When
+// app is set, its uploads are locked while they are deleted and the caller
+// must drain CompleteUploads and TerminatedUploads.
+func newHandler(store storage.Store, resolver identity.Resolver, deferred *DeferredUploads, app *App) (*handler.Handler, *handler.StoreComposer, error) {
+	// Limit uploads with deferred length on top of the store
+	backend := handler.NewStoreComposer()
+	store.UseIn(backend)
 	composer := handler.NewStoreComposer()
-	store.UseIn(composer)
+	deferred.wrapStore(backend).UseIn(composer)
+	// Uploads are locked while tusd handles a request for them, and while
+	// deferred uploads are reaped, even if the store brings no locker.
+	if !composer.UsesLocker {
+		memorylocker.New().UseIn(composer)
+	}
 
+	hooks := uploadHooks{composer: composer, resolver: resolver, app: app}
 	tusHandler, err := handler.NewHandler(handler.Config{
 		BasePath:                "/files/",
 		StoreComposer:           composer,
-		NotifyCompleteUploads:   false,
-		RespectForwardedHeaders: true,
+		NotifyCompleteUploads:   app != nil,
+		NotifyTerminatedUploads: app != nil,
+		RespectForwardedHeaders: RespectForwardedHeaders,
+		// CORS is handled in front of the handler so the policy lives in one place.
+		Cors:                       &handler.CorsConfig{Disable: true},
+		PreUploadCreateCallback:    hooks.preUploadCreate,
+		PreUploadTerminateCallback: hooks.preUploadTerminate,
 	})
 	if err != nil {
-		return nil, fmt.Errorf("unable to create tus handler: %w", err)
+		return nil, nil, fmt.Errorf("unable to create tus handler: %w", err)
 	}
 
-	return http.StripPrefix("/files/", tusHandler), nil
+	return tusHandler, composer, nil
 }
 
-// ListFilesHandler returns a JSON list of files in the bucket.
+// ListFilesHandler returns a JSON list of the tracks in the catalog,
+// optionally only those of the artist and album query parameters.
 func (a *App) ListFilesHandler(w http.ResponseWriter, r *http.Request) {
-	output, err := a.S3Client.ListObjectsV2(r.Context(), &s3.ListObjectsV2Input{
-		Bucket: aws.String(a.BucketName),
+	tracks, err := a.Catalog.Tracks(r.Context(), catalog.TrackFilter{
+		Artist: r.URL.Query().Get("artist"),
+		Album:  r.URL.Query().Get("album"),
 	})
 	if err != nil {
-		http.Error(w, fmt.Errorf("failed to list objects: %w", err).Error(), http.StatusInternalServerError)
+		http.Error(w, fmt.Errorf("failed to list tracks: %w", err).Error(), http.StatusInternalServerError)
 		return
 	}
 
-	type FileInfo struct {
-		Key  string `json:"key"`
-		Name string `json:"name"`
-		Size int64  `json:"size"`
-		URL  string `json:"url"`
-	}
-
-	files := make([]FileInfo, 0)
-	for _, obj := range output.Contents {
-		key := aws.ToString(obj.Key)
-		// Only include files (not directories or tus info files ending in .info)
-		if key != "" && !(len(key) > 5 && key[len(key)-5:] == ".info") {
-			// Try to get metadata from .info file
-			name := key
-			infoKey := key + ".info"
-			infoObj, err := a.S3Client.GetObject(r.Context(), &s3.GetObjectInput{
-				Bucket: aws.String(a.BucketName),
-				Key:    aws.String(infoKey),
-			})
-			if err == nil {
-				var info struct {
-					MetaData map[string]string `json:"MetaData"`
-				}
-				if err := json.NewDecoder(infoObj.Body).Decode(&info); err == nil {
-					if filename, ok := info.MetaData["filename"]; ok {
-						name = filename
-					}
-				}
-				infoObj.Body.Close()
-			}
-
-			// Get the public S3 URL (using localhost for frontend convenience if endpoint is internal)
-			url := fmt.Sprintf("%s/%s/%s", a.S3Endpoint, a.BucketName, key)
-			// Replace internal minio host with localhost for the browser
-			url = strings.Replace(url, "http://minio:9000", "http://localhost:9000", 1)
-
-			files = append(files, FileInfo{
-				Key:  key,
-				Name: name,
-				Size: aws.ToInt64(obj.Size),
-				URL:  url,
-			})
-		}
+	files := make([]fileInfo, 0, len(tracks))
+	for _, t := range tracks {
+		files = append(files, a.fileInfo(t))
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 	if err := json.NewEncoder(w).Encode(files); err != nil {
 		http.Error(w, "failed to encode response", http.StatusInternalServerError)
 	}
 }
+
+type renditionInfo struct {
+	Name        string `json:"name"`
+	URL         string `json:"url"`
+	ContentType string `json:"content_type"`
+}
+
+// fileInfo describes a track to clients.
+type fileInfo struct {
+	Key         string          `json:"key"`
+	Name        string          `json:"name"`
+	Size        int64           `json:"size"`
+	URL         string          `json:"url"`
+	SHA256      string          `json:"sha256,omitempty"`
+	Title       string          `json:"title,omitempty"`
+	Artist      string          `json:"artist,omitempty"`
+	Album       string          `json:"album,omitempty"`
+	AlbumArtist string          `json:"album_artist,omitempty"`
+	Genre       string          `json:"genre,omitempty"`
+	TrackNumber int             `json:"track_number,omitempty"`
+	Year        int             `json:"year,omitempty"`
+	Explicit    bool            `json:"explicit,omitempty"`
+	Renditions  []renditionInfo `json:"renditions,omitempty"`
+	Format      *formatInfo     `json:"format,omitempty"`
+	Loudness    *loudnessInfo   `json:"loudness,omitempty"`
+}
+
+func (a *App) fileInfo(t catalog.Track) fileInfo {
+	var list []renditionInfo
+	for _, r := range renditions(t.Metadata) {
+		list = append(list, renditionInfo{
+			Name:        r.Name(),
+			URL:         a.renditionURL(t.Key, r),
+			ContentType: r.ContentType(),
+		})
+	}
+	return fileInfo{
+		Key:         t.Key,
+		Name:        t.Name,
+		Size:        t.Size,
+		URL:         a.fileURL(t.Key, t.DataKey),
+		SHA256:      t.SHA256,
+		Title:       t.Title,
+		Artist:      t.Artist,
+		Album:       t.Album,
+		AlbumArtist: t.AlbumArtist,
+		Genre:       t.Genre,
+		TrackNumber: t.TrackNumber,
+		Year:        t.Year,
+		Explicit:    t.Explicit,
+		Renditions:  list,
+		Format:      formatOf(t.Metadata),
+		Loudness:    loudnessOf(t.Metadata),
+	}
+}
+
+// fileURL returns where clients fetch an upload from: straight from the
+// store if it is publicly reachable, otherwise the download endpoint.
+func (a *App) fileURL(key, dataKey string) string {
+	urler, ok := a.Store.(storage.URLer)
+	if !ok {
+		return "/files/" + key
+	}
+	url, ok := urler.URL(dataKey)
+	if !ok {
+		return "/files/" + key
+	}
+	// Use localhost for frontend convenience if the endpoint is internal
+	return strings.Replace(url, "http://minio:9000", "http://localhost:9000", 1)
+}
+
+// renditionURL returns where clients fetch a rendition of an upload from,
+// like fileURL.
+func (a *App) renditionURL(key string, r transcode.Rendition) string {
+	url := a.fileURL(key, renditionKey(key, r))
+	if strings.HasPrefix(url, "/files/") {
+		return url + "?rendition=" + r.Name()
+	}
+	return url
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
 	"testing"
 
@@ -14,6 +15,11 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"music-streaming/backend/internal/identity"
+	"music-streaming/backend/internal/s3fake"
+	"music-streaming/backend/internal/storage"
 )
 
 // MockS3Client matches the s3store.S3API interface
@@ -110,18 +116,34 @@ func (m *MockS3Client) UploadPartCopy(ctx context.Context, input *s3.UploadPartC
 	return args.Get(0).(*s3.UploadPartCopyOutput), args.Error(1)
 }
 
+func (m *MockS3Client) CopyObject(ctx context.Context, input *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	args := m.Called(ctx, input, optFns)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*s3.CopyObjectOutput), args.Error(1)
+}
+
+// newMultipartStore returns a store on client that uses multipart uploads
+// for every upload, as the mock scripts s3store's calls.
+func newMultipartStore(client S3API) *storage.S3 {
+	store := storage.NewS3("test-bucket", client, "")
+	store.SmallUploadThreshold = 0
+	return store
+}
+
 func TestNewHandler_Creation(t *testing.T) {
 	mockS3 := new(MockS3Client)
 	// We only mock what's needed for initialization or checking existence if any
 
-	handler, err := NewTusHandler("test-bucket", mockS3)
+	handler, err := NewTusHandler(newMultipartStore(mockS3), identity.Resolver{})
 	assert.NoError(t, err)
 	assert.NotNil(t, handler)
 }
 
 func TestTusCreation_HappyPath(t *testing.T) {
 	mockS3 := new(MockS3Client)
-	handler, _ := NewTusHandler("test-bucket", mockS3)
+	handler, _ := NewTusHandler(newMultipartStore(mockS3), identity.Resolver{})
 
 	// s3store.NewUpload flow:
 	// 1. CreateMultipartUpload to get UploadId
@@ -158,7 +180,7 @@ func TestTusCreation_HappyPath(t *testing.T) {
 
 func TestTusCreation_StorageFailure(t *testing.T) {
 	mockS3 := new(MockS3Client)
-	handler, _ := NewTusHandler("test-bucket", mockS3)
+	handler, _ := NewTusHandler(newMultipartStore(mockS3), identity.Resolver{})
 
 	// Simulate S3 Error during Multipart creation (e.g. Storage Full/Permissions)
 	mockS3.On("CreateMultipartUpload", mock.Anything, mock.Anything, mock.Anything).Return(nil, errors.New("s3: ServiceUnavailable"))
@@ -182,14 +204,121 @@ func TestTusCreation_StorageFailure(t *testing.T) {
 	mockS3.AssertExpectations(t)
 }
 
-func TestListFiles(t *testing.T) {
+// deferredInfo is the .info s3store writes for an upload created with
+// Upload-Defer-Length.
+const deferredInfo = `{"ID":"rec+mp","Size":0,"SizeIsDeferred":true,"Offset":0,"MetaData":{},"Storage":{"Type":"s3store","Bucket":"test-bucket","Key":"rec","MultipartUpload":"mp"}}`
+
+// mockDeferredUpload scripts the calls s3store makes to read the info of the
+// deferred upload "rec+mp" before any data has been written.
+func mockDeferredUpload(mockS3 *MockS3Client) {
+	mockS3.On("GetObject", mock.Anything, keyIs("rec.info"), mock.Anything).Return(&s3.GetObjectOutput{
+		Body: io.NopCloser(strings.NewReader(deferredInfo)),
+	}, nil).Once()
+	mockS3.On("ListParts", mock.Anything, mock.Anything, mock.Anything).Return(&s3.ListPartsOutput{}, nil)
+	mockS3.On("HeadObject", mock.Anything, keyIs("rec.part"), mock.Anything).Return(nil, &types.NotFound{})
+}
+
+func newPatchRequest(id, body string) *http.Request {
+	req, _ := http.NewRequest("PATCH", "/files/"+id, strings.NewReader(body))
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", "0")
+	return req
+}
+
+func TestTusCreation_DeferredLength(t *testing.T) {
+	mockS3 := new(MockS3Client)
+	handler, _ := NewTusHandler(newMultipartStore(mockS3), identity.Resolver{})
+
+	mockS3.On("CreateMultipartUpload", mock.Anything, mock.Anything, mock.Anything).Return(&s3.CreateMultipartUploadOutput{
+		UploadId: aws.String("mp"),
+	}, nil)
+	var info string
+	mockS3.On("PutObject", mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		body, _ := io.ReadAll(args.Get(1).(*s3.PutObjectInput).Body)
+		info = string(body)
+	}).Return(&s3.PutObjectOutput{}, nil)
+
+	req, _ := http.NewRequest("POST", "/files/", nil)
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	req.Header.Set("Upload-Defer-Length", "1")
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.Contains(t, info, `"SizeIsDeferred":true`)
+}
+
+func TestTusPatch_DeclaresDeferredLength(t *testing.T) {
 	mockS3 := new(MockS3Client)
-	app := &App{
-		S3Client:   mockS3,
-		BucketName: "test-bucket",
-		S3Endpoint: "http://localhost:9000",
+	handler, _ := NewTusHandler(newMultipartStore(mockS3), identity.Resolver{})
+	mockDeferredUpload(mockS3)
+
+	// The length is declared before the chunk is written, so the chunk is
+	// uploaded as the final part and the upload is completed right away.
+	var declared string
+	mockS3.On("PutObject", mock.Anything, keyIs("rec.info"), mock.Anything).Run(func(args mock.Arguments) {
+		body, _ := io.ReadAll(args.Get(1).(*s3.PutObjectInput).Body)
+		declared = string(body)
+	}).Return(&s3.PutObjectOutput{}, nil).Once()
+	mockS3.On("UploadPart", mock.Anything, mock.MatchedBy(func(input *s3.UploadPartInput) bool {
+		return *input.Key == "rec" && *input.PartNumber == 1
+	}), mock.Anything).Return(&s3.UploadPartOutput{ETag: aws.String("etag-1")}, nil).Once()
+	mockS3.On("CompleteMultipartUpload", mock.Anything, mock.MatchedBy(func(input *s3.CompleteMultipartUploadInput) bool {
+		return len(input.MultipartUpload.Parts) == 1
+	}), mock.Anything).Return(&s3.CompleteMultipartUploadOutput{}, nil).Once()
+
+	req := newPatchRequest("rec+mp", "some data")
+	req.Header.Set("Upload-Length", "9")
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	assert.Equal(t, "9", rr.Header().Get("Upload-Offset"))
+	assert.Contains(t, declared, `"Size":9`)
+	assert.Contains(t, declared, `"SizeIsDeferred":false`)
+	mockS3.AssertExpectations(t)
+}
+
+func TestTusPatch_DeferredSizeLimit(t *testing.T) {
+	newLimitedHandler := func(mockS3 *MockS3Client) http.Handler {
+		tusHandler, _, err := newHandler(newMultipartStore(mockS3), identity.Resolver{}, NewDeferredUploads(DeferredConfig{MaxSize: 4}), nil)
+		assert.NoError(t, err)
+		return http.StripPrefix("/files/", tusHandler)
 	}
 
+	t.Run("data beyond the limit", func(t *testing.T) {
+		mockS3 := new(MockS3Client)
+		mockDeferredUpload(mockS3)
+
+		rr := httptest.NewRecorder()
+		newLimitedHandler(mockS3).ServeHTTP(rr, newPatchRequest("rec+mp", "some data"))
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+		assert.Contains(t, rr.Body.String(), "ERR_DEFERRED_SIZE_EXCEEDED")
+		mockS3.AssertNotCalled(t, "UploadPart", mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("declared length beyond the limit", func(t *testing.T) {
+		mockS3 := new(MockS3Client)
+		mockDeferredUpload(mockS3)
+
+		req := newPatchRequest("rec+mp", "some data")
+		req.Header.Set("Upload-Length", "9")
+		rr := httptest.NewRecorder()
+		newLimitedHandler(mockS3).ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+		mockS3.AssertNotCalled(t, "PutObject", mock.Anything, mock.Anything, mock.Anything)
+	})
+}
+
+func TestListFiles(t *testing.T) {
+	mockS3 := new(MockS3Client)
+	app := &App{Store: storage.NewS3("test-bucket", mockS3, "http://localhost:9000"), Catalog: newTestCatalog(t)}
+
 	mockS3.On("ListObjectsV2", mock.Anything, mock.Anything, mock.Anything).Return(&s3.ListObjectsV2Output{
 		Contents: []types.Object{
 			{Key: aws.String("file1.mp3"), Size: aws.Int64(1000)},
@@ -205,6 +334,7 @@ func TestListFiles(t *testing.T) {
 		Body: io.NopCloser(strings.NewReader(infoContent)),
 	}, nil)
 
+	require.NoError(t, app.RebuildCatalog(context.Background()))
 	req, _ := http.NewRequest("GET", "/files/", nil)
 	rr := httptest.NewRecorder()
 	app.ListFilesHandler(rr, req)
@@ -214,3 +344,141 @@ func TestListFiles(t *testing.T) {
 	assert.Contains(t, rr.Body.String(), "http://localhost:9000/test-bucket/file1.mp3")
 	mockS3.AssertExpectations(t)
 }
+
+// testSmallUploadThreshold is the size up to which newS3App stores uploads
+// with a single PutObject, where tests ask for it.
+const testSmallUploadThreshold = 1 << 20
+
+// newS3App returns an App storing uploads in an in-memory S3 bucket, with
+// its tus handler and the fake behind it. Uploads up to smallUploadThreshold
+// bytes are stored without multipart uploads.
+func newS3App(t *testing.T, smallUploadThreshold int64) (*App, http.Handler, *s3fake.Client) {
+	client := s3fake.New()
+	store := storage.NewS3("test-bucket", client, "")
+	store.SmallUploadThreshold = smallUploadThreshold
+	tusHandler, composer, err := newHandler(store, identity.Resolver{}, NewDeferredUploads(DeferredConfig{}), nil)
+	require.NoError(t, err)
+	app := &App{Store: store, Catalog: newTestCatalog(t), composer: composer}
+	app.TusHandler = protocolHandler(tusHandler, composer, 0)
+	return app, app.TusHandler, client
+}
+
+func headOffset(t *testing.T, tusHandler http.Handler, id string) string {
+	req := httptest.NewRequest("HEAD", "/files/"+id, nil)
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	rr := httptest.NewRecorder()
+	tusHandler.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	return rr.Header().Get("Upload-Offset")
+}
+
+func TestTusUpload_S3EndToEnd(t *testing.T) {
+	app, tusHandler, client := newS3App(t, 0)
+	data := strings.Repeat("0123456789", 1<<20)
+	half := len(data) / 2
+
+	// The first half is smaller than a part and waits in a .part object.
+	id := createUpload(t, tusHandler, len(data), data[:half], "filename c29uZy5tcDM=")
+	assert.Equal(t, strconv.Itoa(half), headOffset(t, tusHandler, id))
+
+	req := newPatchRequest(id, data[half:])
+	req.Header.Set("Upload-Offset", strconv.Itoa(half))
+	rr := httptest.NewRecorder()
+	tusHandler.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusNoContent, rr.Code)
+
+	key, _, _ := strings.Cut(id, "+")
+	stored, ok := client.Object("test-bucket", key)
+	require.True(t, ok)
+	assert.Equal(t, data, string(stored))
+	assert.Zero(t, client.MultipartUploads("test-bucket"))
+
+	rr = download(app, id, "bytes=0-9")
+	assert.Equal(t, http.StatusPartialContent, rr.Code)
+	assert.Equal(t, "0123456789", rr.Body.String())
+
+	req = httptest.NewRequest("DELETE", "/files/"+id, nil)
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	rr = httptest.NewRecorder()
+	tusHandler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	assert.Empty(t, client.Keys("test-bucket"))
+}
+
+func TestTusUpload_S3ResumesAfterFailedPart(t *testing.T) {
+	_, tusHandler, client := newS3App(t, 0)
+	data := strings.Repeat("x", 6<<20)
+
+	req := httptest.NewRequest("POST", "/files/", nil)
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	req.Header.Set("Upload-Length", strconv.Itoa(len(data)))
+	rr := httptest.NewRecorder()
+	tusHandler.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusCreated, rr.Code)
+	id := rr.Header().Get("Location")[strings.LastIndex(rr.Header().Get("Location"), "/")+1:]
+
+	client.Inject(s3fake.Fault{Op: "UploadPart", Err: errors.New("connection reset"), Times: 1})
+	rr = httptest.NewRecorder()
+	tusHandler.ServeHTTP(rr, newPatchRequest(id, data))
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+
+	// The client resumes from whatever offset the server reports.
+	offset, err := strconv.Atoi(headOffset(t, tusHandler, id))
+	require.NoError(t, err)
+	req = newPatchRequest(id, data[offset:])
+	req.Header.Set("Upload-Offset", strconv.Itoa(offset))
+	rr = httptest.NewRecorder()
+	tusHandler.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusNoContent, rr.Code)
+
+	key, _, _ := strings.Cut(id, "+")
+	stored, ok := client.Object("test-bucket", key)
+	require.True(t, ok)
+	assert.Equal(t, len(data), len(stored))
+	assert.Equal(t, 2, client.Calls("UploadPart"))
+}
+
+func TestTusUpload_S3SmallFile(t *testing.T) {
+	app, tusHandler, client := newS3App(t, testSmallUploadThreshold)
+
+	// Creation with upload stores the whole file with one request.
+	req := httptest.NewRequest("POST", "/files/", strings.NewReader("0123456789"))
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	req.Header.Set("Upload-Length", "10")
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	rr := httptest.NewRecorder()
+	tusHandler.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusCreated, rr.Code)
+	assert.Equal(t, "10", rr.Header().Get("Upload-Offset"))
+	id := rr.Header().Get("Location")[strings.LastIndex(rr.Header().Get("Location"), "/")+1:]
+
+	assert.NotContains(t, id, "+")
+	assert.Equal(t, 2, client.Calls("PutObject")) // the .info and the file
+	assert.Zero(t, client.Calls("CreateMultipartUpload"))
+	assert.Equal(t, "0123456789", download(app, id, "").Body.String())
+	assert.Equal(t, "10", headOffset(t, tusHandler, id))
+
+	// The data of each request of a chunked upload is stored once, as a
+	// part, until the request completing the upload puts the file.
+	id = createUpload(t, tusHandler, 10, "01234", "")
+	assert.Equal(t, "5", headOffset(t, tusHandler, id))
+	part, ok := client.Object("test-bucket", id+".0.part")
+	assert.True(t, ok)
+	assert.Equal(t, "01234", string(part))
+
+	req = newPatchRequest(id, "56789")
+	req.Header.Set("Upload-Offset", "5")
+	rr = httptest.NewRecorder()
+	tusHandler.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusNoContent, rr.Code)
+	stored, _ := client.Object("test-bucket", id)
+	assert.Equal(t, "0123456789", string(stored))
+	_, ok = client.Object("test-bucket", id+".0.part")
+	assert.False(t, ok)
+	assert.Equal(t, 5, client.Calls("PutObject")) // the part is put once
+	assert.Zero(t, client.Calls("CreateMultipartUpload"))
+
+	// Larger uploads still use multipart uploads.
+	createUpload(t, tusHandler, testSmallUploadThreshold+1, "0", "")
+	assert.Equal(t, 1, client.Calls("CreateMultipartUpload"))
+}
@@ -0,0 +1,108 @@
+package uploader
+
+import (
+	"context"
+
+	"github.com/tus/tusd/v2/pkg/handler"
+)
+
+// storeWrapper is a tusd data store that decorates the uploads of an inner
+// store while keeping all of the inner store's extensions available. The
+// uploads returned by wrap must implement unwrapper, so that they can be
+// handed back to the inner store's extensions, which type-assert them to
+// their own upload type.
+type storeWrapper struct {
+	inner *handler.StoreComposer
+	wrap  func(upload handler.Upload) handler.Upload
+	// created, if set, is called with every upload created through the store.
+	created func(ctx context.Context, info handler.FileInfo)
+}
+
+// unwrapper is implemented by uploads decorated by a storeWrapper.
+type unwrapper interface {
+	Unwrap() handler.Upload
+}
+
+// unwrap removes one layer of decoration from upload.
+func unwrap(upload handler.Upload) handler.Upload {
+	if u, ok := upload.(unwrapper); ok {
+		return u.Unwrap()
+	}
+	return upload
+}
+
+// UseIn registers the wrapper for every extension the inner store supports.
+func (s storeWrapper) UseIn(composer *handler.StoreComposer) {
+	composer.UseCore(s)
+	if s.inner.UsesTerminater {
+		composer.UseTerminater(s)
+	}
+	if s.inner.UsesConcater {
+		composer.UseConcater(s)
+	}
+	if s.inner.UsesLengthDeferrer {
+		composer.UseLengthDeferrer(s)
+	}
+	if s.inner.UsesContentServer {
+		composer.UseContentServer(s)
+	}
+	if s.inner.UsesLocker {
+		composer.UseLocker(s.inner.Locker)
+	}
+}
+
+func (s storeWrapper) NewUpload(ctx context.Context, info handler.FileInfo) (handler.Upload, error) {
+	upload, err := s.inner.Core.NewUpload(ctx, info)
+	if err != nil {
+		return nil, err
+	}
+	if s.created != nil {
+		if info, err := upload.GetInfo(ctx); err == nil {
+			s.created(ctx, info)
+		}
+	}
+	return s.wrap(upload), nil
+}
+
+func (s storeWrapper) GetUpload(ctx context.Context, id string) (handler.Upload, error) {
+	upload, err := s.inner.Core.GetUpload(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return s.wrap(upload), nil
+}
+
+func (s storeWrapper) AsTerminatableUpload(upload handler.Upload) handler.TerminatableUpload {
+	return s.inner.Terminater.AsTerminatableUpload(unwrap(upload))
+}
+
+func (s storeWrapper) AsLengthDeclarableUpload(upload handler.Upload) handler.LengthDeclarableUpload {
+	if declarable, ok := upload.(handler.LengthDeclarableUpload); ok {
+		return declarable
+	}
+	return s.inner.LengthDeferrer.AsLengthDeclarableUpload(unwrap(upload))
+}
+
+func (s storeWrapper) AsServableUpload(upload handler.Upload) handler.ServableUpload {
+	return s.inner.ContentServer.AsServableUpload(unwrap(upload))
+}
+
+func (s storeWrapper) AsConcatableUpload(upload handler.Upload) handler.ConcatableUpload {
+	return concatableUpload{
+		ConcatableUpload: s.inner.Concater.AsConcatableUpload(unwrap(upload)),
+	}
+}
+
+// concatableUpload unwraps the partial uploads before handing them to the
+// inner store.
+type concatableUpload struct {
+	handler.ConcatableUpload
+}
+
+func (u concatableUpload) ConcatUploads(ctx context.Context, partials []handler.Upload) error {
+	inner := make([]handler.Upload, len(partials))
+	for i, partial := range partials {
+		inner[i] = unwrap(partial)
+	}
+	return u.ConcatableUpload.ConcatUploads(ctx, inner)
+}
@@ -0,0 +1,72 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"music-streaming/backend/internal/audio"
+)
+
+// Upload metadata keys of the tags embedded in a track.
+const (
+	MetadataTitle       = "tag_title"
+	MetadataArtist      = "tag_artist"
+	MetadataAlbum       = "tag_album"
+	MetadataAlbumArtist = "tag_album_artist"
+	MetadataGenre       = "tag_genre"
+	MetadataTrackNumber = "tag_track"
+	MetadataYear        = "tag_year"
+	// MetadataExplicit is "true" for tracks with a parental advisory.
+	MetadataExplicit = "tag_explicit"
+)
+
+// TagStage records the title, artist, album and other tags embedded in
+// completed uploads. Uploads in formats without known tags are skipped.
+type TagStage struct{}
+
+func (TagStage) Name() string { return "tags" }
+
+func (TagStage) Process(ctx context.Context, upload *CompletedUpload) error {
+	app := upload.App
+	dataKey := objectKey(upload.Info)
+	if blob := upload.Info.MetaData[MetadataBlob]; blob != "" {
+		dataKey = blob
+	}
+
+	obj, err := app.Store.Stat(ctx, dataKey)
+	if err != nil {
+		return fmt.Errorf("failed to read upload: %w", err)
+	}
+	tags, err := audio.ReadTags(&storeReaderAt{ctx: ctx, store: app.Store, key: dataKey, size: obj.Size}, obj.Size)
+	if errors.Is(err, audio.ErrUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	metadata := upload.Info.MetaData
+	for key, value := range map[string]string{
+		MetadataTitle:       tags.Title,
+		MetadataArtist:      tags.Artist,
+		MetadataAlbum:       tags.Album,
+		MetadataAlbumArtist: tags.AlbumArtist,
+		MetadataGenre:       tags.Genre,
+	} {
+		if value != "" {
+			metadata[key] = value
+		}
+	}
+	if tags.Track > 0 {
+		metadata[MetadataTrackNumber] = strconv.Itoa(tags.Track)
+	}
+	if tags.Year > 0 {
+		metadata[MetadataYear] = strconv.Itoa(tags.Year)
+	}
+	if tags.Explicit {
+		metadata[MetadataExplicit] = "true"
+	}
+	return nil
+}
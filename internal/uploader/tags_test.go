@@ -0,0 +1,46 @@
+package uploader
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// taggedMP3 returns silentMP3 behind an ID3v2.3 tag holding frames, given
+// as frame IDs and values.
+func taggedMP3(frames ...string) []byte {
+	var body []byte
+	for i := 0; i+1 < len(frames); i += 2 {
+		body = append(body, frames[i]...)
+		body = binary.BigEndian.AppendUint32(body, uint32(1+len(frames[i+1])))
+		body = append(body, 0, 0, 3)
+		body = append(body, frames[i+1]...)
+	}
+	size := len(body)
+	tag := []byte{'I', 'D', '3', 3, 0, 0, byte(size >> 21 & 0x7F), byte(size >> 14 & 0x7F), byte(size >> 7 & 0x7F), byte(size & 0x7F)}
+	return append(append(tag, body...), silentMP3()...)
+}
+
+func TestTagStage(t *testing.T) {
+	app, tusHandler := newFileApp(t)
+	mp3 := taggedMP3("TIT2", "Song", "TPE1", "Band", "TALB", "Record", "TRCK", "4/9", "TCON", "(8)", "TYER", "2001")
+	id := processUpload(t, app, tusHandler, string(mp3), ChecksumStage{}, TagStage{})
+	other := processUpload(t, app, tusHandler, "master", ChecksumStage{}, TagStage{})
+
+	info, err := app.loadInfo(context.Background(), id)
+	require.NoError(t, err)
+	assert.Equal(t, "Song", info.MetaData[MetadataTitle])
+	assert.Equal(t, "Band", info.MetaData[MetadataArtist])
+	assert.Equal(t, "Record", info.MetaData[MetadataAlbum])
+	assert.Equal(t, "Jazz", info.MetaData[MetadataGenre])
+	assert.Equal(t, "4", info.MetaData[MetadataTrackNumber])
+	assert.Equal(t, "2001", info.MetaData[MetadataYear])
+	assert.Empty(t, info.MetaData[MetadataAlbumArtist])
+
+	info, err = app.loadInfo(context.Background(), other)
+	require.NoError(t, err)
+	assert.Empty(t, info.MetaData[MetadataTitle])
+}
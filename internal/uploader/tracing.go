@@ -0,0 +1,130 @@
+package uploader
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"music-streaming/backend/internal/telemetry"
+)
+
+// TraceS3 wraps an S3API so that every call is recorded as a client span
+// that is a child of the span found in the call's context.
+func TraceS3(client S3API) S3API {
+	if _, ok := client.(*tracedS3Client); ok {
+		return client
+	}
+	return &tracedS3Client{next: client}
+}
+
+type tracedS3Client struct {
+	next S3API
+}
+
+// traceS3Call runs call inside a span named after the S3 operation.
+func traceS3Call[T any](ctx context.Context, op string, bucket, key *string, call func(context.Context) (T, error)) (T, error) {
+	attrs := []attribute.KeyValue{
+		attribute.String("rpc.system", "aws-api"),
+		attribute.String("rpc.service", "S3"),
+		attribute.String("rpc.method", op),
+		attribute.String("aws.s3.bucket", aws.ToString(bucket)),
+	}
+	if key != nil {
+		attrs = append(attrs, attribute.String("aws.s3.key", aws.ToString(key)))
+	}
+
+	ctx, span := telemetry.Tracer().Start(ctx, "S3."+op,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...),
+	)
+	defer span.End()
+
+	out, err := call(ctx)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return out, err
+}
+
+func (c *tracedS3Client) PutObject(ctx context.Context, input *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	return traceS3Call(ctx, "PutObject", input.Bucket, input.Key, func(ctx context.Context) (*s3.PutObjectOutput, error) {
+		return c.next.PutObject(ctx, input, optFns...)
+	})
+}
+
+func (c *tracedS3Client) GetObject(ctx context.Context, input *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	return traceS3Call(ctx, "GetObject", input.Bucket, input.Key, func(ctx context.Context) (*s3.GetObjectOutput, error) {
+		return c.next.GetObject(ctx, input, optFns...)
+	})
+}
+
+func (c *tracedS3Client) HeadObject(ctx context.Context, input *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	return traceS3Call(ctx, "HeadObject", input.Bucket, input.Key, func(ctx context.Context) (*s3.HeadObjectOutput, error) {
+		return c.next.HeadObject(ctx, input, optFns...)
+	})
+}
+
+func (c *tracedS3Client) DeleteObject(ctx context.Context, input *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	return traceS3Call(ctx, "DeleteObject", input.Bucket, input.Key, func(ctx context.Context) (*s3.DeleteObjectOutput, error) {
+		return c.next.DeleteObject(ctx, input, optFns...)
+	})
+}
+
+func (c *tracedS3Client) DeleteObjects(ctx context.Context, input *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	return traceS3Call(ctx, "DeleteObjects", input.Bucket, nil, func(ctx context.Context) (*s3.DeleteObjectsOutput, error) {
+		return c.next.DeleteObjects(ctx, input, optFns...)
+	})
+}
+
+func (c *tracedS3Client) ListObjectsV2(ctx context.Context, input *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	return traceS3Call(ctx, "ListObjectsV2", input.Bucket, input.Prefix, func(ctx context.Context) (*s3.ListObjectsV2Output, error) {
+		return c.next.ListObjectsV2(ctx, input, optFns...)
+	})
+}
+
+func (c *tracedS3Client) CreateMultipartUpload(ctx context.Context, input *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	return traceS3Call(ctx, "CreateMultipartUpload", input.Bucket, input.Key, func(ctx context.Context) (*s3.CreateMultipartUploadOutput, error) {
+		return c.next.CreateMultipartUpload(ctx, input, optFns...)
+	})
+}
+
+func (c *tracedS3Client) CompleteMultipartUpload(ctx context.Context, input *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	return traceS3Call(ctx, "CompleteMultipartUpload", input.Bucket, input.Key, func(ctx context.Context) (*s3.CompleteMultipartUploadOutput, error) {
+		return c.next.CompleteMultipartUpload(ctx, input, optFns...)
+	})
+}
+
+func (c *tracedS3Client) AbortMultipartUpload(ctx context.Context, input *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	return traceS3Call(ctx, "AbortMultipartUpload", input.Bucket, input.Key, func(ctx context.Context) (*s3.AbortMultipartUploadOutput, error) {
+		return c.next.AbortMultipartUpload(ctx, input, optFns...)
+	})
+}
+
+func (c *tracedS3Client) ListParts(ctx context.Context, input *s3.ListPartsInput, optFns ...func(*s3.Options)) (*s3.ListPartsOutput, error) {
+	return traceS3Call(ctx, "ListParts", input.Bucket, input.Key, func(ctx context.Context) (*s3.ListPartsOutput, error) {
+		return c.next.ListParts(ctx, input, optFns...)
+	})
+}
+
+func (c *tracedS3Client) UploadPart(ctx context.Context, input *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	return traceS3Call(ctx, "UploadPart", input.Bucket, input.Key, func(ctx context.Context) (*s3.UploadPartOutput, error) {
+		return c.next.UploadPart(ctx, input, optFns...)
+	})
+}
+
+func (c *tracedS3Client) UploadPartCopy(ctx context.Context, input *s3.UploadPartCopyInput, optFns ...func(*s3.Options)) (*s3.UploadPartCopyOutput, error) {
+	return traceS3Call(ctx, "UploadPartCopy", input.Bucket, input.Key, func(ctx context.Context) (*s3.UploadPartCopyOutput, error) {
+		return c.next.UploadPartCopy(ctx, input, optFns...)
+	})
+}
+
+func (c *tracedS3Client) CopyObject(ctx context.Context, input *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	return traceS3Call(ctx, "CopyObject", input.Bucket, input.Key, func(ctx context.Context) (*s3.CopyObjectOutput, error) {
+		return c.next.CopyObject(ctx, input, optFns...)
+	})
+}
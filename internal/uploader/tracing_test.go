@@ -0,0 +1,129 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/tus/tusd/v2/pkg/handler"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"music-streaming/backend/internal/storage"
+)
+
+func newSpanRecorder(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	return recorder
+}
+
+func TestTraceS3_RecordsChildSpans(t *testing.T) {
+	recorder := newSpanRecorder(t)
+	mockS3 := new(MockS3Client)
+	client := TraceS3(mockS3)
+
+	mockS3.On("HeadObject", mock.Anything, mock.Anything, mock.Anything).Return(&s3.HeadObjectOutput{}, nil)
+	mockS3.On("DeleteObject", mock.Anything, mock.Anything, mock.Anything).Return(nil, errors.New("s3: AccessDenied"))
+
+	ctx, parent := otel.Tracer("test").Start(context.Background(), "parent")
+	_, err := client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String("test-bucket"), Key: aws.String("a.info")})
+	require.NoError(t, err)
+	_, err = client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String("test-bucket"), Key: aws.String("a")})
+	require.Error(t, err)
+	parent.End()
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 3)
+	assert.Equal(t, "S3.HeadObject", spans[0].Name())
+	assert.Equal(t, parent.SpanContext().SpanID(), spans[0].Parent().SpanID())
+	assert.Equal(t, "S3.DeleteObject", spans[1].Name())
+	assert.Equal(t, codes.Error, spans[1].Status().Code)
+	mockS3.AssertExpectations(t)
+}
+
+func TestTraceS3_DoesNotDoubleWrap(t *testing.T) {
+	client := TraceS3(new(MockS3Client))
+	assert.Same(t, client, TraceS3(client))
+}
+
+type funcStage struct {
+	name string
+	fn   func(ctx context.Context, upload *CompletedUpload) error
+}
+
+func (s funcStage) Name() string { return s.name }
+
+func (s funcStage) Process(ctx context.Context, upload *CompletedUpload) error {
+	return s.fn(ctx, upload)
+}
+
+// newStoredApp returns an App on a local store holding the .info of info.
+func newStoredApp(t *testing.T, info handler.FileInfo) *App {
+	store, err := storage.NewFile(t.TempDir())
+	require.NoError(t, err)
+	app := &App{Store: store}
+	require.NoError(t, app.saveInfo(context.Background(), info))
+	return app
+}
+
+func TestPipeline_StageSpans(t *testing.T) {
+	recorder := newSpanRecorder(t)
+	ran := []string{}
+	pipeline := &Pipeline{Stages: []Stage{
+		funcStage{"first", func(ctx context.Context, upload *CompletedUpload) error {
+			ran = append(ran, "first")
+			return errors.New("boom")
+		}},
+		funcStage{"second", func(ctx context.Context, upload *CompletedUpload) error {
+			ran = append(ran, "second")
+			return nil
+		}},
+	}}
+
+	info := handler.FileInfo{ID: "abc"}
+	pipeline.Process(context.Background(), newStoredApp(t, info), info)
+
+	// A failing stage does not stop the following ones.
+	assert.Equal(t, []string{"first", "second"}, ran)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 3)
+	root := spans[2]
+	assert.Equal(t, "upload.postprocess", root.Name())
+	assert.Equal(t, "stage.first", spans[0].Name())
+	assert.Equal(t, codes.Error, spans[0].Status().Code)
+	assert.Equal(t, root.SpanContext().SpanID(), spans[0].Parent().SpanID())
+	assert.Equal(t, "stage.second", spans[1].Name())
+}
+
+func TestPipeline_StagePanics(t *testing.T) {
+	ran := false
+	pipeline := &Pipeline{Stages: []Stage{
+		funcStage{"parser", func(ctx context.Context, upload *CompletedUpload) error {
+			var b []byte
+			_ = b[0]
+			return nil
+		}},
+		funcStage{"next", func(ctx context.Context, upload *CompletedUpload) error {
+			ran = true
+			return nil
+		}},
+	}}
+
+	// A panicking stage fails like one returning an error.
+	info := handler.FileInfo{ID: "abc"}
+	app := newStoredApp(t, info)
+	assert.NotPanics(t, func() { pipeline.Process(context.Background(), app, info) })
+	assert.True(t, ran)
+}
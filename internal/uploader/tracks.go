@@ -0,0 +1,432 @@
+package uploader
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/tus/tusd/v2/pkg/handler"
+
+	"music-streaming/backend/internal/audio"
+	"music-streaming/backend/internal/catalog"
+	"music-streaming/backend/internal/storage"
+)
+
+// MetadataVersions lists the SHA-256 of earlier versions of an upload's
+// data, comma separated, once tags have been written back into it. Their
+// blobs are kept until the upload is deleted.
+const MetadataVersions = "versions"
+
+const (
+	// maxTagLength is the most characters a text tag may have.
+	maxTagLength = 256
+	// maxTrackEditSize caps the body of a track edit.
+	maxTrackEditSize = 64 << 10
+)
+
+var (
+	errTrackChanged     = errors.New("track has changed")
+	errTrackForbidden   = errors.New("track belongs to another user")
+	errTrackOwnerless   = errors.New("track has no owner to edit it")
+	errEditorUnknown    = errors.New("track edits require an identified user")
+	errTagsNotWritable  = errors.New("tags cannot be written into this format")
+	errTrackEditInvalid = errors.New("invalid track edit")
+)
+
+// trackEdit is the body of a PATCH of a track. Fields left out are kept,
+// empty strings and zero numbers clear them.
+type trackEdit struct {
+	Title       *string `json:"title"`
+	Artist      *string `json:"artist"`
+	Album       *string `json:"album"`
+	AlbumArtist *string `json:"album_artist"`
+	Genre       *string `json:"genre"`
+	TrackNumber *int    `json:"track_number"`
+	Year        *int    `json:"year"`
+	Explicit    *bool   `json:"explicit"`
+	// WriteTags writes the tags into the audio file too, as a new version
+	// of its data.
+	WriteTags bool `json:"write_tags"`
+}
+
+// validate checks the edit and trims the space around its text.
+func (e *trackEdit) validate() error {
+	for name, value := range map[string]*string{
+		"title": e.Title, "artist": e.Artist, "album": e.Album,
+		"album_artist": e.AlbumArtist, "genre": e.Genre,
+	} {
+		if value == nil {
+			continue
+		}
+		*value = strings.TrimSpace(*value)
+		if !utf8.ValidString(*value) {
+			return fmt.Errorf("%w: %s is not valid UTF-8", errTrackEditInvalid, name)
+		}
+		if strings.ContainsFunc(*value, unicode.IsControl) {
+			return fmt.Errorf("%w: %s contains control characters", errTrackEditInvalid, name)
+		}
+		if utf8.RuneCountInString(*value) > maxTagLength {
+			return fmt.Errorf("%w: %s is longer than %d characters", errTrackEditInvalid, name, maxTagLength)
+		}
+	}
+	if e.TrackNumber != nil && (*e.TrackNumber < 0 || *e.TrackNumber > 999) {
+		return fmt.Errorf("%w: track_number must be between 0 and 999", errTrackEditInvalid)
+	}
+	if e.Year != nil && (*e.Year < 0 || *e.Year > 9999) {
+		return fmt.Errorf("%w: year must be between 0 and 9999", errTrackEditInvalid)
+	}
+	if e.Title == nil && e.Artist == nil && e.Album == nil && e.AlbumArtist == nil && e.Genre == nil &&
+		e.TrackNumber == nil && e.Year == nil && e.Explicit == nil && !e.WriteTags {
+		return fmt.Errorf("%w: nothing to change", errTrackEditInvalid)
+	}
+	return nil
+}
+
+// apply makes the edit to upload metadata.
+func (e *trackEdit) apply(metadata handler.MetaData) {
+	text := func(key string, value *string) {
+		switch {
+		case value == nil:
+		case *value == "":
+			delete(metadata, key)
+		default:
+			metadata[key] = *value
+		}
+	}
+	number := func(key string, value *int) {
+		switch {
+		case value == nil:
+		case *value == 0:
+			delete(metadata, key)
+		default:
+			metadata[key] = strconv.Itoa(*value)
+		}
+	}
+	text(MetadataTitle, e.Title)
+	text(MetadataArtist, e.Artist)
+	text(MetadataAlbum, e.Album)
+	text(MetadataAlbumArtist, e.AlbumArtist)
+	text(MetadataGenre, e.Genre)
+	number(MetadataTrackNumber, e.TrackNumber)
+	number(MetadataYear, e.Year)
+	if e.Explicit != nil {
+		explicit := ""
+		if *e.Explicit {
+			explicit = "true"
+		}
+		text(MetadataExplicit, &explicit)
+	}
+}
+
+// tagsOf returns the tags recorded in upload metadata.
+func tagsOf(metadata handler.MetaData) *audio.Tags {
+	t := &audio.Tags{
+		Title:       metadata[MetadataTitle],
+		Artist:      metadata[MetadataArtist],
+		Album:       metadata[MetadataAlbum],
+		AlbumArtist: metadata[MetadataAlbumArtist],
+		Genre:       metadata[MetadataGenre],
+		Explicit:    metadata[MetadataExplicit] == "true",
+	}
+	t.Track, _ = strconv.Atoi(metadata[MetadataTrackNumber])
+	t.Year, _ = strconv.Atoi(metadata[MetadataYear])
+	return t
+}
+
+// trackETag returns the entity tag of a version of a track.
+func trackETag(t *catalog.Track) string {
+	return `"` + strconv.Itoa(t.Version) + `"`
+}
+
+// etagMatches reports whether an If-Match header matches etag.
+func etagMatches(ifMatch, etag string) bool {
+	for _, tag := range strings.Split(ifMatch, ",") {
+		if tag = strings.TrimSpace(tag); tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// TracksHandler serves the tags of the track of an upload at
+// /tracks/{id}: GET returns them with the version of the track as ETag,
+// and PATCH edits them, given that version in If-Match. GET
+// /tracks/{id}/history lists the edits of the track.
+//
+// Edits of tracks with an owner are up to that owner. Edits asking to
+// write_tags also write the tags into MP3 and FLAC files, whose new data
+// is stored as a blob of its own.
+func (a *App) TracksHandler(w http.ResponseWriter, r *http.Request) {
+	id, history := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/tracks/"), "/history")
+	key, _, _ := strings.Cut(id, "+")
+	if key == "" || strings.Contains(key, "/") {
+		writeTusError(w, http.StatusNotFound, "ERR_TRACK_NOT_FOUND", "track not found")
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		if history {
+			a.trackHistory(w, r, key)
+		} else {
+			a.getTrack(w, r, key)
+		}
+	case r.Method == http.MethodPatch && !history:
+		a.editTrack(w, r, key)
+	default:
+		if history {
+			w.Header().Set("Allow", "GET, HEAD")
+		} else {
+			w.Header().Set("Allow", "GET, HEAD, PATCH")
+		}
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *App) getTrack(w http.ResponseWriter, r *http.Request, key string) {
+	track, err := a.Catalog.Track(r.Context(), key)
+	if errors.Is(err, catalog.ErrNotFound) {
+		writeTusError(w, http.StatusNotFound, "ERR_TRACK_NOT_FOUND", "track not found")
+		return
+	}
+	if err != nil {
+		writeTusError(w, http.StatusInternalServerError, "ERR_INTERNAL_SERVER_ERROR", err.Error())
+		return
+	}
+	a.writeTrack(w, track)
+}
+
+// trackInfo is a track as GET and PATCH return it.
+type trackInfo struct {
+	fileInfo
+	Version int `json:"version"`
+}
+
+func (a *App) writeTrack(w http.ResponseWriter, track *catalog.Track) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", trackETag(track))
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := json.NewEncoder(w).Encode(trackInfo{fileInfo: a.fileInfo(*track), Version: track.Version}); err != nil {
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+	}
+}
+
+func (a *App) trackHistory(w http.ResponseWriter, r *http.Request, key string) {
+	edits, err := a.Catalog.TrackHistory(r.Context(), key)
+	if errors.Is(err, catalog.ErrNotFound) {
+		writeTusError(w, http.StatusNotFound, "ERR_TRACK_NOT_FOUND", "track not found")
+		return
+	}
+	if err != nil {
+		writeTusError(w, http.StatusInternalServerError, "ERR_INTERNAL_SERVER_ERROR", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(edits); err != nil {
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+	}
+}
+
+func (a *App) editTrack(w http.ResponseWriter, r *http.Request, key string) {
+	var edit trackEdit
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxTrackEditSize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&edit); err != nil {
+		writeTusError(w, http.StatusBadRequest, "ERR_INVALID_TRACK_EDIT", err.Error())
+		return
+	}
+	if err := edit.validate(); err != nil {
+		writeTusError(w, http.StatusBadRequest, "ERR_INVALID_TRACK_EDIT", err.Error())
+		return
+	}
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		writeTusError(w, http.StatusPreconditionRequired, "ERR_PRECONDITION_REQUIRED", "If-Match is required")
+		return
+	}
+	editor := a.Resolver.Resolve(r).UserID
+	if editor == "" {
+		writeTusError(w, http.StatusForbidden, "ERR_TRACK_FORBIDDEN", errEditorUnknown.Error())
+		return
+	}
+
+	// Edits are seen through once begun.
+	track, err := a.applyEdit(context.WithoutCancel(r.Context()), key, ifMatch, editor, &edit)
+	switch {
+	case errors.Is(err, catalog.ErrNotFound):
+		writeTusError(w, http.StatusNotFound, "ERR_TRACK_NOT_FOUND", "track not found")
+	case errors.Is(err, errTrackChanged), errors.Is(err, catalog.ErrConflict):
+		writeTusError(w, http.StatusPreconditionFailed, "ERR_TRACK_CHANGED", "track has changed since it was read")
+	case errors.Is(err, errTrackForbidden), errors.Is(err, errTrackOwnerless):
+		writeTusError(w, http.StatusForbidden, "ERR_TRACK_FORBIDDEN", err.Error())
+	case errors.Is(err, errTagsNotWritable):
+		writeTusError(w, http.StatusUnprocessableEntity, "ERR_TAGS_NOT_WRITABLE", err.Error())
+	case err != nil:
+		writeTusError(w, http.StatusInternalServerError, "ERR_INTERNAL_SERVER_ERROR", err.Error())
+	default:
+		a.writeTrack(w, track)
+	}
+}
+
+// applyEdit edits the track stored under key if its version matches
+// ifMatch: in the upload's .info, in its data if asked to, and in the
+// catalog, which records the edit. It holds the upload's lock, so that the
+// version cannot change between its check and the edit, other than by a
+// catalog rebuild; the .info and data are then restored. DELETE requests
+// take the lock as well, so the upload cannot be deleted in the middle of
+// the edit, and one deleted before it is not found rather than having its
+// .info and data written again.
+func (a *App) applyEdit(ctx context.Context, key, ifMatch, editor string, edit *trackEdit) (*catalog.Track, error) {
+	defer a.uploadLocks.Lock(key)()
+	track, err := a.Catalog.Track(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if !etagMatches(ifMatch, trackETag(track)) {
+		return nil, errTrackChanged
+	}
+	if track.Owner == "" && !a.AllowOwnerlessEdits {
+		return nil, errTrackOwnerless
+	}
+	if track.Owner != "" && track.Owner != editor {
+		return nil, errTrackForbidden
+	}
+
+	// The catalog keeps a deleted track until the pipeline drops it.
+	info, err := a.loadInfo(ctx, key)
+	if storage.IsNotFound(err) {
+		return nil, catalog.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	previous := info
+	info.MetaData = maps.Clone(info.MetaData)
+	edit.apply(info.MetaData)
+	size := track.Size
+	if edit.WriteTags {
+		if size, err = a.writeTags(ctx, key, info.MetaData); err != nil {
+			return nil, err
+		}
+	}
+	if err := a.saveInfo(ctx, info); err != nil {
+		return nil, err
+	}
+
+	dataKey := key
+	if blob := info.MetaData[MetadataBlob]; blob != "" {
+		dataKey = blob
+	}
+	if _, err := a.Catalog.EditTrack(ctx, trackOf(key, dataKey, size, info.MetaData), track.Version, editor); err != nil {
+		if rollbackErr := a.rollbackEdit(ctx, previous, info); rollbackErr != nil {
+			return nil, errors.Join(err, rollbackErr)
+		}
+		return nil, err
+	}
+	if track, err = a.Catalog.Track(ctx, key); err != nil {
+		return nil, err
+	}
+	if a.Search != nil {
+		a.Search.Add(documentOf(track))
+	}
+	return track, nil
+}
+
+// rollbackEdit restores the .info of an upload edited into edited, and
+// drops the reference of the upload to the data version the edit made.
+func (a *App) rollbackEdit(ctx context.Context, previous, edited handler.FileInfo) error {
+	if err := a.saveInfo(ctx, previous); err != nil {
+		return err
+	}
+	sum := edited.MetaData[MetadataSHA256]
+	if sum == previous.MetaData[MetadataSHA256] || slices.Contains(strings.Split(previous.MetaData[MetadataVersions], ","), sum) {
+		return nil
+	}
+	return a.releaseBlob(ctx, sum, objectKey(edited))
+}
+
+// writeTags writes the tags of metadata into the data of the upload stored
+// under key, as a new blob the metadata then points at, and returns its
+// size. The blob of the previous version is kept, and listed in
+// MetadataVersions.
+func (a *App) writeTags(ctx context.Context, key string, metadata handler.MetaData) (int64, error) {
+	blob, sum := metadata[MetadataBlob], metadata[MetadataSHA256]
+	if blob == "" || sum == "" {
+		return 0, fmt.Errorf("%w: upload is not stored as a blob", errTagsNotWritable)
+	}
+	obj, err := a.Store.Stat(ctx, blob)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read upload: %w", err)
+	}
+
+	f, err := os.CreateTemp("", "tags-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	h := sha256.New()
+	err = audio.WriteTags(io.MultiWriter(f, h), &storeReaderAt{ctx: ctx, store: a.Store, key: blob, size: obj.Size}, obj.Size, tagsOf(metadata))
+	if errors.Is(err, audio.ErrUnsupported) {
+		return 0, errTagsNotWritable
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to write tags: %w", err)
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	newSum := hex.EncodeToString(h.Sum(nil))
+	if newSum == sum {
+		return size, nil
+	}
+
+	// The new version is shared like any other blob, in case it is
+	// identical to another upload.
+	defer a.blobLocks.Lock(newSum)()
+	if _, err := a.Store.Stat(ctx, blobKey(newSum)); storage.IsNotFound(err) {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+		if err := a.Store.Put(ctx, blobKey(newSum), f, size); err != nil {
+			return 0, fmt.Errorf("failed to store tagged data: %w", err)
+		}
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to check blob: %w", err)
+	}
+	refs, err := a.loadBlobRefs(ctx, newSum)
+	if err != nil {
+		return 0, err
+	}
+	if !slices.Contains(refs.Refs, key) {
+		refs.Refs = append(refs.Refs, key)
+		if err := a.saveBlobRefs(ctx, newSum, refs); err != nil {
+			return 0, err
+		}
+	}
+
+	var versions []string
+	if v := metadata[MetadataVersions]; v != "" {
+		versions = strings.Split(v, ",")
+	}
+	if !slices.Contains(versions, sum) {
+		metadata[MetadataVersions] = strings.Join(append(versions, sum), ",")
+	}
+	metadata[MetadataSHA256] = newSum
+	metadata[MetadataBlob] = blobKey(newSum)
+	return size, nil
+}
@@ -0,0 +1,222 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"music-streaming/backend/internal/audio"
+	"music-streaming/backend/internal/catalog"
+	"music-streaming/backend/internal/identity"
+	"music-streaming/backend/internal/storage"
+)
+
+func trackRequest(app *App, method, path, ifMatch, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+	req.Header.Set(identity.DefaultUserHeader, "alice")
+	rr := httptest.NewRecorder()
+	app.TracksHandler(rr, req)
+	return rr
+}
+
+func TestTracksHandler(t *testing.T) {
+	ctx := context.Background()
+	app, tusHandler := newFileApp(t)
+	mp3 := taggedMP3("TIT2", "Song", "TALB", "Record")
+	id := processUpload(t, app, tusHandler, string(mp3), ChecksumStage{}, DedupStage{}, TagStage{}, CatalogStage{})
+	path := "/tracks/" + id
+
+	rr := trackRequest(app, "GET", path, "", "")
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `"1"`, rr.Header().Get("ETag"))
+	var track trackInfo
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &track))
+	assert.Equal(t, "Song", track.Title)
+	assert.Equal(t, 1, track.Version)
+
+	assert.Equal(t, http.StatusPreconditionRequired, trackRequest(app, "PATCH", path, "", `{"title":"New"}`).Code)
+	for _, body := range []string{`{"name":"x"}`, `{}`, `{"track_number":1000}`, `{"title":"a\u0007b"}`, `{"genre":"` + strings.Repeat("x", 257) + `"}`} {
+		assert.Equal(t, http.StatusBadRequest, trackRequest(app, "PATCH", path, `"1"`, body).Code, body)
+	}
+
+	rr = trackRequest(app, "PATCH", path, `"1"`, `{"title":" New ","artist":"Band","explicit":true}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, `"2"`, rr.Header().Get("ETag"))
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &track))
+	assert.Equal(t, "New", track.Title)
+	assert.True(t, track.Explicit)
+	info, err := app.loadInfo(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, "Band", info.MetaData[MetadataArtist])
+	assert.Equal(t, "true", info.MetaData[MetadataExplicit])
+
+	// Edits of a version that has been replaced fail.
+	assert.Equal(t, http.StatusPreconditionFailed, trackRequest(app, "PATCH", path, `"1"`, `{"title":"Old"}`).Code)
+
+	// Written back tags make a new version of the data.
+	sum := info.MetaData[MetadataSHA256]
+	rr = trackRequest(app, "PATCH", path, `"2"`, `{"album":"","write_tags":true}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	info, err = app.loadInfo(ctx, id)
+	require.NoError(t, err)
+	newSum := info.MetaData[MetadataSHA256]
+	assert.NotEqual(t, sum, newSum)
+	assert.Equal(t, sum, info.MetaData[MetadataVersions])
+	data := download(app, id, "").Body.Bytes()
+	tags, err := audio.ReadTags(bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+	assert.Equal(t, &audio.Tags{Title: "New", Artist: "Band", Explicit: true}, tags)
+
+	rr = trackRequest(app, "GET", path+"/history", "", "")
+	require.Equal(t, http.StatusOK, rr.Code)
+	var history []catalog.Edit
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &history))
+	require.Len(t, history, 2)
+	assert.Equal(t, "alice", history[0].Editor)
+	assert.Equal(t, []catalog.Change{
+		{Field: "album", From: "Record", To: ""},
+		{Field: "sha256", From: sum, To: newSum},
+	}, history[1].Changes)
+
+	// Deleting the upload drops every version.
+	require.NoError(t, DedupStage{}.Terminate(ctx, &CompletedUpload{App: app, Info: info}))
+	for _, s := range []string{sum, newSum} {
+		_, err := app.Store.Stat(ctx, blobKey(s))
+		assert.Error(t, err)
+	}
+
+	assert.Equal(t, http.StatusNotFound, trackRequest(app, "GET", "/tracks/missing", "", "").Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, trackRequest(app, "DELETE", path, "", "").Code)
+}
+
+func TestTracksHandler_NotWritable(t *testing.T) {
+	app, tusHandler := newFileApp(t)
+	wav := audio.EncodeWAV(8000, 1, make([]float64, 100))
+	id := processUpload(t, app, tusHandler, string(wav), ChecksumStage{}, DedupStage{}, CatalogStage{})
+	rr := trackRequest(app, "PATCH", "/tracks/"+id, `"1"`, `{"title":"Memo","write_tags":true}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	assert.Contains(t, rr.Body.String(), "ERR_TAGS_NOT_WRITABLE")
+
+	// Tracks of other users are theirs to edit.
+	require.NoError(t, app.Catalog.PutTrack(context.Background(), &catalog.Track{Key: "owned", Name: "a.mp3", DataKey: "owned", Owner: "bob"}))
+	rr = trackRequest(app, "PATCH", "/tracks/owned", "*", `{"title":"Mine"}`)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
+
+func TestTracksHandler_OwnerlessAndAnonymous(t *testing.T) {
+	ctx := context.Background()
+	app, tusHandler := newFileApp(t)
+	id := processUpload(t, app, tusHandler, string(taggedMP3("TIT2", "Song")), ChecksumStage{}, DedupStage{}, TagStage{}, CatalogStage{})
+	track, err := app.Catalog.Track(ctx, id)
+	require.NoError(t, err)
+	track.Owner = ""
+	require.NoError(t, app.Catalog.PutTrack(ctx, track))
+	path := "/tracks/" + id
+
+	// Tracks uploaded anonymously are no one's to edit, unless configured.
+	rr := trackRequest(app, "PATCH", path, "*", `{"title":"Mine"}`)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Contains(t, rr.Body.String(), "ERR_TRACK_FORBIDDEN")
+	app.AllowOwnerlessEdits = true
+	rr = trackRequest(app, "PATCH", path, "*", `{"title":"Mine"}`)
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	// Anonymous clients edit nothing, not even with ownerless edits allowed.
+	req := httptest.NewRequest("PATCH", path, strings.NewReader(`{"title":"Other"}`))
+	req.Header.Set("If-Match", "*")
+	rr = httptest.NewRecorder()
+	app.TracksHandler(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Contains(t, rr.Body.String(), "identified user")
+}
+
+func TestTracksHandler_ConcurrentEdits(t *testing.T) {
+	app, tusHandler := newFileApp(t)
+	id := processUpload(t, app, tusHandler, string(taggedMP3("TIT2", "Song")), ChecksumStage{}, DedupStage{}, TagStage{}, CatalogStage{})
+
+	// Of two edits of the same version, only one goes through.
+	codes := make(chan int, 2)
+	for _, title := range []string{"One", "Two"} {
+		go func() {
+			codes <- trackRequest(app, "PATCH", "/tracks/"+id, `"1"`, `{"title":"`+title+`","write_tags":true}`).Code
+		}()
+	}
+	assert.ElementsMatch(t, []int{http.StatusOK, http.StatusPreconditionFailed}, []int{<-codes, <-codes})
+	track, err := app.Catalog.Track(context.Background(), id)
+	require.NoError(t, err)
+	info, err := app.loadInfo(context.Background(), id)
+	require.NoError(t, err)
+	assert.Equal(t, track.Title, info.MetaData[MetadataTitle])
+	assert.Equal(t, track.SHA256, info.MetaData[MetadataSHA256])
+}
+
+func TestTracksHandler_EditAndDelete(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store, err := storage.NewFile(t.TempDir())
+	require.NoError(t, err)
+	resolver := identity.Resolver{UserHeader: identity.DefaultUserHeader, TrustGatewayHeaders: true}
+	app, err := NewApp(ctx, store, newTestCatalog(t), DeferredConfig{}, resolver)
+	require.NoError(t, err)
+	mp3 := taggedMP3("TIT2", "Song")
+	id := createUpload(t, app.TusHandler, len(mp3), string(mp3), "")
+	require.Eventually(t, func() bool {
+		return trackRequest(app, "GET", "/tracks/"+id, "", "").Code == http.StatusOK
+	}, 10*time.Second, 10*time.Millisecond)
+
+	// A DELETE waits for an edit holding the upload, and edits after it
+	// find the track gone rather than bring back its .info and data.
+	unlock := app.uploadLocks.Lock(id)
+	deleted := make(chan int)
+	go func() {
+		req := httptest.NewRequest("DELETE", "/files/"+id, nil)
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		rr := httptest.NewRecorder()
+		app.TusHandler.ServeHTTP(rr, req)
+		deleted <- rr.Code
+	}()
+	select {
+	case <-deleted:
+		t.Fatal("upload deleted while it was edited")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	require.Equal(t, http.StatusNoContent, <-deleted)
+
+	assert.Equal(t, http.StatusNotFound, trackRequest(app, "PATCH", "/tracks/"+id, "*", `{"title":"New","write_tags":true}`).Code)
+	assert.Eventually(t, func() bool {
+		objects, err := store.List(ctx, "")
+		return err == nil && len(objects) == 0
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+func TestApp_RollbackEdit(t *testing.T) {
+	ctx := context.Background()
+	app, tusHandler := newFileApp(t)
+	id := processUpload(t, app, tusHandler, string(taggedMP3("TIT2", "Song")), ChecksumStage{}, DedupStage{}, TagStage{}, CatalogStage{})
+	previous, err := app.loadInfo(ctx, id)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, trackRequest(app, "PATCH", "/tracks/"+id, `"1"`, `{"title":"New","write_tags":true}`).Code)
+	edited, err := app.loadInfo(ctx, id)
+	require.NoError(t, err)
+
+	require.NoError(t, app.rollbackEdit(ctx, previous, edited))
+	info, err := app.loadInfo(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, previous.MetaData, info.MetaData)
+	_, err = app.Store.Stat(ctx, edited.MetaData[MetadataBlob])
+	assert.Error(t, err)
+	_, err = app.Store.Stat(ctx, previous.MetaData[MetadataBlob])
+	assert.NoError(t, err)
+}
@@ -0,0 +1,238 @@
+package uploader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"music-streaming/backend/internal/storage"
+	"music-streaming/backend/internal/transcode"
+)
+
+// MetadataRenditions is the upload metadata key listing the names of the
+// renditions transcoded from the upload, separated by commas.
+const MetadataRenditions = "renditions"
+
+// derivedPrefix is where objects derived from uploads, like renditions,
+// live, under the key of their upload.
+const derivedPrefix = "derived/"
+
+func renditionKey(key string, r transcode.Rendition) string {
+	return derivedPrefix + key + "/" + r.Name() + "." + r.Extension()
+}
+
+// renditions returns the renditions recorded in metadata.
+func renditions(metadata map[string]string) []transcode.Rendition {
+	var list []transcode.Rendition
+	for _, name := range strings.Split(metadata[MetadataRenditions], ",") {
+		if r, err := transcode.ParseRendition(name); err == nil {
+			list = append(list, r)
+		}
+	}
+	return list
+}
+
+// TranscodeStage produces the configured renditions of completed uploads,
+// so listeners can stream a compressed file rather than the master. The
+// master is copied to a temporary file, as ffmpeg needs to seek in some
+// formats, and renditions are transcoded from it Concurrency at a time.
+// Renditions that fail are left out and logged; the others are still
+// recorded.
+type TranscodeStage struct {
+	Transcoder transcode.Transcoder
+	Renditions []transcode.Rendition
+	// Concurrency is how many renditions are transcoded at once, one per
+	// CPU if zero.
+	Concurrency int
+}
+
+// TranscodeStageFromEnv returns a stage producing the renditions listed in
+// TRANSCODE_RENDITIONS, such as "aac-128k,opus-96k,mp3-320k", with the
+// ffmpeg at FFMPEG_PATH (default "ffmpeg" from PATH), running at most
+// FFMPEG_CONCURRENCY (default one per CPU) at once. Without renditions it
+// returns nil.
+func TranscodeStageFromEnv() (*TranscodeStage, error) {
+	list, err := transcode.ParseRenditions(os.Getenv("TRANSCODE_RENDITIONS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid TRANSCODE_RENDITIONS: %w", err)
+	}
+	if len(list) == 0 {
+		return nil, nil
+	}
+	concurrency, err := ffmpegConcurrencyFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	ffmpeg := transcode.NewFFmpeg(os.Getenv("FFMPEG_PATH"))
+	if !ffmpeg.Available() {
+		return nil, fmt.Errorf("TRANSCODE_RENDITIONS needs ffmpeg, %q was not found", ffmpeg.Path)
+	}
+	return &TranscodeStage{Transcoder: ffmpeg, Renditions: list, Concurrency: concurrency}, nil
+}
+
+// ffmpegConcurrencyFromEnv reads FFMPEG_CONCURRENCY, 0 if unset.
+func ffmpegConcurrencyFromEnv() (int, error) {
+	v := os.Getenv("FFMPEG_CONCURRENCY")
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid FFMPEG_CONCURRENCY %q", v)
+	}
+	return n, nil
+}
+
+// forEachRendition calls fn with every rendition, at most concurrency (one
+// per CPU if zero) at once, and returns what the calls returned, in the
+// order of renditions.
+func forEachRendition(renditions []transcode.Rendition, concurrency int, fn func(transcode.Rendition) error) []error {
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU()
+	}
+	errs := make([]error, len(renditions))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, r := range renditions {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			errs[i] = fn(r)
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+func (TranscodeStage) Name() string { return "transcode" }
+
+func (s TranscodeStage) Process(ctx context.Context, upload *CompletedUpload) error {
+	app := upload.App
+	key := objectKey(upload.Info)
+	master, err := upload.localCopy(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read master: %w", err)
+	}
+	dir, err := os.MkdirTemp("", "transcode-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	var done []string
+	var errs []error
+	results := forEachRendition(s.Renditions, s.Concurrency, func(r transcode.Rendition) error {
+		return s.transcode(ctx, app.Store, master, filepath.Join(dir, r.Name()), renditionKey(key, r), r)
+	})
+	for i, err := range results {
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		done = append(done, s.Renditions[i].Name())
+	}
+	if len(done) > 0 {
+		upload.Info.MetaData[MetadataRenditions] = strings.Join(done, ",")
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to transcode %d of %d renditions: %w", len(errs), len(s.Renditions), errs[0])
+	}
+	return nil
+}
+
+func (s TranscodeStage) transcode(ctx context.Context, store storage.Store, master, output, key string, r transcode.Rendition) error {
+	if err := s.Transcoder.Transcode(ctx, master, output, r); err != nil {
+		return err
+	}
+	if err := putFile(ctx, store, key, output); err != nil {
+		return fmt.Errorf("failed to store %s: %w", r.Name(), err)
+	}
+	return nil
+}
+
+// Terminate deletes the renditions of the upload.
+func (TranscodeStage) Terminate(ctx context.Context, upload *CompletedUpload) error {
+	key := objectKey(upload.Info)
+	var keys []string
+	for _, r := range renditions(upload.Info.MetaData) {
+		keys = append(keys, renditionKey(key, r))
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	if err := upload.App.Store.Delete(ctx, keys...); err != nil {
+		return fmt.Errorf("failed to delete renditions: %w", err)
+	}
+	return nil
+}
+
+// localCopy returns the path of a temporary file holding the data of the
+// upload, downloading it on first use. Stages needing a file, like those
+// running ffmpeg, share it, rather than each downloading the data again;
+// the Pipeline removes it once all stages have run.
+func (u *CompletedUpload) localCopy(ctx context.Context) (string, error) {
+	dataKey := objectKey(u.Info)
+	if blob := u.Info.MetaData[MetadataBlob]; blob != "" {
+		dataKey = blob
+	}
+	if u.local != "" && u.localKey == dataKey {
+		return u.local, nil
+	}
+	u.removeLocalCopy()
+
+	dir, err := os.MkdirTemp("", "upload-*")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "data")
+	if err := downloadTo(ctx, u.App.Store, dataKey, path); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	u.local, u.localKey = path, dataKey
+	return path, nil
+}
+
+// removeLocalCopy removes the file made by localCopy, if any.
+func (u *CompletedUpload) removeLocalCopy() {
+	if u.local != "" {
+		os.RemoveAll(filepath.Dir(u.local))
+		u.local, u.localKey = "", ""
+	}
+}
+
+// downloadTo copies the object under key to a new file at path.
+func downloadTo(ctx context.Context, store storage.Store, key, path string) error {
+	body, err := store.Open(ctx, key, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, body); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// findRendition returns the rendition named name, if the upload has one.
+func findRendition(metadata map[string]string, name string) (transcode.Rendition, bool) {
+	list := renditions(metadata)
+	i := slices.IndexFunc(list, func(r transcode.Rendition) bool { return r.Name() == name })
+	if i < 0 {
+		return transcode.Rendition{}, false
+	}
+	return list[i], true
+}
@@ -0,0 +1,178 @@
+package uploader
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"music-streaming/backend/internal/storage"
+	"music-streaming/backend/internal/transcode"
+)
+
+func TestTranscodeStage(t *testing.T) {
+	ctx := context.Background()
+	app, tusHandler := newFileApp(t)
+	fake := &transcode.Fake{}
+	stage := TranscodeStage{Transcoder: fake, Renditions: []transcode.Rendition{{Codec: "aac", Kbps: 128}, {Codec: "opus", Kbps: 96}}}
+	app.Pipeline = &Pipeline{Stages: []Stage{ChecksumStage{}, DedupStage{}, stage, CatalogStage{}}}
+
+	// filename song.wav, filetype audio/wav
+	id := createUpload(t, tusHandler, 6, "master", "filename c29uZy53YXY=,filetype YXVkaW8vd2F2")
+	info, err := app.loadInfo(ctx, id)
+	require.NoError(t, err)
+	app.Pipeline.Process(ctx, app, info)
+	assert.Len(t, fake.Calls(), 2)
+
+	rr := download(app, id, "")
+	assert.Equal(t, "master", rr.Body.String())
+	assert.Equal(t, "audio/wav", rr.Header().Get("Content-Type"))
+
+	req := httptest.NewRequest("GET", "/files/"+id+"?rendition=opus-96k", nil)
+	rr = httptest.NewRecorder()
+	app.DownloadHandler(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "opus-96k\nmaster", rr.Body.String())
+	assert.Equal(t, "audio/ogg", rr.Header().Get("Content-Type"))
+	assert.Equal(t, "inline; filename=song.opus", rr.Header().Get("Content-Disposition"))
+	assert.Empty(t, rr.Header().Get("ETag"))
+
+	req = httptest.NewRequest("GET", "/files/"+id+"?rendition=mp3-320k", nil)
+	rr = httptest.NewRecorder()
+	app.DownloadHandler(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	// Renditions are listed with their upload, not as files of their own.
+	rr = httptest.NewRecorder()
+	app.ListFilesHandler(rr, httptest.NewRequest("GET", "/files/", nil))
+	var files []struct {
+		Key        string `json:"key"`
+		Renditions []struct {
+			Name        string `json:"name"`
+			URL         string `json:"url"`
+			ContentType string `json:"content_type"`
+		} `json:"renditions"`
+	}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &files))
+	require.Len(t, files, 1)
+	require.Len(t, files[0].Renditions, 2)
+	assert.Equal(t, "aac-128k", files[0].Renditions[0].Name)
+	assert.Equal(t, "/files/"+id+"?rendition=aac-128k", files[0].Renditions[0].URL)
+	assert.Equal(t, "audio/aac", files[0].Renditions[0].ContentType)
+
+	info, err = app.loadInfo(ctx, id)
+	require.NoError(t, err)
+	require.NoError(t, stage.Terminate(ctx, &CompletedUpload{App: app, Info: info}))
+	objects, err := app.Store.List(ctx, derivedPrefix)
+	require.NoError(t, err)
+	assert.Empty(t, objects)
+}
+
+func TestTranscodeStage_Fails(t *testing.T) {
+	ctx := context.Background()
+	app, tusHandler := newFileApp(t)
+	stage := TranscodeStage{Transcoder: &transcode.Fake{Err: errors.New("no audio stream")}, Renditions: []transcode.Rendition{{Codec: "aac", Kbps: 128}}}
+
+	id := createUpload(t, tusHandler, 4, "data", "")
+	info, err := app.loadInfo(ctx, id)
+	require.NoError(t, err)
+	upload := &CompletedUpload{App: app, Info: info}
+	defer upload.removeLocalCopy()
+	assert.Error(t, stage.Process(ctx, upload))
+	assert.Empty(t, upload.Info.MetaData[MetadataRenditions])
+
+	objects, err := app.Store.List(ctx, derivedPrefix)
+	require.NoError(t, err)
+	assert.Empty(t, objects)
+}
+
+// countingStore counts the objects opened in the store it wraps.
+type countingStore struct {
+	storage.Store
+	opens atomic.Int32
+}
+
+func (s *countingStore) Open(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	s.opens.Add(1)
+	return s.Store.Open(ctx, key, offset, length)
+}
+
+func TestTranscodeStage_SharesLocalCopy(t *testing.T) {
+	ctx := context.Background()
+	app, tusHandler := newFileApp(t)
+	renditions := []transcode.Rendition{{Codec: "aac", Kbps: 128}, {Codec: "opus", Kbps: 96}, {Codec: "aac", Kbps: 64}}
+	fake := &transcode.Fake{}
+	id := createUpload(t, tusHandler, 6, "master", "")
+	info, err := app.loadInfo(ctx, id)
+	require.NoError(t, err)
+
+	// Both ffmpeg stages read the data once, and remove it when done.
+	store := &countingStore{Store: app.Store}
+	app.Store = store
+	app.Pipeline = &Pipeline{Stages: []Stage{
+		TranscodeStage{Transcoder: fake, Renditions: renditions, Concurrency: 2},
+		HLSStage{Packager: fake, Renditions: renditions, Concurrency: 2},
+	}}
+	upload := app.Pipeline.Process(ctx, app, info)
+	assert.Len(t, fake.Calls(), 6)
+	assert.EqualValues(t, 1, store.opens.Load())
+	assert.Empty(t, upload.local)
+	assert.Equal(t, "aac-128k,opus-96k,aac-64k", upload.Info.MetaData[MetadataRenditions])
+	assert.Equal(t, "aac-64k,opus-96k,aac-128k", upload.Info.MetaData[MetadataHLS])
+}
+
+func TestForEachRendition(t *testing.T) {
+	renditions := make([]transcode.Rendition, 8)
+	for i := range renditions {
+		renditions[i] = transcode.Rendition{Codec: "aac", Kbps: 32 * (i + 1)}
+	}
+	var mu sync.Mutex
+	running, most := 0, 0
+	errs := forEachRendition(renditions, 3, func(r transcode.Rendition) error {
+		mu.Lock()
+		running++
+		most = max(most, running)
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		if r.Kbps == 64 {
+			return errors.New("failed")
+		}
+		return nil
+	})
+	assert.LessOrEqual(t, most, 3)
+	require.Len(t, errs, 8)
+	assert.Error(t, errs[1])
+	assert.NoError(t, errs[0])
+}
+
+func TestTranscodeStageFromEnv(t *testing.T) {
+	stage, err := TranscodeStageFromEnv()
+	require.NoError(t, err)
+	assert.Nil(t, stage)
+
+	t.Setenv("TRANSCODE_RENDITIONS", "aac-128k,wma-64k")
+	_, err = TranscodeStageFromEnv()
+	assert.Error(t, err)
+
+	t.Setenv("TRANSCODE_RENDITIONS", "aac-128k")
+	t.Setenv("FFMPEG_CONCURRENCY", "0")
+	_, err = TranscodeStageFromEnv()
+	assert.ErrorContains(t, err, "FFMPEG_CONCURRENCY")
+	t.Setenv("FFMPEG_CONCURRENCY", "2")
+
+	t.Setenv("FFMPEG_PATH", "/nonexistent/ffmpeg")
+	_, err = TranscodeStageFromEnv()
+	assert.Error(t, err)
+}
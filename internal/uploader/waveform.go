@@ -0,0 +1,140 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"music-streaming/backend/internal/audio"
+	"music-streaming/backend/internal/storage"
+)
+
+// MetadataWaveform is the upload metadata key holding the storage key of
+// the upload's waveform peaks.
+const MetadataWaveform = "waveform"
+
+// waveformKey is where the waveform peaks of the upload stored under key
+// live.
+func waveformKey(key string) string {
+	return derivedPrefix + key + "/waveform.json"
+}
+
+// WaveformStage computes the waveform peaks of completed WAV, FLAC and MP3
+// uploads at the given resolutions, DefaultWaveformResolutions if unset,
+// and stores them as JSON next to the upload. Uploads in other formats are
+// skipped.
+type WaveformStage struct {
+	Resolutions []int
+}
+
+func (WaveformStage) Name() string { return "waveform" }
+
+func (s WaveformStage) Process(ctx context.Context, upload *CompletedUpload) error {
+	app := upload.App
+	key := objectKey(upload.Info)
+	dataKey := key
+	if blob := upload.Info.MetaData[MetadataBlob]; blob != "" {
+		dataKey = blob
+	}
+
+	body, err := app.Store.Open(ctx, dataKey, 0, -1)
+	if err != nil {
+		return fmt.Errorf("failed to read upload: %w", err)
+	}
+	defer body.Close()
+	d, err := audio.Decode(body)
+	if errors.Is(err, audio.ErrUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	resolutions := s.Resolutions
+	if len(resolutions) == 0 {
+		resolutions = audio.DefaultWaveformResolutions
+	}
+	waveform, err := audio.ComputeWaveform(d, resolutions)
+	if err != nil {
+		return fmt.Errorf("failed to decode %s: %w", d.Format, err)
+	}
+	data, err := json.Marshal(waveform)
+	if err != nil {
+		return err
+	}
+	if err := app.Store.Put(ctx, waveformKey(key), bytes.NewReader(data), int64(len(data))); err != nil {
+		return fmt.Errorf("failed to store waveform: %w", err)
+	}
+	upload.Info.MetaData[MetadataWaveform] = waveformKey(key)
+	return nil
+}
+
+// Terminate deletes the waveform of the upload. Its key is derived from
+// the upload's rather than read from the metadata, so that whatever the
+// metadata says, no other object is deleted.
+func (WaveformStage) Terminate(ctx context.Context, upload *CompletedUpload) error {
+	if upload.Info.MetaData[MetadataWaveform] == "" {
+		return nil
+	}
+	if err := upload.App.Store.Delete(ctx, waveformKey(objectKey(upload.Info))); err != nil && !storage.IsNotFound(err) {
+		return fmt.Errorf("failed to delete waveform: %w", err)
+	}
+	return nil
+}
+
+// WaveformHandler serves the waveform peaks of an upload at
+// /files/{id}/waveform. They never change for an upload, so clients may
+// cache them for a day and revalidate with their ETag.
+func (a *App) WaveformHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/files/"), "/waveform")
+	key, _, _ := strings.Cut(id, "+")
+	if key == "" || strings.Contains(key, "/") {
+		writeTusError(w, http.StatusNotFound, "ERR_UPLOAD_NOT_FOUND", "upload not found")
+		return
+	}
+
+	info, err := a.loadInfo(r.Context(), key)
+	if storage.IsNotFound(err) {
+		writeTusError(w, http.StatusNotFound, "ERR_UPLOAD_NOT_FOUND", "upload not found")
+		return
+	}
+	if err != nil {
+		writeTusError(w, http.StatusInternalServerError, "ERR_INTERNAL_SERVER_ERROR", err.Error())
+		return
+	}
+	if info.MetaData[MetadataWaveform] == "" {
+		writeTusError(w, http.StatusNotFound, "ERR_WAVEFORM_NOT_FOUND", "waveform not found")
+		return
+	}
+
+	body, err := a.Store.Open(r.Context(), waveformKey(objectKey(info)), 0, -1)
+	if storage.IsNotFound(err) {
+		writeTusError(w, http.StatusNotFound, "ERR_WAVEFORM_NOT_FOUND", "waveform not found")
+		return
+	}
+	if err != nil {
+		writeTusError(w, http.StatusInternalServerError, "ERR_INTERNAL_SERVER_ERROR", err.Error())
+		return
+	}
+	data, err := io.ReadAll(body)
+	body.Close()
+	if err != nil {
+		writeTusError(w, http.StatusInternalServerError, "ERR_INTERNAL_SERVER_ERROR", err.Error())
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	h.Set("Cache-Control", "public, max-age=86400")
+	// The peaks follow from the data, so its checksum identifies them.
+	if sum := info.MetaData[MetadataSHA256]; sum != "" {
+		h.Set("ETag", `"waveform-`+sum+`"`)
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
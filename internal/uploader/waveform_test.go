@@ -0,0 +1,74 @@
+package uploader
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"music-streaming/backend/internal/audio"
+)
+
+func getWaveform(app *App, id, etag string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/files/"+id+"/waveform", nil)
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	rr := httptest.NewRecorder()
+	app.WaveformHandler(rr, req)
+	return rr
+}
+
+func TestWaveformStage(t *testing.T) {
+	ctx := context.Background()
+	app, tusHandler := newFileApp(t)
+	stage := WaveformStage{Resolutions: []int{100, 400}}
+	wav := audio.EncodeWAV(8000, 1, audio.Sine(8000, 1, 200, 0.5, 0.1))
+	id := processUpload(t, app, tusHandler, string(wav), ChecksumStage{}, DedupStage{}, stage)
+
+	rr := getWaveform(app, id, "")
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	assert.Equal(t, "public, max-age=86400", rr.Header().Get("Cache-Control"))
+	var waveform audio.Waveform
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &waveform))
+	assert.Equal(t, 8000, waveform.SampleRate)
+	assert.EqualValues(t, 800, waveform.Samples)
+	require.Len(t, waveform.Levels, 2)
+	assert.Len(t, waveform.Levels[0].Peaks, 16)
+	assert.Len(t, waveform.Levels[1].Peaks, 4)
+	assert.Equal(t, []byte{0xC0, 64}, waveform.Levels[1].Peaks[:2])
+
+	etag := rr.Header().Get("ETag")
+	require.True(t, strings.HasPrefix(etag, `"waveform-`), etag)
+	assert.Equal(t, http.StatusNotModified, getWaveform(app, id, etag).Code)
+
+	// Only the waveform is deleted, whatever the metadata points at.
+	info, err := app.loadInfo(ctx, id)
+	require.NoError(t, err)
+	blob := info.MetaData[MetadataBlob]
+	info.MetaData[MetadataWaveform] = blob
+	require.NoError(t, stage.Terminate(ctx, &CompletedUpload{App: app, Info: info}))
+	objects, err := app.Store.List(ctx, derivedPrefix)
+	require.NoError(t, err)
+	assert.Empty(t, objects)
+	_, err = app.Store.Stat(ctx, blob)
+	assert.NoError(t, err)
+}
+
+func TestWaveformStage_NotAudio(t *testing.T) {
+	app, tusHandler := newFileApp(t)
+	id := processUpload(t, app, tusHandler, "master", ChecksumStage{}, WaveformStage{})
+
+	rr := getWaveform(app, id, "")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Contains(t, rr.Body.String(), "ERR_WAVEFORM_NOT_FOUND")
+
+	rr = getWaveform(app, "missing", "")
+	assert.Contains(t, rr.Body.String(), "ERR_UPLOAD_NOT_FOUND")
+}
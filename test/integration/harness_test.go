@@ -0,0 +1,150 @@
+//go:build integration
+// +build integration
+
+package integration
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"music-streaming/backend/internal/catalog"
+	"music-streaming/backend/internal/identity"
+	"music-streaming/backend/internal/s3fake"
+	"music-streaming/backend/internal/server"
+	"music-streaming/backend/internal/storage"
+	"music-streaming/backend/internal/uploader"
+)
+
+const bucket = "uploads"
+
+// harness is the service as cmd/server wires it, listening on a local port
+// with an in-memory bucket behind it.
+type harness struct {
+	// BaseURL is the URL uploads are created at.
+	BaseURL string
+	// Handler is the handler behind BaseURL.
+	Handler http.Handler
+	S3      *s3fake.Client
+	Client  *http.Client
+}
+
+func newHarness(t *testing.T) *harness {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	// Policies are configured as in production, from the environment, with
+	// the gateway that sets the user header in front.
+	t.Setenv("TRUST_GATEWAY_HEADERS", "true")
+	cfg, err := server.ConfigFromEnv()
+	require.NoError(t, err)
+	client := s3fake.New()
+	cat, err := catalog.Open(":memory:")
+	require.NoError(t, err)
+	t.Cleanup(func() { cat.Close() })
+	app, err := uploader.NewApp(ctx, storage.NewS3(bucket, client, ""), cat, uploader.DeferredConfig{}, cfg.Resolver)
+	require.NoError(t, err)
+	handler, err := server.New(app, cfg, server.NewRegistry())
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return &harness{
+		BaseURL: srv.URL + "/files/",
+		Handler: handler,
+		S3:      client,
+		Client:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// send sends a tus request as user and returns the response with its body
+// read. It may be called outside the test goroutine.
+func (h *harness) send(user, method, url string, body io.Reader, headers ...string) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	req.Header.Set(identity.DefaultUserHeader, user)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	return resp, data, err
+}
+
+// do is send failing the test on errors.
+func (h *harness) do(t *testing.T, user, method, url string, body io.Reader, headers ...string) (*http.Response, []byte) {
+	t.Helper()
+	resp, data, err := h.send(user, method, url, body, headers...)
+	require.NoError(t, err)
+	return resp, data
+}
+
+// create creates an upload of size bytes and returns its URL.
+func (h *harness) create(t *testing.T, user string, size int, metadata string) string {
+	t.Helper()
+	resp, _ := h.do(t, user, "POST", h.BaseURL, nil,
+		"Upload-Length", strconv.Itoa(size),
+		"Upload-Metadata", metadata)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	location := resp.Header.Get("Location")
+	require.NotEmpty(t, location, "Location header should not be empty")
+	return location
+}
+
+// patch writes data at offset and returns the new offset.
+func (h *harness) patch(t *testing.T, user, uploadURL string, offset int, data []byte) int {
+	t.Helper()
+	resp, _ := h.do(t, user, "PATCH", uploadURL, bytes.NewReader(data),
+		"Content-Type", "application/offset+octet-stream",
+		"Upload-Offset", strconv.Itoa(offset))
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	newOffset, err := strconv.Atoi(resp.Header.Get("Upload-Offset"))
+	require.NoError(t, err)
+	return newOffset
+}
+
+// offset returns the offset the server reports for an upload, waiting for
+// requests still holding the upload to let go of it.
+func (h *harness) offset(t *testing.T, user, uploadURL string) int {
+	t.Helper()
+	var offset int
+	require.Eventually(t, func() bool {
+		resp, _, err := h.send(user, "HEAD", uploadURL, nil)
+		if err != nil {
+			return false
+		}
+		if resp.StatusCode != http.StatusOK {
+			return false
+		}
+		offset, err = strconv.Atoi(resp.Header.Get("Upload-Offset"))
+		return err == nil
+	}, 10*time.Second, 20*time.Millisecond)
+	return offset
+}
+
+// waitProcessed waits until the post-processing pipeline has moved a
+// finished upload into its content-addressed blob.
+func (h *harness) waitProcessed(t *testing.T, uploadURL string) {
+	t.Helper()
+	key, _, _ := strings.Cut(uploadURL[strings.LastIndex(uploadURL, "/")+1:], "+")
+	require.Eventually(t, func() bool {
+		info, ok := h.S3.Object(bucket, key+".info")
+		return ok && bytes.Contains(info, []byte(`"`+uploader.MetadataBlob+`":`))
+	}, 10*time.Second, 20*time.Millisecond)
+}
@@ -5,101 +5,230 @@ package integration
 
 import (
 	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
-	"time"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
-)
 
-const (
-	baseURL = "http://localhost:8080/files/"
+	"music-streaming/backend/internal/identity"
+	"music-streaming/backend/internal/s3fake"
+	"music-streaming/backend/internal/storage"
+	"music-streaming/backend/internal/tustest"
 )
 
+// multipartSize is large enough for uploads to be stored with a multipart
+// upload rather than a single PutObject.
+const multipartSize = storage.DefaultSmallUploadThreshold + 1<<20
+
 func TestResumableUpload_E2E(t *testing.T) {
+	h := newHarness(t)
+
 	// 1. Prepare Data
 	content := []byte("Hello, this is a test data for resumable upload integration testing.")
 	totalSize := len(content)
 	chunkSize := totalSize / 2 // Split into two chunks
 
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-	}
-
 	// 2. Create Upload (POST)
-	req, err := http.NewRequest("POST", baseURL, nil)
-	require.NoError(t, err)
-	req.Header.Set("Tus-Resumable", "1.0.0")
-	req.Header.Set("Upload-Length", strconv.Itoa(totalSize))
-	req.Header.Set("Upload-Metadata", "filename dGVzdF9yZXN1bWUudHh0") // filename test_resume.txt
+	uploadURL := h.create(t, "alice", totalSize, "filename dGVzdF9yZXN1bWUudHh0") // filename test_resume.txt
+	t.Logf("Upload created at: %s", uploadURL)
 
-	resp, err := client.Do(req)
-	require.NoError(t, err)
-	defer resp.Body.Close()
+	// 3. Upload First Chunk (PATCH) - Simulating Interruption after this
+	newOffset := h.patch(t, "alice", uploadURL, 0, content[:chunkSize])
+	require.Equal(t, chunkSize, newOffset, "Offset should match chunk size")
 
-	require.Equal(t, http.StatusCreated, resp.StatusCode)
-	uploadURL := resp.Header.Get("Location")
-	require.NotEmpty(t, uploadURL, "Location header should not be empty")
+	// 4. Verify Offset (HEAD) - Simulating Resume Check
+	headOffset := h.offset(t, "alice", uploadURL)
+	require.Equal(t, chunkSize, headOffset, "HEAD - Offset should match previously uploaded size")
 
-	t.Logf("Upload created at: %s", uploadURL)
+	// 5. Upload Second Chunk (PATCH) - Resume
+	finalOffset := h.patch(t, "alice", uploadURL, headOffset, content[chunkSize:])
+	require.Equal(t, totalSize, finalOffset, "Final offset should match total size")
+}
 
-	// 3. Upload First Chunk (PATCH) - Simulating Interruption after this
-	chunk1 := content[:chunkSize]
-	req, err = http.NewRequest("PATCH", uploadURL, bytes.NewReader(chunk1))
+// TestConformance checks the protocol through every policy the server puts in
+// front of the tus handler.
+func TestConformance(t *testing.T) {
+	tustest.Run(t, tustest.Config{
+		BasePath: "/files/",
+		NewHandler: func(t *testing.T) http.Handler {
+			handler := newHarness(t).Handler
+			// Only identified users may concatenate uploads.
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				r.Header.Set(identity.DefaultUserHeader, "alice")
+				handler.ServeHTTP(w, r)
+			})
+		},
+	})
+}
+
+func TestUploadLifecycle(t *testing.T) {
+	h := newHarness(t)
+	// Large enough to span a multipart upload with its first PATCH buffered
+	// in an incomplete part.
+	content := bytes.Repeat([]byte("0123456789abcdef"), multipartSize/16)
+	uploadURL := h.create(t, "alice", len(content), "filename c29uZy5tcDM=,filetype YXVkaW8vbXBlZw==")
+	offset := h.patch(t, "alice", uploadURL, 0, content[:1<<20])
+	h.patch(t, "alice", uploadURL, offset, content[offset:])
+	h.waitProcessed(t, uploadURL)
+
+	// List
+	resp, body := h.do(t, "alice", "GET", h.BaseURL, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var files []struct {
+		Name   string `json:"name"`
+		Size   int64  `json:"size"`
+		SHA256 string `json:"sha256"`
+	}
+	require.NoError(t, json.Unmarshal(body, &files))
+	require.Len(t, files, 1)
+	assert.Equal(t, "song.mp3", files[0].Name)
+	assert.Equal(t, int64(len(content)), files[0].Size)
+	assert.NotEmpty(t, files[0].SHA256)
+
+	// Download, whole and ranged
+	resp, body = h.do(t, "alice", "GET", uploadURL, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "audio/mpeg", resp.Header.Get("Content-Type"))
+	assert.True(t, bytes.Equal(content, body), "downloaded content differs")
+	resp, body = h.do(t, "alice", "GET", uploadURL, nil, "Range", "bytes=16-31")
+	require.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "0123456789abcdef", string(body))
+
+	// Delete
+	resp, _ = h.do(t, "alice", "DELETE", uploadURL, nil)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp, _ = h.do(t, "alice", "GET", uploadURL, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	_, body = h.do(t, "alice", "GET", h.BaseURL, nil)
+	assert.JSONEq(t, `[]`, string(body))
+}
+
+// failingReader returns data and then fails, like a client losing its
+// connection.
+type failingReader struct {
+	data []byte
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, errors.New("connection lost")
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestUpload_ClientDisconnectsMidPart(t *testing.T) {
+	h := newHarness(t)
+	content := bytes.Repeat([]byte("x"), multipartSize)
+	uploadURL := h.create(t, "alice", len(content), "")
+
+	// The connection drops after 2 MiB of a PATCH announcing all of it.
+	req, err := http.NewRequest("PATCH", uploadURL, &failingReader{data: content[:2<<20]})
 	require.NoError(t, err)
+	req.ContentLength = int64(len(content))
 	req.Header.Set("Tus-Resumable", "1.0.0")
 	req.Header.Set("Content-Type", "application/offset+octet-stream")
 	req.Header.Set("Upload-Offset", "0")
+	_, err = h.Client.Do(req)
+	require.Error(t, err)
 
-	resp, err = client.Do(req)
-	require.NoError(t, err)
-	resp.Body.Close()
-
-	require.Equal(t, http.StatusNoContent, resp.StatusCode)
-	
-	newOffsetStr := resp.Header.Get("Upload-Offset")
-	newOffset, err := strconv.Atoi(newOffsetStr)
-	require.NoError(t, err)
-	require.Equal(t, chunkSize, newOffset, "Offset should match chunk size")
+	// Whatever reached the server is kept and the upload resumes from there.
+	offset := h.offset(t, "alice", uploadURL)
+	assert.LessOrEqual(t, offset, 2<<20)
+	require.Equal(t, len(content), h.patch(t, "alice", uploadURL, offset, content[offset:]))
+	h.waitProcessed(t, uploadURL)
 
-	t.Logf("Chunk 1 uploaded. Server offset: %d", newOffset)
+	_, body := h.do(t, "alice", "GET", uploadURL, nil)
+	assert.True(t, bytes.Equal(content, body), "downloaded content differs")
+}
 
-	// 4. Verify Offset (HEAD) - Simulating Resume Check
-	req, err = http.NewRequest("HEAD", uploadURL, nil)
-	require.NoError(t, err)
-	req.Header.Set("Tus-Resumable", "1.0.0")
+func TestUpload_StorageFailsMidPart(t *testing.T) {
+	h := newHarness(t)
+	content := bytes.Repeat([]byte("y"), multipartSize)
+	uploadURL := h.create(t, "alice", len(content), "")
 
-	resp, err = client.Do(req)
-	require.NoError(t, err)
-	resp.Body.Close()
+	h.S3.Inject(s3fake.Fault{Op: "UploadPart", Err: errors.New("service unavailable"), Times: 1})
+	resp, _ := h.do(t, "alice", "PATCH", uploadURL, bytes.NewReader(content),
+		"Content-Type", "application/offset+octet-stream",
+		"Upload-Offset", "0")
+	require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
 
-	require.Equal(t, http.StatusOK, resp.StatusCode)
-	headOffsetStr := resp.Header.Get("Upload-Offset")
-	headOffset, err := strconv.Atoi(headOffsetStr)
-	require.NoError(t, err)
-	require.Equal(t, chunkSize, headOffset, "HEAD - Offset should match previously uploaded size")
+	offset := h.offset(t, "alice", uploadURL)
+	require.Equal(t, len(content), h.patch(t, "alice", uploadURL, offset, content[offset:]))
+	h.waitProcessed(t, uploadURL)
 
-	t.Log("HEAD check passed. Resuming upload...")
+	_, body := h.do(t, "alice", "GET", uploadURL, nil)
+	assert.True(t, bytes.Equal(content, body), "downloaded content differs")
+}
 
-	// 5. Upload Second Chunk (PATCH) - Resume
-	chunk2 := content[chunkSize:]
-	req, err = http.NewRequest("PATCH", uploadURL, bytes.NewReader(chunk2))
-	require.NoError(t, err)
-	req.Header.Set("Tus-Resumable", "1.0.0")
-	req.Header.Set("Content-Type", "application/offset+octet-stream")
-	req.Header.Set("Upload-Offset", strconv.Itoa(headOffset))
+func TestUpload_ConcurrentClients(t *testing.T) {
+	h := newHarness(t)
+	const clients = 8
+
+	urls := make([]string, clients)
+	contents := make([][]byte, clients)
+	errs := make([]error, clients)
+	var wg sync.WaitGroup
+	for i := range clients {
+		user := fmt.Sprintf("user-%d", i)
+		contents[i] = []byte(strings.Repeat(user+" ", 4096))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			urls[i], errs[i] = upload(h, user, contents[i])
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
 
-	resp, err = client.Do(req)
-	require.NoError(t, err)
-	resp.Body.Close()
+	for i, uploadURL := range urls {
+		h.waitProcessed(t, uploadURL)
+		_, body := h.do(t, "reader", "GET", uploadURL, nil)
+		assert.True(t, bytes.Equal(contents[i], body), "content of upload %d differs", i)
+	}
 
-	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	_, body := h.do(t, "reader", "GET", h.BaseURL, nil)
+	var files []json.RawMessage
+	require.NoError(t, json.Unmarshal(body, &files))
+	assert.Len(t, files, clients)
+}
 
-	finalOffsetStr := resp.Header.Get("Upload-Offset")
-	finalOffset, err := strconv.Atoi(finalOffsetStr)
-	require.NoError(t, err)
-	require.Equal(t, totalSize, finalOffset, "Final offset should match total size")
+// upload uploads content in two requests. Unlike the harness helpers it
+// reports failures as errors, so it can run outside the test goroutine.
+func upload(h *harness, user string, content []byte) (string, error) {
+	resp, _, err := h.send(user, "POST", h.BaseURL, nil,
+		"Upload-Length", strconv.Itoa(len(content)),
+		"Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte(user+".mp3")))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("create: unexpected status %d", resp.StatusCode)
+	}
+	uploadURL := resp.Header.Get("Location")
 
-	t.Log("Upload completed successfully.")
+	half := len(content) / 2
+	for _, chunk := range [][2]int{{0, half}, {half, len(content)}} {
+		resp, _, err := h.send(user, "PATCH", uploadURL, bytes.NewReader(content[chunk[0]:chunk[1]]),
+			"Content-Type", "application/offset+octet-stream",
+			"Upload-Offset", strconv.Itoa(chunk[0]))
+		if err != nil {
+			return "", err
+		}
+		if resp.StatusCode != http.StatusNoContent {
+			return "", fmt.Errorf("patch at %d: unexpected status %d", chunk[0], resp.StatusCode)
+		}
+	}
+	return uploadURL, nil
 }